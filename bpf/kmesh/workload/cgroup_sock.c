@@ -45,8 +45,10 @@ static inline int sock_traffic_control(struct kmesh_context *kmesh_ctx)
 
     frontend_v = map_lookup_frontend(&frontend_k);
     if (!frontend_v) {
+        frontend_report_miss(&frontend_k);
         return -ENOENT;
     }
+    frontend_touch(&frontend_k);
 
     BPF_LOG(
         DEBUG,
@@ -78,6 +80,8 @@ int cgroup_connect4_prog(struct bpf_sock_addr *ctx)
         return CGROUP_SOCK_OK;
     }
     int ret = sock_traffic_control(&kmesh_ctx);
+    if (ret == -EPERM)
+        return CGROUP_SOCK_ERR;
     if (ret) {
         BPF_LOG(ERR, KMESH, "sock_traffic_control failed: %d\n", ret);
         return CGROUP_SOCK_OK;
@@ -111,6 +115,8 @@ int cgroup_connect6_prog(struct bpf_sock_addr *ctx)
     BPF_LOG(DEBUG, KMESH, "enter cgroup/connect6\n");
 
     int ret = sock_traffic_control(&kmesh_ctx);
+    if (ret == -EPERM)
+        return CGROUP_SOCK_ERR;
     if (ret) {
         BPF_LOG(ERR, KMESH, "sock_traffic_control failed: %d\n", ret);
         return CGROUP_SOCK_OK;
@@ -16,6 +16,31 @@ static inline backend_value *map_lookup_backend(const backend_key *key)
     return kmesh_map_lookup_elem(&map_of_backend, key);
 }
 
+static inline bool is_dual_stack(const backend_value *backend_v)
+{
+    return backend_v->addr6.ip6[0] || backend_v->addr6.ip6[1] || backend_v->addr6.ip6[2] || backend_v->addr6.ip6[3];
+}
+
+/*
+ * backend_denied tells whether a DENY authorization policy of the backend matches every connection,
+ * the connection is then refused without reaching the backend. The policies depending on the client
+ * are enforced by the userspace authorization.
+ */
+static inline bool backend_denied(const backend_value *backend_v)
+{
+    authz_policy_value *policy = NULL;
+
+#pragma unroll
+    for (__u32 i = 0; i < MAX_POLICY_COUNT; i++) {
+        if (i >= backend_v->policy_count)
+            break;
+        policy = kmesh_map_lookup_elem(&map_of_authz_policy, &backend_v->policies[i]);
+        if (policy && policy->action == AUTHZ_ACTION_DENY && policy->match_all)
+            return true;
+    }
+    return false;
+}
+
 static inline int waypoint_manager(struct kmesh_context *kmesh_ctx, struct ip_addr *wp_addr, __u32 port)
 {
     int ret;
@@ -56,6 +81,11 @@ backend_manager(struct kmesh_context *kmesh_ctx, backend_value *backend_v, __u32
     ctx_buff_t *ctx = (ctx_buff_t *)kmesh_ctx->ctx;
     __u32 user_port = ctx->user_port;
 
+    if (backend_denied(backend_v)) {
+        BPF_LOG(DEBUG, BACKEND, "connection to the backend of service %u denied by its policies\n", service_id);
+        return -EPERM;
+    }
+
     if (backend_v->waypoint_port != 0) {
         BPF_LOG(
             DEBUG,
@@ -70,6 +100,21 @@ backend_manager(struct kmesh_context *kmesh_ctx, backend_value *backend_v, __u32
         return ret;
     }
 
+    // a workload on a remote network is not routable, the connection is tunneled through its network gateway
+    if (backend_v->tunnel_type == TUNNEL_TYPE_HBONE && backend_v->tunnel_port != 0) {
+        BPF_LOG(
+            DEBUG,
+            BACKEND,
+            "find network gateway addr=[%s:%u]\n",
+            ip2str((__u32 *)&backend_v->tunnel_endpoint, ctx->family == AF_INET),
+            bpf_ntohs(backend_v->tunnel_port));
+        ret = waypoint_manager(kmesh_ctx, &backend_v->tunnel_endpoint, backend_v->tunnel_port);
+        if (ret != 0) {
+            BPF_LOG(ERR, BACKEND, "tunnel through network gateway failed, ret: %d\n", ret);
+        }
+        return ret;
+    }
+
 #pragma unroll
     for (__u32 i = 0; i < MAX_SERVICE_COUNT; i++) {
         if (i >= backend_v->service_count) {
@@ -83,6 +128,8 @@ backend_manager(struct kmesh_context *kmesh_ctx, backend_value *backend_v, __u32
                 if (user_port == service_v->service_port[j]) {
                     if (ctx->user_family == AF_INET)
                         kmesh_ctx->dnat_ip.ip4 = backend_v->addr.ip4;
+                    else if (is_dual_stack(backend_v))
+                        bpf_memcpy(kmesh_ctx->dnat_ip.ip6, backend_v->addr6.ip6, IPV6_ADDR_LEN);
                     else
                         bpf_memcpy(kmesh_ctx->dnat_ip.ip6, backend_v->addr.ip6, IPV6_ADDR_LEN);
                     kmesh_ctx->dnat_port = service_v->target_port[j];
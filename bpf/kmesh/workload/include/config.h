@@ -5,18 +5,25 @@
 #define _KMESH_CONFIG_H_
 
 // map size
-#define MAP_SIZE_OF_FRONTEND 105000
-#define MAP_SIZE_OF_SERVICE  5000
-#define MAP_SIZE_OF_ENDPOINT 105000
-#define MAP_SIZE_OF_BACKEND  100000
-#define MAP_SIZE_OF_AUTH     8192
-#define MAP_SIZE_OF_DSTINFO  8192
+#define MAP_SIZE_OF_FRONTEND     105000
+#define MAP_SIZE_OF_SERVICE      5000
+#define MAP_SIZE_OF_ENDPOINT     105000
+#define MAP_SIZE_OF_BACKEND      100000
+#define MAP_SIZE_OF_AUTH         8192
+#define MAP_SIZE_OF_DSTINFO      8192
+#define MAP_SIZE_OF_AUTHZ_POLICY 8192
 
 // map name
-#define map_of_frontend kmesh_frontend
-#define map_of_service  kmesh_service
-#define map_of_endpoint kmesh_endpoint
-#define map_of_backend  kmesh_backend
-#define map_of_manager  kmesh_manage
+#define map_of_frontend            kmesh_frontend
+#define map_of_service             kmesh_service
+#define map_of_endpoint            kmesh_endpoint
+#define map_of_backend             kmesh_backend
+#define map_of_manager             kmesh_manage
+#define map_of_endpoint_hits       kmesh_endpoint_hits
+#define map_of_count_endpoint_hits kmesh_count_endpoint_hits
+#define map_of_frontend_access     kmesh_frontend_access
+#define map_of_frontend_miss       kmesh_frontend_miss
+#define map_of_lazy_frontend       kmesh_lazy_frontend
+#define map_of_authz_policy        kmesh_authz_policy
 
 #endif // _CONFIG_H_
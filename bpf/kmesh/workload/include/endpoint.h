@@ -12,6 +12,34 @@ static inline endpoint_value *map_lookup_endpoint(const endpoint_key *key)
     return kmesh_map_lookup_elem(&map_of_endpoint, key);
 }
 
+// endpoint_hit counts a connection sent to the backend of the service, if enabled by the userspace
+static inline void endpoint_hit(__u32 service_id, __u32 backend_uid)
+{
+    __u32 zero = 0;
+    __u32 *enabled = NULL;
+    __u64 init = 1;
+    __u64 *hits = NULL;
+    endpoint_hit_key key = {
+        .service_id = service_id,
+        .backend_uid = backend_uid,
+    };
+
+    enabled = kmesh_map_lookup_elem(&map_of_count_endpoint_hits, &zero);
+    if (!enabled || !*enabled)
+        return;
+
+    hits = bpf_map_lookup_elem(&map_of_endpoint_hits, &key);
+    if (hits) {
+        __sync_fetch_and_add(hits, 1);
+        return;
+    }
+    if (bpf_map_update_elem(&map_of_endpoint_hits, &key, &init, BPF_NOEXIST) == -EEXIST) {
+        hits = bpf_map_lookup_elem(&map_of_endpoint_hits, &key);
+        if (hits)
+            __sync_fetch_and_add(hits, 1);
+    }
+}
+
 static inline int endpoint_manager(
     struct kmesh_context *kmesh_ctx, endpoint_value *endpoint_v, __u32 service_id, service_value *service_v)
 {
@@ -33,6 +61,7 @@ static inline int endpoint_manager(
         return ret;
     }
 
+    endpoint_hit(service_id, backend_k.backend_uid);
     return 0;
 }
 
@@ -13,6 +13,26 @@ static inline frontend_value *map_lookup_frontend(const frontend_key *key)
     return kmesh_map_lookup_elem(&map_of_frontend, key);
 }
 
+static inline void frontend_touch(const frontend_key *key)
+{
+    __u64 now = bpf_ktime_get_ns();
+
+    // only the entries tracked by the userspace are refreshed
+    bpf_map_update_elem(&map_of_frontend_access, key, &now, BPF_EXIST);
+}
+
+static inline void frontend_report_miss(const frontend_key *key)
+{
+    __u32 zero = 0;
+    __u32 *lazy = kmesh_map_lookup_elem(&map_of_lazy_frontend, &zero);
+
+    if (!lazy || !*lazy)
+        return;
+    // the connection is not redirected, later ones are once the userspace programs the frontend
+    if (bpf_ringbuf_output(&map_of_frontend_miss, (void *)key, sizeof(*key), 0))
+        BPF_LOG(WARN, FRONTEND, "report frontend miss failed\n");
+}
+
 static inline int frontend_manager(struct kmesh_context *kmesh_ctx, frontend_value *frontend_v)
 {
     int ret = 0;
@@ -35,6 +55,10 @@ static inline int frontend_manager(struct kmesh_context *kmesh_ctx, frontend_val
     }
 
     if (direct_backend) {
+        if (backend_denied(backend_v)) {
+            BPF_LOG(DEBUG, FRONTEND, "connection to the backend denied by its policies\n");
+            return -EPERM;
+        }
         // For pod direct access, if a pod has watpoint captured, we will redirect to waypoint, otherwise we do nothing.
         if (backend_v->waypoint_port != 0) {
             BPF_LOG(
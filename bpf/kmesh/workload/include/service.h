@@ -19,9 +19,15 @@ static inline int lb_random_handle(struct kmesh_context *kmesh_ctx, __u32 servic
     endpoint_value *endpoint_v = NULL;
 
     endpoint_k.service_id = service_id;
-    endpoint_k.backend_index = bpf_get_prandom_u32() % service_v->endpoint_count + 1;
-
-    endpoint_v = map_lookup_endpoint(&endpoint_k);
+    // skip the endpoints marked unready by the active health checking, the last pick is used even
+    // if unready, so that a service whose endpoints are all unreachable is still load balanced
+#pragma unroll
+    for (__u32 i = 0; i < MAX_ENDPOINT_PICKS; i++) {
+        endpoint_k.backend_index = bpf_get_prandom_u32() % service_v->endpoint_count + 1;
+        endpoint_v = map_lookup_endpoint(&endpoint_k);
+        if (!endpoint_v || !endpoint_v->unready)
+            break;
+    }
     if (!endpoint_v) {
         BPF_LOG(WARN, SERVICE, "find endpoint [%u/%u] failed", service_id, endpoint_k.backend_index);
         return -ENOENT;
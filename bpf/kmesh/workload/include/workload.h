@@ -6,9 +6,15 @@
 
 #include "config.h"
 
-#define MAX_PORT_COUNT    10
-#define MAX_SERVICE_COUNT 10
-#define RINGBUF_SIZE      (1 << 12)
+#define MAX_PORT_COUNT     10
+#define MAX_SERVICE_COUNT  10
+#define MAX_POLICY_COUNT   10
+#define MAX_ENDPOINT_PICKS 3 // random picks of an endpoint before using an unready one
+#define RINGBUF_SIZE       (1 << 12)
+
+#define TUNNEL_TYPE_HBONE 1 // HBONE tunnel terminated by the network gateway
+
+#define AUTHZ_ACTION_DENY 1 // action of a DENY authorization policy
 
 #pragma pack(1)
 // frontend map
@@ -33,6 +39,8 @@ typedef struct {
     __u32 target_port[MAX_PORT_COUNT];
     struct ip_addr wp_addr;
     __u32 waypoint_port;
+    __u8 external; // the service is outside of the cluster domain, e.g. an egress target
+    __u8 pad[3];   // padding
 } service_value;
 
 // endpoint map
@@ -42,7 +50,11 @@ typedef struct {
 } endpoint_key;
 
 typedef struct {
-    __u32 backend_uid; // workload_uid to uint32
+    __u32 backend_uid;  // workload_uid to uint32
+    __u8 local;         // 1 if the backend runs on the local node
+    __u8 unready;       // 1 if the active health checking found the backend unreachable
+    __u8 pad[2];        // padding
+    __u64 last_updated; // unix nanoseconds of the last insert or update
 } endpoint_value;
 
 // backend map
@@ -55,7 +67,25 @@ typedef struct {
     __u32 service[MAX_SERVICE_COUNT];
     struct ip_addr wp_addr;
     __u32 waypoint_port;
+    __u32 tunnel_type;              // tunnel through the network gateway, 0 for a workload on the local network
+    struct ip_addr tunnel_endpoint; // network gateway ip of a workload on a remote network
+    __u32 tunnel_port;              // hbone port of the network gateway, in network byte order
+    __u32 policy_count;             // number of the authorization policies of the workload
+    __u32 policies[MAX_POLICY_COUNT]; // ids of the authorization policies of the workload
+    struct ip_addr addr6;           // ipv6 address of a dual-stack workload, addr is its ipv4 address then
 } backend_value;
+
+// authorization policy map, keyed by policy id
+typedef struct {
+    __u32 action;    // action of the policy, AUTHZ_ACTION_DENY for a DENY policy
+    __u32 match_all; // the policy has a rule matching every connection
+} authz_policy_value;
+
+// endpoint hits map, counts the connections sent to each backend of a service
+typedef struct {
+    __u32 service_id;  // service id
+    __u32 backend_uid; // backend uid chosen by load balancing
+} endpoint_hit_key;
 #pragma pack()
 
 struct {
@@ -103,4 +133,51 @@ struct {
     __uint(max_entries, RINGBUF_SIZE);
 } map_of_tuple SEC(".maps");
 
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, endpoint_hit_key);
+    __type(value, __u64);
+    __uint(max_entries, MAP_SIZE_OF_ENDPOINT);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+} map_of_endpoint_hits SEC(".maps");
+
+// a single non-zero value when the endpoint hits are counted, set by the userspace
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __type(key, __u32);
+    __type(value, __u32);
+    __uint(max_entries, 1);
+} map_of_count_endpoint_hits SEC(".maps");
+
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, __u32);
+    __type(value, authz_policy_value);
+    __uint(max_entries, MAP_SIZE_OF_AUTHZ_POLICY);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+} map_of_authz_policy SEC(".maps");
+
+// last access time of the frontends in ns, read by the userspace to evict the least recently used ones
+struct {
+    __uint(type, BPF_MAP_TYPE_HASH);
+    __type(key, frontend_key);
+    __type(value, __u64);
+    __uint(max_entries, MAP_SIZE_OF_FRONTEND);
+    __uint(map_flags, BPF_F_NO_PREALLOC);
+} map_of_frontend_access SEC(".maps");
+
+// the frontend keys missed by the datapath, reported to the userspace to program them in lazy frontend mode
+struct {
+    __uint(type, BPF_MAP_TYPE_RINGBUF);
+    __uint(max_entries, RINGBUF_SIZE);
+} map_of_frontend_miss SEC(".maps");
+
+// a single non-zero value when the lazy frontend mode is enabled, set by the userspace
+struct {
+    __uint(type, BPF_MAP_TYPE_ARRAY);
+    __type(key, __u32);
+    __type(value, __u32);
+    __uint(max_entries, 1);
+} map_of_lazy_frontend SEC(".maps");
+
 #endif
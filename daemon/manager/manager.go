@@ -52,6 +52,15 @@ func NewCommand() *cobra.Command {
 		Short:        "Start kmesh daemon",
 		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if configs.ConfigFile != "" {
+				if err := configs.LoadFromFile(configs.ConfigFile); err != nil {
+					return err
+				}
+				// parse the command line again, so that the flags take precedence over the config file
+				if err := cmd.ParseFlags(os.Args[1:]); err != nil {
+					return err
+				}
+			}
 			printFlags(cmd.Flags())
 			if err := configs.ParseConfigs(); err != nil {
 				return err
@@ -81,11 +90,27 @@ func Execute(configs *options.BootstrapConfigs) error {
 		log.Warn("rlimit.RemoveMemlock failed")
 	}
 
-	bpfLoader := bpf.NewBpfLoader(configs.BpfConfig)
-	if err := bpfLoader.Start(configs.BpfConfig); err != nil {
+	if configs.BpfConfig.FeatureCheck {
+		if err := bpf.CheckFeatures(); err != nil {
+			return err
+		}
+		log.Info("bpf feature check passed")
+
+		if errs := bpf.CompatCheck(); len(errs) > 0 {
+			log.Warnf("%d host capabilities used by kmesh are missing, the related features may not work:", len(errs))
+			for _, err := range errs {
+				log.Warnf("  %v", err)
+			}
+		}
+	}
+
+	var bpfLoader bpf.ProgramLoader = bpf.NewEbpfProgramLoader(configs.BpfConfig)
+	if err := bpfLoader.Load(); err != nil {
 		return err
 	}
-	defer bpfLoader.Stop()
+	defer func() {
+		_ = bpfLoader.Unload()
+	}()
 	log.Info("bpf loader start successfully")
 
 	stopCh := make(chan struct{})
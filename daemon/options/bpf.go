@@ -26,11 +26,13 @@ import (
 )
 
 type BpfConfig struct {
-	Mode         string
-	BpfFsPath    string
-	Cgroup2Path  string
-	EnableMda    bool
-	EnableBpfLog bool
+	Mode         string `json:"mode"`
+	BpfFsPath    string `json:"bpfFsPath"`
+	Cgroup2Path  string `json:"cgroup2Path"`
+	EnableMda    bool   `json:"enableMda"`
+	EnableBpfLog bool   `json:"enableBpfLog"`
+	// probe the kernel for the required bpf features before loading
+	FeatureCheck bool `json:"featureCheck"`
 }
 
 func (c *BpfConfig) AttachFlags(cmd *cobra.Command) {
@@ -39,6 +41,7 @@ func (c *BpfConfig) AttachFlags(cmd *cobra.Command) {
 	cmd.PersistentFlags().StringVar(&c.Mode, "mode", "workload", "controller plane mode, valid values are [ads, workload]")
 	cmd.PersistentFlags().BoolVar(&c.EnableMda, "enable-mda", false, "enable mda")
 	cmd.PersistentFlags().BoolVar(&c.EnableBpfLog, "enable-bpf-log", false, "enable ebpf log in daemon process")
+	cmd.PersistentFlags().BoolVar(&c.FeatureCheck, "bpf-feature-check", true, "verify the kernel supports the required bpf features at startup")
 }
 
 func (c *BpfConfig) ParseConfig() error {
@@ -20,7 +20,7 @@ import (
 )
 
 type byPassConfig struct {
-	EnableByPass bool
+	EnableByPass bool `json:"enableBypass"`
 }
 
 func (c *byPassConfig) AttachFlags(cmd *cobra.Command) {
@@ -23,9 +23,9 @@ import (
 )
 
 type cniConfig struct {
-	CniMountNetEtcDIR string
-	CniConfigName     string
-	CniConfigChained  bool
+	CniMountNetEtcDIR string `json:"cniEtcPath"`
+	CniConfigName     string `json:"conflistName"`
+	CniConfigChained  bool   `json:"pluginCniChained"`
 }
 
 func (c *cniConfig) AttachFlags(cmd *cobra.Command) {
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2024 The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package options
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+)
+
+type featureGate struct {
+	Description  string
+	DefaultValue bool
+}
+
+var (
+	featureGatesMutex sync.RWMutex
+	// knownFeatureGates holds all the registered gates, keyed by gate name
+	knownFeatureGates = map[string]featureGate{}
+)
+
+// RegisterFeatureGate registers a known experimental feature gate, it is expected to be called from init().
+// Registering the same gate twice overrides the former one.
+func RegisterFeatureGate(name, description string, defaultValue bool) {
+	featureGatesMutex.Lock()
+	defer featureGatesMutex.Unlock()
+	knownFeatureGates[name] = featureGate{
+		Description:  description,
+		DefaultValue: defaultValue,
+	}
+}
+
+func knownFeatureGatesUsage() string {
+	featureGatesMutex.RLock()
+	defer featureGatesMutex.RUnlock()
+
+	names := make([]string, 0, len(knownFeatureGates))
+	for name := range knownFeatureGates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	usage := make([]string, 0, len(names))
+	for _, name := range names {
+		gate := knownFeatureGates[name]
+		usage = append(usage, fmt.Sprintf("%s=true|false (default=%t): %s", name, gate.DefaultValue, gate.Description))
+	}
+	return strings.Join(usage, "; ")
+}
+
+type featureGatesConfig struct {
+	// FeatureGates holds the explicitly configured gates
+	FeatureGates map[string]bool
+	// raw flag value, parsed into FeatureGates
+	rawFeatureGates map[string]string
+}
+
+// MarshalJSON encodes the configured gates as a plain name to value object
+func (c *featureGatesConfig) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.FeatureGates)
+}
+
+func (c *featureGatesConfig) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &c.FeatureGates)
+}
+
+func (c *featureGatesConfig) AttachFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringToStringVar(&c.rawFeatureGates, "feature-gates", nil,
+		"a set of key=value pairs that describe experimental feature gates, known gates are: "+knownFeatureGatesUsage())
+}
+
+func (c *featureGatesConfig) ParseConfig() error {
+	featureGatesMutex.RLock()
+	defer featureGatesMutex.RUnlock()
+
+	// gates loaded from the config file are overridden by the flag
+	gates := make(map[string]bool, len(c.FeatureGates)+len(c.rawFeatureGates))
+	for name, enabled := range c.FeatureGates {
+		if _, ok := knownFeatureGates[name]; !ok {
+			return fmt.Errorf("unknown feature gate %q", name)
+		}
+		gates[name] = enabled
+	}
+	c.FeatureGates = gates
+	for name, value := range c.rawFeatureGates {
+		if _, ok := knownFeatureGates[name]; !ok {
+			return fmt.Errorf("unknown feature gate %q", name)
+		}
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid value %q of feature gate %q: %v", value, name, err)
+		}
+		c.FeatureGates[name] = enabled
+	}
+	return nil
+}
+
+// IsFeatureEnabled returns the configured value of the gate, falling back to the registered default.
+// Unknown gates are always disabled.
+func (c *featureGatesConfig) IsFeatureEnabled(name string) bool {
+	if c != nil {
+		if enabled, ok := c.FeatureGates[name]; ok {
+			return enabled
+		}
+	}
+
+	featureGatesMutex.RLock()
+	defer featureGatesMutex.RUnlock()
+	return knownFeatureGates[name].DefaultValue
+}
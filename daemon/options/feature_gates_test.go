@@ -0,0 +1,69 @@
+/*
+ * Copyright 2024 The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package options
+
+import (
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFeatureGates(t *testing.T) {
+	RegisterFeatureGate("UTFeatureA", "feature for ut", false)
+	RegisterFeatureGate("UTFeatureB", "feature enabled by default for ut", true)
+	defer func() {
+		delete(knownFeatureGates, "UTFeatureA")
+		delete(knownFeatureGates, "UTFeatureB")
+	}()
+
+	parse := func(args ...string) (*BootstrapConfigs, error) {
+		configs := NewBootstrapConfigs()
+		cmd := &cobra.Command{}
+		configs.FeatureGatesConfig.AttachFlags(cmd)
+		if err := cmd.PersistentFlags().Parse(args); err != nil {
+			return nil, err
+		}
+		return configs, configs.FeatureGatesConfig.ParseConfig()
+	}
+
+	t.Run("default values", func(t *testing.T) {
+		configs, err := parse()
+		assert.NoError(t, err)
+		assert.False(t, configs.IsFeatureEnabled("UTFeatureA"))
+		assert.True(t, configs.IsFeatureEnabled("UTFeatureB"))
+		// unknown gate is always disabled
+		assert.False(t, configs.IsFeatureEnabled("UTUnknown"))
+	})
+
+	t.Run("explicitly configured", func(t *testing.T) {
+		configs, err := parse("--feature-gates=UTFeatureA=true,UTFeatureB=false")
+		assert.NoError(t, err)
+		assert.True(t, configs.IsFeatureEnabled("UTFeatureA"))
+		assert.False(t, configs.IsFeatureEnabled("UTFeatureB"))
+	})
+
+	t.Run("unknown gate", func(t *testing.T) {
+		_, err := parse("--feature-gates=UTUnknown=true")
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid value", func(t *testing.T) {
+		_, err := parse("--feature-gates=UTFeatureA=yes")
+		assert.Error(t, err)
+	})
+}
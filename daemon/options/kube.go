@@ -0,0 +1,32 @@
+/* Copyright 2024 The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package options
+
+import (
+	"github.com/spf13/cobra"
+)
+
+type kubeConfig struct {
+	// InCluster reaches the kubernetes api server with the service account of the kmesh pod
+	InCluster bool `json:"inCluster"`
+	// Kubeconfig is the kubeconfig file used to reach the kubernetes api server when not in cluster
+	Kubeconfig string `json:"kubeconfig"`
+}
+
+func (c *kubeConfig) AttachFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().BoolVar(&c.InCluster, "kube-in-cluster", true, "reach the kubernetes api server with the in-cluster service account")
+	cmd.PersistentFlags().StringVar(&c.Kubeconfig, "kubeconfig", "", "kubeconfig file to reach the kubernetes api server with, requires --kube-in-cluster=false")
+}
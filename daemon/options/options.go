@@ -18,17 +18,30 @@
 package options
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"os"
 
 	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
+
+	"kmesh.net/kmesh/pkg/constants"
 )
 
 type BootstrapConfigs struct {
-	BpfConfig           *BpfConfig
-	CniConfig           *cniConfig
-	ByPassConfig        *byPassConfig
-	SecretManagerConfig *secretConfig
+	BpfConfig           *BpfConfig          `json:"bpf"`
+	CniConfig           *cniConfig          `json:"cni"`
+	ByPassConfig        *byPassConfig       `json:"bypass"`
+	SecretManagerConfig *secretConfig       `json:"secretManager"`
+	FeatureGatesConfig  *featureGatesConfig `json:"featureGates"`
+	AdminConfig         *adminConfig        `json:"admin"`
+	ReconcileConfig     *reconcileConfig    `json:"reconcile"`
+	KubeConfig          *kubeConfig         `json:"kube"`
+	WorkloadConfig      *WorkloadConfig     `json:"workload"`
+
+	// ConfigFile is the yaml or json file the configs are loaded from, before the flags are applied
+	ConfigFile string `json:"-"`
 }
 
 func NewBootstrapConfigs() *BootstrapConfigs {
@@ -37,9 +50,16 @@ func NewBootstrapConfigs() *BootstrapConfigs {
 		CniConfig:           &cniConfig{},
 		ByPassConfig:        &byPassConfig{},
 		SecretManagerConfig: &secretConfig{},
+		FeatureGatesConfig:  &featureGatesConfig{},
+		AdminConfig:         &adminConfig{},
+		ReconcileConfig:     &reconcileConfig{},
+		KubeConfig:          &kubeConfig{InCluster: true},
+		WorkloadConfig:      &WorkloadConfig{},
 	}
 }
 
+// String prints the configs as indented json. None of the configs holds key material, the secret manager
+// fetches its certificates at runtime, so nothing is redacted. A new field holding a secret must be tagged json:"-".
 func (c *BootstrapConfigs) String() string {
 	data, err := json.MarshalIndent(c, "", "  ")
 	if err != nil {
@@ -49,11 +69,43 @@ func (c *BootstrapConfigs) String() string {
 	return string(data)
 }
 
+// UnmarshalJSON decodes the configs strictly, unknown fields are rejected so that
+// misspelled options in a config file are not silently ignored
+func (c *BootstrapConfigs) UnmarshalJSON(data []byte) error {
+	// alias drops the methods, otherwise Decode calls UnmarshalJSON recursively
+	type alias BootstrapConfigs
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode((*alias)(c))
+}
+
+// LoadFromFile loads the configs from a yaml or json file, the options absent from the file are kept
+func (c *BootstrapConfigs) LoadFromFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file failed, %s", err)
+	}
+	// json is a subset of yaml
+	if data, err = yaml.YAMLToJSON(data); err != nil {
+		return fmt.Errorf("parse config file %s failed, %s", path, err)
+	}
+	if err = json.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("parse config file %s failed, %s", path, err)
+	}
+	return nil
+}
+
 func (c *BootstrapConfigs) AttachFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().StringVar(&c.ConfigFile, "config-file", "", "yaml or json file to load the configs from, the flags take precedence over it")
 	c.BpfConfig.AttachFlags(cmd)
 	c.CniConfig.AttachFlags(cmd)
 	c.ByPassConfig.AttachFlags(cmd)
 	c.SecretManagerConfig.AttachFlags(cmd)
+	c.FeatureGatesConfig.AttachFlags(cmd)
+	c.AdminConfig.AttachFlags(cmd)
+	c.ReconcileConfig.AttachFlags(cmd)
+	c.KubeConfig.AttachFlags(cmd)
+	c.WorkloadConfig.AttachFlags(cmd)
 }
 
 func (c *BootstrapConfigs) ParseConfigs() error {
@@ -63,5 +115,47 @@ func (c *BootstrapConfigs) ParseConfigs() error {
 	if err := c.CniConfig.ParseConfig(); err != nil {
 		return fmt.Errorf("parse CniConfig failed, %s", err)
 	}
+	if err := c.FeatureGatesConfig.ParseConfig(); err != nil {
+		return fmt.Errorf("parse FeatureGatesConfig failed, %s", err)
+	}
+	return c.Validate()
+}
+
+// Validate checks the invariants across the configs, the options only taking effect
+// in workload mode are rejected in ads mode rather than silently ignored
+func (c *BootstrapConfigs) Validate() error {
+	if !c.BpfConfig.AdsEnabled() && !c.BpfConfig.WdsEnabled() {
+		return fmt.Errorf("invalid mode %q, valid values are [%s, %s]", c.BpfConfig.Mode, constants.AdsMode, constants.WorkloadMode)
+	}
+	if c.ReconcileConfig.KubeInterval < 0 {
+		return fmt.Errorf("invalid kube reconcile interval %s, it must not be negative", c.ReconcileConfig.KubeInterval)
+	}
+	if c.KubeConfig.InCluster && c.KubeConfig.Kubeconfig != "" {
+		return fmt.Errorf("kubeconfig %s conflicts with the in-cluster kube client, disable kube-in-cluster to use it", c.KubeConfig.Kubeconfig)
+	}
+	if !c.KubeConfig.InCluster && c.KubeConfig.Kubeconfig == "" {
+		return fmt.Errorf("a kubeconfig is required when the kube client is not in cluster")
+	}
+	if err := c.WorkloadConfig.Validate(); err != nil {
+		return err
+	}
+
+	if c.BpfConfig.WdsEnabled() {
+		return nil
+	}
+	if c.SecretManagerConfig.Enable {
+		return fmt.Errorf("secret manager is only supported in %s mode", constants.WorkloadMode)
+	}
+	if c.ReconcileConfig.KubeInterval > 0 {
+		return fmt.Errorf("kube reconcile interval is only supported in %s mode", constants.WorkloadMode)
+	}
+	if !c.WorkloadConfig.isDefault() {
+		return fmt.Errorf("workload options are only supported in %s mode", constants.WorkloadMode)
+	}
 	return nil
 }
+
+// IsFeatureEnabled tells whether an experimental feature gate is enabled
+func (c *BootstrapConfigs) IsFeatureEnabled(name string) bool {
+	return c.FeatureGatesConfig.IsFeatureEnabled(name)
+}
@@ -0,0 +1,321 @@
+/*
+ * Copyright 2024 The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package options
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBootstrapConfigsJSON(t *testing.T) {
+	configs := &BootstrapConfigs{
+		BpfConfig: &BpfConfig{
+			Mode:         "ads",
+			BpfFsPath:    "/sys/fs/bpf",
+			Cgroup2Path:  "/mnt/kmesh_cgroup2",
+			EnableMda:    true,
+			EnableBpfLog: true,
+			FeatureCheck: true,
+		},
+		CniConfig: &cniConfig{
+			CniMountNetEtcDIR: "/etc/cni/net.d",
+			CniConfigName:     "10-kindnet.conflist",
+			CniConfigChained:  true,
+		},
+		ByPassConfig:        &byPassConfig{EnableByPass: true},
+		SecretManagerConfig: &secretConfig{Enable: true},
+		FeatureGatesConfig:  &featureGatesConfig{FeatureGates: map[string]bool{"UTFeatureA": true}},
+		AdminConfig:         &adminConfig{SocketPath: "/tmp/admin.sock"},
+		ReconcileConfig:     &reconcileConfig{KubeInterval: time.Minute},
+		KubeConfig:          &kubeConfig{Kubeconfig: "/root/.kube/config"},
+		WorkloadConfig:      &WorkloadConfig{WriteRateLimit: 1000, WriteRateBurst: 100},
+		ConfigFile:          "/etc/kmesh/config.yaml",
+	}
+
+	data, err := json.Marshal(configs)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"bpf": {
+			"mode": "ads",
+			"bpfFsPath": "/sys/fs/bpf",
+			"cgroup2Path": "/mnt/kmesh_cgroup2",
+			"enableMda": true,
+			"enableBpfLog": true,
+			"featureCheck": true
+		},
+		"cni": {
+			"cniEtcPath": "/etc/cni/net.d",
+			"conflistName": "10-kindnet.conflist",
+			"pluginCniChained": true
+		},
+		"bypass": {"enableBypass": true},
+		"secretManager": {"enable": true},
+		"featureGates": {"UTFeatureA": true},
+		"admin": {"socketPath": "/tmp/admin.sock"},
+		"reconcile": {"kubeInterval": 60000000000},
+		"kube": {"inCluster": false, "kubeconfig": "/root/.kube/config"},
+		"workload": {
+			"writeRateLimit": 1000,
+			"writeRateBurst": 100,
+			"restoreWorkers": 0,
+			"countEndpointHits": false,
+			"deferUnknownWaypoints": false,
+			"consistencyCheck": false,
+			"namespaceWaypoints": null,
+			"zeroPortPassthrough": false,
+			"closeTimeout": 0,
+			"shadowMapPath": "",
+			"quarantineThreshold": 0,
+			"coalescingMaxSize": 0,
+			"serviceDebounceWindow": 0,
+			"tracingEndpoint": "",
+			"healthCheckInterval": 0,
+			"healthCheckTimeout": 0,
+			"ephemeralWorkloadTypes": null,
+			"ephemeralSkipPersist": false,
+			"localClusterId": "",
+			"snapshotPath": "",
+			"userspaceMapMirror": false,
+			"namespaceWorkloadLimits": null,
+			"namespaceServiceLimits": null
+		}
+	}`, string(data))
+
+	decoded := NewBootstrapConfigs()
+	assert.NoError(t, json.Unmarshal(data, decoded))
+	// the config file itself is not part of the configs
+	configs.ConfigFile = ""
+	assert.Equal(t, configs, decoded)
+
+	// unknown fields are rejected
+	assert.Error(t, json.Unmarshal([]byte(`{"bpf": {"mdoe": "ads"}}`), NewBootstrapConfigs()))
+	assert.Error(t, json.Unmarshal([]byte(`{"unknown": {}}`), NewBootstrapConfigs()))
+}
+
+func TestBootstrapConfigsLoadFromFile(t *testing.T) {
+	newConfigs := func() *BootstrapConfigs {
+		configs := NewBootstrapConfigs()
+		configs.BpfConfig.Mode = "workload"
+		configs.BpfConfig.BpfFsPath = "/sys/fs/bpf"
+		return configs
+	}
+	dir := t.TempDir()
+
+	t.Run("yaml", func(t *testing.T) {
+		path := filepath.Join(dir, "config.yaml")
+		assert.NoError(t, os.WriteFile(path, []byte(`
+bpf:
+  mode: ads
+  enableMda: true
+bypass:
+  enableBypass: true
+featureGates:
+  UTFeatureA: true
+`), 0644))
+
+		configs := newConfigs()
+		assert.NoError(t, configs.LoadFromFile(path))
+		assert.Equal(t, "ads", configs.BpfConfig.Mode)
+		assert.True(t, configs.BpfConfig.EnableMda)
+		assert.True(t, configs.ByPassConfig.EnableByPass)
+		assert.Equal(t, map[string]bool{"UTFeatureA": true}, configs.FeatureGatesConfig.FeatureGates)
+		// absent from the file
+		assert.Equal(t, "/sys/fs/bpf", configs.BpfConfig.BpfFsPath)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		path := filepath.Join(dir, "config.json")
+		assert.NoError(t, os.WriteFile(path, []byte(`{"admin": {"socketPath": "/tmp/admin.sock"}}`), 0644))
+
+		configs := newConfigs()
+		assert.NoError(t, configs.LoadFromFile(path))
+		assert.Equal(t, "/tmp/admin.sock", configs.AdminConfig.SocketPath)
+		assert.Equal(t, "workload", configs.BpfConfig.Mode)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		path := filepath.Join(dir, "invalid.yaml")
+		assert.NoError(t, os.WriteFile(path, []byte("bpf:\n  mode: [ads\n"), 0644))
+		assert.Error(t, newConfigs().LoadFromFile(path))
+		assert.Error(t, newConfigs().LoadFromFile(filepath.Join(dir, "absent.yaml")))
+	})
+}
+
+func TestBootstrapConfigsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(c *BootstrapConfigs)
+		wantErr string
+	}{
+		{
+			name:   "workload mode",
+			modify: func(c *BootstrapConfigs) {},
+		},
+		{
+			name: "ads mode",
+			modify: func(c *BootstrapConfigs) {
+				c.BpfConfig.Mode = "ads"
+				c.BpfConfig.EnableMda = true
+			},
+		},
+		{
+			name: "workload mode with secret manager, kube reconcile and workload options",
+			modify: func(c *BootstrapConfigs) {
+				c.SecretManagerConfig.Enable = true
+				c.ReconcileConfig.KubeInterval = time.Minute
+				c.WorkloadConfig.WriteRateLimit = 1000
+				c.WorkloadConfig.TracingEndpoint = "otel-collector.istio-system:4317"
+			},
+		},
+		{
+			name:    "unknown mode",
+			modify:  func(c *BootstrapConfigs) { c.BpfConfig.Mode = "envoy" },
+			wantErr: `invalid mode "envoy"`,
+		},
+		{
+			name:    "negative kube reconcile interval",
+			modify:  func(c *BootstrapConfigs) { c.ReconcileConfig.KubeInterval = -time.Second },
+			wantErr: "invalid kube reconcile interval",
+		},
+		{
+			name: "secret manager in ads mode",
+			modify: func(c *BootstrapConfigs) {
+				c.BpfConfig.Mode = "ads"
+				c.SecretManagerConfig.Enable = true
+			},
+			wantErr: "secret manager is only supported in workload mode",
+		},
+		{
+			name: "kube reconcile in ads mode",
+			modify: func(c *BootstrapConfigs) {
+				c.BpfConfig.Mode = "ads"
+				c.ReconcileConfig.KubeInterval = time.Minute
+			},
+			wantErr: "kube reconcile interval is only supported in workload mode",
+		},
+		{
+			name: "kube client out of cluster",
+			modify: func(c *BootstrapConfigs) {
+				c.KubeConfig.InCluster = false
+				c.KubeConfig.Kubeconfig = "/root/.kube/config"
+			},
+		},
+		{
+			name:    "kubeconfig with the in-cluster kube client",
+			modify:  func(c *BootstrapConfigs) { c.KubeConfig.Kubeconfig = "/root/.kube/config" },
+			wantErr: "conflicts with the in-cluster kube client",
+		},
+		{
+			name:    "kube client out of cluster without kubeconfig",
+			modify:  func(c *BootstrapConfigs) { c.KubeConfig.InCluster = false },
+			wantErr: "a kubeconfig is required",
+		},
+		{
+			name:    "negative bpf write rate limit",
+			modify:  func(c *BootstrapConfigs) { c.WorkloadConfig.WriteRateLimit = -1 },
+			wantErr: "invalid bpf write rate limit",
+		},
+		{
+			name: "invalid namespace waypoint",
+			modify: func(c *BootstrapConfigs) {
+				c.WorkloadConfig.NamespaceWaypoints = map[string]string{"default": "10.0.0.1"}
+			},
+			wantErr: "invalid waypoint",
+		},
+		{
+			name:    "negative workload close timeout",
+			modify:  func(c *BootstrapConfigs) { c.WorkloadConfig.CloseTimeout = -time.Second },
+			wantErr: "invalid workload close timeout",
+		},
+		{
+			name:    "negative quarantine threshold",
+			modify:  func(c *BootstrapConfigs) { c.WorkloadConfig.QuarantineThreshold = -1 },
+			wantErr: "invalid quarantine threshold",
+		},
+		{
+			name:    "negative coalescing max size",
+			modify:  func(c *BootstrapConfigs) { c.WorkloadConfig.CoalescingMaxSize = -1 },
+			wantErr: "invalid coalescing max size",
+		},
+		{
+			name:    "negative service debounce window",
+			modify:  func(c *BootstrapConfigs) { c.WorkloadConfig.ServiceDebounceWindow = -time.Second },
+			wantErr: "invalid service debounce window",
+		},
+		{
+			name:    "tracing endpoint without port",
+			modify:  func(c *BootstrapConfigs) { c.WorkloadConfig.TracingEndpoint = "otel-collector" },
+			wantErr: "invalid tracing endpoint",
+		},
+		{
+			name:    "negative health check timeout",
+			modify:  func(c *BootstrapConfigs) { c.WorkloadConfig.HealthCheckTimeout = -time.Second },
+			wantErr: "invalid health check interval",
+		},
+		{
+			name:    "unknown ephemeral workload type",
+			modify:  func(c *BootstrapConfigs) { c.WorkloadConfig.EphemeralWorkloadTypes = []string{"JOB", "daemonset"} },
+			wantErr: `invalid ephemeral workload type "daemonset"`,
+		},
+		{
+			name:    "negative namespace service limit",
+			modify:  func(c *BootstrapConfigs) { c.WorkloadConfig.NamespaceServiceLimits = map[string]int{"default": -1} },
+			wantErr: "invalid service limit -1 of namespace default",
+		},
+		{
+			name:    "negative bpf restore workers",
+			modify:  func(c *BootstrapConfigs) { c.WorkloadConfig.RestoreWorkers = -1 },
+			wantErr: "invalid bpf restore workers",
+		},
+		{
+			name: "workload options in ads mode",
+			modify: func(c *BootstrapConfigs) {
+				c.BpfConfig.Mode = "ads"
+				c.WorkloadConfig.WriteRateLimit = 1000
+			},
+			wantErr: "workload options are only supported in workload mode",
+		},
+		{
+			// the L7 policies are enforced by the waypoints, only workload mode redirects to them
+			name: "namespace waypoints in ads mode",
+			modify: func(c *BootstrapConfigs) {
+				c.BpfConfig.Mode = "ads"
+				c.WorkloadConfig.NamespaceWaypoints = map[string]string{"default": "10.0.0.1:15008"}
+			},
+			wantErr: "workload options are only supported in workload mode",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configs := NewBootstrapConfigs()
+			configs.BpfConfig.Mode = "workload"
+			tt.modify(configs)
+
+			err := configs.Validate()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorContains(t, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+/* Copyright 2024 The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package options
+
+import (
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type reconcileConfig struct {
+	// KubeInterval is the interval of the reconciliation against the kubernetes api server in workload mode
+	KubeInterval time.Duration `json:"kubeInterval"`
+}
+
+func (c *reconcileConfig) AttachFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().DurationVar(&c.KubeInterval, "kube-reconcile-interval", 0,
+		"interval of the reconciliation of the services and endpoints against the kubernetes api server in workload mode, 0 disables it")
+}
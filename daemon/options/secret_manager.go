@@ -20,7 +20,7 @@ import (
 )
 
 type secretConfig struct {
-	Enable bool
+	Enable bool `json:"enable"`
 }
 
 func (c *secretConfig) AttachFlags(cmd *cobra.Command) {
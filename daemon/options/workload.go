@@ -0,0 +1,184 @@
+/* Copyright 2024 The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package options
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"reflect"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+)
+
+// WorkloadConfig holds the options of the workload processor, they only take effect in workload mode
+type WorkloadConfig struct {
+	// WriteRateLimit limits the bpf map writes per second, 0 means unlimited
+	WriteRateLimit int `json:"writeRateLimit"`
+	// WriteRateBurst is the number of bpf map writes allowed at once under the rate limit
+	WriteRateBurst int `json:"writeRateBurst"`
+	// RestoreWorkers is the number of workers restoring the endpoint keys on restart, 0 means one per cpu
+	RestoreWorkers int `json:"restoreWorkers"`
+	// CountEndpointHits counts the connections sent to each backend of the services in the datapath
+	CountEndpointHits bool `json:"countEndpointHits"`
+	// DeferUnknownWaypoints programs the services without their waypoint until the waypoint address is learned
+	DeferUnknownWaypoints bool `json:"deferUnknownWaypoints"`
+	// ConsistencyCheck verifies the bpf maps after each address response, every check dumps the maps
+	ConsistencyCheck bool `json:"consistencyCheck"`
+	// NamespaceWaypoints are the default waypoints of the namespaces as ip:port, applied to their workloads
+	// and services without waypoint, the port is the hbone mtls port of the waypoint
+	NamespaceWaypoints map[string]string `json:"namespaceWaypoints"`
+	// ZeroPortPassthrough programs the vips of the services without ports, their connections are passed through
+	ZeroPortPassthrough bool `json:"zeroPortPassthrough"`
+	// CloseTimeout is how long the processor waits for its goroutines to exit on stop, 0 means the default
+	CloseTimeout time.Duration `json:"closeTimeout"`
+	// ShadowMapPath is the directory of the pinned maps mirroring the workload map writes, empty if disabled
+	ShadowMapPath string `json:"shadowMapPath"`
+	// QuarantineThreshold is the number of consecutive failures quarantining a service or workload, 0 disables it
+	QuarantineThreshold int `json:"quarantineThreshold"`
+	// CoalescingMaxSize is the number of pending resources flushing the coalesced updates, 0 disables the coalescing
+	CoalescingMaxSize int `json:"coalescingMaxSize"`
+	// ServiceDebounceWindow is how long a newly-seen service is held before programmed, 0 disables the debounce
+	ServiceDebounceWindow time.Duration `json:"serviceDebounceWindow"`
+	// TracingEndpoint is the host:port of the OTLP grpc collector the address response spans are exported to, empty if disabled
+	TracingEndpoint string `json:"tracingEndpoint"`
+	// HealthCheckInterval is the interval of the active health check of the endpoints, 0 disables it
+	HealthCheckInterval time.Duration `json:"healthCheckInterval"`
+	// HealthCheckTimeout is how long a health check probe may take, 0 means the default
+	HealthCheckTimeout time.Duration `json:"healthCheckTimeout"`
+	// EphemeralWorkloadTypes are the workload types of the short-lived workloads, JOB and CRONJOB if empty
+	EphemeralWorkloadTypes []string `json:"ephemeralWorkloadTypes"`
+	// EphemeralSkipPersist keeps the hash names of the ephemeral workloads out of the persist file
+	EphemeralSkipPersist bool `json:"ephemeralSkipPersist"`
+	// LocalClusterId is the cluster id given to the workloads received without one, empty if they are left without
+	LocalClusterId string `json:"localClusterId"`
+	// SnapshotPath is the file the cached addresses are saved to on stop and programmed from on boot, empty if disabled
+	SnapshotPath string `json:"snapshotPath"`
+	// UserspaceMapMirror serves the admin queries from a userspace copy of the workload maps instead of the maps in kernel
+	UserspaceMapMirror bool `json:"userspaceMapMirror"`
+	// NamespaceWorkloadLimits cap the workloads programmed per namespace, 0 or absent means no cap
+	NamespaceWorkloadLimits map[string]int `json:"namespaceWorkloadLimits"`
+	// NamespaceServiceLimits cap the services programmed per namespace, 0 or absent means no cap
+	NamespaceServiceLimits map[string]int `json:"namespaceServiceLimits"`
+}
+
+func (c *WorkloadConfig) AttachFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().IntVar(&c.WriteRateLimit, "bpf-write-rate-limit", 0,
+		"bpf map writes per second in workload mode, so that a huge xDS response does not saturate bpf syscalls, 0 means unlimited")
+	cmd.PersistentFlags().IntVar(&c.WriteRateBurst, "bpf-write-rate-burst", 0,
+		"bpf map writes allowed at once under the write rate limit")
+	cmd.PersistentFlags().IntVar(&c.RestoreWorkers, "bpf-restore-workers", 0,
+		"workers looking up the endpoint map in parallel to restore the endpoint keys on restart, 0 means one per cpu")
+	cmd.PersistentFlags().BoolVar(&c.CountEndpointHits, "count-endpoint-hits", false,
+		"count the connections sent to each backend of the services, reported by the EndpointHits admin method")
+	cmd.PersistentFlags().BoolVar(&c.DeferUnknownWaypoints, "defer-unknown-waypoints", false,
+		"program the services referencing a waypoint address not learned yet without waypoint until it is learned")
+	cmd.PersistentFlags().BoolVar(&c.ConsistencyCheck, "bpf-consistency-check", false,
+		"verify the bpf maps against the cached workloads and services after each address response, for debugging")
+	cmd.PersistentFlags().StringToStringVar(&c.NamespaceWaypoints, "namespace-waypoints", nil,
+		"default waypoints of the namespaces as namespace=ip:port, applied to their workloads and services without waypoint")
+	cmd.PersistentFlags().BoolVar(&c.ZeroPortPassthrough, "zero-port-passthrough", false,
+		"program the vips of the services without ports, their connections are passed through or sent to the waypoint")
+	cmd.PersistentFlags().DurationVar(&c.CloseTimeout, "workload-close-timeout", 0,
+		"how long to wait for the background goroutines of the workload processor to exit on stop, 0 means 5s")
+	cmd.PersistentFlags().StringVar(&c.ShadowMapPath, "bpf-shadow-map-path", "",
+		"directory of the pinned frontend, service, endpoint and backend maps to mirror the workload map writes to during a map migration")
+	cmd.PersistentFlags().IntVar(&c.QuarantineThreshold, "quarantine-threshold", 0,
+		"consecutive failures to program a service or workload before it is skipped until it changes, 0 disables the quarantine")
+	cmd.PersistentFlags().IntVar(&c.CoalescingMaxSize, "coalescing-max-size", 0,
+		"hold the service and workload updates for a few milliseconds to write each resource once, they are written at once when that many are pending, 0 disables the coalescing")
+	cmd.PersistentFlags().DurationVar(&c.ServiceDebounceWindow, "service-debounce-window", 0,
+		"hold a newly-seen service for this window before programming it, so that a flapping service is written once, 0 disables the debounce")
+	cmd.PersistentFlags().StringVar(&c.TracingEndpoint, "tracing-endpoint", "",
+		"host:port of the OTLP grpc collector to export the spans of the address responses handling to over plaintext, empty disables tracing")
+	cmd.PersistentFlags().DurationVar(&c.HealthCheckInterval, "health-check-interval", 0,
+		"probe the backends of the endpoints each interval and skip the unreachable ones in the load balancing, 0 disables the active health check")
+	cmd.PersistentFlags().DurationVar(&c.HealthCheckTimeout, "health-check-timeout", 0,
+		"how long a health check probe may take before the endpoint is marked unready, 0 means 1s")
+	cmd.PersistentFlags().StringSliceVar(&c.EphemeralWorkloadTypes, "ephemeral-workload-types", nil,
+		"workload types of the short-lived workloads among DEPLOYMENT, CRONJOB, POD and JOB, JOB and CRONJOB if empty")
+	cmd.PersistentFlags().BoolVar(&c.EphemeralSkipPersist, "ephemeral-skip-persist", false,
+		"keep the hash names of the ephemeral workloads out of the persist file, so that their churn does not grow it")
+	cmd.PersistentFlags().StringVar(&c.LocalClusterId, "local-cluster-id", "",
+		"cluster id given to the workloads received without one, a warning is logged for each of them")
+	cmd.PersistentFlags().StringVar(&c.SnapshotPath, "snapshot-path", "",
+		"file the cached services and workloads are saved to on stop, they are programmed from it on boot until the first address response, empty disables the warm start")
+	cmd.PersistentFlags().BoolVar(&c.UserspaceMapMirror, "userspace-map-mirror", false,
+		"keep a userspace copy of the workload bpf maps the admin queries read, so that kmeshctl issues no bpf syscalls")
+	cmd.PersistentFlags().StringToIntVar(&c.NamespaceWorkloadLimits, "namespace-workload-limits", nil,
+		"caps of the workloads programmed per namespace as namespace=limit, the new workloads beyond the cap are rejected")
+	cmd.PersistentFlags().StringToIntVar(&c.NamespaceServiceLimits, "namespace-service-limits", nil,
+		"caps of the services programmed per namespace as namespace=limit, the new services beyond the cap are rejected")
+}
+
+// Validate checks the values of the options
+func (c *WorkloadConfig) Validate() error {
+	if c.WriteRateLimit < 0 || c.WriteRateBurst < 0 {
+		return fmt.Errorf("invalid bpf write rate limit %d and burst %d, they must not be negative", c.WriteRateLimit, c.WriteRateBurst)
+	}
+	if c.RestoreWorkers < 0 {
+		return fmt.Errorf("invalid bpf restore workers %d, it must not be negative", c.RestoreWorkers)
+	}
+	if c.QuarantineThreshold < 0 {
+		return fmt.Errorf("invalid quarantine threshold %d, it must not be negative", c.QuarantineThreshold)
+	}
+	if c.CoalescingMaxSize < 0 {
+		return fmt.Errorf("invalid coalescing max size %d, it must not be negative", c.CoalescingMaxSize)
+	}
+	if c.ServiceDebounceWindow < 0 {
+		return fmt.Errorf("invalid service debounce window %s, it must not be negative", c.ServiceDebounceWindow)
+	}
+	if c.HealthCheckInterval < 0 || c.HealthCheckTimeout < 0 {
+		return fmt.Errorf("invalid health check interval %s and timeout %s, they must not be negative", c.HealthCheckInterval, c.HealthCheckTimeout)
+	}
+	if c.CloseTimeout < 0 {
+		return fmt.Errorf("invalid workload close timeout %s, it must not be negative", c.CloseTimeout)
+	}
+	if c.TracingEndpoint != "" {
+		if _, _, err := net.SplitHostPort(c.TracingEndpoint); err != nil {
+			return fmt.Errorf("invalid tracing endpoint %q, %s", c.TracingEndpoint, err)
+		}
+	}
+	for _, workloadType := range c.EphemeralWorkloadTypes {
+		if _, ok := workloadapi.WorkloadType_value[workloadType]; !ok {
+			return fmt.Errorf("invalid ephemeral workload type %q", workloadType)
+		}
+	}
+	for namespace, limit := range c.NamespaceWorkloadLimits {
+		if limit < 0 {
+			return fmt.Errorf("invalid workload limit %d of namespace %s, it must not be negative", limit, namespace)
+		}
+	}
+	for namespace, limit := range c.NamespaceServiceLimits {
+		if limit < 0 {
+			return fmt.Errorf("invalid service limit %d of namespace %s, it must not be negative", limit, namespace)
+		}
+	}
+	for namespace, waypoint := range c.NamespaceWaypoints {
+		if _, err := netip.ParseAddrPort(waypoint); err != nil {
+			return fmt.Errorf("invalid waypoint %q of namespace %s, %s", waypoint, namespace, err)
+		}
+	}
+	return nil
+}
+
+// isDefault tells whether all the options are left to their defaults
+func (c *WorkloadConfig) isDefault() bool {
+	return reflect.ValueOf(*c).IsZero()
+}
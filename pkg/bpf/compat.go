@@ -0,0 +1,145 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/features"
+)
+
+const (
+	minKernelVersion = 5<<16 | 10<<8
+
+	lsmListPath     = "/sys/kernel/security/lsm"
+	filesystemsPath = "/proc/filesystems"
+)
+
+// CompatError describes a host capability kmesh relies on which is missing
+type CompatError struct {
+	Feature  string
+	Required string
+	Actual   string
+}
+
+func (e CompatError) Error() string {
+	return fmt.Sprintf("%s: requires %s, got %s", e.Feature, e.Required, e.Actual)
+}
+
+type compatProbe struct {
+	feature  string
+	required string
+	// probe returns the actual state of the host, and whether it meets the requirement
+	probe func() (string, bool)
+}
+
+func compatProbes() []compatProbe {
+	return []compatProbe{
+		{
+			feature:  "kernel version",
+			required: ">= " + kernelVersionString(minKernelVersion),
+			probe: func() (string, bool) {
+				v, err := features.LinuxVersionCode()
+				if err != nil {
+					return fmt.Sprintf("unknown (%v)", err), false
+				}
+				return kernelVersionString(v), v >= minKernelVersion
+			},
+		},
+		{
+			feature:  "bpf_skb_store_bytes helper",
+			required: "available",
+			probe: func() (string, bool) {
+				return probeResult(features.HaveProgramHelper(ebpf.SchedCLS, asm.FnSkbStoreBytes))
+			},
+		},
+		{
+			feature:  "BPF LSM",
+			required: "enabled",
+			probe: func() (string, bool) {
+				if actual, ok := probeResult(features.HaveProgramType(ebpf.LSM)); !ok {
+					return actual, false
+				}
+				data, err := os.ReadFile(lsmListPath)
+				if err != nil {
+					return fmt.Sprintf("unknown (%v)", err), false
+				}
+				lsms := strings.TrimSpace(string(data))
+				if !slices.Contains(strings.Split(lsms, ","), "bpf") {
+					return "not in the active lsm list " + lsms, false
+				}
+				return "enabled", true
+			},
+		},
+		{
+			feature:  "cgroup v2",
+			required: "supported",
+			probe: func() (string, bool) {
+				data, err := os.ReadFile(filesystemsPath)
+				if err != nil {
+					return fmt.Sprintf("unknown (%v)", err), false
+				}
+				for _, line := range strings.Split(string(data), "\n") {
+					fields := strings.Fields(line)
+					if len(fields) > 0 && fields[len(fields)-1] == "cgroup2" {
+						return "supported", true
+					}
+				}
+				return "unsupported", false
+			},
+		},
+	}
+}
+
+// CompatCheck verifies the host provides the capabilities kmesh relies on, beyond the bpf features
+// checked by CheckFeatures, and returns one CompatError for each missing capability
+func CompatCheck() []CompatError {
+	return compatCheck(compatProbes())
+}
+
+func compatCheck(probes []compatProbe) []CompatError {
+	var errs []CompatError
+
+	for _, p := range probes {
+		if actual, ok := p.probe(); !ok {
+			errs = append(errs, CompatError{Feature: p.feature, Required: p.required, Actual: actual})
+		}
+	}
+	return errs
+}
+
+func probeResult(err error) (string, bool) {
+	switch {
+	case err == nil:
+		return "available", true
+	case errors.Is(err, ebpf.ErrNotSupported):
+		return "unavailable", false
+	default:
+		return fmt.Sprintf("unknown (%v)", err), false
+	}
+}
+
+// kernelVersionString formats a version in the KERNEL_VERSION format as major.minor.patch
+func kernelVersionString(v uint32) string {
+	return fmt.Sprintf("%d.%d.%d", v>>16, v>>8&0xff, v&0xff)
+}
@@ -0,0 +1,53 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompatCheck(t *testing.T) {
+	met := func(actual string) func() (string, bool) {
+		return func() (string, bool) { return actual, true }
+	}
+	missing := func(actual string) func() (string, bool) {
+		return func() (string, bool) { return actual, false }
+	}
+
+	assert.Empty(t, compatCheck([]compatProbe{
+		{feature: "kernel version", required: ">= 5.10.0", probe: met("6.1.0")},
+		{feature: "cgroup v2", required: "supported", probe: met("supported")},
+	}))
+
+	errs := compatCheck([]compatProbe{
+		{feature: "kernel version", required: ">= 5.10.0", probe: missing("5.4.0")},
+		{feature: "cgroup v2", required: "supported", probe: met("supported")},
+		{feature: "BPF LSM", required: "enabled", probe: missing("not in the active lsm list lockdown,capability")},
+	})
+	assert.Equal(t, []CompatError{
+		{Feature: "kernel version", Required: ">= 5.10.0", Actual: "5.4.0"},
+		{Feature: "BPF LSM", Required: "enabled", Actual: "not in the active lsm list lockdown,capability"},
+	}, errs)
+	assert.EqualError(t, errs[0], "kernel version: requires >= 5.10.0, got 5.4.0")
+}
+
+func TestKernelVersionString(t *testing.T) {
+	assert.Equal(t, "5.10.0", kernelVersionString(minKernelVersion))
+	assert.Equal(t, "6.8.12", kernelVersionString(6<<16|8<<8|12))
+}
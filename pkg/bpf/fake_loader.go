@@ -0,0 +1,60 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpf
+
+import (
+	"github.com/cilium/ebpf"
+)
+
+// FakeProgramLoader is a ProgramLoader handing out injected bpf objects, for tests
+// which do not load real bpf programs nor mount a bpf filesystem.
+type FakeProgramLoader struct {
+	Workload *BpfKmeshWorkload
+	LogLevel *ebpf.Map
+	// LoadErr is returned by Load if set
+	LoadErr error
+	Loaded  bool
+}
+
+var _ ProgramLoader = &FakeProgramLoader{}
+
+func NewFakeProgramLoader(workload *BpfKmeshWorkload) *FakeProgramLoader {
+	return &FakeProgramLoader{
+		Workload: workload,
+	}
+}
+
+func (l *FakeProgramLoader) Load() error {
+	if l.LoadErr != nil {
+		return l.LoadErr
+	}
+	l.Loaded = true
+	return nil
+}
+
+func (l *FakeProgramLoader) Unload() error {
+	l.Loaded = false
+	return nil
+}
+
+func (l *FakeProgramLoader) GetBpfKmeshWorkload() *BpfKmeshWorkload {
+	return l.Workload
+}
+
+func (l *FakeProgramLoader) GetBpfLogLevel() *ebpf.Map {
+	return l.LogLevel
+}
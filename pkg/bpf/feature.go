@@ -0,0 +1,94 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpf
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/features"
+)
+
+type featureProbe struct {
+	name  string
+	probe func() error
+}
+
+func mapTypeProbe(mt ebpf.MapType) featureProbe {
+	return featureProbe{
+		name:  "map type " + mt.String(),
+		probe: func() error { return features.HaveMapType(mt) },
+	}
+}
+
+func programTypeProbe(pt ebpf.ProgramType) featureProbe {
+	return featureProbe{
+		name:  "program type " + pt.String(),
+		probe: func() error { return features.HaveProgramType(pt) },
+	}
+}
+
+// requiredFeatures are the bpf features used by the kmesh bpf programs
+func requiredFeatures() []featureProbe {
+	return []featureProbe{
+		mapTypeProbe(ebpf.Hash),
+		mapTypeProbe(ebpf.Array),
+		mapTypeProbe(ebpf.PerCPUArray),
+		mapTypeProbe(ebpf.ArrayOfMaps),
+		mapTypeProbe(ebpf.ProgramArray),
+		mapTypeProbe(ebpf.RingBuf),
+		mapTypeProbe(ebpf.SkStorage),
+		mapTypeProbe(ebpf.SockHash),
+		programTypeProbe(ebpf.CGroupSockAddr),
+		programTypeProbe(ebpf.SockOps),
+		programTypeProbe(ebpf.SkMsg),
+		programTypeProbe(ebpf.XDP),
+	}
+}
+
+// CheckFeatures probes the kernel for the bpf features required by kmesh, and returns an error
+// listing the unsupported ones, rather than failing later on an obscure map or program creation.
+func CheckFeatures() error {
+	return checkFeatures(requiredFeatures())
+}
+
+func checkFeatures(probes []featureProbe) error {
+	var (
+		unsupported []string
+		errs        []error
+	)
+
+	for _, p := range probes {
+		err := p.probe()
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, ebpf.ErrNotSupported) {
+			unsupported = append(unsupported, p.name)
+		} else {
+			errs = append(errs, fmt.Errorf("probe %s failed: %v", p.name, err))
+		}
+	}
+
+	if len(unsupported) > 0 {
+		errs = append([]error{fmt.Errorf("kernel does not support the bpf features required by kmesh: %s",
+			strings.Join(unsupported, ", "))}, errs...)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,57 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpf
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckFeatures(t *testing.T) {
+	supported := func() error { return nil }
+	unsupported := func() error { return fmt.Errorf("probe: %w", ebpf.ErrNotSupported) }
+
+	t.Run("supported kernel", func(t *testing.T) {
+		err := checkFeatures([]featureProbe{
+			{name: "map type Hash", probe: supported},
+			{name: "program type SockOps", probe: supported},
+		})
+		assert.NoError(t, err)
+	})
+
+	t.Run("unsupported kernel", func(t *testing.T) {
+		err := checkFeatures([]featureProbe{
+			{name: "map type Hash", probe: supported},
+			{name: "map type RingBuf", probe: unsupported},
+			{name: "program type SkMsg", probe: unsupported},
+		})
+		assert.EqualError(t, err, "kernel does not support the bpf features required by kmesh: map type RingBuf, program type SkMsg")
+	})
+
+	t.Run("probe failure", func(t *testing.T) {
+		err := checkFeatures([]featureProbe{
+			{name: "map type RingBuf", probe: unsupported},
+			{name: "map type Hash", probe: func() error { return errors.New("operation not permitted") }},
+		})
+		assert.ErrorContains(t, err, "map type RingBuf")
+		assert.ErrorContains(t, err, "probe map type Hash failed: operation not permitted")
+	})
+}
@@ -0,0 +1,53 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpf
+
+import (
+	"github.com/cilium/ebpf"
+
+	"kmesh.net/kmesh/daemon/options"
+)
+
+// ProgramLoader loads the kmesh bpf programs and maps, and exposes them to the controllers
+type ProgramLoader interface {
+	Load() error
+	Unload() error
+	GetBpfKmeshWorkload() *BpfKmeshWorkload
+	GetBpfLogLevel() *ebpf.Map
+}
+
+// EbpfProgramLoader is the ProgramLoader loading the bpf programs into the kernel
+type EbpfProgramLoader struct {
+	*BpfLoader
+}
+
+var _ ProgramLoader = &EbpfProgramLoader{}
+
+func NewEbpfProgramLoader(config *options.BpfConfig) *EbpfProgramLoader {
+	return &EbpfProgramLoader{
+		BpfLoader: NewBpfLoader(config),
+	}
+}
+
+func (l *EbpfProgramLoader) Load() error {
+	return l.Start(l.config)
+}
+
+func (l *EbpfProgramLoader) Unload() error {
+	l.Stop()
+	return nil
+}
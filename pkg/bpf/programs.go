@@ -0,0 +1,104 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpf
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/cilium/ebpf"
+)
+
+// kmeshPinDirs are the directories under the bpf fs the programs of ads and workload mode are pinned in
+var kmeshPinDirs = []string{"bpf_kmesh", "bpf_kmesh_workload"}
+
+// ProgramInfo describes a bpf program pinned by kmesh
+type ProgramInfo struct {
+	ID           uint32 `json:"id"`
+	Name         string `json:"name"`
+	Type         string `json:"type"`
+	Tag          string `json:"tag"`
+	Instructions int    `json:"instructions"`
+	PinPath      string `json:"pinPath"`
+}
+
+// GetLoadedPrograms returns the programs pinned by kmesh under bpfFsPath, sorted by pin path.
+// The instruction count is 0 if the kernel doesn't expose the instructions to the caller.
+func GetLoadedPrograms(bpfFsPath string) ([]ProgramInfo, error) {
+	var programs []ProgramInfo
+
+	for _, dir := range kmeshPinDirs {
+		root := filepath.Join(bpfFsPath, dir)
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			info, err := pinnedProgramInfo(path)
+			if err != nil {
+				log.Debugf("skip %s: %v", path, err)
+				return nil
+			}
+			programs = append(programs, *info)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("walk %s failed: %v", root, err)
+		}
+	}
+
+	sort.Slice(programs, func(i, j int) bool {
+		return programs[i].PinPath < programs[j].PinPath
+	})
+	return programs, nil
+}
+
+// pinnedProgramInfo describes the program pinned at path, it fails if a map is pinned there
+func pinnedProgramInfo(path string) (*ProgramInfo, error) {
+	prog, err := ebpf.LoadPinnedProgram(path, &ebpf.LoadPinOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer prog.Close()
+
+	info, err := prog.Info()
+	if err != nil {
+		return nil, fmt.Errorf("get prog info failed, %s", err)
+	}
+	pi := &ProgramInfo{
+		Name:    info.Name,
+		Type:    info.Type.String(),
+		Tag:     info.Tag,
+		PinPath: path,
+	}
+	if id, ok := info.ID(); ok {
+		pi.ID = uint32(id)
+	}
+	if insns, err := info.Instructions(); err == nil {
+		pi.Instructions = len(insns)
+	}
+	return pi, nil
+}
@@ -25,6 +25,7 @@ import (
 	"google.golang.org/grpc"
 	istiogrpc "istio.io/istio/pilot/pkg/grpc"
 
+	"kmesh.net/kmesh/daemon/options"
 	"kmesh.net/kmesh/pkg/bpf"
 	"kmesh.net/kmesh/pkg/constants"
 	"kmesh.net/kmesh/pkg/controller/ads"
@@ -48,20 +49,23 @@ type XdsClient struct {
 	xdsConfig          *config.XdsConfig
 }
 
-func NewXdsClient(mode string, bpfWorkload *bpf.BpfKmeshWorkload) *XdsClient {
+func NewXdsClient(mode string, bpfWorkload *bpf.BpfKmeshWorkload, workloadConfig *options.WorkloadConfig) (*XdsClient, error) {
+	var err error
 	client := &XdsClient{
 		mode:      mode,
 		xdsConfig: config.GetConfig(mode),
 	}
 
 	if mode == constants.WorkloadMode {
-		client.WorkloadController = workload.NewController(bpfWorkload)
+		if client.WorkloadController, err = workload.NewController(bpfWorkload, workloadConfig); err != nil {
+			return nil, err
+		}
 	} else if mode == constants.AdsMode {
 		client.AdsController = ads.NewController()
 	}
 
 	client.ctx, client.cancel = context.WithCancel(context.Background())
-	return client
+	return client, nil
 }
 
 func (c *XdsClient) createGrpcStreamClient() error {
@@ -28,16 +28,19 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 
+	"kmesh.net/kmesh/daemon/options"
 	"kmesh.net/kmesh/pkg/bpf"
 	"kmesh.net/kmesh/pkg/constants"
 	"kmesh.net/kmesh/pkg/controller/workload"
+	"kmesh.net/kmesh/pkg/controller/workload/bpfcache"
 	"kmesh.net/kmesh/pkg/controller/xdstest"
 	"kmesh.net/kmesh/pkg/nets"
 )
 
 func TestRecoverConnection(t *testing.T) {
 	t.Run("test reconnect success", func(t *testing.T) {
-		utClient := NewXdsClient(constants.AdsMode, &bpf.BpfKmeshWorkload{})
+		utClient, err := NewXdsClient(constants.AdsMode, &bpf.BpfKmeshWorkload{}, &options.WorkloadConfig{})
+		assert.NoError(t, err)
 		patches := gomonkey.NewPatches()
 		defer patches.Reset()
 		iteration := 0
@@ -78,8 +81,9 @@ func TestClientResponseProcess(t *testing.T) {
 				}))
 		})
 
-		utClient := NewXdsClient(constants.AdsMode, &bpf.BpfKmeshWorkload{})
-		err := utClient.createGrpcStreamClient()
+		utClient, err := NewXdsClient(constants.AdsMode, &bpf.BpfKmeshWorkload{}, &options.WorkloadConfig{})
+		assert.NoError(t, err)
+		err = utClient.createGrpcStreamClient()
 		assert.NoError(t, err)
 
 		reConnectPatches := gomonkey.NewPatches()
@@ -125,8 +129,13 @@ func TestClientResponseProcess(t *testing.T) {
 				}))
 		})
 
-		utClient := NewXdsClient(constants.WorkloadMode, &bpf.BpfKmeshWorkload{})
-		err := utClient.createGrpcStreamClient()
+		// the workload options are written to the maps
+		bpfWorkload := &bpf.BpfKmeshWorkload{}
+		bpfWorkload.SockConn.KmeshCgroupSockWorkloadMaps = bpfcache.NewFakeWorkloadMap(t)
+		defer bpfcache.CleanupFakeWorkloadMap(bpfWorkload.SockConn.KmeshCgroupSockWorkloadMaps)
+		utClient, err := NewXdsClient(constants.WorkloadMode, bpfWorkload, &options.WorkloadConfig{})
+		assert.NoError(t, err)
+		err = utClient.createGrpcStreamClient()
 		assert.NoError(t, err)
 
 		reConnectPatches := gomonkey.NewPatches()
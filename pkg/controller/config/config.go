@@ -44,6 +44,16 @@ const (
 	defaultClusterLocalDomain = "cluster.local"
 )
 
+// The well-known keys of XdsNodeMetadata, istiod selects the config pushed to the node with them
+const (
+	// NodeMetadataClusterID is the cluster the node belongs to, overriding CLUSTER_ID env
+	NodeMetadataClusterID = "CLUSTER_ID"
+	// NodeMetadataNetwork is the network the node belongs to, used for multi-network routing
+	NodeMetadataNetwork = "NETWORK"
+	// NodeMetadataRegion is the region the node is located in, used for locality load balancing
+	NodeMetadataRegion = "REGION"
+)
+
 var (
 	log    = logger.NewLoggerField("controller/config")
 	config *XdsConfig
@@ -53,6 +63,9 @@ type XdsConfig struct {
 	ServiceNode      string
 	DiscoveryAddress string
 	Metadata         *model.BootstrapNodeMetadata
+	// XdsNodeMetadata are the custom metadata sent with the node, they take precedence over
+	// the ones derived from Metadata, see the NodeMetadata* keys
+	XdsNodeMetadata map[string]string
 }
 
 func NewXDSConfig(mode string) *XdsConfig {
@@ -67,6 +80,8 @@ func NewXDSConfig(mode string) *XdsConfig {
 	sa := env.Register("SERVICE_ACCOUNT", "", "").Get()
 	nodeName := env.Register("NODE_NAME", "", "").Get()
 	meshID := env.Register("MESH_ID", "cluster.local", "").Get()
+	nodeMetadata := env.Register("XDS_NODE_METADATA", "",
+		"custom node metadata sent to the control plane, in the form key1=value1,key2=value2").Get()
 
 	ip := localHostIPv4
 	if podIP != "" {
@@ -87,6 +102,7 @@ func NewXDSConfig(mode string) *XdsConfig {
 	c.Metadata.MeshID = meshID
 	c.Metadata.NodeName = nodeName
 	c.Metadata.NodeMetadata.ServiceAccount = sa
+	c.XdsNodeMetadata = parseNodeMetadata(nodeMetadata)
 
 	return c
 }
@@ -105,6 +121,12 @@ func (c *XdsConfig) GetNode() *config_core_v3.Node {
 	if err != nil {
 		log.Fatalf("failed to convert node metadata to struct, %v", err)
 	}
+	for key, value := range c.XdsNodeMetadata {
+		if nodeMetadata.Fields == nil {
+			nodeMetadata.Fields = make(map[string]*structpb.Value)
+		}
+		nodeMetadata.Fields[key] = &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: value}}
+	}
 	return &config_core_v3.Node{
 		Id:       c.ServiceNode,
 		Metadata: nodeMetadata,
@@ -123,6 +145,24 @@ func nodeMetadataToStruct(meta *model.BootstrapNodeMetadata) (*structpb.Struct,
 	return pbs, nil
 }
 
+// parseNodeMetadata parses the metadata in the form key1=value1,key2=value2, the malformed pairs are skipped
+func parseNodeMetadata(s string) map[string]string {
+	if s == "" {
+		return nil
+	}
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			log.Warnf("skip malformed node metadata %q", pair)
+			continue
+		}
+		metadata[key] = strings.TrimSpace(value)
+	}
+	return metadata
+}
+
 func getNodeRole(mode string) string {
 	switch mode {
 	case constants.WorkloadMode:
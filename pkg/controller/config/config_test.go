@@ -32,3 +32,22 @@ func TestInit(t *testing.T) {
 	assert.Equal(t, "sidecar~10.244.0.81~test.testNs~testNs.svc.cluster.local", config.ServiceNode)
 	assert.Equal(t, "istiod.istio-system.svc:15012", config.DiscoveryAddress)
 }
+
+func TestGetNodeWithCustomMetadata(t *testing.T) {
+	os.Setenv("CLUSTER_ID", "Kubernetes")
+	os.Setenv("XDS_NODE_METADATA", "CLUSTER_ID=cluster1, NETWORK=network1,REGION=region1,malformed")
+	defer os.Unsetenv("XDS_NODE_METADATA")
+	c := NewXDSConfig("workload")
+	assert.DeepEqual(t, map[string]string{
+		NodeMetadataClusterID: "cluster1",
+		NodeMetadataNetwork:   "network1",
+		NodeMetadataRegion:    "region1",
+	}, c.XdsNodeMetadata)
+
+	// the custom metadata take precedence over the derived ones
+	fields := c.GetNode().GetMetadata().GetFields()
+	assert.Equal(t, "cluster1", fields[NodeMetadataClusterID].GetStringValue())
+	assert.Equal(t, "network1", fields[NodeMetadataNetwork].GetStringValue())
+	assert.Equal(t, "region1", fields[NodeMetadataRegion].GetStringValue())
+	assert.Equal(t, "cluster.local", fields["MESH_ID"].GetStringValue())
+}
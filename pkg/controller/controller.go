@@ -19,6 +19,9 @@ package controller
 import (
 	"context"
 	"fmt"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
 
 	"kmesh.net/kmesh/daemon/options"
 	"kmesh.net/kmesh/pkg/bpf"
@@ -26,6 +29,7 @@ import (
 	"kmesh.net/kmesh/pkg/controller/bypass"
 	manage "kmesh.net/kmesh/pkg/controller/manage"
 	"kmesh.net/kmesh/pkg/controller/security"
+	"kmesh.net/kmesh/pkg/controller/workload"
 	"kmesh.net/kmesh/pkg/dns"
 	"kmesh.net/kmesh/pkg/logger"
 	"kmesh.net/kmesh/pkg/utils"
@@ -44,6 +48,13 @@ type Controller struct {
 	enableSecretManager bool
 	bpfFsPath           string
 	enableBpfLog        bool
+	adminSocketPath     string
+	adminServer         *workload.AdminServer
+	// kubeconfig file of the kube client, empty if the in-cluster service account is used
+	kubeconfig string
+	// interval of the reconciliation against the kubernetes api server, 0 if disabled
+	kubeReconcileInterval time.Duration
+	workloadConfig        *options.WorkloadConfig
 }
 
 func NewController(opts *options.BootstrapConfigs, bpfWorkloadObj *bpf.BpfKmeshWorkload, bpfFsPath string, enableBpfLog bool) *Controller {
@@ -54,7 +65,19 @@ func NewController(opts *options.BootstrapConfigs, bpfWorkloadObj *bpf.BpfKmeshW
 		enableSecretManager: opts.SecretManagerConfig.Enable,
 		bpfFsPath:           bpfFsPath,
 		enableBpfLog:        enableBpfLog,
+		adminSocketPath:     opts.AdminConfig.SocketPath,
+		kubeconfig:          opts.KubeConfig.Kubeconfig,
+
+		kubeReconcileInterval: opts.ReconcileConfig.KubeInterval,
+		workloadConfig:        opts.WorkloadConfig,
+	}
+}
+
+func (c *Controller) newKubeClient() (kubernetes.Interface, error) {
+	if c.kubeconfig != "" {
+		return utils.CreateK8sClientSet(c.kubeconfig)
 	}
+	return utils.GetK8sclient()
 }
 
 func (c *Controller) Start(stopCh <-chan struct{}) error {
@@ -70,7 +93,7 @@ func (c *Controller) Start(stopCh <-chan struct{}) error {
 		go secertManager.Run(stopCh)
 	}
 
-	clientset, err := utils.GetK8sclient()
+	clientset, err := c.newKubeClient()
 	if err != nil {
 		return err
 	}
@@ -101,10 +124,19 @@ func (c *Controller) Start(stopCh <-chan struct{}) error {
 			return fmt.Errorf("fail to start ringbuf reader: %v", err)
 		}
 	}
-	c.client = NewXdsClient(c.mode, c.bpfWorkloadObj)
+	if c.client, err = NewXdsClient(c.mode, c.bpfWorkloadObj, c.workloadConfig); err != nil {
+		return fmt.Errorf("xds client create failed: %v", err)
+	}
 
 	if c.client.WorkloadController != nil {
 		c.client.WorkloadController.Run(ctx)
+		go workload.NewKubeReconciler(clientset, c.client.WorkloadController.Processor, c.kubeReconcileInterval).Run(ctx)
+
+		c.adminServer = workload.NewAdminServer(c.client.WorkloadController.Processor, c.adminSocketPath)
+		if err := c.adminServer.Start(); err != nil {
+			log.Errorf("failed to start admin server: %v", err)
+			c.adminServer = nil
+		}
 	}
 
 	if c.client.AdsController != nil {
@@ -124,7 +156,17 @@ func (c *Controller) Stop() {
 		return
 	}
 	cancel()
+	if c.adminServer != nil {
+		if err := c.adminServer.Stop(); err != nil {
+			log.Errorf("failed to stop admin server: %v", err)
+		}
+	}
 	if c.client != nil {
+		if c.client.WorkloadController != nil {
+			if err := c.client.WorkloadController.Stop(); err != nil {
+				log.Errorf("failed to stop workload controller: %v", err)
+			}
+		}
 		c.client.Close()
 	}
 }
@@ -0,0 +1,70 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package telemetry
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+var noopTracer = noop.NewTracerProvider().Tracer("")
+
+// NewOTLPTracerProvider returns a tracer provider exporting the spans in batches over plaintext grpc
+// to the OTLP collector at endpoint, it must be shut down to flush the last spans
+func NewOTLPTracerProvider(ctx context.Context, endpoint string) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracegrpc.New(ctx, otlptracegrpc.WithEndpoint(endpoint), otlptracegrpc.WithInsecure())
+	if err != nil {
+		return nil, fmt.Errorf("create otlp trace exporter failed, %s", err)
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "kmesh"))),
+	), nil
+}
+
+// Tracer wraps an OpenTelemetry tracer, the spans started by a nil Tracer do not record
+type Tracer struct {
+	tracer trace.Tracer
+}
+
+// NewTracer returns the tracer named name of tp, nil if tp is nil
+func NewTracer(tp trace.TracerProvider, name string) *Tracer {
+	if tp == nil {
+		return nil
+	}
+	return &Tracer{tracer: tp.Tracer(name)}
+}
+
+// Enabled tells whether the spans are recorded, so that the callers can skip building their attributes
+func (t *Tracer) Enabled() bool {
+	return t != nil
+}
+
+// Start starts a span as a child of the span in ctx
+func (t *Tracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if t == nil {
+		return noopTracer.Start(ctx, name, opts...)
+	}
+	return t.tracer.Start(ctx, name, opts...)
+}
@@ -173,6 +173,83 @@ var (
 			Name: "kmesh_tcp_conntections_failed_total",
 			Help: "The total number of TCP connections failed to a service.",
 		}, serviceLabels)
+
+	// WorkloadSkippedUpdates counts the workload updates which are identical to the cached ones
+	WorkloadSkippedUpdates = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "kmesh_workload_skipped_updates_total",
+			Help: "The total number of workload updates skipped because the workload was not changed.",
+		})
+
+	// WorkloadUnchangedOnRestart counts the workloads found identical to the bpf maps left by the last run
+	WorkloadUnchangedOnRestart = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "kmesh_workload_unchanged_on_restart_total",
+			Help: "The total number of workloads not rewritten on restart because the bpf maps were already up to date.",
+		})
+
+	// StaleEndpointsDetected counts the endpoints not updated within the stale window
+	StaleEndpointsDetected = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "kmesh_stale_endpoints_detected_total",
+			Help: "The total number of endpoints detected as potentially stale.",
+		})
+
+	// ServiceSelfWaypoints counts the services whose waypoint is one of their own addresses
+	ServiceSelfWaypoints = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "kmesh_service_self_waypoints_total",
+			Help: "The total number of service updates whose waypoint was refused because it is one of the service addresses.",
+		})
+
+	// ServiceZeroPortsSkipped counts the service updates without ports whose vips were not programmed
+	ServiceZeroPortsSkipped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "kmesh_service_zero_ports_skipped_total",
+			Help: "The total number of service updates without any port whose addresses were not programmed.",
+		})
+
+	// KubeReconcileCorrections counts the services corrected by the reconciliation against the api server
+	KubeReconcileCorrections = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "kmesh_kube_reconcile_corrections_total",
+			Help: "The total number of services whose drift from the kubernetes api server was corrected.",
+		})
+
+	// ResourcesQuarantined counts the services and workloads quarantined after repeatedly failing to be programmed
+	ResourcesQuarantined = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "kmesh_resources_quarantined_total",
+			Help: "The total number of services and workloads quarantined after repeatedly failing to be programmed.",
+		})
+
+	// CoalescingQueueUpdates counts the updates of services and workloads held by the coalescing queue
+	CoalescingQueueUpdates = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "kmesh_coalescing_queue_updates_total",
+			Help: "The total number of service and workload updates held by the coalescing queue.",
+		})
+
+	// CoalescingQueueWrites counts the updates written by the coalescing queue, once per resource flushed
+	CoalescingQueueWrites = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "kmesh_coalescing_queue_writes_total",
+			Help: "The total number of service and workload updates written by the coalescing queue.",
+		})
+
+	// CoalescingRatio is the number of updates held per update written by the coalescing queue
+	CoalescingRatio = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "kmesh_coalescing_ratio",
+			Help: "The number of service and workload updates held per update written by the coalescing queue.",
+		})
+
+	// NamespaceLimitRejected counts the workloads and services rejected because their namespace reached its limit
+	NamespaceLimitRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "kmesh_namespace_limit_rejected_total",
+			Help: "The total number of workloads and services rejected because their namespace reached its limit.",
+		}, []string{"namespace", "kind"})
 )
 
 func RunPrometheusClient(ctx context.Context) {
@@ -193,6 +270,10 @@ func runPrometheusClient(registry *prometheus.Registry) {
 	defer mu.Unlock()
 	registry.MustRegister(tcpConnectionOpenedInWorkload, tcpConnectionClosedInWorkload, tcpReceivedBytesInWorkload, tcpSentBytesInWorkload)
 	registry.MustRegister(tcpConnectionOpenedInService, tcpConnectionClosedInService, tcpReceivedBytesInService, tcpSentBytesInService)
+	registry.MustRegister(WorkloadSkippedUpdates, WorkloadUnchangedOnRestart, StaleEndpointsDetected, ServiceSelfWaypoints, ServiceZeroPortsSkipped)
+	registry.MustRegister(KubeReconcileCorrections, ResourcesQuarantined)
+	registry.MustRegister(CoalescingQueueUpdates, CoalescingQueueWrites, CoalescingRatio)
+	registry.MustRegister(NamespaceLimitRejected)
 
 	http.Handle("/status/metric", promhttp.HandlerFor(registry, promhttp.HandlerOpts{
 		Registry: registry,
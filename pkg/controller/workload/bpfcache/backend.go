@@ -17,11 +17,25 @@
 package bpfcache
 
 import (
+	"errors"
+	"slices"
+	"unsafe"
+
+	"github.com/cespare/xxhash/v2"
 	"github.com/cilium/ebpf"
 )
 
 const (
 	MaxServiceNum = 10
+	MaxPolicyNum  = 10
+
+	// number of backends read by a BPF_MAP_LOOKUP_BATCH call
+	backendLookupBatchSize = 1024
+)
+
+const (
+	TunnelTypeNone  = 0
+	TunnelTypeHbone = 1 // HBONE tunnel terminated by the network gateway
 )
 
 type BackendKey struct {
@@ -30,25 +44,102 @@ type BackendKey struct {
 
 type ServiceList [MaxServiceNum]uint32
 
+type PolicyList [MaxPolicyNum]uint32
+
 type BackendValue struct {
-	Ip           [16]byte
-	ServiceCount uint32
-	Services     ServiceList
-	WaypointAddr [16]byte
-	WaypointPort uint32
+	Ip             [16]byte
+	ServiceCount   uint32
+	Services       ServiceList
+	WaypointAddr   [16]byte
+	WaypointPort   uint32
+	TunnelType     uint32     // tunnel through the network gateway, TunnelTypeNone for a workload on the local network
+	TunnelEndpoint [16]byte   // network gateway ip of a workload on a remote network
+	TunnelPort     uint32     // hbone port of the network gateway, in network byte order
+	PolicyCount    uint32     // number of the authorization policies of the workload
+	Policies       PolicyList // ids of the authorization policies of the workload
+	Ip6            [16]byte   // ipv6 address of a dual-stack workload, Ip is its ipv4 address then
+}
+
+// Addresses returns the addresses of the backend, both of them for a dual-stack workload
+func (v *BackendValue) Addresses() [][16]byte {
+	if v.Ip6 == [16]byte{} {
+		return [][16]byte{v.Ip}
+	}
+	return [][16]byte{v.Ip, v.Ip6}
 }
 
 func (c *Cache) BackendUpdate(key *BackendKey, value *BackendValue) error {
 	log.Debugf("BackendUpdate [%#v], [%#v]", *key, *value)
-	return c.bpfMap.KmeshBackend.Update(key, value, ebpf.UpdateAny)
+	c.waitWrite()
+	err := c.bpfMap.KmeshBackend.Update(key, value, ebpf.UpdateAny)
+	c.recordWrite(BackendMap, BpfOpUpdate, key, value, err)
+	if err != nil {
+		return err
+	}
+	c.shadowUpdate(c.shadowMap.KmeshBackend, key, value)
+	return nil
 }
 
 func (c *Cache) BackendDelete(key *BackendKey) error {
 	log.Debugf("BackendDelete [%#v]", *key)
-	return c.bpfMap.KmeshBackend.Delete(key)
+	c.waitWrite()
+	err := c.bpfMap.KmeshBackend.Delete(key)
+	c.recordWrite(BackendMap, BpfOpDelete, key, nil, err)
+	if err != nil {
+		return err
+	}
+	c.shadowDelete(c.shadowMap.KmeshBackend, key)
+	return nil
 }
 
 func (c *Cache) BackendLookup(key *BackendKey, value *BackendValue) error {
 	log.Debugf("BackendLookup [%#v]", *key)
+	c.opCounter.countLookup(BackendMap)
 	return c.bpfMap.KmeshBackend.Lookup(key, value)
 }
+
+// Digest hashes all the fields of the backend value, the order of the services and policies doesn't matter
+func (v BackendValue) Digest() uint64 {
+	slices.Sort(v.Services[:min(v.ServiceCount, MaxServiceNum)])
+	slices.Sort(v.Policies[:min(v.PolicyCount, MaxPolicyNum)])
+	// the layout has no implicit padding, all the fields are 4 bytes aligned
+	return xxhash.Sum64(unsafe.Slice((*byte)(unsafe.Pointer(&v)), unsafe.Sizeof(v)))
+}
+
+// BackendDigests returns the digest of every backend value in the map, keyed by backend uid.
+// The map is read with BPF_MAP_LOOKUP_BATCH, or iterated if the kernel doesn't support it.
+func (c *Cache) BackendDigests() (map[uint32]uint64, error) {
+	var (
+		cursor = ebpf.MapBatchCursor{}
+		keys   = make([]BackendKey, backendLookupBatchSize)
+		values = make([]BackendValue, backendLookupBatchSize)
+	)
+
+	digests := make(map[uint32]uint64)
+	for {
+		n, err := c.bpfMap.KmeshBackend.BatchLookup(&cursor, keys, values, nil)
+		for i := range values[:n] {
+			digests[keys[i].BackendUid] = values[i].Digest()
+		}
+		if errors.Is(err, ebpf.ErrKeyNotExist) {
+			// the end of the map is reached
+			return digests, nil
+		}
+		if errors.Is(err, ebpf.ErrNotSupported) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		key   = BackendKey{}
+		value = BackendValue{}
+		iter  = c.bpfMap.KmeshBackend.Iterate()
+	)
+	for iter.Next(&key, &value) {
+		digests[key.BackendUid] = value.Digest()
+	}
+	return digests, iter.Err()
+}
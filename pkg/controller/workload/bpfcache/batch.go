@@ -0,0 +1,95 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpfcache
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/cilium/ebpf"
+)
+
+// FrontendBatchDelete deletes the frontend keys with BPF_MAP_DELETE_BATCH, falling back to
+// per-entry deletions if the kernel doesn't support it. The keys failed to delete don't stop
+// the deletion of the others, their errors are joined.
+func (c *Cache) FrontendBatchDelete(keys []FrontendKey) error {
+	log.Debugf("FrontendBatchDelete %d keys", len(keys))
+	return batchDelete(c, FrontendMap, c.bpfMap.KmeshFrontend, c.shadowMap.KmeshFrontend, keys, c.frontendDeleted)
+}
+
+// BackendBatchDelete deletes the backend keys the same way as FrontendBatchDelete
+func (c *Cache) BackendBatchDelete(keys []BackendKey) error {
+	log.Debugf("BackendBatchDelete %d keys", len(keys))
+	return batchDelete(c, BackendMap, c.bpfMap.KmeshBackend, c.shadowMap.KmeshBackend, keys, nil)
+}
+
+// batchDelete counts as a single write for the write limiter, whatever the number of keys.
+// deleted is called with each key deleted if not nil.
+func batchDelete[K any](c *Cache, mapType BpfMapType, m, shadow *ebpf.Map, keys []K, deleted func(*K)) error {
+	var errs []error
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	c.waitWrite()
+	for pending := keys; len(pending) > 0; {
+		n, err := m.BatchDelete(pending, nil)
+		for i := range pending[:n] {
+			c.recordWrite(mapType, BpfOpDelete, &pending[i], nil, nil)
+			c.shadowDelete(shadow, &pending[i])
+			if deleted != nil {
+				deleted(&pending[i])
+			}
+		}
+		if err == nil {
+			break
+		}
+		if errors.Is(err, ebpf.ErrNotSupported) {
+			errs = append(errs, deleteEach(c, mapType, m, shadow, pending[n:], deleted)...)
+			break
+		}
+		if n >= len(pending) {
+			errs = append(errs, err)
+			break
+		}
+		// the batch stops at the first key failed to delete, skip it and go on with the rest
+		c.recordWrite(mapType, BpfOpDelete, &pending[n], nil, err)
+		errs = append(errs, fmt.Errorf("delete [%#v]: %w", pending[n], err))
+		pending = pending[n+1:]
+	}
+
+	return errors.Join(errs...)
+}
+
+func deleteEach[K any](c *Cache, mapType BpfMapType, m, shadow *ebpf.Map, keys []K, deleted func(*K)) []error {
+	var errs []error
+
+	for i := range keys {
+		err := m.Delete(&keys[i])
+		c.recordWrite(mapType, BpfOpDelete, &keys[i], nil, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("delete [%#v]: %w", keys[i], err))
+			continue
+		}
+		c.shadowDelete(shadow, &keys[i])
+		if deleted != nil {
+			deleted(&keys[i])
+		}
+	}
+	return errs
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpfcache
+
+import (
+	"fmt"
+
+	"github.com/cilium/ebpf"
+	"istio.io/istio/pkg/util/sets"
+)
+
+// Entry is a key/value pair of a bpf map
+type Entry[K, V any] struct {
+	Key   K `json:"key"`
+	Value V `json:"value"`
+}
+
+// MapDump is a snapshot of all the workload bpf maps
+type MapDump struct {
+	Frontends []Entry[FrontendKey, FrontendValue] `json:"frontends"`
+	Services  []Entry[ServiceKey, ServiceValue]   `json:"services"`
+	Endpoints []Entry[EndpointKey, EndpointValue] `json:"endpoints"`
+	Backends  []Entry[BackendKey, BackendValue]   `json:"backends"`
+}
+
+// Dump reads all the entries of the workload bpf maps
+func (c *Cache) Dump() (*MapDump, error) {
+	var dump = &MapDump{}
+
+	keys, values, err := c.GetAllFrontends()
+	if err != nil {
+		return nil, err
+	}
+	for i := range keys {
+		dump.Frontends = append(dump.Frontends, Entry[FrontendKey, FrontendValue]{Key: keys[i], Value: values[i]})
+	}
+	if dump.Services, err = dumpMap[ServiceKey, ServiceValue](c.bpfMap.KmeshService); err != nil {
+		return nil, fmt.Errorf("dump service map failed, %s", err)
+	}
+	if dump.Endpoints, err = dumpMap[EndpointKey, EndpointValue](c.bpfMap.KmeshEndpoint); err != nil {
+		return nil, fmt.Errorf("dump endpoint map failed, %s", err)
+	}
+	if dump.Backends, err = dumpMap[BackendKey, BackendValue](c.bpfMap.KmeshBackend); err != nil {
+		return nil, fmt.Errorf("dump backend map failed, %s", err)
+	}
+	return dump, nil
+}
+
+func dumpMap[K, V any](m *ebpf.Map) ([]Entry[K, V], error) {
+	var (
+		key     K
+		value   V
+		entries []Entry[K, V]
+	)
+
+	iter := m.Iterate()
+	for iter.Next(&key, &value) {
+		entries = append(entries, Entry[K, V]{Key: key, Value: value})
+	}
+	return entries, iter.Err()
+}
+
+// Flush deletes all the entries of the workload bpf maps and clears the endpoint index
+func (c *Cache) Flush() error {
+	dump, err := c.Dump()
+	if err != nil {
+		return err
+	}
+
+	for _, e := range dump.Frontends {
+		if err = c.FrontendDelete(&e.Key); err != nil {
+			return fmt.Errorf("flush frontend map failed, %s", err)
+		}
+	}
+	for _, e := range dump.Services {
+		if err = c.ServiceDelete(&e.Key); err != nil {
+			return fmt.Errorf("flush service map failed, %s", err)
+		}
+	}
+	for _, e := range dump.Endpoints {
+		if err = c.EndpointDelete(&e.Key); err != nil {
+			return fmt.Errorf("flush endpoint map failed, %s", err)
+		}
+	}
+	for _, e := range dump.Backends {
+		if err = c.BackendDelete(&e.Key); err != nil {
+			return fmt.Errorf("flush backend map failed, %s", err)
+		}
+	}
+	c.resetEndpointIndex(make(map[uint32]sets.Set[EndpointKey]))
+	return nil
+}
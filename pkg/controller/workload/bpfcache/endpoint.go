@@ -17,7 +17,13 @@
 package bpfcache
 
 import (
+	"context"
+	"errors"
+	"runtime"
+	"slices"
+
 	"github.com/cilium/ebpf"
+	"golang.org/x/sync/errgroup"
 	"istio.io/istio/pkg/util/sets"
 )
 
@@ -27,19 +33,32 @@ type EndpointKey struct {
 }
 
 type EndpointValue struct {
-	BackendUid uint32 // workloadUid to uint32
+	BackendUid  uint32   // workloadUid to uint32
+	Local       uint8    // 1 if the backend runs on the local node
+	Unready     uint8    // 1 if the active health checking found the backend unreachable
+	_           [2]uint8 // padding, keep the layout same as the packed c struct
+	LastUpdated int64    // unix nanoseconds of the last insert or update
 }
 
 func (c *Cache) EndpointUpdate(key *EndpointKey, value *EndpointValue) error {
 	log.Debugf("EndpointUpdate [%#v], [%#v]", *key, *value)
-	// update endpointKeys index
-	if c.endpointKeys[value.BackendUid] == nil {
-		c.endpointKeys[value.BackendUid] = sets.New[EndpointKey](*key)
-	} else {
-		c.endpointKeys[value.BackendUid].Insert(*key)
+	c.waitWrite()
+	old := &EndpointValue{}
+	overwritten := c.bpfMap.KmeshEndpoint.Lookup(key, old) == nil && old.BackendUid != value.BackendUid
+
+	err := c.bpfMap.KmeshEndpoint.Update(key, value, ebpf.UpdateAny)
+	c.recordWrite(EndpointMap, BpfOpUpdate, key, value, err)
+	if err != nil {
+		return err
 	}
 
-	return c.bpfMap.KmeshEndpoint.Update(key, value, ebpf.UpdateAny)
+	// update endpointKeys index once written, the key may be overwritten with another backend
+	if overwritten {
+		c.unindexEndpoint(*key, old.BackendUid)
+	}
+	c.indexEndpoint(*key, value.BackendUid)
+	c.shadowUpdate(c.shadowMap.KmeshEndpoint, key, value)
+	return nil
 }
 
 func (c *Cache) EndpointDelete(key *EndpointKey) error {
@@ -50,12 +69,16 @@ func (c *Cache) EndpointDelete(key *EndpointKey) error {
 		log.Infof("endpoint [%#v] does not exist", key)
 		return nil
 	}
-	c.endpointKeys[value.BackendUid].Delete(*key)
-	if len(c.endpointKeys[value.BackendUid]) == 0 {
-		delete(c.endpointKeys, value.BackendUid)
-	}
+	c.unindexEndpoint(*key, value.BackendUid)
 
-	return c.bpfMap.KmeshEndpoint.Delete(key)
+	c.waitWrite()
+	err := c.bpfMap.KmeshEndpoint.Delete(key)
+	c.recordWrite(EndpointMap, BpfOpDelete, key, nil, err)
+	if err != nil {
+		return err
+	}
+	c.shadowDelete(c.shadowMap.KmeshEndpoint, key)
+	return nil
 }
 
 // EndpointSwap update the last endpoint index and remove the current endpoint
@@ -85,35 +108,164 @@ func (c *Cache) EndpointSwap(currentIndex, lastIndex uint32, serviceId uint32) e
 	}
 
 	// update the last endpoint's index, in other word delete the current endpoint
-	if err := c.bpfMap.KmeshEndpoint.Update(currentKey, lastValue, ebpf.UpdateAny); err != nil {
+	c.waitWrite()
+	err := c.bpfMap.KmeshEndpoint.Update(currentKey, lastValue, ebpf.UpdateAny)
+	c.recordWrite(EndpointMap, BpfOpUpdate, currentKey, lastValue, err)
+	if err != nil {
 		return err
 	}
+	c.shadowUpdate(c.shadowMap.KmeshEndpoint, currentKey, lastValue)
 
 	// delete the duplicate last endpoint
-	if err := c.bpfMap.KmeshEndpoint.Delete(lastKey); err != nil {
+	c.waitWrite()
+	err = c.bpfMap.KmeshEndpoint.Delete(lastKey)
+	c.recordWrite(EndpointMap, BpfOpDelete, lastKey, nil, err)
+	if err != nil {
 		return err
 	}
+	c.shadowDelete(c.shadowMap.KmeshEndpoint, lastKey)
 
 	// delete index for the current endpoint
-	c.endpointKeys[currentValue.BackendUid].Delete(*currentKey)
-	if len(c.endpointKeys[currentValue.BackendUid]) == 0 {
-		delete(c.endpointKeys, currentValue.BackendUid)
-	}
+	c.unindexEndpoint(*currentKey, currentValue.BackendUid)
 
 	// update the last endpoint index
-	c.endpointKeys[lastValue.BackendUid].Delete(*lastKey)
-	c.endpointKeys[lastValue.BackendUid].Insert(*currentKey)
+	c.unindexEndpoint(*lastKey, lastValue.BackendUid)
+	c.indexEndpoint(*currentKey, lastValue.BackendUid)
 	return nil
 }
 
+// indexEndpoint adds the endpoint to the index by workload uid and to the index by service id
+func (c *Cache) indexEndpoint(key EndpointKey, backendUid uint32) {
+	if c.endpointKeys[backendUid] == nil {
+		c.endpointKeys[backendUid] = sets.New[EndpointKey](key)
+	} else {
+		c.endpointKeys[backendUid].Insert(key)
+	}
+
+	c.serviceEndpointsMutex.Lock()
+	defer c.serviceEndpointsMutex.Unlock()
+	if c.serviceEndpoints[key.ServiceId] == nil {
+		c.serviceEndpoints[key.ServiceId] = sets.New[uint32](key.BackendIndex)
+	} else {
+		c.serviceEndpoints[key.ServiceId].Insert(key.BackendIndex)
+	}
+}
+
+// unindexEndpoint removes the endpoint from the index by workload uid and from the index by service id
+func (c *Cache) unindexEndpoint(key EndpointKey, backendUid uint32) {
+	c.endpointKeys[backendUid].Delete(key)
+	if len(c.endpointKeys[backendUid]) == 0 {
+		delete(c.endpointKeys, backendUid)
+	}
+
+	c.serviceEndpointsMutex.Lock()
+	defer c.serviceEndpointsMutex.Unlock()
+	c.serviceEndpoints[key.ServiceId].Delete(key.BackendIndex)
+	if len(c.serviceEndpoints[key.ServiceId]) == 0 {
+		delete(c.serviceEndpoints, key.ServiceId)
+	}
+}
+
+// resetEndpointIndex clears the endpoint indexes, the index by service id is rebuilt from endpointKeys
+func (c *Cache) resetEndpointIndex(endpointKeys map[uint32]sets.Set[EndpointKey]) {
+	c.endpointKeys = endpointKeys
+
+	c.serviceEndpointsMutex.Lock()
+	defer c.serviceEndpointsMutex.Unlock()
+	c.serviceEndpoints = make(map[uint32]sets.Set[uint32])
+	for _, eks := range endpointKeys {
+		for ek := range eks {
+			if c.serviceEndpoints[ek.ServiceId] == nil {
+				c.serviceEndpoints[ek.ServiceId] = sets.New[uint32]()
+			}
+			c.serviceEndpoints[ek.ServiceId].Insert(ek.BackendIndex)
+		}
+	}
+}
+
 func (c *Cache) EndpointLookup(key *EndpointKey, value *EndpointValue) error {
 	log.Debugf("EndpointLookup [%#v]", *key)
+	c.opCounter.countLookup(EndpointMap)
 	return c.bpfMap.KmeshEndpoint.Lookup(key, value)
 }
 
-// RestoreEndpointKeys called on restart to construct endpoint indexes from bpf map
+// RestoreEndpointKeys called on restart or reconcile to construct endpoint indexes from bpf map,
+// the endpoints are looked up by restoreWorkers workers in parallel.
 func (c *Cache) RestoreEndpointKeys() {
 	log.Debugf("init endpoint keys")
+
+	workers := c.restoreWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	c.resetEndpointIndex(make(map[uint32]sets.Set[EndpointKey]))
+	if workers == 1 {
+		c.restoreEndpointKeys()
+		return
+	}
+
+	var (
+		g, ctx  = errgroup.WithContext(context.Background())
+		keys    = make(chan EndpointKey, 1024)
+		indexes = make([]map[uint32][]EndpointKey, workers)
+	)
+
+	g.Go(func() error {
+		defer close(keys)
+		var key, next EndpointKey
+		var cursor interface{}
+		for {
+			if err := c.bpfMap.KmeshEndpoint.NextKey(cursor, &next); err != nil {
+				if errors.Is(err, ebpf.ErrKeyNotExist) {
+					return nil
+				}
+				return err
+			}
+			key = next
+			cursor = &key
+			select {
+			case keys <- key:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	})
+	for i := 0; i < workers; i++ {
+		index := make(map[uint32][]EndpointKey)
+		indexes[i] = index
+		g.Go(func() error {
+			value := EndpointValue{}
+			for key := range keys {
+				if err := c.bpfMap.KmeshEndpoint.Lookup(&key, &value); err != nil {
+					// deleted since listed
+					if errors.Is(err, ebpf.ErrKeyNotExist) {
+						continue
+					}
+					return err
+				}
+				index[value.BackendUid] = append(index[value.BackendUid], key)
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		log.Errorf("restore endpoint keys failed: %v", err)
+	}
+
+	endpointKeys := make(map[uint32]sets.Set[EndpointKey])
+	for _, index := range indexes {
+		for backendUid, eks := range index {
+			if endpointKeys[backendUid] == nil {
+				endpointKeys[backendUid] = sets.New[EndpointKey](eks...)
+			} else {
+				endpointKeys[backendUid].InsertAll(eks...)
+			}
+		}
+	}
+	c.resetEndpointIndex(endpointKeys)
+}
+
+func (c *Cache) restoreEndpointKeys() {
 	var (
 		key   = EndpointKey{}
 		value = EndpointValue{}
@@ -122,30 +274,112 @@ func (c *Cache) RestoreEndpointKeys() {
 	iter := c.bpfMap.KmeshEndpoint.Iterate()
 	for iter.Next(&key, &value) {
 		// update endpointKeys index
-		if c.endpointKeys[value.BackendUid] == nil {
-			c.endpointKeys[value.BackendUid] = sets.New[EndpointKey](key)
-		} else {
-			c.endpointKeys[value.BackendUid].Insert(key)
+		c.indexEndpoint(key, value.BackendUid)
+	}
+}
+
+// CompactEndpointIndices called on restart after RestoreEndpointKeys and before ReconcileEndpointCount,
+// moves the endpoints of each service so that their indices are contiguous from 1 to the endpoint count,
+// the datapath iterates the endpoints by count and would skip the ones behind a gap.
+// The relative order of the endpoints is kept.
+func (c *Cache) CompactEndpointIndices() {
+	for _, serviceId := range c.EndpointServiceIds() {
+		target := uint32(0)
+		err := c.IterateEndpoints(serviceId, func(key EndpointKey, _ EndpointValue) error {
+			// the endpoints are iterated in index order, so the target index is always free
+			target++
+			if key.BackendIndex == target {
+				return nil
+			}
+			return c.moveEndpoint(serviceId, key.BackendIndex, target)
+		})
+		if err != nil {
+			log.Errorf("compact endpoint indices of service %d failed: %v", serviceId, err)
 		}
 	}
 }
 
-// GetAllEndpointsForService returns all the endpoints for a service
-// Note only used for testing
-func (c *Cache) GetAllEndpointsForService(serviceId uint32) []EndpointValue {
-	log.Debugf("init endpoint keys")
+// moveEndpoint writes the endpoint to the new index before deleting the old one,
+// so that the backend is never missing from the endpoint map
+func (c *Cache) moveEndpoint(serviceId, from, to uint32) error {
+	fromKey := &EndpointKey{ServiceId: serviceId, BackendIndex: from}
+	value := &EndpointValue{}
+	if err := c.EndpointLookup(fromKey, value); err != nil {
+		return err
+	}
+
+	log.Infof("service %d endpoint index gap found, move backend %d from index %d to %d", serviceId, value.BackendUid, from, to)
+	if err := c.EndpointUpdate(&EndpointKey{ServiceId: serviceId, BackendIndex: to}, value); err != nil {
+		return err
+	}
+	return c.EndpointDelete(fromKey)
+}
+
+// IterateEndpoints calls fn for each endpoint of the service in the endpoint map, in backend index order.
+// Only the endpoints of the service are looked up, the indexes are taken from the index by service id,
+// so fn may write the endpoint map. Iteration stops at the first error returned by fn.
+func (c *Cache) IterateEndpoints(serviceId uint32, fn func(EndpointKey, EndpointValue) error) error {
+	c.serviceEndpointsMutex.RLock()
+	backendIndexes := sets.SortedList(c.serviceEndpoints[serviceId])
+	c.serviceEndpointsMutex.RUnlock()
+
+	key := EndpointKey{ServiceId: serviceId}
+	value := EndpointValue{}
+	for _, backendIndex := range backendIndexes {
+		key.BackendIndex = backendIndex
+		if err := c.bpfMap.KmeshEndpoint.Lookup(&key, &value); err != nil {
+			// deleted since listed
+			if errors.Is(err, ebpf.ErrKeyNotExist) {
+				continue
+			}
+			return err
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EndpointServiceIds returns the ids of the services having endpoints in the endpoint map, sorted
+func (c *Cache) EndpointServiceIds() []uint32 {
+	c.serviceEndpointsMutex.RLock()
+	defer c.serviceEndpointsMutex.RUnlock()
+	serviceIds := make([]uint32, 0, len(c.serviceEndpoints))
+	for serviceId := range c.serviceEndpoints {
+		serviceIds = append(serviceIds, serviceId)
+	}
+	slices.Sort(serviceIds)
+	return serviceIds
+}
+
+// RangeEndpoints calls fn for each endpoint in the endpoint map.
+// Iteration stops at the first error returned by fn.
+func (c *Cache) RangeEndpoints(fn func(EndpointKey, EndpointValue) error) error {
 	var (
 		key   = EndpointKey{}
 		value = EndpointValue{}
 	)
 
-	var res []EndpointValue
-
 	iter := c.bpfMap.KmeshEndpoint.Iterate()
 	for iter.Next(&key, &value) {
-		if key.ServiceId == serviceId {
-			res = append(res, value)
+		if err := fn(key, value); err != nil {
+			return err
 		}
 	}
+	return iter.Err()
+}
+
+// GetAllEndpointsForService returns all the endpoints for a service
+// Note only used for testing
+func (c *Cache) GetAllEndpointsForService(serviceId uint32) []EndpointValue {
+	var res []EndpointValue
+
+	if err := c.IterateEndpoints(serviceId, func(_ EndpointKey, value EndpointValue) error {
+		res = append(res, value)
+		return nil
+	}); err != nil {
+		log.Errorf("iterate endpoints of service %d failed: %v", serviceId, err)
+	}
 	return res
 }
@@ -0,0 +1,54 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpfcache
+
+import (
+	"github.com/cilium/ebpf"
+)
+
+type EndpointHitKey struct {
+	ServiceId  uint32 // service id
+	BackendUid uint32 // backend uid chosen by load balancing
+}
+
+// SetEndpointHits tells the datapath whether to count the connections sent to each backend of the services,
+// every counted connection costs a map update
+func (c *Cache) SetEndpointHits(enabled bool) error {
+	var key, value uint32
+	if enabled {
+		value = 1
+	}
+	return c.bpfMap.KmeshCountEndpointHits.Update(&key, &value, ebpf.UpdateAny)
+}
+
+// GetEndpointHits returns the numbers of connections the datapath sent to each backend of the service,
+// keyed by backend uid
+func (c *Cache) GetEndpointHits(serviceId uint32) (map[uint32]uint64, error) {
+	var (
+		key  EndpointHitKey
+		hits uint64
+		res  = make(map[uint32]uint64)
+	)
+
+	iter := c.bpfMap.KmeshEndpointHits.Iterate()
+	for iter.Next(&key, &hits) {
+		if key.ServiceId == serviceId {
+			res[key.BackendUid] = hits
+		}
+	}
+	return res, iter.Err()
+}
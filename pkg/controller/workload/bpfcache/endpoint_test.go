@@ -0,0 +1,232 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpfcache
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"testing"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/stretchr/testify/assert"
+	"istio.io/istio/pkg/util/sets"
+
+	"kmesh.net/kmesh/bpf/kmesh/bpf2go"
+)
+
+func TestIterateEndpoints(t *testing.T) {
+	workloadMap := NewFakeWorkloadMap(t)
+	defer CleanupFakeWorkloadMap(workloadMap)
+
+	c := NewCache(workloadMap)
+	// service 1 has 3 endpoints, service 2 has 2 endpoints
+	endpoints := map[EndpointKey]EndpointValue{
+		{ServiceId: 1, BackendIndex: 1}: {BackendUid: 100},
+		{ServiceId: 1, BackendIndex: 2}: {BackendUid: 101},
+		{ServiceId: 1, BackendIndex: 3}: {BackendUid: 102},
+		{ServiceId: 2, BackendIndex: 1}: {BackendUid: 100},
+		{ServiceId: 2, BackendIndex: 2}: {BackendUid: 200},
+	}
+	for k, v := range endpoints {
+		ek, ev := k, v
+		assert.NoError(t, c.EndpointUpdate(&ek, &ev))
+	}
+
+	t.Run("visit all endpoints of a service", func(t *testing.T) {
+		visited := map[EndpointKey]EndpointValue{}
+		err := c.IterateEndpoints(1, func(k EndpointKey, v EndpointValue) error {
+			visited[k] = v
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, map[EndpointKey]EndpointValue{
+			{ServiceId: 1, BackendIndex: 1}: {BackendUid: 100},
+			{ServiceId: 1, BackendIndex: 2}: {BackendUid: 101},
+			{ServiceId: 1, BackendIndex: 3}: {BackendUid: 102},
+		}, visited)
+	})
+
+	t.Run("in backend index order", func(t *testing.T) {
+		var indexes []uint32
+		err := c.IterateEndpoints(1, func(k EndpointKey, v EndpointValue) error {
+			indexes = append(indexes, k.BackendIndex)
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, []uint32{1, 2, 3}, indexes)
+		assert.Equal(t, []uint32{1, 2}, c.EndpointServiceIds())
+	})
+
+	t.Run("unknown service", func(t *testing.T) {
+		count := 0
+		err := c.IterateEndpoints(3, func(k EndpointKey, v EndpointValue) error {
+			count++
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 0, count)
+	})
+
+	t.Run("stop on error", func(t *testing.T) {
+		count := 0
+		stopErr := errors.New("stop")
+		err := c.IterateEndpoints(1, func(k EndpointKey, v EndpointValue) error {
+			count++
+			return stopErr
+		})
+		assert.ErrorIs(t, err, stopErr)
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("GetAllEndpointsForService", func(t *testing.T) {
+		assert.ElementsMatch(t, []EndpointValue{{BackendUid: 100}, {BackendUid: 200}}, c.GetAllEndpointsForService(2))
+	})
+}
+
+func TestRestoreEndpointKeys(t *testing.T) {
+	workloadMap := NewFakeWorkloadMap(t)
+	defer CleanupFakeWorkloadMap(workloadMap)
+
+	c := NewCache(workloadMap)
+	// 10 services with 50 endpoints each, spread over 100 backends
+	for svc := uint32(1); svc <= 10; svc++ {
+		for i := uint32(1); i <= 50; i++ {
+			ek := EndpointKey{ServiceId: svc, BackendIndex: i}
+			ev := EndpointValue{BackendUid: (svc*50 + i) % 100}
+			assert.NoError(t, c.EndpointUpdate(&ek, &ev))
+		}
+	}
+	expected := c.endpointKeys
+	assert.Len(t, expected, 100)
+	expectedServices := c.serviceEndpoints
+	assert.Len(t, expectedServices, 10)
+
+	for _, workers := range []int{1, 4, 0} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			restored := NewCache(workloadMap)
+			restored.SetRestoreWorkers(workers)
+			restored.RestoreEndpointKeys()
+			assert.Equal(t, expected, restored.endpointKeys)
+			assert.Equal(t, expectedServices, restored.serviceEndpoints)
+		})
+	}
+}
+
+func TestCompactEndpointIndices(t *testing.T) {
+	workloadMap := NewFakeWorkloadMap(t)
+	defer CleanupFakeWorkloadMap(workloadMap)
+
+	c := NewCache(workloadMap)
+	// service 1 has gaps before index 2 and 5, service 2 is already contiguous
+	endpoints := map[EndpointKey]EndpointValue{
+		{ServiceId: 1, BackendIndex: 2}: {BackendUid: 100, LastUpdated: 1},
+		{ServiceId: 1, BackendIndex: 5}: {BackendUid: 101, LastUpdated: 2},
+		{ServiceId: 1, BackendIndex: 6}: {BackendUid: 102, LastUpdated: 3},
+		{ServiceId: 2, BackendIndex: 1}: {BackendUid: 100},
+		{ServiceId: 2, BackendIndex: 2}: {BackendUid: 200},
+	}
+	for k, v := range endpoints {
+		ek, ev := k, v
+		assert.NoError(t, c.EndpointUpdate(&ek, &ev))
+	}
+	assert.NoError(t, c.ServiceUpdate(&ServiceKey{ServiceId: 1}, &ServiceValue{EndpointCount: 6}))
+	assert.NoError(t, c.ServiceUpdate(&ServiceKey{ServiceId: 2}, &ServiceValue{EndpointCount: 2}))
+
+	restored := NewCache(workloadMap)
+	restored.RestoreEndpointKeys()
+	restored.CompactEndpointIndices()
+	restored.ReconcileEndpointCount()
+
+	// the backends keep their order and the indices are contiguous from 1
+	expected := map[EndpointKey]EndpointValue{
+		{ServiceId: 1, BackendIndex: 1}: {BackendUid: 100, LastUpdated: 1},
+		{ServiceId: 1, BackendIndex: 2}: {BackendUid: 101, LastUpdated: 2},
+		{ServiceId: 1, BackendIndex: 3}: {BackendUid: 102, LastUpdated: 3},
+		{ServiceId: 2, BackendIndex: 1}: {BackendUid: 100},
+		{ServiceId: 2, BackendIndex: 2}: {BackendUid: 200},
+	}
+	actual := map[EndpointKey]EndpointValue{}
+	var (
+		key   EndpointKey
+		value EndpointValue
+	)
+	iter := workloadMap.KmeshEndpoint.Iterate()
+	for iter.Next(&key, &value) {
+		actual[key] = value
+	}
+	assert.NoError(t, iter.Err())
+	assert.Equal(t, expected, actual)
+
+	var sv ServiceValue
+	assert.NoError(t, restored.ServiceLookup(&ServiceKey{ServiceId: 1}, &sv))
+	assert.Equal(t, uint32(3), sv.EndpointCount)
+
+	// the endpoint index follows the moved endpoints
+	assert.Equal(t, sets.New(EndpointKey{ServiceId: 1, BackendIndex: 1}, EndpointKey{ServiceId: 2, BackendIndex: 1}), restored.GetEndpointKeys(100))
+	assert.Equal(t, sets.New(EndpointKey{ServiceId: 1, BackendIndex: 2}), restored.GetEndpointKeys(101))
+	assert.Equal(t, sets.New(EndpointKey{ServiceId: 1, BackendIndex: 3}), restored.GetEndpointKeys(102))
+
+	// nothing to do once contiguous
+	restored.CompactEndpointIndices()
+	assert.Equal(t, sets.New(EndpointKey{ServiceId: 1, BackendIndex: 3}), restored.GetEndpointKeys(102))
+}
+
+func BenchmarkRestoreEndpointKeys(b *testing.B) {
+	const entries = 100000
+	endpointMap, err := ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "kmesh_endpoint",
+		Type:       ebpf.Hash,
+		KeySize:    uint32(unsafe.Sizeof(EndpointKey{})),
+		ValueSize:  uint32(unsafe.Sizeof(EndpointValue{})),
+		MaxEntries: entries,
+	})
+	if err != nil {
+		b.Fatalf("create endpoint map failed, err is %v", err)
+	}
+	defer endpointMap.Close()
+
+	keys := make([]EndpointKey, 0, entries)
+	values := make([]EndpointValue, 0, entries)
+	for i := uint32(0); i < entries; i++ {
+		keys = append(keys, EndpointKey{ServiceId: i / 100, BackendIndex: i%100 + 1})
+		values = append(values, EndpointValue{BackendUid: i % 5000})
+	}
+	if _, err = endpointMap.BatchUpdate(keys, values, nil); err != nil {
+		b.Fatalf("fill endpoint map failed, err is %v", err)
+	}
+
+	for _, workers := range []int{1, 4, runtime.NumCPU()} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			c := NewCache(bpf2go.KmeshCgroupSockWorkloadMaps{KmeshEndpoint: endpointMap})
+			c.SetRestoreWorkers(workers)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.RestoreEndpointKeys()
+			}
+			b.StopTimer()
+			restored := 0
+			for _, eks := range c.endpointKeys {
+				restored += eks.Len()
+			}
+			if restored != entries {
+				b.Fatalf("restored %d endpoint keys, want %d", restored, entries)
+			}
+		})
+	}
+}
@@ -17,6 +17,11 @@
 package bpfcache
 
 import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
 	"istio.io/istio/pkg/util/sets"
 
 	"kmesh.net/kmesh/bpf/kmesh/bpf2go"
@@ -29,12 +34,40 @@ type Cache struct {
 	bpfMap bpf2go.KmeshCgroupSockWorkloadMaps
 	// endpointKeys by workload uid
 	endpointKeys map[uint32]sets.Set[EndpointKey]
+	// backend indexes by service id, the endpoints of a service are iterated without scanning the map,
+	// guarded by serviceEndpointsMutex as the watchdog reads it alongside the xDS processing
+	serviceEndpoints      map[uint32]sets.Set[uint32]
+	serviceEndpointsMutex sync.RWMutex
+	// directory the maps are pinned in, watched for external changes
+	pinPath string
+	// limits the rate of bpf map writes, nil means unlimited
+	writeLimiter *rate.Limiter
+	// maps mirroring all the writes, zero value if disabled
+	shadowMap bpf2go.KmeshCgroupSockWorkloadMaps
+	// number of workers restoring the endpoint keys, runtime.NumCPU() if not positive
+	restoreWorkers int
+	// serializes MultiUpdate calls
+	multiMutex sync.Mutex
+	// the frontend entries are counted and their access time seeded, see EnableFrontendLRU
+	frontendLRU   bool
+	frontendCount int
+	// records the writes to the workload bpf maps, nil if disabled
+	txLog *TxLog
+	// counts the operations on the workload bpf maps, nil if disabled
+	opCounter *OpCounter
+	// notified of the writes to the workload bpf maps, nil if disabled, writeStarted is the start of the last write
+	writeObserver WriteObserver
+	writeStarted  time.Time
+	// notified of the successful writes to the workload bpf maps, see Subscribe
+	subMutex    sync.RWMutex
+	subscribers []*subscriber
 }
 
 func NewCache(workloadMap bpf2go.KmeshCgroupSockWorkloadMaps) *Cache {
 	return &Cache{
-		bpfMap:       workloadMap,
-		endpointKeys: make(map[uint32]sets.Set[EndpointKey]),
+		bpfMap:           workloadMap,
+		endpointKeys:     make(map[uint32]sets.Set[EndpointKey]),
+		serviceEndpoints: make(map[uint32]sets.Set[uint32]),
 	}
 }
 
@@ -45,3 +78,35 @@ func (c *Cache) GetEndpointKeys(workloadID uint32) sets.Set[EndpointKey] {
 
 	return c.endpointKeys[workloadID]
 }
+
+// SetWriteRateLimit limits the bpf map writes to opsPerSec, allowing bursts of burst writes,
+// so that a huge xDS response is applied in chunks instead of saturating bpf syscalls.
+// Writes are still issued synchronously, so ordering is preserved. opsPerSec <= 0 removes the limit.
+func (c *Cache) SetWriteRateLimit(opsPerSec, burst int) {
+	if opsPerSec <= 0 {
+		c.writeLimiter = nil
+		return
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	c.writeLimiter = rate.NewLimiter(rate.Limit(opsPerSec), burst)
+}
+
+// SetRestoreWorkers sets the number of workers looking up the endpoint map in parallel in RestoreEndpointKeys,
+// n <= 0 uses one worker per cpu and n == 1 restores the keys in a single iteration.
+func (c *Cache) SetRestoreWorkers(n int) {
+	c.restoreWorkers = n
+}
+
+// waitWrite blocks until a bpf map write is allowed by the write rate limiter
+func (c *Cache) waitWrite() {
+	if c.writeLimiter != nil {
+		if err := c.writeLimiter.Wait(context.Background()); err != nil {
+			log.Errorf("wait for bpf map write failed: %v", err)
+		}
+	}
+	if c.writeObserver != nil {
+		c.writeStarted = time.Now()
+	}
+}
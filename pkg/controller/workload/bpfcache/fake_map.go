@@ -17,6 +17,7 @@
 package bpfcache
 
 import (
+	"sync"
 	"testing"
 	"unsafe"
 
@@ -27,13 +28,18 @@ import (
 )
 
 func NewFakeWorkloadMap(t *testing.T) bpf2go.KmeshCgroupSockWorkloadMaps {
+	return NewFakeWorkloadMapWithSize(t, 1024)
+}
+
+// NewFakeWorkloadMapWithSize is the same as NewFakeWorkloadMap, except the hash maps hold up to maxEntries
+func NewFakeWorkloadMapWithSize(t *testing.T, maxEntries uint32) bpf2go.KmeshCgroupSockWorkloadMaps {
 	_ = rlimit.RemoveMemlock()
 	backEndMap, err := ebpf.NewMap(&ebpf.MapSpec{
 		Name:       "kmesh_backend",
 		Type:       ebpf.Hash,
 		KeySize:    uint32(unsafe.Sizeof(BackendKey{})),
 		ValueSize:  uint32(unsafe.Sizeof(BackendValue{})),
-		MaxEntries: 1024,
+		MaxEntries: maxEntries,
 	})
 	if err != nil {
 		t.Fatalf("create backEndMap map failed, err is %v", err)
@@ -44,7 +50,7 @@ func NewFakeWorkloadMap(t *testing.T) bpf2go.KmeshCgroupSockWorkloadMaps {
 		Type:       ebpf.Hash,
 		KeySize:    uint32(unsafe.Sizeof(EndpointKey{})),
 		ValueSize:  uint32(unsafe.Sizeof(EndpointValue{})),
-		MaxEntries: 1024,
+		MaxEntries: maxEntries,
 	})
 	if err != nil {
 		t.Fatalf("create endpointMap map failed, err is %v", err)
@@ -55,7 +61,7 @@ func NewFakeWorkloadMap(t *testing.T) bpf2go.KmeshCgroupSockWorkloadMaps {
 		Type:       ebpf.Hash,
 		KeySize:    uint32(unsafe.Sizeof(FrontendKey{})),
 		ValueSize:  uint32(unsafe.Sizeof(FrontendValue{})),
-		MaxEntries: 1024,
+		MaxEntries: maxEntries,
 	})
 	if err != nil {
 		t.Fatalf("create frontendMap map failed, err is %v", err)
@@ -66,12 +72,76 @@ func NewFakeWorkloadMap(t *testing.T) bpf2go.KmeshCgroupSockWorkloadMaps {
 		Type:       ebpf.Hash,
 		KeySize:    uint32(unsafe.Sizeof(ServiceKey{})),
 		ValueSize:  uint32(unsafe.Sizeof(ServiceValue{})),
-		MaxEntries: 1024,
+		MaxEntries: maxEntries,
 	})
 	if err != nil {
 		t.Fatalf("create serviceMap map failed, err is %v", err)
 	}
 
+	endpointHitsMap, err := ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "kmesh_endpoint_hits",
+		Type:       ebpf.Hash,
+		KeySize:    uint32(unsafe.Sizeof(EndpointHitKey{})),
+		ValueSize:  uint32(unsafe.Sizeof(uint64(0))),
+		MaxEntries: maxEntries,
+	})
+	if err != nil {
+		t.Fatalf("create endpointHitsMap map failed, err is %v", err)
+	}
+
+	countEndpointHitsMap, err := ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "kmesh_count_endpoint_hits",
+		Type:       ebpf.Array,
+		KeySize:    uint32(unsafe.Sizeof(uint32(0))),
+		ValueSize:  uint32(unsafe.Sizeof(uint32(0))),
+		MaxEntries: 1,
+	})
+	if err != nil {
+		t.Fatalf("create countEndpointHitsMap map failed, err is %v", err)
+	}
+
+	frontendAccessMap, err := ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "kmesh_frontend_access",
+		Type:       ebpf.Hash,
+		KeySize:    uint32(unsafe.Sizeof(FrontendKey{})),
+		ValueSize:  uint32(unsafe.Sizeof(uint64(0))),
+		MaxEntries: maxEntries,
+	})
+	if err != nil {
+		t.Fatalf("create frontendAccessMap map failed, err is %v", err)
+	}
+
+	frontendMissMap, err := ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "kmesh_frontend_miss",
+		Type:       ebpf.RingBuf,
+		MaxEntries: 1 << 12,
+	})
+	if err != nil {
+		t.Fatalf("create frontendMissMap map failed, err is %v", err)
+	}
+
+	lazyFrontendMap, err := ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "kmesh_lazy_frontend",
+		Type:       ebpf.Array,
+		KeySize:    uint32(unsafe.Sizeof(uint32(0))),
+		ValueSize:  uint32(unsafe.Sizeof(uint32(0))),
+		MaxEntries: 1,
+	})
+	if err != nil {
+		t.Fatalf("create lazyFrontendMap map failed, err is %v", err)
+	}
+
+	authzPolicyMap, err := ebpf.NewMap(&ebpf.MapSpec{
+		Name:       "kmesh_authz_policy",
+		Type:       ebpf.Hash,
+		KeySize:    uint32(unsafe.Sizeof(uint32(0))),
+		ValueSize:  uint32(unsafe.Sizeof(AuthzPolicyValue{})),
+		MaxEntries: maxEntries,
+	})
+	if err != nil {
+		t.Fatalf("create authzPolicyMap map failed, err is %v", err)
+	}
+
 	// TODO: add other maps when needed
 
 	return bpf2go.KmeshCgroupSockWorkloadMaps{
@@ -79,6 +149,13 @@ func NewFakeWorkloadMap(t *testing.T) bpf2go.KmeshCgroupSockWorkloadMaps {
 		KmeshEndpoint: endpointMap,
 		KmeshFrontend: frontendMap,
 		KmeshService:  serviceMap,
+
+		KmeshEndpointHits:      endpointHitsMap,
+		KmeshCountEndpointHits: countEndpointHitsMap,
+		KmeshFrontendAccess:    frontendAccessMap,
+		KmeshFrontendMiss:      frontendMissMap,
+		KmeshLazyFrontend:      lazyFrontendMap,
+		KmeshAuthzPolicy:       authzPolicyMap,
 	}
 }
 
@@ -87,4 +164,81 @@ func CleanupFakeWorkloadMap(maps bpf2go.KmeshCgroupSockWorkloadMaps) {
 	maps.KmeshEndpoint.Close()
 	maps.KmeshFrontend.Close()
 	maps.KmeshService.Close()
+	maps.KmeshEndpointHits.Close()
+	maps.KmeshCountEndpointHits.Close()
+	maps.KmeshFrontendAccess.Close()
+	maps.KmeshFrontendMiss.Close()
+	maps.KmeshLazyFrontend.Close()
+	maps.KmeshAuthzPolicy.Close()
+}
+
+// OpCounter counts the lookups, updates and deletes issued by a Cache per workload map, for tests to
+// assert e.g. no redundant write. The fake maps are kernel maps, so the operations are counted by the
+// Cache: the lookups made through its Lookup methods and all its writes, a batch counting one per key.
+type OpCounter struct {
+	mutex   sync.Mutex
+	lookups map[BpfMapType]int
+	updates map[BpfMapType]int
+	deletes map[BpfMapType]int
+}
+
+func NewOpCounter() *OpCounter {
+	c := &OpCounter{}
+	c.Reset()
+	return c
+}
+
+// SetOpCounter counts the operations of the Cache in counter, nil disables it. Like NewFakeWorkloadMap it is
+// only meant for tests, hence no daemon option enables it.
+func (c *Cache) SetOpCounter(counter *OpCounter) {
+	c.opCounter = counter
+}
+
+func (c *OpCounter) countLookup(m BpfMapType) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lookups[m]++
+}
+
+func (c *OpCounter) countWrite(m BpfMapType, op BpfOpType) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if op == BpfOpDelete {
+		c.deletes[m]++
+	} else {
+		c.updates[m]++
+	}
+}
+
+func (c *OpCounter) Lookups(m BpfMapType) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lookups[m]
+}
+
+func (c *OpCounter) Updates(m BpfMapType) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.updates[m]
+}
+
+func (c *OpCounter) Deletes(m BpfMapType) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.deletes[m]
+}
+
+// Reset sets all the counts back to zero
+func (c *OpCounter) Reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lookups = make(map[BpfMapType]int)
+	c.updates = make(map[BpfMapType]int)
+	c.deletes = make(map[BpfMapType]int)
 }
@@ -0,0 +1,82 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpfcache
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpCounter(t *testing.T) {
+	workloadMap := NewFakeWorkloadMap(t)
+	defer CleanupFakeWorkloadMap(workloadMap)
+
+	c := NewCache(workloadMap)
+	// operations before the counter is set are not counted
+	assert.NoError(t, c.ServiceUpdate(&ServiceKey{ServiceId: 1}, &ServiceValue{}))
+	counter := NewOpCounter()
+	c.SetOpCounter(counter)
+
+	fk1 := &FrontendKey{Ip: netip.MustParseAddr("10.244.0.1").As16()}
+	fk2 := &FrontendKey{Ip: netip.MustParseAddr("10.244.0.2").As16()}
+	fv := &FrontendValue{UpstreamId: 100}
+	assert.NoError(t, c.FrontendUpdate(fk1, fv))
+	assert.NoError(t, c.FrontendUpdate(fk2, fv))
+	assert.NoError(t, c.FrontendUpdate(fk2, fv))
+	assert.NoError(t, c.FrontendLookup(fk1, fv))
+	assert.NoError(t, c.FrontendDelete(fk1))
+	// failed operations are counted too
+	assert.ErrorIs(t, c.FrontendLookup(fk1, fv), ebpf.ErrKeyNotExist)
+	assert.ErrorIs(t, c.FrontendDelete(fk1), ebpf.ErrKeyNotExist)
+
+	var sv ServiceValue
+	assert.NoError(t, c.ServiceLookup(&ServiceKey{ServiceId: 1}, &sv))
+	assert.NoError(t, c.EndpointUpdate(&EndpointKey{ServiceId: 1, BackendIndex: 1}, &EndpointValue{BackendUid: 100}))
+	assert.NoError(t, c.BackendUpdate(&BackendKey{BackendUid: 100}, &BackendValue{}))
+	assert.NoError(t, c.BackendUpdate(&BackendKey{BackendUid: 101}, &BackendValue{}))
+	// a batch counts once per key
+	assert.NoError(t, c.BackendBatchDelete([]BackendKey{{BackendUid: 100}, {BackendUid: 101}}))
+	assert.NoError(t, c.MultiUpdate([]BpfOp{
+		{Map: FrontendMap, Op: BpfOpUpdate, Key: fk1, Value: fv},
+		{Map: FrontendMap, Op: BpfOpUpdate, Key: fk2, Value: fv},
+		{Map: ServiceMap, Op: BpfOpDelete, Key: &ServiceKey{ServiceId: 1}},
+	}))
+
+	assert.Equal(t, 2, counter.Lookups(FrontendMap))
+	assert.Equal(t, 5, counter.Updates(FrontendMap))
+	assert.Equal(t, 2, counter.Deletes(FrontendMap))
+	assert.Equal(t, 1, counter.Lookups(ServiceMap))
+	assert.Equal(t, 0, counter.Updates(ServiceMap))
+	assert.Equal(t, 1, counter.Deletes(ServiceMap))
+	assert.Equal(t, 0, counter.Lookups(EndpointMap))
+	assert.Equal(t, 1, counter.Updates(EndpointMap))
+	assert.Equal(t, 2, counter.Updates(BackendMap))
+	assert.Equal(t, 2, counter.Deletes(BackendMap))
+
+	counter.Reset()
+	assert.Equal(t, 0, counter.Updates(FrontendMap))
+	assert.NoError(t, c.FrontendDelete(fk1))
+	assert.Equal(t, 1, counter.Deletes(FrontendMap))
+
+	// and nothing once unset
+	c.SetOpCounter(nil)
+	assert.NoError(t, c.FrontendDelete(fk2))
+	assert.Equal(t, 1, counter.Deletes(FrontendMap))
+}
@@ -17,7 +17,11 @@
 package bpfcache
 
 import (
+	"errors"
+	"fmt"
+
 	"github.com/cilium/ebpf"
+	"golang.org/x/sys/unix"
 )
 
 type FrontendKey struct {
@@ -30,18 +34,41 @@ type FrontendValue struct {
 
 func (c *Cache) FrontendUpdate(key *FrontendKey, value *FrontendValue) error {
 	log.Debugf("FrontendUpdate [%#v], [%#v]", *key, *value)
-	return c.bpfMap.KmeshFrontend.
-		Update(key, value, ebpf.UpdateAny)
+	var added bool
+	if c.frontendLRU {
+		var old FrontendValue
+		added = c.bpfMap.KmeshFrontend.Lookup(key, &old) != nil
+	}
+
+	c.waitWrite()
+	err := c.bpfMap.KmeshFrontend.Update(key, value, ebpf.UpdateAny)
+	c.recordWrite(FrontendMap, BpfOpUpdate, key, value, err)
+	if err != nil {
+		return err
+	}
+	c.shadowUpdate(c.shadowMap.KmeshFrontend, key, value)
+	if added {
+		c.frontendAdded(key)
+	}
+	return nil
 }
 
 func (c *Cache) FrontendDelete(key *FrontendKey) error {
 	log.Debugf("FrontendDelete [%#v]", *key)
-	return c.bpfMap.KmeshFrontend.
-		Delete(key)
+	c.waitWrite()
+	err := c.bpfMap.KmeshFrontend.Delete(key)
+	c.recordWrite(FrontendMap, BpfOpDelete, key, nil, err)
+	if err != nil {
+		return err
+	}
+	c.shadowDelete(c.shadowMap.KmeshFrontend, key)
+	c.frontendDeleted(key)
+	return nil
 }
 
 func (c *Cache) FrontendLookup(key *FrontendKey, value *FrontendValue) error {
 	log.Debugf("FrontendLookup [%#v]", *key)
+	c.opCounter.countLookup(FrontendMap)
 	return c.bpfMap.KmeshFrontend.
 		Lookup(key, value)
 }
@@ -64,3 +91,113 @@ func (c *Cache) FrontendIterFindKey(upstreamId uint32) []FrontendKey {
 	log.Debugf("res:[%#v]", res)
 	return res
 }
+
+// GetAllFrontends returns all the entries of the frontend map, keys[i] maps to values[i]
+func (c *Cache) GetAllFrontends() ([]FrontendKey, []FrontendValue, error) {
+	var (
+		key    = FrontendKey{}
+		value  = FrontendValue{}
+		keys   []FrontendKey
+		values []FrontendValue
+		iter   = c.bpfMap.KmeshFrontend.Iterate()
+	)
+
+	for iter.Next(&key, &value) {
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, nil, fmt.Errorf("iterate frontend map failed, %s", err)
+	}
+	return keys, values, nil
+}
+
+// EnableFrontendLRU counts the frontend entries for FrontendCount, and seeds the access time of
+// the entries with the current time, so that an entry never accessed by the datapath ages
+// from its creation instead of looking the least recently used.
+func (c *Cache) EnableFrontendLRU() error {
+	var (
+		key   = FrontendKey{}
+		value = FrontendValue{}
+		count = 0
+		iter  = c.bpfMap.KmeshFrontend.Iterate()
+	)
+
+	now, err := monotonicNow()
+	if err != nil {
+		return err
+	}
+	for iter.Next(&key, &value) {
+		count++
+		// keep the access time left by a previous run of kmesh
+		err := c.bpfMap.KmeshFrontendAccess.Update(&key, now, ebpf.UpdateNoExist)
+		if err != nil && !errors.Is(err, ebpf.ErrKeyExist) {
+			log.Errorf("seed access time of frontend [%#v] failed: %v", key, err)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("count frontend entries failed: %w", err)
+	}
+
+	c.frontendCount = count
+	c.frontendLRU = true
+	return nil
+}
+
+// SetLazyFrontend tells the datapath whether to report the frontend keys it misses to the userspace
+func (c *Cache) SetLazyFrontend(enabled bool) error {
+	var key, value uint32
+	if enabled {
+		value = 1
+	}
+	return c.bpfMap.KmeshLazyFrontend.Update(&key, &value, ebpf.UpdateAny)
+}
+
+// FrontendCount returns the number of frontend entries, only counted once EnableFrontendLRU is called
+func (c *Cache) FrontendCount() int {
+	return c.frontendCount
+}
+
+// FrontendAccessTime returns the last time in CLOCK_MONOTONIC nanoseconds the datapath looked up the frontend,
+// or the time it was added if never accessed
+func (c *Cache) FrontendAccessTime(key *FrontendKey) (uint64, error) {
+	var ns uint64
+	err := c.bpfMap.KmeshFrontendAccess.Lookup(key, &ns)
+	return ns, err
+}
+
+// FrontendTouch sets the access time of the frontend to now, as the datapath does on each lookup
+func (c *Cache) FrontendTouch(key *FrontendKey) error {
+	now, err := monotonicNow()
+	if err != nil {
+		return err
+	}
+	return c.bpfMap.KmeshFrontendAccess.Update(key, now, ebpf.UpdateAny)
+}
+
+// monotonicNow returns the time of bpf_ktime_get_ns()
+func monotonicNow() (uint64, error) {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0, err
+	}
+	return uint64(ts.Nano()), nil
+}
+
+func (c *Cache) frontendAdded(key *FrontendKey) {
+	c.frontendCount++
+	if err := c.FrontendTouch(key); err != nil {
+		log.Errorf("seed access time of frontend [%#v] failed: %v", *key, err)
+	}
+}
+
+// frontendDeleted drops the access time of the frontend deleted
+func (c *Cache) frontendDeleted(key *FrontendKey) {
+	if !c.frontendLRU {
+		return
+	}
+	c.frontendCount--
+	if err := c.bpfMap.KmeshFrontendAccess.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		log.Errorf("delete access time of frontend [%#v] failed: %v", *key, err)
+	}
+}
@@ -0,0 +1,276 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpfcache
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/cilium/ebpf"
+
+	"kmesh.net/kmesh/bpf/kmesh/bpf2go"
+)
+
+type BpfMapType uint8
+
+const (
+	FrontendMap BpfMapType = iota
+	ServiceMap
+	EndpointMap
+	BackendMap
+)
+
+func (t BpfMapType) String() string {
+	switch t {
+	case FrontendMap:
+		return "frontend"
+	case ServiceMap:
+		return "service"
+	case EndpointMap:
+		return "endpoint"
+	case BackendMap:
+		return "backend"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(t))
+	}
+}
+
+type BpfOpType uint8
+
+const (
+	BpfOpUpdate BpfOpType = iota
+	BpfOpDelete
+)
+
+func (t BpfOpType) String() string {
+	switch t {
+	case BpfOpUpdate:
+		return "update"
+	case BpfOpDelete:
+		return "delete"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(t))
+	}
+}
+
+// BpfOp is a write of MultiUpdate. Key and Value point to the key and value types of the map,
+// e.g. *FrontendKey and *FrontendValue for FrontendMap, Value is ignored by BpfOpDelete.
+type BpfOp struct {
+	Map   BpfMapType
+	Op    BpfOpType
+	Key   any
+	Value any
+}
+
+type bpfMapSpec struct {
+	keyType   reflect.Type
+	valueType reflect.Type
+	bpfMap    func(maps *bpf2go.KmeshCgroupSockWorkloadMaps) *ebpf.Map
+}
+
+var bpfMapSpecs = map[BpfMapType]bpfMapSpec{
+	FrontendMap: {
+		keyType:   reflect.TypeOf(&FrontendKey{}),
+		valueType: reflect.TypeOf(&FrontendValue{}),
+		bpfMap:    func(maps *bpf2go.KmeshCgroupSockWorkloadMaps) *ebpf.Map { return maps.KmeshFrontend },
+	},
+	ServiceMap: {
+		keyType:   reflect.TypeOf(&ServiceKey{}),
+		valueType: reflect.TypeOf(&ServiceValue{}),
+		bpfMap:    func(maps *bpf2go.KmeshCgroupSockWorkloadMaps) *ebpf.Map { return maps.KmeshService },
+	},
+	EndpointMap: {
+		keyType:   reflect.TypeOf(&EndpointKey{}),
+		valueType: reflect.TypeOf(&EndpointValue{}),
+		bpfMap:    func(maps *bpf2go.KmeshCgroupSockWorkloadMaps) *ebpf.Map { return maps.KmeshEndpoint },
+	},
+	BackendMap: {
+		keyType:   reflect.TypeOf(&BackendKey{}),
+		valueType: reflect.TypeOf(&BackendValue{}),
+		bpfMap:    func(maps *bpf2go.KmeshCgroupSockWorkloadMaps) *ebpf.Map { return maps.KmeshBackend },
+	},
+}
+
+// undoOp restores an entry written by MultiUpdate to its previous value
+type undoOp struct {
+	op      BpfOp
+	old     any
+	existed bool
+}
+
+// MultiUpdate applies the ops in order as a whole: if one of them fails, the ops already applied are
+// compensated, the entries updated are restored or deleted and the entries deleted are restored.
+// Consecutive updates of the same map are written with BPF_MAP_UPDATE_BATCH when supported.
+// MultiUpdate calls are serialized with each other, but the bpf progs and the single map writes
+// of the Cache may still see the intermediate state.
+func (c *Cache) MultiUpdate(ops []BpfOp) error {
+	for i, op := range ops {
+		if err := validateOp(op); err != nil {
+			return fmt.Errorf("op %d: %w", i, err)
+		}
+	}
+
+	c.multiMutex.Lock()
+	defer c.multiMutex.Unlock()
+
+	undos := make([]undoOp, 0, len(ops))
+	for i := 0; i < len(ops); {
+		end := i + 1
+		// the endpoint map is left out of batches, its writes must go through EndpointUpdate to keep the endpoint index
+		if ops[i].Op == BpfOpUpdate && ops[i].Map != EndpointMap {
+			for end < len(ops) && ops[end].Map == ops[i].Map && ops[end].Op == BpfOpUpdate {
+				end++
+			}
+		}
+
+		applied, err := c.applyOps(ops[i:end], &undos)
+		if err != nil {
+			err = fmt.Errorf("op %d on %s map: %w", i+applied, ops[i+applied].Map, err)
+			if rollbackErr := c.rollback(undos); rollbackErr != nil {
+				return errors.Join(err, fmt.Errorf("rollback failed: %w", rollbackErr))
+			}
+			return err
+		}
+		i = end
+	}
+
+	return nil
+}
+
+func validateOp(op BpfOp) error {
+	spec, ok := bpfMapSpecs[op.Map]
+	if !ok {
+		return fmt.Errorf("unknown map %s", op.Map)
+	}
+	if reflect.TypeOf(op.Key) != spec.keyType {
+		return fmt.Errorf("key of %s map must be %s, got %T", op.Map, spec.keyType, op.Key)
+	}
+
+	switch op.Op {
+	case BpfOpUpdate:
+		if reflect.TypeOf(op.Value) != spec.valueType {
+			return fmt.Errorf("value of %s map must be %s, got %T", op.Map, spec.valueType, op.Value)
+		}
+	case BpfOpDelete:
+	default:
+		return fmt.Errorf("unknown op %d", op.Op)
+	}
+	return nil
+}
+
+// applyOps applies ops of the same map, and records how to undo the ones applied.
+// It returns the number of ops applied.
+func (c *Cache) applyOps(ops []BpfOp, undos *[]undoOp) (int, error) {
+	spec := bpfMapSpecs[ops[0].Map]
+	bpfMap := spec.bpfMap(&c.bpfMap)
+
+	pending := make([]undoOp, 0, len(ops))
+	for _, op := range ops {
+		old := reflect.New(spec.valueType.Elem()).Interface()
+		existed := bpfMap.Lookup(op.Key, old) == nil
+		pending = append(pending, undoOp{op: op, old: old, existed: existed})
+	}
+
+	if len(ops) > 1 {
+		keys := reflect.MakeSlice(reflect.SliceOf(spec.keyType.Elem()), len(ops), len(ops))
+		values := reflect.MakeSlice(reflect.SliceOf(spec.valueType.Elem()), len(ops), len(ops))
+		for i, op := range ops {
+			keys.Index(i).Set(reflect.ValueOf(op.Key).Elem())
+			values.Index(i).Set(reflect.ValueOf(op.Value).Elem())
+		}
+
+		c.waitWrite()
+		n, err := bpfMap.BatchUpdate(keys.Interface(), values.Interface(), nil)
+		if !errors.Is(err, ebpf.ErrNotSupported) {
+			shadow := spec.bpfMap(&c.shadowMap)
+			for i, op := range ops[:n] {
+				c.recordWrite(op.Map, op.Op, op.Key, op.Value, nil)
+				c.shadowUpdate(shadow, op.Key, op.Value)
+				if key, ok := op.Key.(*FrontendKey); ok && c.frontendLRU && !pending[i].existed {
+					c.frontendAdded(key)
+				}
+			}
+			*undos = append(*undos, pending[:n]...)
+			if err != nil && n < len(ops) {
+				c.recordWrite(ops[n].Map, ops[n].Op, ops[n].Key, ops[n].Value, err)
+			}
+			return n, err
+		}
+		log.Debugf("batch update of %s map not supported, fall back to single updates", ops[0].Map)
+	}
+
+	for i, op := range ops {
+		if err := c.applyOp(op); err != nil {
+			return i, err
+		}
+		*undos = append(*undos, pending[i])
+	}
+	return len(ops), nil
+}
+
+func (c *Cache) applyOp(op BpfOp) error {
+	if op.Op == BpfOpDelete {
+		switch key := op.Key.(type) {
+		case *FrontendKey:
+			return c.FrontendDelete(key)
+		case *ServiceKey:
+			return c.ServiceDelete(key)
+		case *EndpointKey:
+			return c.EndpointDelete(key)
+		case *BackendKey:
+			return c.BackendDelete(key)
+		}
+	}
+
+	switch key := op.Key.(type) {
+	case *FrontendKey:
+		return c.FrontendUpdate(key, op.Value.(*FrontendValue))
+	case *ServiceKey:
+		return c.ServiceUpdate(key, op.Value.(*ServiceValue))
+	case *EndpointKey:
+		return c.EndpointUpdate(key, op.Value.(*EndpointValue))
+	case *BackendKey:
+		return c.BackendUpdate(key, op.Value.(*BackendValue))
+	}
+	return fmt.Errorf("unknown key type %T", op.Key)
+}
+
+// rollback undoes the ops in reverse order, so that an entry written several times gets its first value back
+func (c *Cache) rollback(undos []undoOp) error {
+	var errs []error
+
+	for i := len(undos) - 1; i >= 0; i-- {
+		u := undos[i]
+		var err error
+		switch {
+		case u.existed:
+			if u.op.Map == EndpointMap {
+				// drop the endpoint index of the value written before restoring the old one
+				_ = c.EndpointDelete(u.op.Key.(*EndpointKey))
+			}
+			err = c.applyOp(BpfOp{Map: u.op.Map, Op: BpfOpUpdate, Key: u.op.Key, Value: u.old})
+		case u.op.Op == BpfOpUpdate:
+			err = c.applyOp(BpfOp{Map: u.op.Map, Op: BpfOpDelete, Key: u.op.Key})
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("undo op on %s map: %w", u.op.Map, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpfcache
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultiUpdate(t *testing.T) {
+	workloadMap := NewFakeWorkloadMap(t)
+	defer CleanupFakeWorkloadMap(workloadMap)
+
+	c := NewCache(workloadMap)
+	fk1 := &FrontendKey{Ip: netip.MustParseAddr("10.244.0.1").As16()}
+	fk2 := &FrontendKey{Ip: netip.MustParseAddr("10.244.0.2").As16()}
+	bk := &BackendKey{BackendUid: 100}
+	ek := &EndpointKey{ServiceId: 1, BackendIndex: 1}
+
+	err := c.MultiUpdate([]BpfOp{
+		{Map: FrontendMap, Op: BpfOpUpdate, Key: fk1, Value: &FrontendValue{UpstreamId: 100}},
+		{Map: FrontendMap, Op: BpfOpUpdate, Key: fk2, Value: &FrontendValue{UpstreamId: 100}},
+		{Map: BackendMap, Op: BpfOpUpdate, Key: bk, Value: &BackendValue{Ip: fk1.Ip}},
+		{Map: EndpointMap, Op: BpfOpUpdate, Key: ek, Value: &EndpointValue{BackendUid: 100}},
+		{Map: ServiceMap, Op: BpfOpUpdate, Key: &ServiceKey{ServiceId: 1}, Value: &ServiceValue{EndpointCount: 1}},
+		{Map: FrontendMap, Op: BpfOpDelete, Key: fk2},
+	})
+	assert.NoError(t, err)
+
+	var fv FrontendValue
+	assert.NoError(t, c.FrontendLookup(fk1, &fv))
+	assert.Equal(t, uint32(100), fv.UpstreamId)
+	assert.ErrorIs(t, c.FrontendLookup(fk2, &fv), ebpf.ErrKeyNotExist)
+	var bv BackendValue
+	assert.NoError(t, c.BackendLookup(bk, &bv))
+	var sv ServiceValue
+	assert.NoError(t, c.ServiceLookup(&ServiceKey{ServiceId: 1}, &sv))
+	assert.Equal(t, uint32(1), sv.EndpointCount)
+	assert.True(t, c.GetEndpointKeys(100).Contains(*ek))
+
+	// invalid ops are refused before anything is written
+	err = c.MultiUpdate([]BpfOp{
+		{Map: FrontendMap, Op: BpfOpUpdate, Key: fk2, Value: &FrontendValue{UpstreamId: 1}},
+		{Map: BackendMap, Op: BpfOpUpdate, Key: fk2, Value: &BackendValue{}},
+	})
+	assert.ErrorContains(t, err, "key of backend map must be *bpfcache.BackendKey")
+	assert.ErrorIs(t, c.FrontendLookup(fk2, &fv), ebpf.ErrKeyNotExist)
+}
+
+func TestMultiUpdateRollback(t *testing.T) {
+	workloadMap := NewFakeWorkloadMap(t)
+	defer CleanupFakeWorkloadMap(workloadMap)
+
+	c := NewCache(workloadMap)
+	existing := &FrontendKey{Ip: netip.MustParseAddr("10.244.0.1").As16()}
+	deleted := &FrontendKey{Ip: netip.MustParseAddr("10.244.0.3").As16()}
+	endpoint := &EndpointKey{ServiceId: 1, BackendIndex: 1}
+	assert.NoError(t, c.FrontendUpdate(existing, &FrontendValue{UpstreamId: 1}))
+	assert.NoError(t, c.FrontendUpdate(deleted, &FrontendValue{UpstreamId: 3}))
+	assert.NoError(t, c.EndpointUpdate(endpoint, &EndpointValue{BackendUid: 1}))
+
+	added := &FrontendKey{Ip: netip.MustParseAddr("10.244.0.2").As16()}
+	bk := &BackendKey{BackendUid: 200}
+	err := c.MultiUpdate([]BpfOp{
+		{Map: FrontendMap, Op: BpfOpUpdate, Key: existing, Value: &FrontendValue{UpstreamId: 200}},
+		{Map: FrontendMap, Op: BpfOpUpdate, Key: added, Value: &FrontendValue{UpstreamId: 200}},
+		{Map: BackendMap, Op: BpfOpUpdate, Key: bk, Value: &BackendValue{Ip: added.Ip}},
+		{Map: EndpointMap, Op: BpfOpUpdate, Key: endpoint, Value: &EndpointValue{BackendUid: 200}},
+		{Map: FrontendMap, Op: BpfOpDelete, Key: deleted},
+		// the service doesn't exist, fails the whole operation
+		{Map: ServiceMap, Op: BpfOpDelete, Key: &ServiceKey{ServiceId: 1}},
+	})
+	assert.ErrorIs(t, err, ebpf.ErrKeyNotExist)
+	assert.ErrorContains(t, err, "op 5 on service map")
+
+	// the entries updated get their previous value back
+	var fv FrontendValue
+	assert.NoError(t, c.FrontendLookup(existing, &fv))
+	assert.Equal(t, uint32(1), fv.UpstreamId)
+	var ev EndpointValue
+	assert.NoError(t, c.EndpointLookup(endpoint, &ev))
+	assert.Equal(t, uint32(1), ev.BackendUid)
+	assert.True(t, c.GetEndpointKeys(1).Contains(*endpoint))
+	assert.Empty(t, c.GetEndpointKeys(200))
+	// the entries added are deleted
+	assert.ErrorIs(t, c.FrontendLookup(added, &fv), ebpf.ErrKeyNotExist)
+	var bv BackendValue
+	assert.ErrorIs(t, c.BackendLookup(bk, &bv), ebpf.ErrKeyNotExist)
+	// and the entries deleted are restored
+	assert.NoError(t, c.FrontendLookup(deleted, &fv))
+	assert.Equal(t, uint32(3), fv.UpstreamId)
+}
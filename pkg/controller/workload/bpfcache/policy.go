@@ -0,0 +1,47 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpfcache
+
+import (
+	"github.com/cilium/ebpf"
+)
+
+const (
+	AuthzActionAllow = 0
+	AuthzActionDeny  = 1
+)
+
+// AuthzPolicyValue is the datapath view of an authorization policy, keyed by policy id
+type AuthzPolicyValue struct {
+	Action   uint32 // AuthzActionAllow or AuthzActionDeny
+	MatchAll uint32 // 1 if the policy has a rule matching every connection
+}
+
+func (c *Cache) AuthzPolicyUpdate(id uint32, value *AuthzPolicyValue) error {
+	log.Debugf("AuthzPolicyUpdate [%d], [%#v]", id, *value)
+	return c.bpfMap.KmeshAuthzPolicy.Update(&id, value, ebpf.UpdateAny)
+}
+
+func (c *Cache) AuthzPolicyDelete(id uint32) error {
+	log.Debugf("AuthzPolicyDelete [%d]", id)
+	return c.bpfMap.KmeshAuthzPolicy.Delete(&id)
+}
+
+func (c *Cache) AuthzPolicyLookup(id uint32, value *AuthzPolicyValue) error {
+	log.Debugf("AuthzPolicyLookup [%d]", id)
+	return c.bpfMap.KmeshAuthzPolicy.Lookup(&id, value)
+}
@@ -38,19 +38,73 @@ type ServiceValue struct {
 	TargetPort    TargetPorts
 	WaypointAddr  [16]byte
 	WaypointPort  uint32
+	External      bool     // the service is outside of the cluster domain, e.g. an egress target
+	_             [3]uint8 // padding, keep the layout same as the packed c struct
 }
 
 func (c *Cache) ServiceUpdate(key *ServiceKey, value *ServiceValue) error {
 	log.Debugf("ServiceUpdate [%#v], [%#v]", *key, *value)
-	return c.bpfMap.KmeshService.Update(key, value, ebpf.UpdateAny)
+	c.waitWrite()
+	err := c.bpfMap.KmeshService.Update(key, value, ebpf.UpdateAny)
+	c.recordWrite(ServiceMap, BpfOpUpdate, key, value, err)
+	if err != nil {
+		return err
+	}
+	c.shadowUpdate(c.shadowMap.KmeshService, key, value)
+	return nil
 }
 
 func (c *Cache) ServiceDelete(key *ServiceKey) error {
 	log.Debugf("ServiceDelete [%#v]", *key)
-	return c.bpfMap.KmeshService.Delete(key)
+	c.waitWrite()
+	err := c.bpfMap.KmeshService.Delete(key)
+	c.recordWrite(ServiceMap, BpfOpDelete, key, nil, err)
+	if err != nil {
+		return err
+	}
+	c.shadowDelete(c.shadowMap.KmeshService, key)
+	return nil
 }
 
 func (c *Cache) ServiceLookup(key *ServiceKey, value *ServiceValue) error {
 	log.Debugf("ServiceLookup [%#v]", *key)
+	c.opCounter.countLookup(ServiceMap)
 	return c.bpfMap.KmeshService.Lookup(key, value)
 }
+
+// ReconcileEndpointCount called on restart after RestoreEndpointKeys, corrects the EndpointCount
+// of each service with the number of endpoints actually stored in the endpoint map,
+// endpoints could have been added or removed while the daemon was down
+func (c *Cache) ReconcileEndpointCount() {
+	var (
+		key    = ServiceKey{}
+		value  = ServiceValue{}
+		counts = make(map[uint32]uint32)
+		fixed  = make(map[ServiceKey]ServiceValue)
+	)
+
+	for _, eks := range c.endpointKeys {
+		for ek := range eks {
+			counts[ek.ServiceId]++
+		}
+	}
+
+	iter := c.bpfMap.KmeshService.Iterate()
+	for iter.Next(&key, &value) {
+		if count := counts[key.ServiceId]; value.EndpointCount != count {
+			log.Warnf("service %d endpoint count %d mismatch with endpoint map, correct it to %d", key.ServiceId, value.EndpointCount, count)
+			value.EndpointCount = count
+			fixed[key] = value
+		}
+	}
+	if err := iter.Err(); err != nil {
+		log.Errorf("iterate service map failed: %v", err)
+	}
+
+	// do not update the map while iterating it
+	for k, v := range fixed {
+		if err := c.ServiceUpdate(&k, &v); err != nil {
+			log.Errorf("update service %d endpoint count failed: %v", k.ServiceId, err)
+		}
+	}
+}
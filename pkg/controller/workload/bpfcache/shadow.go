@@ -0,0 +1,141 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpfcache
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/cilium/ebpf"
+
+	"kmesh.net/kmesh/bpf/kmesh/bpf2go"
+)
+
+// SetShadowMaps mirrors all the following frontend, service, endpoint and backend writes to the shadow maps,
+// so that a new map layout can be populated and verified with VerifyShadow during a migration window.
+// The writes to the shadow maps are best effort, they never fail the writes to the maps in use.
+// Pass the zero value to stop mirroring.
+func (c *Cache) SetShadowMaps(maps bpf2go.KmeshCgroupSockWorkloadMaps) {
+	c.shadowMap = maps
+}
+
+// LoadShadowMaps mirrors the writes to the frontend, service, endpoint and backend maps pinned in dir
+// under the names of the workload maps, e.g. by the loader of a new map layout. They are closed by CloseShadowMaps.
+func (c *Cache) LoadShadowMaps(dir string) error {
+	var (
+		maps bpf2go.KmeshCgroupSockWorkloadMaps
+		err  error
+	)
+
+	for name, m := range map[string]**ebpf.Map{
+		"kmesh_frontend": &maps.KmeshFrontend,
+		"kmesh_service":  &maps.KmeshService,
+		"kmesh_endpoint": &maps.KmeshEndpoint,
+		"kmesh_backend":  &maps.KmeshBackend,
+	} {
+		if *m, err = ebpf.LoadPinnedMap(filepath.Join(dir, name), nil); err != nil {
+			closeShadowMaps(&maps)
+			return fmt.Errorf("load shadow map %s failed, %s", name, err)
+		}
+	}
+	c.shadowMap = maps
+	return nil
+}
+
+// CloseShadowMaps stops mirroring the writes and closes the shadow maps
+func (c *Cache) CloseShadowMaps() {
+	closeShadowMaps(&c.shadowMap)
+	c.shadowMap = bpf2go.KmeshCgroupSockWorkloadMaps{}
+}
+
+func closeShadowMaps(maps *bpf2go.KmeshCgroupSockWorkloadMaps) {
+	for _, m := range []*ebpf.Map{maps.KmeshFrontend, maps.KmeshService, maps.KmeshEndpoint, maps.KmeshBackend} {
+		if m != nil {
+			m.Close()
+		}
+	}
+}
+
+func (c *Cache) shadowUpdate(m *ebpf.Map, key, value interface{}) {
+	if m == nil {
+		return
+	}
+	if err := m.Update(key, value, ebpf.UpdateAny); err != nil {
+		log.Errorf("shadow map %s update [%#v] failed: %v", m, key, err)
+	}
+}
+
+func (c *Cache) shadowDelete(m *ebpf.Map, key interface{}) {
+	if m == nil {
+		return
+	}
+	if err := m.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		log.Errorf("shadow map %s delete [%#v] failed: %v", m, key, err)
+	}
+}
+
+// VerifyShadow compares the workload bpf maps with their shadow maps, and returns an error
+// describing the first mismatching map
+func (c *Cache) VerifyShadow() error {
+	if c.shadowMap.KmeshFrontend == nil || c.shadowMap.KmeshService == nil ||
+		c.shadowMap.KmeshEndpoint == nil || c.shadowMap.KmeshBackend == nil {
+		return fmt.Errorf("shadow maps are not set")
+	}
+
+	dump, err := c.Dump()
+	if err != nil {
+		return err
+	}
+	shadow, err := NewCache(c.shadowMap).Dump()
+	if err != nil {
+		return fmt.Errorf("dump shadow maps failed, %s", err)
+	}
+
+	if err = compareEntries("frontend", dump.Frontends, shadow.Frontends); err != nil {
+		return err
+	}
+	if err = compareEntries("service", dump.Services, shadow.Services); err != nil {
+		return err
+	}
+	if err = compareEntries("endpoint", dump.Endpoints, shadow.Endpoints); err != nil {
+		return err
+	}
+	return compareEntries("backend", dump.Backends, shadow.Backends)
+}
+
+// compareEntries compares the entries of a map with its shadow regardless of their order
+func compareEntries[K, V comparable](name string, entries, shadowEntries []Entry[K, V]) error {
+	if len(entries) != len(shadowEntries) {
+		return fmt.Errorf("%s map has %d entries, its shadow has %d", name, len(entries), len(shadowEntries))
+	}
+
+	shadow := make(map[K]V, len(shadowEntries))
+	for _, e := range shadowEntries {
+		shadow[e.Key] = e.Value
+	}
+	for _, e := range entries {
+		value, ok := shadow[e.Key]
+		if !ok {
+			return fmt.Errorf("%s map key [%#v] is missing in its shadow", name, e.Key)
+		}
+		if value != e.Value {
+			return fmt.Errorf("%s map key [%#v] has value [%#v], its shadow has [%#v]", name, e.Key, e.Value, value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpfcache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// TxLog records the writes of a Cache to the workload bpf maps in the order they are issued, one line each:
+//
+//	<map> <op> key=<hex> [value=<hex>] err=<error>
+//
+// the keys and values are in the byte layout of the bpf maps. It is meant for debugging the ordering of
+// the writes, not for production use.
+type TxLog struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+// SetTxLog records the writes to the workload bpf maps in l, nil disables it. Like NewFakeWorkloadMap it is
+// only meant for tests, hence no daemon option enables it.
+func (c *Cache) SetTxLog(l *TxLog) {
+	c.txLog = l
+}
+
+// WriteObserver is called after each write to the workload bpf maps with the time it was started,
+// the keys of a batch are observed one by one with the start of the batch
+type WriteObserver func(m BpfMapType, op BpfOpType, start time.Time, err error)
+
+// SetWriteObserver calls o after each write to the workload bpf maps, nil disables it. Like the writes,
+// it must be called under the lock serializing them.
+func (c *Cache) SetWriteObserver(o WriteObserver) {
+	c.writeObserver = o
+}
+
+// recordWrite is called with every write to the workload bpf maps, after it is issued
+func (c *Cache) recordWrite(m BpfMapType, op BpfOpType, key, value any, err error) {
+	if c.txLog != nil {
+		c.txLog.record(m, op, key, value, err)
+	}
+	if c.writeObserver != nil {
+		c.writeObserver(m, op, c.writeStarted, err)
+	}
+	c.opCounter.countWrite(m, op)
+	if err == nil {
+		c.publishWrite(m, op, key, value)
+	}
+}
+
+func (l *TxLog) record(m BpfMapType, op BpfOpType, key, value any, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	fmt.Fprintf(&l.buf, "%s %s key=%x", m, op, encodeTx(key))
+	if op == BpfOpUpdate {
+		fmt.Fprintf(&l.buf, " value=%x", encodeTx(value))
+	}
+	fmt.Fprintf(&l.buf, " err=%v\n", err)
+}
+
+func encodeTx(v any) []byte {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, v); err != nil {
+		return []byte(fmt.Sprintf("%#v", v))
+	}
+	return buf.Bytes()
+}
+
+func (l *TxLog) String() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.buf.String()
+}
+
+// Reset drops the writes recorded so far
+func (l *TxLog) Reset() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.buf.Reset()
+}
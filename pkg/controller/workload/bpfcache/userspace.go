@@ -0,0 +1,258 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpfcache
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/cilium/ebpf"
+)
+
+// MapStore is the CRUD interface of the workload maps, implemented by Cache on the bpf maps
+// and by UserspaceWorkloadMap on their userspace copy
+type MapStore interface {
+	FrontendUpdate(key *FrontendKey, value *FrontendValue) error
+	FrontendDelete(key *FrontendKey) error
+	FrontendLookup(key *FrontendKey, value *FrontendValue) error
+	ServiceUpdate(key *ServiceKey, value *ServiceValue) error
+	ServiceDelete(key *ServiceKey) error
+	ServiceLookup(key *ServiceKey, value *ServiceValue) error
+	EndpointUpdate(key *EndpointKey, value *EndpointValue) error
+	EndpointDelete(key *EndpointKey) error
+	EndpointLookup(key *EndpointKey, value *EndpointValue) error
+	BackendUpdate(key *BackendKey, value *BackendValue) error
+	BackendDelete(key *BackendKey) error
+	BackendLookup(key *BackendKey, value *BackendValue) error
+}
+
+var (
+	_ MapStore = &Cache{}
+	_ MapStore = &UserspaceWorkloadMap{}
+)
+
+// subscriber is notified of the successful writes to the workload bpf maps
+type subscriber struct {
+	fn func(op BpfOp)
+}
+
+// Subscribe calls fn after each successful write to the workload bpf maps, with the key and value
+// pointing to the types of the map like BpfOp, Value is nil for BpfOpDelete. They are only valid
+// during the call. fn is called by the writer, it must not block. Call the returned func to unsubscribe.
+func (c *Cache) Subscribe(fn func(op BpfOp)) func() {
+	s := &subscriber{fn: fn}
+	c.subMutex.Lock()
+	defer c.subMutex.Unlock()
+	c.subscribers = append(c.subscribers, s)
+	return func() {
+		c.subMutex.Lock()
+		defer c.subMutex.Unlock()
+		for i := range c.subscribers {
+			if c.subscribers[i] == s {
+				c.subscribers = append(c.subscribers[:i:i], c.subscribers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (c *Cache) publishWrite(m BpfMapType, op BpfOpType, key, value any) {
+	c.subMutex.RLock()
+	defer c.subMutex.RUnlock()
+	for _, s := range c.subscribers {
+		s.fn(BpfOp{Map: m, Op: op, Key: key, Value: value})
+	}
+}
+
+// UserspaceWorkloadMap is a copy of the workload bpf maps in Go maps, kept in sync with the writes of the
+// Cache it is copied from. It lets the components without bpf capability inspect the routing state.
+// It is safe for concurrent use.
+type UserspaceWorkloadMap struct {
+	mutex       sync.RWMutex
+	frontends   map[FrontendKey]FrontendValue
+	services    map[ServiceKey]ServiceValue
+	endpoints   map[EndpointKey]EndpointValue
+	backends    map[BackendKey]BackendValue
+	unsubscribe func()
+}
+
+// CopyToUserspace copies the workload bpf maps to a UserspaceWorkloadMap, and keeps it in sync with the
+// following writes until it is closed. Like the writes, it must be called under the lock serializing them,
+// or the writes issued while copying may be missed.
+func (c *Cache) CopyToUserspace() (*UserspaceWorkloadMap, error) {
+	dump, err := c.Dump()
+	if err != nil {
+		return nil, fmt.Errorf("copy workload maps failed, %s", err)
+	}
+
+	u := &UserspaceWorkloadMap{
+		frontends: make(map[FrontendKey]FrontendValue, len(dump.Frontends)),
+		services:  make(map[ServiceKey]ServiceValue, len(dump.Services)),
+		endpoints: make(map[EndpointKey]EndpointValue, len(dump.Endpoints)),
+		backends:  make(map[BackendKey]BackendValue, len(dump.Backends)),
+	}
+	for _, e := range dump.Frontends {
+		u.frontends[e.Key] = e.Value
+	}
+	for _, e := range dump.Services {
+		u.services[e.Key] = e.Value
+	}
+	for _, e := range dump.Endpoints {
+		u.endpoints[e.Key] = e.Value
+	}
+	for _, e := range dump.Backends {
+		u.backends[e.Key] = e.Value
+	}
+	u.unsubscribe = c.Subscribe(u.apply)
+	return u, nil
+}
+
+// Close stops syncing the copy with the bpf maps, it keeps the entries copied so far
+func (u *UserspaceWorkloadMap) Close() {
+	if u.unsubscribe != nil {
+		u.unsubscribe()
+	}
+}
+
+// apply applies a write to the bpf maps to the copy
+func (u *UserspaceWorkloadMap) apply(op BpfOp) {
+	var err error
+	if op.Op == BpfOpDelete {
+		switch key := op.Key.(type) {
+		case *FrontendKey:
+			err = u.FrontendDelete(key)
+		case *ServiceKey:
+			err = u.ServiceDelete(key)
+		case *EndpointKey:
+			err = u.EndpointDelete(key)
+		case *BackendKey:
+			err = u.BackendDelete(key)
+		}
+	} else {
+		switch key := op.Key.(type) {
+		case *FrontendKey:
+			err = u.FrontendUpdate(key, op.Value.(*FrontendValue))
+		case *ServiceKey:
+			err = u.ServiceUpdate(key, op.Value.(*ServiceValue))
+		case *EndpointKey:
+			err = u.EndpointUpdate(key, op.Value.(*EndpointValue))
+		case *BackendKey:
+			err = u.BackendUpdate(key, op.Value.(*BackendValue))
+		}
+	}
+	if err != nil {
+		log.Debugf("apply %s on %s map to the userspace copy: %v", op.Op, op.Map, err)
+	}
+}
+
+func (u *UserspaceWorkloadMap) FrontendUpdate(key *FrontendKey, value *FrontendValue) error {
+	return userspaceUpdate(u, u.frontends, key, value)
+}
+
+func (u *UserspaceWorkloadMap) FrontendDelete(key *FrontendKey) error {
+	return userspaceDelete(u, u.frontends, key)
+}
+
+func (u *UserspaceWorkloadMap) FrontendLookup(key *FrontendKey, value *FrontendValue) error {
+	return userspaceLookup(u, u.frontends, key, value)
+}
+
+func (u *UserspaceWorkloadMap) ServiceUpdate(key *ServiceKey, value *ServiceValue) error {
+	return userspaceUpdate(u, u.services, key, value)
+}
+
+func (u *UserspaceWorkloadMap) ServiceDelete(key *ServiceKey) error {
+	return userspaceDelete(u, u.services, key)
+}
+
+func (u *UserspaceWorkloadMap) ServiceLookup(key *ServiceKey, value *ServiceValue) error {
+	return userspaceLookup(u, u.services, key, value)
+}
+
+func (u *UserspaceWorkloadMap) EndpointUpdate(key *EndpointKey, value *EndpointValue) error {
+	return userspaceUpdate(u, u.endpoints, key, value)
+}
+
+func (u *UserspaceWorkloadMap) EndpointDelete(key *EndpointKey) error {
+	return userspaceDelete(u, u.endpoints, key)
+}
+
+func (u *UserspaceWorkloadMap) EndpointLookup(key *EndpointKey, value *EndpointValue) error {
+	return userspaceLookup(u, u.endpoints, key, value)
+}
+
+func (u *UserspaceWorkloadMap) BackendUpdate(key *BackendKey, value *BackendValue) error {
+	return userspaceUpdate(u, u.backends, key, value)
+}
+
+func (u *UserspaceWorkloadMap) BackendDelete(key *BackendKey) error {
+	return userspaceDelete(u, u.backends, key)
+}
+
+func (u *UserspaceWorkloadMap) BackendLookup(key *BackendKey, value *BackendValue) error {
+	return userspaceLookup(u, u.backends, key, value)
+}
+
+// Dump reads all the entries of the copy, in no particular order like Cache.Dump
+func (u *UserspaceWorkloadMap) Dump() *MapDump {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	return &MapDump{
+		Frontends: userspaceEntries(u.frontends),
+		Services:  userspaceEntries(u.services),
+		Endpoints: userspaceEntries(u.endpoints),
+		Backends:  userspaceEntries(u.backends),
+	}
+}
+
+func userspaceUpdate[K comparable, V any](u *UserspaceWorkloadMap, m map[K]V, key *K, value *V) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	m[*key] = *value
+	return nil
+}
+
+// userspaceDelete fails with ebpf.ErrKeyNotExist for a missing key like a bpf map
+func userspaceDelete[K comparable, V any](u *UserspaceWorkloadMap, m map[K]V, key *K) error {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if _, ok := m[*key]; !ok {
+		return ebpf.ErrKeyNotExist
+	}
+	delete(m, *key)
+	return nil
+}
+
+// userspaceLookup fails with ebpf.ErrKeyNotExist for a missing key like a bpf map
+func userspaceLookup[K comparable, V any](u *UserspaceWorkloadMap, m map[K]V, key *K, value *V) error {
+	u.mutex.RLock()
+	defer u.mutex.RUnlock()
+	v, ok := m[*key]
+	if !ok {
+		return ebpf.ErrKeyNotExist
+	}
+	*value = v
+	return nil
+}
+
+func userspaceEntries[K comparable, V any](m map[K]V) []Entry[K, V] {
+	entries := make([]Entry[K, V], 0, len(m))
+	for k, v := range m {
+		entries = append(entries, Entry[K, V]{Key: k, Value: v})
+	}
+	return entries
+}
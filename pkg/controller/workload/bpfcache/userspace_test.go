@@ -0,0 +1,130 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpfcache
+
+import (
+	"net/netip"
+	"sync"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/stretchr/testify/assert"
+)
+
+func assertSameDump(t *testing.T, c *Cache, u *UserspaceWorkloadMap) {
+	dump, err := c.Dump()
+	assert.NoError(t, err)
+	copied := u.Dump()
+	assert.ElementsMatch(t, dump.Frontends, copied.Frontends)
+	assert.ElementsMatch(t, dump.Services, copied.Services)
+	assert.ElementsMatch(t, dump.Endpoints, copied.Endpoints)
+	assert.ElementsMatch(t, dump.Backends, copied.Backends)
+}
+
+func TestCopyToUserspace(t *testing.T) {
+	workloadMap := NewFakeWorkloadMap(t)
+	defer CleanupFakeWorkloadMap(workloadMap)
+
+	c := NewCache(workloadMap)
+	fk := &FrontendKey{Ip: netip.MustParseAddr("10.244.0.1").As16()}
+	assert.NoError(t, c.FrontendUpdate(fk, &FrontendValue{UpstreamId: 1}))
+
+	// the entries written before are copied
+	u, err := c.CopyToUserspace()
+	assert.NoError(t, err)
+	var fv FrontendValue
+	assert.NoError(t, u.FrontendLookup(fk, &fv))
+	assert.Equal(t, uint32(1), fv.UpstreamId)
+
+	// the single, multi and batch writes are mirrored
+	bk := &BackendKey{BackendUid: 1}
+	assert.NoError(t, c.BackendUpdate(bk, &BackendValue{Ip: fk.Ip}))
+	assert.NoError(t, c.MultiUpdate([]BpfOp{
+		{Map: ServiceMap, Op: BpfOpUpdate, Key: &ServiceKey{ServiceId: 2}, Value: &ServiceValue{EndpointCount: 1}},
+		{Map: EndpointMap, Op: BpfOpUpdate, Key: &EndpointKey{ServiceId: 2, BackendIndex: 1}, Value: &EndpointValue{BackendUid: 1}},
+	}))
+	assertSameDump(t, c, u)
+	assert.NoError(t, c.FrontendBatchDelete([]FrontendKey{*fk}))
+	assert.ErrorIs(t, u.FrontendLookup(fk, &fv), ebpf.ErrKeyNotExist)
+	assertSameDump(t, c, u)
+
+	// the failed writes are not
+	assert.Error(t, c.ServiceDelete(&ServiceKey{ServiceId: 3}))
+	assertSameDump(t, c, u)
+
+	// closed, the copy is left as is
+	u.Close()
+	assert.NoError(t, c.BackendDelete(bk))
+	var bv BackendValue
+	assert.NoError(t, u.BackendLookup(bk, &bv))
+}
+
+func TestCopyToUserspaceConcurrent(t *testing.T) {
+	workloadMap := NewFakeWorkloadMap(t)
+	defer CleanupFakeWorkloadMap(workloadMap)
+
+	c := NewCache(workloadMap)
+	u, err := c.CopyToUserspace()
+	assert.NoError(t, err)
+	defer u.Close()
+
+	// the writes of the cache are serialized by its user, the copy is read meanwhile
+	var writeMutex sync.Mutex
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for w := uint32(0); w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := uint32(0); i < 100; i++ {
+				id := w*1000 + i
+				fk := &FrontendKey{Ip: netip.AddrFrom4([4]byte{10, byte(w), byte(i >> 8), byte(i)}).As16()}
+				writeMutex.Lock()
+				assert.NoError(t, c.FrontendUpdate(fk, &FrontendValue{UpstreamId: id}))
+				assert.NoError(t, c.BackendUpdate(&BackendKey{BackendUid: id}, &BackendValue{Ip: fk.Ip}))
+				assert.NoError(t, c.ServiceUpdate(&ServiceKey{ServiceId: id}, &ServiceValue{EndpointCount: 1}))
+				assert.NoError(t, c.EndpointUpdate(&EndpointKey{ServiceId: id, BackendIndex: 1}, &EndpointValue{BackendUid: id}))
+				if i%3 == 0 {
+					assert.NoError(t, c.FrontendDelete(fk))
+					assert.NoError(t, c.EndpointDelete(&EndpointKey{ServiceId: id, BackendIndex: 1}))
+				}
+				writeMutex.Unlock()
+			}
+		}()
+	}
+	var readers sync.WaitGroup
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				var sv ServiceValue
+				_ = u.ServiceLookup(&ServiceKey{ServiceId: 1}, &sv)
+				_ = u.Dump()
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+	assertSameDump(t, c, u)
+	assert.Len(t, u.Dump().Frontends, 4*(100-34))
+}
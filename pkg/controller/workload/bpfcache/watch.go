@@ -0,0 +1,107 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpfcache
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+type BpfFsOp uint32
+
+const (
+	BpfFsCreate BpfFsOp = iota
+	BpfFsRemove
+	BpfFsRename
+)
+
+func (op BpfFsOp) String() string {
+	switch op {
+	case BpfFsCreate:
+		return "CREATE"
+	case BpfFsRemove:
+		return "REMOVE"
+	case BpfFsRename:
+		return "RENAME"
+	}
+	return "UNKNOWN"
+}
+
+// BpfFsEvent reports a change of the pinned map directory, the processor state
+// should be reconciled with the bpf maps when receiving it.
+type BpfFsEvent struct {
+	Path string
+	Op   BpfFsOp
+}
+
+// SetPinPath sets the directory the workload maps are pinned in, it is watched by Watch.
+func (c *Cache) SetPinPath(path string) {
+	c.pinPath = path
+}
+
+// Watch monitors the pinned map directory until ctx is done, and emits an event to events
+// for every pinned map created, removed or renamed outside of kmesh.
+func (c *Cache) Watch(ctx context.Context, events chan<- BpfFsEvent) error {
+	if c.pinPath == "" {
+		return fmt.Errorf("bpf map pin path is not set")
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("create bpf fs watcher failed, %s", err)
+	}
+	defer watcher.Close()
+
+	if err = watcher.Add(c.pinPath); err != nil {
+		return fmt.Errorf("watch %s failed, %s", c.pinPath, err)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			var op BpfFsOp
+			switch {
+			case event.Has(fsnotify.Create):
+				op = BpfFsCreate
+			case event.Has(fsnotify.Remove):
+				op = BpfFsRemove
+			case event.Has(fsnotify.Rename):
+				op = BpfFsRename
+			default:
+				continue
+			}
+			log.Warnf("pinned bpf map %s changed externally: %s", event.Name, op)
+			select {
+			case events <- BpfFsEvent{Path: event.Name, Op: op}:
+			case <-ctx.Done():
+				return nil
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Errorf("bpf fs watcher error: %v", err)
+		}
+	}
+}
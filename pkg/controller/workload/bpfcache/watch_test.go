@@ -0,0 +1,65 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package bpfcache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatch(t *testing.T) {
+	pinPath := t.TempDir()
+	pinned := filepath.Join(pinPath, "km_endpoint")
+	assert.NoError(t, os.WriteFile(pinned, nil, 0600))
+
+	c := NewCache(NewFakeWorkloadMap(t))
+	c.SetPinPath(pinPath)
+	defer CleanupFakeWorkloadMap(c.bpfMap)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan BpfFsEvent, 16)
+	done := make(chan error)
+	go func() {
+		done <- c.Watch(ctx, events)
+	}()
+
+	// the watcher is added asynchronously, recreate the pinned map until the removal is seen
+	assert.Eventually(t, func() bool {
+		_ = os.WriteFile(pinned, nil, 0600)
+		assert.NoError(t, os.Remove(pinned))
+		for {
+			select {
+			case event := <-events:
+				if event.Op == BpfFsRemove && event.Path == pinned {
+					return true
+				}
+			case <-time.After(50 * time.Millisecond):
+				return false
+			}
+		}
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	assert.NoError(t, <-done)
+
+	assert.Error(t, NewCache(c.bpfMap).Watch(context.Background(), events))
+}
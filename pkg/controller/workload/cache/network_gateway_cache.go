@@ -0,0 +1,60 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"sync"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+)
+
+// NetworkGatewayCache records the gateway through which the traffic to each remote network is tunneled
+type NetworkGatewayCache interface {
+	AddOrUpdateGateway(network string, gateway *workloadapi.GatewayAddress)
+	DeleteGateway(network string)
+	GetGateway(network string) *workloadapi.GatewayAddress
+}
+
+type networkGatewayCache struct {
+	mutex sync.RWMutex
+	// keyed by network name->gateway
+	gatewaysByNetwork map[string]*workloadapi.GatewayAddress
+}
+
+func NewNetworkGatewayCache() *networkGatewayCache {
+	return &networkGatewayCache{
+		gatewaysByNetwork: make(map[string]*workloadapi.GatewayAddress),
+	}
+}
+
+func (n *networkGatewayCache) AddOrUpdateGateway(network string, gateway *workloadapi.GatewayAddress) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.gatewaysByNetwork[network] = gateway
+}
+
+func (n *networkGatewayCache) DeleteGateway(network string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	delete(n.gatewaysByNetwork, network)
+}
+
+func (n *networkGatewayCache) GetGateway(network string) *workloadapi.GatewayAddress {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.gatewaysByNetwork[network]
+}
@@ -0,0 +1,60 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"sync"
+
+	"kmesh.net/kmesh/api/v2/workloadapi/security"
+)
+
+// PolicyCache records the authorization policies, workloads refer to them by resource name
+type PolicyCache interface {
+	AddOrUpdatePolicy(policy *security.Authorization)
+	DeletePolicy(resourceName string)
+	GetPolicy(resourceName string) *security.Authorization
+}
+
+type policyCache struct {
+	mutex sync.RWMutex
+	// keyed by namespace/name->policy
+	policiesByResourceName map[string]*security.Authorization
+}
+
+func NewPolicyCache() *policyCache {
+	return &policyCache{
+		policiesByResourceName: make(map[string]*security.Authorization),
+	}
+}
+
+func (p *policyCache) AddOrUpdatePolicy(policy *security.Authorization) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.policiesByResourceName[policy.ResourceName()] = policy
+}
+
+func (p *policyCache) DeletePolicy(resourceName string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.policiesByResourceName, resourceName)
+}
+
+func (p *policyCache) GetPolicy(resourceName string) *security.Authorization {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.policiesByResourceName[resourceName]
+}
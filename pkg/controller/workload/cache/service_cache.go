@@ -25,7 +25,7 @@ import (
 type ServiceCache interface {
 	List() []*workloadapi.Service
 	AddOrUpdateService(svc *workloadapi.Service)
-	DeleteService(resourceName string)
+	DeleteService(resourceName string) *workloadapi.Service
 	GetService(resourceName string) *workloadapi.Service
 }
 
@@ -47,10 +47,13 @@ func (s *serviceCache) AddOrUpdateService(svc *workloadapi.Service) {
 	s.servicesByResourceName[svc.ResourceName()] = svc
 }
 
-func (s *serviceCache) DeleteService(resourceName string) {
+// DeleteService deletes the service and returns it, nil if there is none
+func (s *serviceCache) DeleteService(resourceName string) *workloadapi.Service {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	svc := s.servicesByResourceName[resourceName]
 	delete(s.servicesByResourceName, resourceName)
+	return svc
 }
 
 func (s *serviceCache) List() []*workloadapi.Service {
@@ -18,6 +18,8 @@ package cache
 
 import (
 	"net/netip"
+	"slices"
+	"strings"
 	"sync"
 
 	"google.golang.org/protobuf/proto"
@@ -26,12 +28,26 @@ import (
 	"kmesh.net/kmesh/api/v2/workloadapi"
 )
 
+// WorkloadCache indexes the workloads by uid and by address, it is safe for concurrent use.
+// Each method is atomic, a lookup followed by an update is not.
 type WorkloadCache interface {
 	GetWorkloadByUid(uid string) *workloadapi.Workload
 	GetWorkloadByAddr(networkAddress NetworkAddress) *workloadapi.Workload
 	AddOrUpdateWorkload(workload *workloadapi.Workload) (deletedServices []string, newServices []string)
-	DeleteWorkload(uid string)
+	GetOrCreate(uid string, factory func() *workloadapi.Workload) (*workloadapi.Workload, bool)
+	DeleteWorkload(uid string) *workloadapi.Workload
 	List() []*workloadapi.Workload
+	Diff(other WorkloadCache) WorkloadCacheDiff
+}
+
+// WorkloadCacheDiff is the delta from one workload cache snapshot to another, sorted by uid
+type WorkloadCacheDiff struct {
+	// Added are the workloads in the other cache only
+	Added []*workloadapi.Workload
+	// Updated are the workloads in both caches with different contents, taken from the other cache
+	Updated []*workloadapi.Workload
+	// Deleted are the workloads in this cache only
+	Deleted []*workloadapi.Workload
 }
 
 type NetworkAddress struct {
@@ -42,13 +58,21 @@ type NetworkAddress struct {
 type cache struct {
 	byUid  map[string]*workloadapi.Workload
 	byAddr map[NetworkAddress]*workloadapi.Workload
-	mutex  sync.RWMutex
+	// generations is the generation an address was last claimed at by a workload, and claims the
+	// generations of the addresses claimed by each workload. An address claimed by a workload and then
+	// by another one, like the IP of a deleted pod reused by a new pod, is told apart by the generation.
+	generations map[NetworkAddress]uint64
+	claims      map[string]map[NetworkAddress]uint64
+	generation  uint64
+	mutex       sync.RWMutex
 }
 
 func NewWorkloadCache() *cache {
 	return &cache{
-		byUid:  make(map[string]*workloadapi.Workload),
-		byAddr: make(map[NetworkAddress]*workloadapi.Workload),
+		byUid:       make(map[string]*workloadapi.Workload),
+		byAddr:      make(map[NetworkAddress]*workloadapi.Workload),
+		generations: make(map[NetworkAddress]uint64),
+		claims:      make(map[string]map[NetworkAddress]uint64),
 	}
 }
 
@@ -61,13 +85,17 @@ func (w *cache) GetWorkloadByUid(uid string) *workloadapi.Workload {
 func (w *cache) GetWorkloadByAddr(networkAddress NetworkAddress) *workloadapi.Workload {
 	w.mutex.RLock()
 	defer w.mutex.RUnlock()
+	// addresses are indexed in the unmapped form, see composeNetworkAddress
+	networkAddress.Address = networkAddress.Address.Unmap()
 	return w.byAddr[networkAddress]
 }
 
+// composeNetworkAddress normalizes IPv4-mapped IPv6 addresses to IPv4, so that
+// ::ffff:1.2.3.4 and 1.2.3.4 refer to the same workload, as in the bpf maps
 func composeNetworkAddress(network string, addr netip.Addr) NetworkAddress {
 	return NetworkAddress{
 		Network: network,
-		Address: addr,
+		Address: addr.Unmap(),
 	}
 }
 
@@ -113,38 +141,96 @@ func (w *cache) AddOrUpdateWorkload(workload *workloadapi.Workload) ([]string, [
 	}
 
 	w.byUid[workload.Uid] = workload
+	w.indexAddresses(workload)
+	return deletedServices, newServices
+}
+
+// GetOrCreate returns the workload of uid, if there is none, the workload returned by factory is
+// stored and returned. The check and the insert are done under the same lock, so concurrent callers
+// get the same workload and only one of them is told it is created.
+func (w *cache) GetOrCreate(uid string, factory func() *workloadapi.Workload) (*workloadapi.Workload, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if workload, exist := w.byUid[uid]; exist {
+		return workload, false
+	}
+	workload := factory()
+	if workload == nil {
+		return nil, false
+	}
 
+	w.byUid[uid] = workload
+	w.indexAddresses(workload)
+	return workload, true
+}
+
+func (w *cache) indexAddresses(workload *workloadapi.Workload) {
 	// We should exclude the workloads that use host network mode
 	// Since they are using the host ip, we can not use address to identify them
 	if workload.NetworkMode != workloadapi.NetworkMode_HOST_NETWORK {
+		oldClaims := w.claims[workload.Uid]
+		claims := make(map[NetworkAddress]uint64, len(workload.Addresses))
 		for _, ip := range workload.Addresses {
 			addr, _ := netip.AddrFromSlice(ip)
 			networkAddress := composeNetworkAddress(workload.Network, addr)
 			w.byAddr[networkAddress] = workload
+			// an update of the workload keeps the generation of the addresses it still holds
+			if gen, ok := oldClaims[networkAddress]; ok && gen == w.generations[networkAddress] {
+				claims[networkAddress] = gen
+				continue
+			}
+			w.generation++
+			w.generations[networkAddress] = w.generation
+			claims[networkAddress] = w.generation
+		}
+		// the addresses the workload no longer holds
+		for networkAddress := range oldClaims {
+			if _, ok := claims[networkAddress]; !ok {
+				w.unindexAddress(workload.Uid, networkAddress)
+			}
 		}
+		w.claims[workload.Uid] = claims
 	}
-	return deletedServices, newServices
 }
 
-func (w *cache) DeleteWorkload(uid string) {
+// unindexAddress deletes the address claimed by the workload of uid from the index, unless another workload claimed it since
+func (w *cache) unindexAddress(uid string, networkAddress NetworkAddress) {
+	if w.reassigned(uid, networkAddress) {
+		return
+	}
+	delete(w.byAddr, networkAddress)
+	delete(w.generations, networkAddress)
+}
+
+// DeleteWorkload deletes the workload of uid and returns it, nil if there is none. The addresses claimed
+// by another workload since are kept indexed to that workload, they are found by GetWorkloadByAddr once
+// the workload is deleted.
+func (w *cache) DeleteWorkload(uid string) *workloadapi.Workload {
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
 
 	workload, exist := w.byUid[uid]
-	if exist {
-		for _, ip := range workload.Addresses {
-			addr, _ := netip.AddrFromSlice(ip)
-			networkAddress := composeNetworkAddress(workload.Network, addr)
-			delete(w.byAddr, networkAddress)
-		}
-
-		delete(w.byUid, uid)
+	if !exist {
+		return nil
 	}
+	for networkAddress := range w.claims[uid] {
+		w.unindexAddress(uid, networkAddress)
+	}
+	delete(w.byUid, uid)
+	delete(w.claims, uid)
+	return workload
+}
+
+// reassigned tells whether the address was claimed by another workload after the workload of uid claimed it
+func (w *cache) reassigned(uid string, networkAddress NetworkAddress) bool {
+	gen, ok := w.claims[uid][networkAddress]
+	return ok && gen != w.generations[networkAddress]
 }
 
 func (w *cache) List() []*workloadapi.Workload {
-	w.mutex.Lock()
-	defer w.mutex.Unlock()
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
 	out := make([]*workloadapi.Workload, 0, len(w.byUid))
 	for _, workload := range w.byUid {
 		out = append(out, workload)
@@ -152,3 +238,37 @@ func (w *cache) List() []*workloadapi.Workload {
 
 	return out
 }
+
+// Diff computes the workloads added, updated and deleted from this cache to the other
+func (w *cache) Diff(other WorkloadCache) WorkloadCacheDiff {
+	var diff WorkloadCacheDiff
+
+	// list the other cache before locking, it can be this cache
+	otherWorkloads := other.List()
+	seen := sets.New[string]()
+
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+	for _, workload := range otherWorkloads {
+		seen.Insert(workload.GetUid())
+		old, exist := w.byUid[workload.GetUid()]
+		if !exist {
+			diff.Added = append(diff.Added, workload)
+		} else if !proto.Equal(old, workload) {
+			diff.Updated = append(diff.Updated, workload)
+		}
+	}
+	for uid, workload := range w.byUid {
+		if !seen.Contains(uid) {
+			diff.Deleted = append(diff.Deleted, workload)
+		}
+	}
+
+	byUid := func(a, b *workloadapi.Workload) int {
+		return strings.Compare(a.GetUid(), b.GetUid())
+	}
+	slices.SortFunc(diff.Added, byUid)
+	slices.SortFunc(diff.Updated, byUid)
+	slices.SortFunc(diff.Deleted, byUid)
+	return diff
+}
@@ -17,7 +17,11 @@
 package cache
 
 import (
+	"fmt"
+	"math/rand/v2"
 	"net/netip"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -156,3 +160,204 @@ func TestDeleteWorkload(t *testing.T) {
 		assert.Equal(t, (*workloadapi.Workload)(nil), w.byAddr[NetworkAddress{Network: "ut-net", Address: addr2}])
 	})
 }
+
+func TestDeleteReassignedWorkload(t *testing.T) {
+	w := NewWorkloadCache()
+	addr := netip.MustParseAddr("10.244.0.1")
+	networkAddress := NetworkAddress{Address: addr}
+	oldPod := &workloadapi.Workload{Uid: "old", Addresses: [][]byte{addr.AsSlice()}}
+	newPod := &workloadapi.Workload{Uid: "new", Addresses: [][]byte{addr.AsSlice()}}
+
+	w.AddOrUpdateWorkload(oldPod)
+	assert.False(t, w.reassigned("old", networkAddress))
+
+	// the new pod gets the ip before the old pod is deleted
+	w.AddOrUpdateWorkload(newPod)
+	assert.True(t, w.reassigned("old", networkAddress))
+	assert.False(t, w.reassigned("new", networkAddress))
+
+	// an update of the new pod keeps its claim
+	w.AddOrUpdateWorkload(&workloadapi.Workload{Uid: "new", Name: "new", Addresses: [][]byte{addr.AsSlice()}})
+	assert.False(t, w.reassigned("new", networkAddress))
+
+	assert.Same(t, oldPod, w.DeleteWorkload("old"))
+	assert.Equal(t, "new", w.GetWorkloadByAddr(networkAddress).GetUid())
+
+	assert.Equal(t, "new", w.DeleteWorkload("new").GetUid())
+	assert.Nil(t, w.DeleteWorkload("new"))
+	assert.Nil(t, w.GetWorkloadByAddr(networkAddress))
+	assert.Empty(t, w.generations)
+	assert.Empty(t, w.claims)
+}
+
+func TestGetOrCreate(t *testing.T) {
+	w := NewWorkloadCache()
+	addr := netip.MustParseAddr("10.244.0.1")
+
+	const goroutines = 32
+	var (
+		wg        sync.WaitGroup
+		factories atomic.Int32
+		created   atomic.Int32
+		results   = make([]*workloadapi.Workload, goroutines)
+	)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			workload, ok := w.GetOrCreate("123456", func() *workloadapi.Workload {
+				factories.Add(1)
+				return &workloadapi.Workload{
+					Name:      fmt.Sprintf("ut-workload-%d", i),
+					Uid:       "123456",
+					Network:   "ut-net",
+					Addresses: [][]byte{addr.AsSlice()},
+				}
+			})
+			if ok {
+				created.Add(1)
+			}
+			results[i] = workload
+		}(i)
+	}
+	wg.Wait()
+
+	// exactly one workload is created and every caller gets it
+	assert.Equal(t, int32(1), factories.Load())
+	assert.Equal(t, int32(1), created.Load())
+	workload := w.GetWorkloadByUid("123456")
+	assert.NotNil(t, workload)
+	for _, result := range results {
+		assert.Same(t, workload, result)
+	}
+	assert.Same(t, workload, w.GetWorkloadByAddr(NetworkAddress{Network: "ut-net", Address: addr}))
+
+	// a nil workload from factory is not stored
+	workload, ok := w.GetOrCreate("654321", func() *workloadapi.Workload { return nil })
+	assert.Nil(t, workload)
+	assert.False(t, ok)
+	assert.Nil(t, w.GetWorkloadByUid("654321"))
+}
+
+func TestDiff(t *testing.T) {
+	newWorkload := func(uid, ip string) *workloadapi.Workload {
+		return &workloadapi.Workload{
+			Name:      uid,
+			Uid:       uid,
+			Network:   "ut-net",
+			Addresses: [][]byte{netip.MustParseAddr(ip).AsSlice()},
+		}
+	}
+
+	unchanged := newWorkload("unchanged", "10.0.0.1")
+	updatedOld := newWorkload("updated", "10.0.0.2")
+	updatedNew := newWorkload("updated", "10.0.0.22")
+	deleted := newWorkload("deleted", "10.0.0.3")
+	added1 := newWorkload("added1", "10.0.0.4")
+	added2 := newWorkload("added2", "10.0.0.5")
+
+	self := NewWorkloadCache()
+	for _, wl := range []*workloadapi.Workload{unchanged, updatedOld, deleted} {
+		self.AddOrUpdateWorkload(wl)
+	}
+	other := NewWorkloadCache()
+	// an identical copy is not an update
+	other.AddOrUpdateWorkload(newWorkload("unchanged", "10.0.0.1"))
+	for _, wl := range []*workloadapi.Workload{updatedNew, added2, added1} {
+		other.AddOrUpdateWorkload(wl)
+	}
+
+	t.Run("added", func(t *testing.T) {
+		assert.Equal(t, []*workloadapi.Workload{added1, added2}, self.Diff(other).Added)
+	})
+
+	t.Run("updated", func(t *testing.T) {
+		assert.Equal(t, []*workloadapi.Workload{updatedNew}, self.Diff(other).Updated)
+	})
+
+	t.Run("deleted", func(t *testing.T) {
+		assert.Equal(t, []*workloadapi.Workload{deleted}, self.Diff(other).Deleted)
+	})
+
+	t.Run("reversed", func(t *testing.T) {
+		diff := other.Diff(self)
+		assert.Equal(t, []*workloadapi.Workload{deleted}, diff.Added)
+		assert.Equal(t, []*workloadapi.Workload{updatedOld}, diff.Updated)
+		assert.Equal(t, []*workloadapi.Workload{added1, added2}, diff.Deleted)
+	})
+
+	t.Run("same cache", func(t *testing.T) {
+		assert.Equal(t, WorkloadCacheDiff{}, self.Diff(self))
+	})
+}
+
+func TestWorkloadCacheConcurrency(t *testing.T) {
+	const (
+		goroutines = 50
+		operations = 1000
+		uids       = 20
+		addrs      = 10
+	)
+	w := NewWorkloadCache()
+	newWorkload := func(r *rand.Rand) *workloadapi.Workload {
+		addr := netip.AddrFrom4([4]byte{10, 0, 0, byte(r.IntN(addrs))})
+		return &workloadapi.Workload{
+			Uid:       fmt.Sprintf("uid-%d", r.IntN(uids)),
+			Name:      fmt.Sprintf("name-%d", r.IntN(2)),
+			Network:   "ut-net",
+			Addresses: [][]byte{addr.AsSlice()},
+			Services:  map[string]*workloadapi.PortList{fmt.Sprintf("svc-%d", r.IntN(3)): {}},
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(seed uint64) {
+			defer wg.Done()
+			r := rand.New(rand.NewPCG(seed, seed))
+			for j := 0; j < operations; j++ {
+				workload := newWorkload(r)
+				switch r.IntN(7) {
+				case 0:
+					w.AddOrUpdateWorkload(workload)
+				case 1:
+					w.GetOrCreate(workload.Uid, func() *workloadapi.Workload { return workload })
+				case 2:
+					if deleted := w.DeleteWorkload(workload.Uid); deleted != nil {
+						assert.Equal(t, workload.Uid, deleted.Uid)
+					}
+				case 3:
+					if cached := w.GetWorkloadByUid(workload.Uid); cached != nil {
+						assert.Equal(t, workload.Uid, cached.Uid)
+					}
+				case 4:
+					addr, _ := netip.AddrFromSlice(workload.Addresses[0])
+					if cached := w.GetWorkloadByAddr(NetworkAddress{Network: "ut-net", Address: addr}); cached != nil {
+						assert.Contains(t, cached.Addresses, workload.Addresses[0])
+					}
+				case 5:
+					assert.LessOrEqual(t, len(w.List()), uids)
+				case 6:
+					w.Diff(NewWorkloadCache())
+				}
+			}
+		}(uint64(i))
+	}
+	wg.Wait()
+
+	// every indexed address is claimed by the cached workload it is indexed to
+	assert.Equal(t, len(w.byAddr), len(w.generations))
+	for networkAddress, workload := range w.byAddr {
+		assert.Same(t, w.byUid[workload.Uid], workload)
+		assert.Equal(t, w.generations[networkAddress], w.claims[workload.Uid][networkAddress])
+	}
+
+	for i := 0; i < uids; i++ {
+		w.DeleteWorkload(fmt.Sprintf("uid-%d", i))
+	}
+	assert.Empty(t, w.byUid)
+	assert.Empty(t, w.byAddr)
+	assert.Empty(t, w.generations)
+	assert.Empty(t, w.claims)
+}
@@ -0,0 +1,221 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/controller/telemetry"
+)
+
+const (
+	MinCoalescingWindow = time.Millisecond
+	MaxCoalescingWindow = 10 * time.Millisecond
+	// the coalescing window is this multiple of the average time programming a resource takes
+	coalescingLatencyFactor = 100
+)
+
+// CoalescingQueue accumulates the updates of services and workloads keyed by resource name, an update
+// replaces the pending update of the same resource, so that a resource updated several times within the
+// window is written once with its latest value. The queue is flushed by onTimer once the window expires.
+// The window adapts to the latency of the bpf writes: the slower they are, the longer the updates are held.
+type CoalescingQueue struct {
+	mutex   sync.Mutex
+	maxSize int
+	onTimer func()
+	timer   *time.Timer
+
+	// pending holds the latest update of each resource, names keeps the resources in arrival order
+	pending map[string]proto.Message
+	names   []string
+
+	// latency is the moving average of the time programming a resource takes
+	latency time.Duration
+
+	// updates queued and written since created
+	updates uint64
+	writes  uint64
+}
+
+func NewCoalescingQueue(maxSize int, onTimer func()) *CoalescingQueue {
+	return &CoalescingQueue{
+		maxSize: maxSize,
+		onTimer: onTimer,
+		pending: make(map[string]proto.Message),
+	}
+}
+
+// Add queues the update of the resource, and tells whether the queue holds maxSize resources and must be flushed
+func (q *CoalescingQueue) Add(name string, resource proto.Message) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if _, ok := q.pending[name]; !ok {
+		q.names = append(q.names, name)
+	}
+	q.pending[name] = resource
+	q.updates++
+	telemetry.CoalescingQueueUpdates.Inc()
+
+	if q.timer == nil {
+		q.timer = time.AfterFunc(q.windowLocked(), q.onTimer)
+	}
+	return len(q.pending) >= q.maxSize
+}
+
+// Take removes the pending updates from the queue, and returns them in arrival order
+func (q *CoalescingQueue) Take() (services []*workloadapi.Service, workloads []*workloadapi.Workload) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.stopLocked()
+	for _, name := range q.names {
+		switch resource := q.pending[name].(type) {
+		case *workloadapi.Service:
+			services = append(services, resource)
+		case *workloadapi.Workload:
+			workloads = append(workloads, resource)
+		}
+	}
+	if len(q.names) > 0 {
+		q.writes += uint64(len(q.names))
+		telemetry.CoalescingQueueWrites.Add(float64(len(q.names)))
+		telemetry.CoalescingRatio.Set(float64(q.updates) / float64(q.writes))
+	}
+	q.pending = make(map[string]proto.Message)
+	q.names = nil
+	return services, workloads
+}
+
+// Remove drops the pending updates of the removed resources
+func (q *CoalescingQueue) Remove(names []string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	removed := false
+	for _, name := range names {
+		if _, ok := q.pending[name]; ok {
+			delete(q.pending, name)
+			removed = true
+		}
+	}
+	if !removed {
+		return
+	}
+	kept := q.names[:0]
+	for _, name := range q.names {
+		if _, ok := q.pending[name]; ok {
+			kept = append(kept, name)
+		}
+	}
+	q.names = kept
+}
+
+// Len returns the number of resources pending
+func (q *CoalescingQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return len(q.pending)
+}
+
+// ObserveLatency accounts the time programming a resource took in the coalescing window
+func (q *CoalescingQueue) ObserveLatency(d time.Duration) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.latency == 0 {
+		q.latency = d
+		return
+	}
+	q.latency += (d - q.latency) / 5
+}
+
+// Window returns how long the updates are held before written
+func (q *CoalescingQueue) Window() time.Duration {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.windowLocked()
+}
+
+func (q *CoalescingQueue) windowLocked() time.Duration {
+	return min(max(q.latency*coalescingLatencyFactor, MinCoalescingWindow), MaxCoalescingWindow)
+}
+
+// Stop stops the timer, the pending updates are kept
+func (q *CoalescingQueue) Stop() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.stopLocked()
+}
+
+func (q *CoalescingQueue) stopLocked() {
+	if q.timer != nil {
+		q.timer.Stop()
+		q.timer = nil
+	}
+}
+
+// SetCoalescing holds the updates of services and workloads for a short window, see CoalescingQueue, and
+// writes the latest update of each resource once, when the window expires or maxSize resources are pending.
+// The failures of the updates written while handling a response nack it. The failures of the updates written
+// once the window expired, after their response was acked, nack the next response.
+// maxSize <= 0 disables it, the pending updates are written then.
+func (p *Processor) SetCoalescing(maxSize int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.coalescer != nil {
+		p.coalescedErrs = append(p.coalescedErrs, p.flushCoalesced(context.Background())...)
+		p.coalescer = nil
+	}
+	if maxSize > 0 {
+		p.coalescer = NewCoalescingQueue(maxSize, func() {
+			p.mutex.Lock()
+			defer p.mutex.Unlock()
+
+			if !p.closed && p.coalescer != nil {
+				p.coalescedErrs = append(p.coalescedErrs, p.flushCoalesced(context.Background())...)
+			}
+		})
+	}
+}
+
+// flushCoalesced writes the pending updates and returns the errors of the failed ones, the caller must hold p.mutex
+func (p *Processor) flushCoalesced(ctx context.Context) []error {
+	services, workloads := p.coalescer.Take()
+	if len(services)+len(workloads) == 0 {
+		return nil
+	}
+
+	ctx, span := p.startSpan(ctx, spanFlushCoalesced, len(services)+len(workloads))
+	start := time.Now()
+	errs := p.handleAddresses(ctx, services, workloads)
+	endSpan(span, len(errs))
+	p.coalescer.ObserveLatency(time.Since(start) / time.Duration(len(services)+len(workloads)))
+	for _, err := range errs {
+		log.Errorf("write coalesced update failed: %v", err)
+	}
+	return errs
+}
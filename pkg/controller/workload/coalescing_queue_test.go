@@ -0,0 +1,196 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	service_discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"istio.io/istio/pilot/pkg/util/protoconv"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/controller/telemetry"
+	"kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+)
+
+func TestCoalescingQueue(t *testing.T) {
+	q := NewCoalescingQueue(3, func() {})
+	defer q.Stop()
+
+	wl1 := createWorkload("wl1", "10.244.0.1", workloadapi.NetworkMode_STANDARD)
+	wl1v2 := proto.Clone(wl1).(*workloadapi.Workload)
+	wl1v2.Name = "wl1v2"
+	wl2 := createWorkload("wl2", "10.244.0.2", workloadapi.NetworkMode_STANDARD)
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+
+	// the latest update of a resource replaces the pending one
+	assert.False(t, q.Add(wl1.ResourceName(), wl1))
+	assert.False(t, q.Add(wl2.ResourceName(), wl2))
+	assert.False(t, q.Add(wl1.ResourceName(), wl1v2))
+	assert.Equal(t, 2, q.Len())
+	assert.True(t, q.Add(svc.ResourceName(), svc))
+
+	q.Remove([]string{wl2.ResourceName(), "default/unknown.default.svc.cluster.local"})
+	services, workloads := q.Take()
+	assert.Equal(t, []*workloadapi.Service{svc}, services)
+	assert.Equal(t, []*workloadapi.Workload{wl1v2}, workloads)
+	assert.Equal(t, 0, q.Len())
+
+	// the window follows the write latency within its bounds
+	assert.Equal(t, MinCoalescingWindow, q.Window())
+	q.ObserveLatency(50 * time.Microsecond)
+	assert.Equal(t, 5*time.Millisecond, q.Window())
+	for i := 0; i < 20; i++ {
+		q.ObserveLatency(time.Millisecond)
+	}
+	assert.Equal(t, MaxCoalescingWindow, q.Window())
+}
+
+func TestCoalescingSingleWrite(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+	counter := bpfcache.NewOpCounter()
+	p.bpf.SetOpCounter(counter)
+	p.SetCoalescing(100)
+
+	// the caller holds p.mutex as processWorkloadResponse does, which also holds back the timer flush
+	push := func(wl *workloadapi.Workload) {
+		assert.NoError(t, p.handleAddressTypeResponse(&service_discovery_v3.DeltaDiscoveryResponse{
+			TypeUrl: AddressType,
+			Resources: []*service_discovery_v3.Resource{
+				{Resource: protoconv.MessageToAny(workloadToAddress(wl))},
+			},
+		}))
+	}
+	// the first response is written at once, the restart cleanup needs its addresses
+	p.mutex.Lock()
+	push(createWorkload("wl0", "10.244.0.100", workloadapi.NetworkMode_STANDARD))
+	counter.Reset()
+
+	updates := testutil.ToFloat64(telemetry.CoalescingQueueUpdates)
+	writes := testutil.ToFloat64(telemetry.CoalescingQueueWrites)
+	wl := createWorkload("wl1", "10.244.0.1", workloadapi.NetworkMode_STANDARD)
+	for i := 0; i < 5; i++ {
+		wl = proto.Clone(wl).(*workloadapi.Workload)
+		wl.Waypoint = &workloadapi.GatewayAddress{
+			Destination: &workloadapi.GatewayAddress_Address{
+				Address: &workloadapi.NetworkAddress{
+					Address: netip.MustParseAddr("10.10.10.10").AsSlice(),
+				},
+			},
+			HboneMtlsPort: uint32(15008 + i),
+		}
+		push(wl)
+	}
+	assert.Equal(t, 0, counter.Updates(bpfcache.BackendMap))
+	p.mutex.Unlock()
+
+	assert.Eventually(t, func() bool {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		return counter.Updates(bpfcache.BackendMap) > 0
+	}, time.Second, time.Millisecond)
+	// only the latest update is written
+	assert.Equal(t, 1, counter.Updates(bpfcache.BackendMap))
+	assert.Equal(t, 1, counter.Updates(bpfcache.FrontendMap))
+	checkBackendMap(t, p, p.hashName.Hash(wl.ResourceName()), wl)
+	assert.Equal(t, updates+5, testutil.ToFloat64(telemetry.CoalescingQueueUpdates))
+	assert.Equal(t, writes+1, testutil.ToFloat64(telemetry.CoalescingQueueWrites))
+
+	// a full queue is written at once
+	p.SetCoalescing(1)
+	counter.Reset()
+	p.mutex.Lock()
+	push(createWorkload("wl2", "10.244.0.2", workloadapi.NetworkMode_STANDARD))
+	p.mutex.Unlock()
+	assert.Equal(t, 1, counter.Updates(bpfcache.BackendMap))
+}
+
+func TestCoalescingErrors(t *testing.T) {
+	// the frontend map holds the address of wl0 and 3 of the 4 addresses of bad
+	workloadMap := bpfcache.NewFakeWorkloadMapWithSize(t, 4)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+	p.SetCoalescing(100)
+
+	bad := createWorkload("bad", "10.244.0.2", workloadapi.NetworkMode_STANDARD)
+	for _, ip := range []string{"10.244.0.3", "10.244.0.4", "10.244.0.5"} {
+		bad.Addresses = append(bad.Addresses, netip.MustParseAddr(ip).AsSlice())
+	}
+	push := func(wls ...*workloadapi.Workload) error {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+
+		res := &service_discovery_v3.DeltaDiscoveryResponse{TypeUrl: AddressType}
+		for _, wl := range wls {
+			res.Resources = append(res.Resources, &service_discovery_v3.Resource{
+				Resource: protoconv.MessageToAny(workloadToAddress(wl)),
+			})
+		}
+		return p.handleAddressTypeResponse(res)
+	}
+	assert.NoError(t, push(createWorkload("wl0", "10.244.0.1", workloadapi.NetworkMode_STANDARD)))
+
+	// bad fails once the window expires, after its response was acked, the next response is nacked
+	assert.NoError(t, push(bad))
+	assert.Eventually(t, func() bool {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		return p.coalescer.Len() == 0
+	}, time.Second, time.Millisecond)
+	assert.ErrorContains(t, push(), bad.ResourceName())
+	assert.NoError(t, push())
+}
+
+func TestCoalescingFlushOnClose(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+	p.SetCoalescing(100)
+
+	wl0 := createWorkload("wl0", "10.244.0.1", workloadapi.NetworkMode_STANDARD)
+	wl1 := createWorkload("wl1", "10.244.0.2", workloadapi.NetworkMode_STANDARD)
+	p.mutex.Lock()
+	for _, wl := range []*workloadapi.Workload{wl0, wl1} {
+		assert.NoError(t, p.handleAddressTypeResponse(&service_discovery_v3.DeltaDiscoveryResponse{
+			TypeUrl: AddressType,
+			Resources: []*service_discovery_v3.Resource{
+				{Resource: protoconv.MessageToAny(workloadToAddress(wl))},
+			},
+		}))
+	}
+	// the window never expires, wl1 is only written by Close
+	p.coalescer.Stop()
+	p.mutex.Unlock()
+	assert.Equal(t, 1, p.coalescer.Len())
+
+	assert.NoError(t, p.Close())
+	assert.Equal(t, 0, p.coalescer.Len())
+	checkBackendMap(t, p, p.hashName.Hash(wl1.ResourceName()), wl1)
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+const DefaultEventLogSize = 10000
+
+type EventOp string
+
+const (
+	EventOpWorkload EventOp = "workload"
+	EventOpService  EventOp = "service"
+)
+
+// Event records a handling of a workload or service resource
+type Event struct {
+	Time     time.Time `json:"time"`
+	Op       EventOp   `json:"op"`
+	Resource string    `json:"resource"`
+	Success  bool      `json:"success"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// EventLog keeps the latest events in a ring buffer for auditing, the oldest events are
+// overwritten once it is full. A nil EventLog records nothing.
+type EventLog struct {
+	mutex  sync.RWMutex
+	events []Event
+	// index the next event is written to
+	next int
+	full bool
+}
+
+// NewEventLog creates an EventLog holding size events, DefaultEventLogSize if size is not positive
+func NewEventLog(size int) *EventLog {
+	if size <= 0 {
+		size = DefaultEventLogSize
+	}
+	return &EventLog{
+		events: make([]Event, size),
+	}
+}
+
+func (l *EventLog) Record(op EventOp, resource string, err error) {
+	if l == nil {
+		return
+	}
+
+	event := Event{
+		Time:     time.Now(),
+		Op:       op,
+		Resource: resource,
+		Success:  err == nil,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.events[l.next] = event
+	l.next++
+	if l.next == len(l.events) {
+		l.next = 0
+		l.full = true
+	}
+}
+
+// Events returns the events held, oldest first
+func (l *EventLog) Events() []Event {
+	if l == nil {
+		return nil
+	}
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if !l.full {
+		return append([]Event(nil), l.events[:l.next]...)
+	}
+	events := make([]Event, 0, len(l.events))
+	events = append(events, l.events[l.next:]...)
+	return append(events, l.events[:l.next]...)
+}
+
+// Export writes the events recorded at or after since to w, one json object per line, oldest first
+func (l *EventLog) Export(w io.Writer, since time.Time) error {
+	encoder := json.NewEncoder(w)
+	for _, event := range l.Events() {
+		if event.Time.Before(since) {
+			continue
+		}
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
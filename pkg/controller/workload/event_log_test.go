@@ -0,0 +1,109 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+)
+
+func resourcesOf(events []Event) []string {
+	resources := make([]string, 0, len(events))
+	for _, event := range events {
+		resources = append(resources, event.Resource)
+	}
+	return resources
+}
+
+func TestEventLog(t *testing.T) {
+	l := NewEventLog(3)
+	assert.Empty(t, l.Events())
+
+	l.Record(EventOpService, "svc1", nil)
+	l.Record(EventOpWorkload, "wl1", errors.New("failed"))
+	events := l.Events()
+	assert.Equal(t, []string{"svc1", "wl1"}, resourcesOf(events))
+	assert.Equal(t, EventOpService, events[0].Op)
+	assert.True(t, events[0].Success)
+	assert.False(t, events[1].Success)
+	assert.Equal(t, "failed", events[1].Error)
+
+	// the oldest events are overwritten once full
+	for i := 2; i <= 5; i++ {
+		l.Record(EventOpWorkload, fmt.Sprintf("wl%d", i), nil)
+	}
+	events = l.Events()
+	assert.Equal(t, []string{"wl3", "wl4", "wl5"}, resourcesOf(events))
+	for i := 1; i < len(events); i++ {
+		assert.False(t, events[i].Time.Before(events[i-1].Time))
+	}
+
+	// nil event log records nothing
+	var nilLog *EventLog
+	nilLog.Record(EventOpService, "svc1", nil)
+	assert.Empty(t, nilLog.Events())
+	assert.Equal(t, DefaultEventLogSize, len(NewEventLog(0).events))
+}
+
+func TestEventLogExport(t *testing.T) {
+	l := NewEventLog(10)
+	l.Record(EventOpService, "svc1", nil)
+	time.Sleep(10 * time.Millisecond)
+	since := time.Now()
+	l.Record(EventOpWorkload, "wl1", nil)
+	l.Record(EventOpService, "svc2", nil)
+
+	var buf bytes.Buffer
+	assert.NoError(t, l.Export(&buf, since))
+	var exported []Event
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var event Event
+		assert.NoError(t, decoder.Decode(&event))
+		exported = append(exported, event)
+	}
+	assert.Equal(t, []string{"wl1", "svc2"}, resourcesOf(exported))
+}
+
+func TestProcessorEventLog(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	wl := createWorkload("pod1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	assert.NoError(t, p.handleService(svc))
+	assert.NoError(t, p.handleWorkload(wl))
+
+	events := p.EventLog.Events()
+	assert.Equal(t, []string{svc.ResourceName(), wl.ResourceName()}, resourcesOf(events))
+	assert.Equal(t, EventOpService, events[0].Op)
+	assert.Equal(t, EventOpWorkload, events[1].Op)
+	assert.True(t, events[0].Success)
+	assert.True(t, events[1].Success)
+}
@@ -0,0 +1,206 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/ringbuf"
+	"istio.io/istio/pkg/util/sets"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	bpf "kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+	"kmesh.net/kmesh/pkg/nets"
+)
+
+// SetLazyFrontend enables the lazy frontend mode: the vips of the services handled afterwards are not
+// written to the frontend map until the datapath misses one of them, the misses are delivered by
+// WatchFrontendMisses. The services already programmed are kept. Disabling it programs the deferred vips.
+func (p *Processor) SetLazyFrontend(enabled bool) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.handleMutex.Lock()
+	defer p.handleMutex.Unlock()
+
+	if err := p.bpf.SetLazyFrontend(enabled); err != nil {
+		return fmt.Errorf("set lazy frontend mode of the datapath failed: %v", err)
+	}
+	p.lazyFrontend = enabled
+	if enabled {
+		return nil
+	}
+
+	var errs []error
+	names := sets.New[string]()
+	for _, name := range p.lazyFrontends {
+		names.Insert(name)
+	}
+	for name := range names {
+		if err := p.materializeFrontends(name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WatchFrontendMisses reads the frontend keys missed by the datapath from missMap until ctx is done,
+// and programs the frontends of the services they belong to.
+func (p *Processor) WatchFrontendMisses(ctx context.Context, missMap *ebpf.Map) {
+	reader, err := ringbuf.NewReader(missMap)
+	if err != nil {
+		log.Errorf("open frontend miss ringbuf map failed: %v", err)
+		return
+	}
+	// unblock the read below
+	go func() {
+		<-ctx.Done()
+		if err := reader.Close(); err != nil {
+			log.Errorf("frontend miss ringbuf reader close failed: %v", err)
+		}
+	}()
+
+	rec := ringbuf.Record{}
+	for {
+		if err := reader.ReadInto(&rec); err != nil {
+			if errors.Is(err, ringbuf.ErrClosed) {
+				return
+			}
+			log.Errorf("frontend miss ringbuf reader failed to read: %v", err)
+			continue
+		}
+		if err := p.handleFrontendMissEvent(rec.RawSample); err != nil {
+			log.Errorf("handle frontend miss failed: %v", err)
+		}
+	}
+}
+
+// handleFrontendMissEvent programs the frontends of the service owning the vip missed by the datapath,
+// the misses of other addresses are ignored
+func (p *Processor) handleFrontendMissEvent(raw []byte) error {
+	var fk bpf.FrontendKey
+	if len(raw) != int(unsafe.Sizeof(fk)) {
+		return fmt.Errorf("wrong length %d of a frontend miss, should be %d", len(raw), unsafe.Sizeof(fk))
+	}
+	copy(fk.Ip[:], raw)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.handleMutex.Lock()
+	defer p.handleMutex.Unlock()
+
+	name, ok := p.lazyFrontends[fk]
+	if !ok {
+		return nil
+	}
+	return p.materializeFrontends(name)
+}
+
+// materializeFrontends writes the deferred frontends of the service to the frontend map
+func (p *Processor) materializeFrontends(name string) error {
+	service := p.ServiceCache.GetService(name)
+	if service == nil {
+		for fk, owner := range p.lazyFrontends {
+			if owner == name {
+				delete(p.lazyFrontends, fk)
+			}
+		}
+		return nil
+	}
+
+	log.Infof("program the deferred frontends of service %s", name)
+	if err := p.storeServiceFrontendData(p.hashName.Hash(name), service); err != nil {
+		return fmt.Errorf("program frontends of service %s failed: %v", name, err)
+	}
+	p.forgetLazyFrontends(service)
+	return nil
+}
+
+// restoreMaterializedFrontends writes the frontends of the services which are not deferred, or not
+// anymore, and are missing from the frontend map, e.g. after the bpf maps are flushed
+func (p *Processor) restoreMaterializedFrontends() error {
+	var (
+		fk   = bpf.FrontendKey{}
+		fv   = bpf.FrontendValue{}
+		errs []error
+	)
+
+	for _, service := range p.ServiceCache.List() {
+		if len(service.GetPorts()) == 0 && !p.zeroPortPassthrough {
+			continue
+		}
+		deferred, missing := false, false
+		for _, networkAddress := range service.GetAddresses() {
+			nets.CopyIpByteFromSlice(&fk.Ip, networkAddress.GetAddress())
+			if _, ok := p.lazyFrontends[fk]; ok {
+				deferred = true
+				break
+			}
+			if err := p.bpf.FrontendLookup(&fk, &fv); err != nil {
+				missing = true
+			}
+		}
+		if deferred || !missing {
+			continue
+		}
+		log.Infof("restore the frontends of service %s", service.ResourceName())
+		if err := p.storeServiceFrontendData(p.hashName.Hash(service.ResourceName()), service); err != nil {
+			errs = append(errs, fmt.Errorf("restore frontends of service %s failed: %v", service.ResourceName(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// deferServiceFrontends records the vips of the service instead of programming them in the lazy frontend
+// mode, it returns false if the service is not lazy, e.g. its frontends are already programmed
+func (p *Processor) deferServiceFrontends(oldService, service *workloadapi.Service) bool {
+	if !p.lazyFrontend {
+		return false
+	}
+
+	var fk bpf.FrontendKey
+	if oldService != nil {
+		lazy := false
+		for _, networkAddress := range oldService.GetAddresses() {
+			nets.CopyIpByteFromSlice(&fk.Ip, networkAddress.GetAddress())
+			if _, ok := p.lazyFrontends[fk]; ok {
+				lazy = true
+				break
+			}
+		}
+		if !lazy {
+			return false
+		}
+	}
+
+	for _, networkAddress := range service.GetAddresses() {
+		nets.CopyIpByteFromSlice(&fk.Ip, networkAddress.GetAddress())
+		p.lazyFrontends[fk] = service.ResourceName()
+	}
+	return true
+}
+
+func (p *Processor) forgetLazyFrontends(service *workloadapi.Service) {
+	for _, networkAddress := range service.GetAddresses() {
+		fk := bpf.FrontendKey{}
+		nets.CopyIpByteFromSlice(&fk.Ip, networkAddress.GetAddress())
+		delete(p.lazyFrontends, fk)
+	}
+}
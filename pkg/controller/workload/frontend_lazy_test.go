@@ -0,0 +1,126 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+	"kmesh.net/kmesh/pkg/nets"
+)
+
+func TestLazyFrontend(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	missEvent := func(ip string) []byte {
+		fk := bpfcache.FrontendKey{}
+		nets.CopyIpByteFromSlice(&fk.Ip, netip.MustParseAddr(ip).AsSlice())
+		return fk.Ip[:]
+	}
+	lazyEnabled := func() uint32 {
+		var key, value uint32
+		assert.NoError(t, workloadMap.KmeshLazyFrontend.Lookup(&key, &value))
+		return value
+	}
+
+	// a service programmed before the lazy mode is kept
+	eager := createFakeService("eager", "10.240.10.9", "10.240.10.200")
+	assert.NoError(t, p.handleService(eager))
+	assert.NoError(t, p.SetLazyFrontend(true))
+	assert.Equal(t, uint32(1), lazyEnabled())
+
+	svc1 := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	svc2 := createFakeService("svc2", "10.240.10.2", "10.240.10.200")
+	wl := createWorkload("pod1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	assert.NoError(t, p.handleService(svc1))
+	assert.NoError(t, p.handleService(svc2))
+	assert.NoError(t, p.handleWorkload(wl))
+
+	// 1. the vips are not programmed, the rest of the services is
+	svc1Id := p.hashName.Hash(svc1.ResourceName())
+	checkNotExistInFrontEndMap(t, svc1.Addresses[0].Address, p)
+	checkNotExistInFrontEndMap(t, svc2.Addresses[0].Address, p)
+	checkServiceMap(t, p, svc1Id, svc1, 1)
+	checkEndpointMap(t, p, svc1, []uint32{p.hashName.Hash(wl.ResourceName())})
+	checkFrontEndMap(t, wl.Addresses[0], p)
+	assert.NoError(t, p.handleService(eager))
+	checkFrontEndMap(t, eager.Addresses[0].Address, p)
+
+	// 2. the misses of other addresses are ignored
+	assert.NoError(t, p.handleFrontendMissEvent(missEvent("10.240.10.100")))
+	assert.ErrorContains(t, p.handleFrontendMissEvent([]byte{10, 240, 10, 1}), "wrong length")
+	checkNotExistInFrontEndMap(t, svc1.Addresses[0].Address, p)
+
+	// 3. the vip missed by the datapath is programmed
+	assert.NoError(t, p.handleFrontendMissEvent(missEvent("10.240.10.1")))
+	assert.Equal(t, svc1Id, checkFrontEndMap(t, svc1.Addresses[0].Address, p))
+	checkNotExistInFrontEndMap(t, svc2.Addresses[0].Address, p)
+
+	// and kept once the service is updated
+	svc1.Ports = svc1.Ports[:1]
+	assert.NoError(t, p.handleService(svc1))
+	assert.Equal(t, svc1Id, checkFrontEndMap(t, svc1.Addresses[0].Address, p))
+
+	// 4. a removed service is forgotten
+	p.handleRemovedAddresses([]string{svc2.ResourceName()})
+	assert.NoError(t, p.handleFrontendMissEvent(missEvent("10.240.10.2")))
+	checkNotExistInFrontEndMap(t, svc2.Addresses[0].Address, p)
+	assert.Empty(t, p.lazyFrontends)
+
+	// 5. disabling the lazy mode programs the deferred vips
+	svc3 := createFakeService("svc3", "10.240.10.3", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc3))
+	checkNotExistInFrontEndMap(t, svc3.Addresses[0].Address, p)
+	assert.NoError(t, p.SetLazyFrontend(false))
+	assert.Equal(t, uint32(0), lazyEnabled())
+	assert.Equal(t, p.hashName.Hash(svc3.ResourceName()), checkFrontEndMap(t, svc3.Addresses[0].Address, p))
+	assert.Empty(t, p.lazyFrontends)
+}
+
+func TestForceResyncLazyFrontend(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	assert.NoError(t, p.SetLazyFrontend(true))
+	svc1 := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	svc2 := createFakeService("svc2", "10.240.10.2", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc1))
+	assert.NoError(t, p.handleService(svc2))
+	fk := bpfcache.FrontendKey{}
+	nets.CopyIpByteFromSlice(&fk.Ip, svc1.Addresses[0].Address)
+	assert.NoError(t, p.handleFrontendMissEvent(fk.Ip[:]))
+	svc1Id := p.hashName.Hash(svc1.ResourceName())
+	assert.Equal(t, svc1Id, checkFrontEndMap(t, svc1.Addresses[0].Address, p))
+
+	// the frontends materialized before the flush are rebuilt, the deferred ones stay deferred
+	assert.NoError(t, p.ForceResync())
+	assert.Equal(t, svc1Id, checkFrontEndMap(t, svc1.Addresses[0].Address, p))
+	checkNotExistInFrontEndMap(t, svc2.Addresses[0].Address, p)
+	checkServiceMap(t, p, p.hashName.Hash(svc2.ResourceName()), svc2, 0)
+	assert.Len(t, p.lazyFrontends, 1)
+}
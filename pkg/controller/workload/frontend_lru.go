@@ -0,0 +1,129 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	bpf "kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+	"kmesh.net/kmesh/pkg/nets"
+)
+
+type frontendLRU struct {
+	// the eviction starts once the frontend map holds highWatermark entries, and stops at lowWatermark
+	highWatermark int
+	lowWatermark  int
+}
+
+// SetFrontendLRU enables the eviction of the frontend entries of serviceless workloads, least recently
+// accessed by the datapath first, once the frontend map holds highWatermark entries, until lowWatermark
+// entries are left. Service vips and pinned workloads are never evicted. highWatermark <= 0 disables it.
+func (p *Processor) SetFrontendLRU(highWatermark, lowWatermark int) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if highWatermark <= 0 {
+		p.frontendLRU = nil
+		return nil
+	}
+	if lowWatermark < 0 || lowWatermark >= highWatermark {
+		return fmt.Errorf("invalid watermarks %d/%d, low watermark must be in [0, %d)", highWatermark, lowWatermark, highWatermark)
+	}
+
+	if err := p.bpf.EnableFrontendLRU(); err != nil {
+		return err
+	}
+	p.frontendLRU = &frontendLRU{
+		highWatermark: highWatermark,
+		lowWatermark:  lowWatermark,
+	}
+	p.evictFrontends()
+	return nil
+}
+
+// PinWorkload keeps the frontend entries of the workload out of the LRU eviction
+func (p *Processor) PinWorkload(uid string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.pinnedWorkloads.Insert(uid)
+}
+
+func (p *Processor) UnpinWorkload(uid string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.pinnedWorkloads.Delete(uid)
+}
+
+// evictFrontends deletes the frontend entries of the serviceless workloads least recently accessed
+// when the frontend map is filled over the high watermark. The workloads are kept in the cache and
+// their frontends are written back once updated.
+func (p *Processor) evictFrontends() {
+	lru := p.frontendLRU
+	if lru == nil || p.bpf.FrontendCount() < lru.highWatermark {
+		return
+	}
+
+	type candidate struct {
+		key      bpf.FrontendKey
+		accessed uint64
+	}
+	var candidates []candidate
+	for _, workload := range p.WorkloadCache.List() {
+		if len(workload.GetServices()) != 0 || p.pinnedWorkloads.Contains(workload.GetUid()) ||
+			workload.GetNetworkMode() == workloadapi.NetworkMode_HOST_NETWORK {
+			continue
+		}
+		for _, ip := range workload.GetAddresses() {
+			c := candidate{}
+			nets.CopyIpByteFromSlice(&c.key.Ip, ip)
+			accessed, err := p.bpf.FrontendAccessTime(&c.key)
+			if err != nil {
+				// no frontend entry, evicted already
+				continue
+			}
+			c.accessed = accessed
+			candidates = append(candidates, c)
+		}
+	}
+	slices.SortFunc(candidates, func(a, b candidate) int {
+		return cmp.Compare(a.accessed, b.accessed)
+	})
+
+	n := min(p.bpf.FrontendCount()-lru.lowWatermark, len(candidates))
+	keys := make([]bpf.FrontendKey, 0, n)
+	for _, c := range candidates[:n] {
+		keys = append(keys, c.key)
+	}
+	if err := p.bpf.FrontendBatchDelete(keys); err != nil {
+		log.Errorf("evict frontend entries failed: %v", err)
+	}
+	log.Infof("evicted %d frontend entries of serviceless workloads, %d left", len(keys), p.bpf.FrontendCount())
+}
+
+// frontendEvicted tells whether the frontend of a workload is missing because of the LRU eviction
+func (p *Processor) frontendEvicted(ip [16]byte) bool {
+	if p.frontendLRU == nil {
+		return false
+	}
+	_, err := p.bpf.FrontendAccessTime(&bpf.FrontendKey{Ip: ip})
+	return err != nil
+}
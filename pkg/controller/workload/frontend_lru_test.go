@@ -0,0 +1,87 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+	"kmesh.net/kmesh/pkg/nets"
+)
+
+func TestFrontendLRU(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	frontendKey := func(ip string) *bpfcache.FrontendKey {
+		fk := &bpfcache.FrontendKey{}
+		nets.CopyIpByteFromSlice(&fk.Ip, netip.MustParseAddr(ip).AsSlice())
+		return fk
+	}
+	hasFrontend := func(ip string) bool {
+		var fv bpfcache.FrontendValue
+		return p.bpf.FrontendLookup(frontendKey(ip), &fv) == nil
+	}
+
+	assert.ErrorContains(t, p.SetFrontendLRU(10, 10), "invalid watermarks")
+	assert.NoError(t, p.SetFrontendLRU(10, 6))
+
+	// the oldest entries, which must survive
+	assert.NoError(t, p.handleService(createFakeService("svc1", "10.240.10.1", "10.240.10.200")))
+	assert.NoError(t, p.handleWorkload(createWorkload("bound", "10.244.1.1", workloadapi.NetworkMode_STANDARD, "svc1")))
+	pinned := createWorkload("pinned", "10.244.1.2", workloadapi.NetworkMode_STANDARD)
+	p.PinWorkload(pinned.GetUid())
+	assert.NoError(t, p.handleWorkload(pinned))
+
+	for i := 0; i < 6; i++ {
+		assert.NoError(t, p.handleWorkload(createWorkload(fmt.Sprintf("pod%d", i), fmt.Sprintf("10.244.0.%d", i), workloadapi.NetworkMode_STANDARD)))
+	}
+	assert.Equal(t, 9, p.bpf.FrontendCount())
+
+	// pod0 is accessed by the datapath, so pod1 becomes the least recently used
+	assert.NoError(t, p.bpf.FrontendTouch(frontendKey("10.244.0.0")))
+	// reaching the high watermark evicts down to the low watermark
+	assert.NoError(t, p.handleWorkload(createWorkload("pod6", "10.244.0.6", workloadapi.NetworkMode_STANDARD)))
+	assert.Equal(t, 6, p.bpf.FrontendCount())
+
+	for _, ip := range []string{"10.244.0.1", "10.244.0.2", "10.244.0.3", "10.244.0.4"} {
+		assert.False(t, hasFrontend(ip), ip)
+	}
+	for _, ip := range []string{"10.240.10.1", "10.244.1.1", "10.244.1.2", "10.244.0.0", "10.244.0.5", "10.244.0.6"} {
+		assert.True(t, hasFrontend(ip), ip)
+	}
+	// the evicted workloads are still known and their backends kept
+	assert.NotNil(t, p.WorkloadCache.GetWorkloadByUid(createWorkload("pod1", "10.244.0.1", workloadapi.NetworkMode_STANDARD).GetUid()))
+
+	// an evicted workload gets its frontend back once updated, and is removed cleanly
+	pod1 := createWorkload("pod1", "10.244.0.1", workloadapi.NetworkMode_STANDARD)
+	pod1.Status = workloadapi.WorkloadStatus_UNHEALTHY
+	assert.NoError(t, p.handleWorkload(pod1))
+	assert.True(t, hasFrontend("10.244.0.1"))
+	assert.Equal(t, 7, p.bpf.FrontendCount())
+	pod2 := createWorkload("pod2", "10.244.0.2", workloadapi.NetworkMode_STANDARD)
+	assert.NoError(t, p.removeWorkloadResource([]string{pod1.GetUid(), pod2.GetUid()}))
+	assert.Equal(t, 6, p.bpf.FrontendCount())
+}
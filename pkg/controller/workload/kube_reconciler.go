@@ -0,0 +1,328 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"istio.io/istio/pkg/util/sets"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/controller/telemetry"
+	bpf "kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+	"kmesh.net/kmesh/pkg/controller/workload/cache"
+	"kmesh.net/kmesh/pkg/nets"
+)
+
+// KubeReconciler periodically compares the services and endpoint slices of the kubernetes api server
+// with the processor state and the bpf maps, and corrects the drift left by the xDS updates kmesh missed:
+//   - the cluster services absent from the api server are removed
+//   - the vips and ports of the services are updated to the ones of the api server
+//   - the vips missing from the frontend map are programmed again
+//   - the ready endpoints of known workloads missing from the endpoint map are added again
+//   - the known workloads with terminating endpoints are removed from the endpoint map until they are no longer terminating
+//
+// The workloads unknown to the processor are left to xDS, they can't be programmed from the api server only.
+type KubeReconciler struct {
+	client    kubernetes.Interface
+	processor *Processor
+	interval  time.Duration
+}
+
+func NewKubeReconciler(client kubernetes.Interface, processor *Processor, interval time.Duration) *KubeReconciler {
+	return &KubeReconciler{
+		client:    client,
+		processor: processor,
+		interval:  interval,
+	}
+}
+
+// Run reconciles every interval until ctx is done, it returns immediately if the interval is not positive
+func (r *KubeReconciler) Run(ctx context.Context) {
+	if r.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			corrected, err := r.Reconcile(ctx)
+			if err != nil {
+				log.Errorf("reconcile against kubernetes api server failed: %v", err)
+				continue
+			}
+			if len(corrected) != 0 {
+				log.Warnf("corrected the drift of services %v from kubernetes api server", corrected)
+			}
+		}
+	}
+}
+
+// Reconcile lists the services and endpoint slices once and corrects the drift,
+// it returns the names of the services corrected
+func (r *KubeReconciler) Reconcile(ctx context.Context) ([]string, error) {
+	services, err := r.client.CoreV1().Services(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("list services failed: %v", err)
+	}
+	endpointSlices, err := r.client.DiscoveryV1().EndpointSlices(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("list endpoint slices failed: %v", err)
+	}
+
+	readyAddresses := make(map[string][]netip.Addr)
+	var terminatingAddresses []netip.Addr
+	for _, slice := range endpointSlices.Items {
+		svcName, ok := slice.Labels[discoveryv1.LabelServiceName]
+		if !ok {
+			continue
+		}
+		name := kubeServiceName(slice.Namespace, svcName)
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.Conditions.Terminating != nil && *endpoint.Conditions.Terminating {
+				for _, address := range endpoint.Addresses {
+					if addr, err := netip.ParseAddr(address); err == nil {
+						terminatingAddresses = append(terminatingAddresses, addr)
+					}
+				}
+				continue
+			}
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			for _, address := range endpoint.Addresses {
+				if addr, err := netip.ParseAddr(address); err == nil {
+					readyAddresses[name] = append(readyAddresses[name], addr)
+				}
+			}
+		}
+	}
+
+	if changed := r.processor.reconcileTerminatingWorkloads(terminatingAddresses); len(changed) != 0 {
+		log.Infof("updated the terminating state of workloads %v from kubernetes api server", changed)
+	}
+	return r.processor.reconcileKubeServices(services.Items, readyAddresses), nil
+}
+
+// kubeServiceName returns the resource name of the kubernetes service in the processor
+func kubeServiceName(namespace, name string) string {
+	return namespace + "/" + name + "." + namespace + clusterServiceSuffix
+}
+
+func (p *Processor) reconcileKubeServices(services []corev1.Service, readyAddresses map[string][]netip.Addr) []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	corrected := sets.New[string]()
+	apiServices := sets.New[string]()
+	for i := range services {
+		name := kubeServiceName(services[i].Namespace, services[i].Name)
+		apiServices.Insert(name)
+		if p.reconcileKubeService(name, &services[i]) {
+			corrected.Insert(name)
+		}
+	}
+
+	var stale []string
+	for _, service := range p.ServiceCache.List() {
+		name := service.ResourceName()
+		if !isExternalService(name) && !apiServices.Contains(name) {
+			log.Warnf("service %s does not exist in kubernetes api server, remove it", name)
+			stale = append(stale, name)
+		}
+	}
+	p.handleMutex.Lock()
+	if len(stale) != 0 {
+		_ = p.removeServiceResource(stale)
+		corrected.InsertAll(stale...)
+	}
+	for name, addresses := range readyAddresses {
+		if p.reconcileKubeEndpoints(name, addresses) {
+			corrected.Insert(name)
+		}
+	}
+	p.handleMutex.Unlock()
+
+	telemetry.KubeReconcileCorrections.Add(float64(corrected.Len()))
+	return sets.SortedList(corrected)
+}
+
+// reconcileKubeService programs the service again if its vips or ports differ from the api server
+// or its vips are missing from the frontend map, it returns whether the service is corrected
+func (p *Processor) reconcileKubeService(name string, apiService *corev1.Service) bool {
+	cached := p.ServiceCache.GetService(name)
+	if cached == nil || apiService.Spec.Type == corev1.ServiceTypeExternalName {
+		return false
+	}
+
+	desired := proto.Clone(cached).(*workloadapi.Service)
+	drift := false
+	if vips := kubeServiceVips(apiService); len(vips) != 0 && !sameAddresses(cached.GetAddresses(), vips) {
+		log.Warnf("service %s vips differ from kubernetes api server: %v", name, vips)
+		network := ""
+		if len(cached.GetAddresses()) != 0 {
+			network = cached.GetAddresses()[0].GetNetwork()
+		}
+		desired.Addresses = nil
+		for _, vip := range vips {
+			desired.Addresses = append(desired.Addresses, &workloadapi.NetworkAddress{Network: network, Address: addressBytes(vip)})
+		}
+		drift = true
+	}
+	if ports := kubeServicePorts(apiService, cached); !samePorts(cached.GetPorts(), ports) {
+		log.Warnf("service %s ports differ from kubernetes api server", name)
+		desired.Ports = ports
+		drift = true
+	}
+	if !drift && !p.missingFrontends(name, cached) {
+		return false
+	}
+
+	if err := p.handleService(desired); err != nil {
+		log.Errorf("correct service %s from kubernetes api server failed: %v", name, err)
+	}
+	return true
+}
+
+// missingFrontends returns whether a vip of the service that should be programmed is missing from the frontend map
+func (p *Processor) missingFrontends(name string, service *workloadapi.Service) bool {
+	if len(service.GetPorts()) == 0 && !p.zeroPortPassthrough {
+		return false
+	}
+
+	var (
+		fk        = bpf.FrontendKey{}
+		fv        = bpf.FrontendValue{}
+		serviceId = p.hashName.Hash(name)
+	)
+	for _, networkAddress := range service.GetAddresses() {
+		nets.CopyIpByteFromSlice(&fk.Ip, networkAddress.GetAddress())
+		if _, ok := p.lazyFrontends[fk]; ok {
+			continue
+		}
+		if err := p.bpf.FrontendLookup(&fk, &fv); err != nil || fv.UpstreamId != serviceId {
+			log.Warnf("vip %s of service %s is not programmed", netip.AddrFrom16(fk.Ip).Unmap(), name)
+			return true
+		}
+	}
+	return false
+}
+
+// reconcileKubeEndpoints adds back the ready endpoints of the known workloads of the service
+// missing from the endpoint map, it returns whether an endpoint is added
+func (p *Processor) reconcileKubeEndpoints(name string, addresses []netip.Addr) bool {
+	if p.ServiceCache.GetService(name) == nil {
+		return false
+	}
+
+	serviceId := p.hashName.Hash(name)
+	added := false
+	for _, addr := range addresses {
+		workload := p.WorkloadCache.GetWorkloadByAddr(cache.NetworkAddress{Network: p.network, Address: addr})
+		if workload == nil {
+			log.Debugf("ready endpoint %s of service %s is not a known workload", addr, name)
+			continue
+		}
+		if _, ok := workload.GetServices()[name]; !ok || p.isTerminatingWorkload(workload) {
+			continue
+		}
+		if !p.shouldAddEndpoint(p.hashName.Hash(workload.GetUid()), serviceId) {
+			continue
+		}
+		log.Warnf("endpoint %s of service %s is not programmed", workload.ResourceName(), name)
+		if err := p.handleWorkloadNewBoundServices(workload, []string{name}); err != nil {
+			log.Errorf("correct endpoint %s of service %s failed: %v", workload.ResourceName(), name, err)
+			continue
+		}
+		added = true
+	}
+	return added
+}
+
+func kubeServiceVips(service *corev1.Service) []netip.Addr {
+	clusterIPs := service.Spec.ClusterIPs
+	if len(clusterIPs) == 0 && service.Spec.ClusterIP != "" {
+		clusterIPs = []string{service.Spec.ClusterIP}
+	}
+
+	var vips []netip.Addr
+	for _, ip := range clusterIPs {
+		if addr, err := netip.ParseAddr(ip); err == nil {
+			vips = append(vips, addr)
+		}
+	}
+	return vips
+}
+
+// kubeServicePorts returns the ports of the kubernetes service, the target ports of the ports known
+// to the cached service are kept since xDS resolves the named target ports
+func kubeServicePorts(service *corev1.Service, cached *workloadapi.Service) []*workloadapi.Port {
+	var ports []*workloadapi.Port
+	for _, port := range service.Spec.Ports {
+		servicePort := uint32(port.Port)
+		targetPort := uint32(port.TargetPort.IntValue())
+		for _, cachedPort := range cached.GetPorts() {
+			if cachedPort.GetServicePort() == servicePort {
+				targetPort = cachedPort.GetTargetPort()
+				break
+			}
+		}
+		if targetPort == 0 && port.TargetPort.StrVal == "" {
+			targetPort = servicePort
+		}
+		ports = append(ports, &workloadapi.Port{ServicePort: servicePort, TargetPort: targetPort})
+	}
+	return ports
+}
+
+func sameAddresses(addresses []*workloadapi.NetworkAddress, vips []netip.Addr) bool {
+	if len(addresses) != len(vips) {
+		return false
+	}
+	for _, networkAddress := range addresses {
+		addr, _ := netip.AddrFromSlice(networkAddress.GetAddress())
+		if !slices.Contains(vips, addr.Unmap()) {
+			return false
+		}
+	}
+	return true
+}
+
+func samePorts(cached, ports []*workloadapi.Port) bool {
+	servicePorts := func(ports []*workloadapi.Port) []uint32 {
+		res := make([]uint32, 0, len(ports))
+		for _, port := range ports {
+			res = append(res, port.GetServicePort())
+		}
+		slices.Sort(res)
+		return res
+	}
+	return slices.Equal(servicePorts(cached), servicePorts(ports))
+}
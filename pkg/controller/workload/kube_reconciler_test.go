@@ -0,0 +1,132 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+	"kmesh.net/kmesh/pkg/nets"
+)
+
+func TestKubeReconciler(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+	// the endpoint addresses are resolved on the local network
+	p.network = "testnetwork"
+
+	kubeService := func(name, ip string, ports ...int32) *corev1.Service {
+		svc := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       corev1.ServiceSpec{ClusterIP: ip, ClusterIPs: []string{ip}},
+		}
+		for _, port := range ports {
+			svc.Spec.Ports = append(svc.Spec.Ports, corev1.ServicePort{Port: port, TargetPort: intstr.FromInt32(port + 8000)})
+		}
+		return svc
+	}
+	ready := true
+	client := fake.NewSimpleClientset(
+		kubeService("svc1", "10.240.10.1", 80, 81, 82),
+		kubeService("svc2", "10.240.10.2", 80, 90),
+		&discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "svc1-abcde",
+				Namespace: "default",
+				Labels:    map[string]string{discoveryv1.LabelServiceName: "svc1"},
+			},
+			Endpoints: []discoveryv1.Endpoint{
+				{Addresses: []string{"10.244.0.1"}, Conditions: discoveryv1.EndpointConditions{Ready: &ready}},
+				// unknown to xDS
+				{Addresses: []string{"10.244.0.9"}},
+			},
+		},
+	)
+	r := NewKubeReconciler(client, p, 0)
+
+	svc1 := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	svc2 := createFakeService("svc2", "10.240.10.2", "10.240.10.200")
+	svc3 := createFakeService("svc3", "10.240.10.3", "10.240.10.200")
+	external := createFakeService("external", "10.240.10.4", "10.240.10.200")
+	external.Hostname = "www.example.com"
+	wl := createWorkload("pod1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	for _, svc := range []*workloadapi.Service{svc1, svc2, svc3, external} {
+		assert.NoError(t, p.handleService(svc))
+	}
+	assert.NoError(t, p.handleWorkload(wl))
+
+	// drift of the bpf maps, the vip and the endpoint of svc1 are lost
+	svc1Id := p.hashName.Hash(svc1.ResourceName())
+	fk := bpfcache.FrontendKey{}
+	nets.CopyIpByteFromSlice(&fk.Ip, svc1.Addresses[0].Address)
+	assert.NoError(t, p.bpf.FrontendDelete(&fk))
+	assert.NoError(t, p.bpf.EndpointDelete(&bpfcache.EndpointKey{ServiceId: svc1Id, BackendIndex: 1}))
+	assert.NoError(t, p.bpf.ServiceUpdate(&bpfcache.ServiceKey{ServiceId: svc1Id}, &bpfcache.ServiceValue{}))
+	checkEndpointMap(t, p, svc1, nil)
+
+	corrected, err := r.Reconcile(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{svc1.ResourceName(), svc2.ResourceName(), svc3.ResourceName()}, corrected)
+
+	// 1. the bpf maps of svc1 are programmed again
+	assert.Equal(t, svc1Id, checkFrontEndMap(t, svc1.Addresses[0].Address, p))
+	checkServiceMap(t, p, svc1Id, svc1, 1)
+	checkEndpointMap(t, p, svc1, []uint32{p.hashName.Hash(wl.ResourceName())})
+
+	// 2. the ports of svc2 are the ones of the api server, the known target ports are kept
+	ports := p.ServiceCache.GetService(svc2.ResourceName()).GetPorts()
+	assert.Len(t, ports, 2)
+	assert.Equal(t, []uint32{80, 8080}, []uint32{ports[0].ServicePort, ports[0].TargetPort})
+	assert.Equal(t, []uint32{90, 8090}, []uint32{ports[1].ServicePort, ports[1].TargetPort})
+	var sv bpfcache.ServiceValue
+	assert.NoError(t, p.bpf.ServiceLookup(&bpfcache.ServiceKey{ServiceId: p.hashName.Hash(svc2.ResourceName())}, &sv))
+	assert.Equal(t, nets.ConvertPortToBigEndian(90), sv.ServicePort[1])
+	assert.Equal(t, uint32(0), sv.ServicePort[2])
+
+	// 3. svc3 absent from the api server is removed, the external service is kept
+	assert.Nil(t, p.ServiceCache.GetService(svc3.ResourceName()))
+	checkNotExistInFrontEndMap(t, svc3.Addresses[0].Address, p)
+	assert.NotNil(t, p.ServiceCache.GetService(external.ResourceName()))
+	checkFrontEndMap(t, external.Addresses[0].Address, p)
+
+	// 4. nothing more to correct
+	corrected, err = r.Reconcile(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, corrected)
+
+	// 5. a vip changed in the api server
+	_, err = client.CoreV1().Services("default").Update(context.Background(), kubeService("svc1", "10.240.10.11", 80, 81, 82), metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	corrected, err = r.Reconcile(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{svc1.ResourceName()}, corrected)
+	assert.Equal(t, svc1Id, checkFrontEndMap(t, netip.MustParseAddr("10.240.10.11").AsSlice(), p))
+	checkNotExistInFrontEndMap(t, svc1.Addresses[0].Address, p)
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"fmt"
+	"time"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	bpf "kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+)
+
+// pendingService is a newly-seen service held during the debounce window, with its latest update
+type pendingService struct {
+	service *workloadapi.Service
+	timer   *time.Timer
+}
+
+// SetServiceDebounceWindow holds a newly-seen service for window before programming it, the updates
+// received meanwhile replace the held one, so that a service flapping e.g. during a controller restart
+// is written once with its final state. The services already programmed are updated at once.
+// window <= 0 disables it, the held services are programmed then.
+func (p *Processor) SetServiceDebounceWindow(window time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.serviceDebounceWindow = window
+	if window <= 0 {
+		for name, pending := range p.pendingServices {
+			if err := p.programPendingService(name, pending); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+// debounceService holds the service if it is newly seen, and tells whether it is held,
+// the caller must hold p.mutex
+func (p *Processor) debounceService(service *workloadapi.Service) bool {
+	if p.serviceDebounceWindow <= 0 {
+		return false
+	}
+
+	name := service.ResourceName()
+	if pending, ok := p.pendingServices[name]; ok {
+		pending.service = service
+		return true
+	}
+	if p.ServiceCache.GetService(name) != nil {
+		return false
+	}
+
+	if p.pendingServices == nil {
+		p.pendingServices = make(map[string]*pendingService)
+	}
+	pending := &pendingService{service: service}
+	pending.timer = time.AfterFunc(p.serviceDebounceWindow, func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+
+		if p.closed {
+			return
+		}
+		if err := p.programPendingService(name, pending); err != nil {
+			log.Error(err)
+		}
+	})
+	p.pendingServices[name] = pending
+	return true
+}
+
+// programPendingService programs the latest update of the held service, unless it was dropped
+// meanwhile, the caller must hold p.mutex
+func (p *Processor) programPendingService(name string, pending *pendingService) error {
+	if p.pendingServices[name] != pending {
+		return nil
+	}
+	pending.timer.Stop()
+	delete(p.pendingServices, name)
+
+	service := pending.service
+	if !p.quarantine.admit(name, service) {
+		log.Debugf("service %s is quarantined, skip it", name)
+		return nil
+	}
+	err := p.handleService(service)
+	p.quarantine.record(name, service, err)
+	if err != nil {
+		return fmt.Errorf("handle debounced service %s failed: %v", name, err)
+	}
+	// the workloads handled while the service was held could not be added as its endpoints
+	if err = p.addCachedEndpoints(name); err != nil {
+		return fmt.Errorf("add the endpoints of debounced service %s failed: %v", name, err)
+	}
+	return nil
+}
+
+// addCachedEndpoints adds the cached workloads bound to the service as its endpoints, in the order of their uids
+func (p *Processor) addCachedEndpoints(serviceName string) error {
+	var (
+		sk = bpf.ServiceKey{}
+		sv = bpf.ServiceValue{}
+	)
+
+	p.handleMutex.Lock()
+	defer p.handleMutex.Unlock()
+
+	sk.ServiceId = p.hashName.Hash(serviceName)
+	if err := p.bpf.ServiceLookup(&sk, &sv); err != nil {
+		return err
+	}
+	workloads := p.WorkloadCache.List()
+	sortWorkloadsByUid(workloads)
+	for _, workload := range workloads {
+		if _, ok := workload.GetServices()[serviceName]; !ok {
+			continue
+		}
+		local := p.isLocalWorkload(workload)
+		if (p.paused && local) || p.isTerminatingWorkload(workload) {
+			continue
+		}
+		if err := p.addWorkloadToService(&sk, &sv, p.hashName.Hash(workload.GetUid()), local); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropPendingServices drops the held services among names
+func (p *Processor) dropPendingServices(names []string) {
+	for _, name := range names {
+		if pending, ok := p.pendingServices[name]; ok {
+			pending.timer.Stop()
+			delete(p.pendingServices, name)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"testing"
+	"time"
+
+	service_discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"istio.io/istio/pilot/pkg/util/protoconv"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+	"kmesh.net/kmesh/pkg/nets"
+)
+
+func TestServiceDebounce(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+	counter := bpfcache.NewOpCounter()
+	p.bpf.SetOpCounter(counter)
+	p.SetServiceDebounceWindow(10 * time.Millisecond)
+
+	// the caller holds p.mutex as processWorkloadResponse does, which also holds back the debounced writes
+	push := func(addresses ...*workloadapi.Address) {
+		res := &service_discovery_v3.DeltaDiscoveryResponse{TypeUrl: AddressType}
+		for _, addr := range addresses {
+			res.Resources = append(res.Resources, &service_discovery_v3.Resource{Resource: protoconv.MessageToAny(addr)})
+		}
+		assert.NoError(t, p.handleAddressTypeResponse(res))
+	}
+
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	wl := createWorkload("wl1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	p.mutex.Lock()
+	// three rapid updates of a new service, the workload is handled while the service is held
+	for i, port := range []uint32{80, 81, 82} {
+		svc = proto.Clone(svc).(*workloadapi.Service)
+		svc.Ports = []*workloadapi.Port{{ServicePort: port, TargetPort: 8080}}
+		if i == 0 {
+			push(serviceToAddress(svc), workloadToAddress(wl))
+		} else {
+			push(serviceToAddress(svc))
+		}
+	}
+	assert.Equal(t, 0, counter.Updates(bpfcache.ServiceMap))
+	assert.Nil(t, p.ServiceCache.GetService(svc.ResourceName()))
+	p.mutex.Unlock()
+
+	assert.Eventually(t, func() bool {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		return p.ServiceCache.GetService(svc.ResourceName()) != nil
+	}, time.Second, time.Millisecond)
+
+	// only the final state is written, once, and the workload is added as its endpoint
+	sk := bpfcache.ServiceKey{ServiceId: p.hashName.Hash(svc.ResourceName())}
+	sv := bpfcache.ServiceValue{}
+	assert.NoError(t, p.bpf.ServiceLookup(&sk, &sv))
+	assert.Equal(t, uint32(1), sv.EndpointCount)
+	assert.Equal(t, nets.ConvertPortToBigEndian(82), sv.ServicePort[0])
+	// once for the service itself, once for its endpoint
+	assert.Equal(t, 2, counter.Updates(bpfcache.ServiceMap))
+	checkEndpointMap(t, p, svc, []uint32{p.hashName.Hash(wl.Uid)})
+
+	// an update of the programmed service is not held
+	svc = proto.Clone(svc).(*workloadapi.Service)
+	svc.Ports = []*workloadapi.Port{{ServicePort: 83, TargetPort: 8080}}
+	p.mutex.Lock()
+	push(serviceToAddress(svc))
+	p.mutex.Unlock()
+	assert.Equal(t, 3, counter.Updates(bpfcache.ServiceMap))
+
+	// a held service removed is never programmed
+	svc2 := createFakeService("svc2", "10.240.10.2", "10.240.10.200")
+	p.mutex.Lock()
+	push(serviceToAddress(svc2))
+	p.handleRemovedAddresses([]string{svc2.ResourceName()})
+	assert.Empty(t, p.pendingServices)
+	p.mutex.Unlock()
+}
+
+func TestServiceDebounceFlushOnClose(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+	p.SetServiceDebounceWindow(time.Hour)
+
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	wl := createWorkload("wl1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	p.mutex.Lock()
+	assert.NoError(t, p.handleAddressTypeResponse(&service_discovery_v3.DeltaDiscoveryResponse{
+		TypeUrl: AddressType,
+		Resources: []*service_discovery_v3.Resource{
+			{Resource: protoconv.MessageToAny(serviceToAddress(svc))},
+			{Resource: protoconv.MessageToAny(workloadToAddress(wl))},
+		},
+	}))
+	p.mutex.Unlock()
+	assert.Nil(t, p.ServiceCache.GetService(svc.ResourceName()))
+
+	// the held service is programmed with its endpoints rather than dropped
+	assert.NoError(t, p.Close())
+	assert.Empty(t, p.pendingServices)
+	assert.NotNil(t, p.ServiceCache.GetService(svc.ResourceName()))
+	checkEndpointMap(t, p, svc, []uint32{p.hashName.Hash(wl.Uid)})
+}
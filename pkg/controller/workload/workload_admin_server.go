@@ -0,0 +1,284 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	service_discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	AdminMethodStats             = "Stats"
+	AdminMethodListServices      = "ListServices"
+	AdminMethodDumpMaps          = "DumpMaps"
+	AdminMethodLookupAddress     = "LookupAddress"
+	AdminMethodWorkloadStatus    = "WorkloadStatus"
+	AdminMethodDiffAddresses     = "DiffAddresses"
+	AdminMethodDrain             = "Drain"
+	AdminMethodResume            = "Resume"
+	AdminMethodResync            = "Resync"
+	AdminMethodVerifyShadow      = "VerifyShadow"
+	AdminMethodRemoveAddress     = "RemoveAddress"
+	AdminMethodEndpointHits      = "EndpointHits"
+	AdminMethodReplaceEndpoints  = "ReplaceEndpoints"
+	AdminMethodPendingReferences = "PendingReferences"
+	AdminMethodTopology          = "Topology"
+
+	// a message is a 4 bytes big endian length followed by the json body
+	adminMessageHeaderLen = 4
+	maxAdminMessageSize   = 64 << 20
+
+	adminTimeout = time.Second * 20
+)
+
+type AdminRequest struct {
+	Method string `json:"method"`
+	// Address is the ip to look up or whose workload to remove, only used by LookupAddress and RemoveAddress
+	Address string `json:"address,omitempty"`
+	// Network is the network of the address, only used by RemoveAddress
+	Network string `json:"network,omitempty"`
+	// Uid is the workload to report, only used by WorkloadStatus
+	Uid string `json:"uid,omitempty"`
+	// Service is the resource name of the service to report or update, only used by EndpointHits and ReplaceEndpoints
+	Service string `json:"service,omitempty"`
+	// Backends are the backend uids to replace the endpoints of the service with, only used by ReplaceEndpoints
+	Backends []uint32 `json:"backends,omitempty"`
+	// Response is the protojson encoded address DeltaDiscoveryResponse to diff, only used by DiffAddresses
+	Response json.RawMessage `json:"response,omitempty"`
+}
+
+type AdminResponse struct {
+	Error  string          `json:"error,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+// AdminServer serves the processor queries of kmeshctl over a unix socket
+type AdminServer struct {
+	processor *Processor
+	path      string
+	listener  net.Listener
+	wg        sync.WaitGroup
+}
+
+func NewAdminServer(p *Processor, path string) *AdminServer {
+	return &AdminServer{
+		processor: p,
+		path:      path,
+	}
+}
+
+func (s *AdminServer) Start() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0750); err != nil {
+		return fmt.Errorf("create admin socket dir failed, %s", err)
+	}
+	// remove the socket left by the last daemon
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove stale admin socket failed, %s", err)
+	}
+
+	listener, err := net.Listen("unix", s.path)
+	if err != nil {
+		return fmt.Errorf("listen on %s failed, %s", s.path, err)
+	}
+	s.listener = listener
+
+	s.wg.Add(1)
+	go s.serve()
+	log.Infof("admin server listening on %s", s.path)
+	return nil
+}
+
+func (s *AdminServer) Stop() error {
+	if s.listener == nil {
+		return nil
+	}
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *AdminServer) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Errorf("admin server accept failed: %v", err)
+			}
+			return
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *AdminServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		var req AdminRequest
+		_ = conn.SetDeadline(time.Now().Add(adminTimeout))
+		if err := readAdminMessage(conn, &req); err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Errorf("admin server read request failed: %v", err)
+			}
+			return
+		}
+		if err := writeAdminMessage(conn, s.handleRequest(&req)); err != nil {
+			log.Errorf("admin server write response failed: %v", err)
+			return
+		}
+	}
+}
+
+func (s *AdminServer) handleRequest(req *AdminRequest) *AdminResponse {
+	var (
+		result any
+		err    error
+	)
+
+	switch req.Method {
+	case AdminMethodStats:
+		result, err = s.processor.Stats()
+	case AdminMethodListServices:
+		result = s.processor.ListServices()
+	case AdminMethodDumpMaps:
+		result, err = s.processor.DumpMaps()
+	case AdminMethodLookupAddress:
+		result, err = s.processor.LookupAddress(req.Address)
+	case AdminMethodWorkloadStatus:
+		result = s.processor.WorkloadStatus(req.Uid)
+	case AdminMethodDiffAddresses:
+		result, err = s.diffAddresses(req.Response)
+	case AdminMethodDrain:
+		ctx, cancel := context.WithTimeout(context.Background(), adminTimeout)
+		err = s.processor.DrainAndPause(ctx)
+		cancel()
+	case AdminMethodResume:
+		err = s.processor.Resume()
+	case AdminMethodResync:
+		err = s.processor.ForceResync()
+	case AdminMethodVerifyShadow:
+		err = s.processor.VerifyShadowMaps()
+	case AdminMethodRemoveAddress:
+		err = s.removeAddress(req.Address, req.Network)
+	case AdminMethodEndpointHits:
+		result, err = s.processor.ServiceEndpointHits(req.Service)
+	case AdminMethodReplaceEndpoints:
+		err = s.processor.ReplaceServiceEndpoints(req.Service, req.Backends)
+	case AdminMethodPendingReferences:
+		result = s.processor.PendingReferences()
+	case AdminMethodTopology:
+		result = s.processor.ExportTopologyDOT()
+	default:
+		err = fmt.Errorf("unknown method %q", req.Method)
+	}
+	if err != nil {
+		return &AdminResponse{Error: err.Error()}
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		return &AdminResponse{Error: fmt.Sprintf("marshal %s result failed, %s", req.Method, err)}
+	}
+	return &AdminResponse{Result: data}
+}
+
+// diffAddresses reports what the proposed address response would change without applying it
+func (s *AdminServer) diffAddresses(data json.RawMessage) (*AddressDiff, error) {
+	rsp := &service_discovery_v3.DeltaDiscoveryResponse{}
+	if err := protojson.Unmarshal(data, rsp); err != nil {
+		return nil, fmt.Errorf("unmarshal response failed, %s", err)
+	}
+	if rsp.GetTypeUrl() != AddressType {
+		return nil, fmt.Errorf("unsupported type url %s", rsp.GetTypeUrl())
+	}
+	return s.processor.DiffAddressTypeResponse(rsp), nil
+}
+
+// removeAddress removes the workload owning the address, e.g. when it is known to be gone before xDS tells
+func (s *AdminServer) removeAddress(address, network string) error {
+	ip, err := netip.ParseAddr(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %q, %s", address, err)
+	}
+	return s.processor.RemoveByAddress(ip, network)
+}
+
+// QueryAdmin sends a request to the admin server listening on path and waits for the response
+func QueryAdmin(path string, req *AdminRequest) (*AdminResponse, error) {
+	conn, err := net.DialTimeout("unix", path, adminTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("connect to admin server failed, %s", err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(adminTimeout))
+	if err = writeAdminMessage(conn, req); err != nil {
+		return nil, fmt.Errorf("send request failed, %s", err)
+	}
+	rsp := &AdminResponse{}
+	if err = readAdminMessage(conn, rsp); err != nil {
+		return nil, fmt.Errorf("receive response failed, %s", err)
+	}
+	return rsp, nil
+}
+
+func readAdminMessage(r io.Reader, v any) error {
+	header := make([]byte, adminMessageHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > maxAdminMessageSize {
+		return fmt.Errorf("message size %d exceeds the limit %d", size, maxAdminMessageSize)
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+func writeAdminMessage(w io.Writer, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(body) > maxAdminMessageSize {
+		return fmt.Errorf("message size %d exceeds the limit %d", len(body), maxAdminMessageSize)
+	}
+
+	msg := make([]byte, adminMessageHeaderLen, adminMessageHeaderLen+len(body))
+	binary.BigEndian.PutUint32(msg, uint32(len(body)))
+	_, err = w.Write(append(msg, body...))
+	return err
+}
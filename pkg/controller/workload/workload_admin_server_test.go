@@ -0,0 +1,190 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	service_discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protojson"
+	"istio.io/istio/pilot/pkg/util/protoconv"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+)
+
+func TestAdminServer(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc))
+	wl := createWorkload("wl1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	assert.NoError(t, p.handleWorkload(wl))
+
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	s := NewAdminServer(p, path)
+	assert.NoError(t, s.Start())
+	defer func() {
+		assert.NoError(t, s.Stop())
+	}()
+
+	rsp, err := QueryAdmin(path, &AdminRequest{Method: AdminMethodStats})
+	assert.NoError(t, err)
+	assert.Empty(t, rsp.Error)
+	stats := ProcessorStats{}
+	assert.NoError(t, json.Unmarshal(rsp.Result, &stats))
+	assert.Equal(t, ProcessorStats{
+		Workloads: 1,
+		Services:  1,
+		Frontends: 2,
+		Backends:  1,
+		Endpoints: 1,
+
+		TotalWorkloads: 1,
+		TotalServices:  1,
+
+		ServiceEndpoints: map[string]EndpointLocality{svc.ResourceName(): {Remote: 1}},
+	}, stats)
+
+	rsp, err = QueryAdmin(path, &AdminRequest{Method: AdminMethodLookupAddress, Address: "10.244.0.1"})
+	assert.NoError(t, err)
+	info := AddressInfo{}
+	assert.NoError(t, json.Unmarshal(rsp.Result, &info))
+	assert.Equal(t, AddressInfo{
+		Address:    "10.244.0.1",
+		UpstreamId: p.hashName.Hash(wl.Uid),
+		Kind:       "workload",
+		Name:       wl.ResourceName(),
+	}, info)
+
+	svc2 := createFakeService("svc2", "10.240.10.2", "10.240.10.200")
+	proposed, err := protojson.Marshal(&service_discovery_v3.DeltaDiscoveryResponse{
+		TypeUrl:          AddressType,
+		Resources:        []*service_discovery_v3.Resource{{Resource: protoconv.MessageToAny(serviceToAddress(svc2))}},
+		RemovedResources: []string{wl.ResourceName()},
+	})
+	assert.NoError(t, err)
+	rsp, err = QueryAdmin(path, &AdminRequest{Method: AdminMethodDiffAddresses, Response: proposed})
+	assert.NoError(t, err)
+	assert.Empty(t, rsp.Error)
+	diff := AddressDiff{}
+	assert.NoError(t, json.Unmarshal(rsp.Result, &diff))
+	assert.Equal(t, AddressDiff{
+		Workloads: ResourceDiff{Removed: []string{wl.ResourceName()}},
+		Services:  ResourceDiff{Added: []string{svc2.ResourceName()}},
+	}, diff)
+	// the diff is not applied
+	assert.Nil(t, p.ServiceCache.GetService(svc2.ResourceName()))
+
+	rsp, err = QueryAdmin(path, &AdminRequest{Method: AdminMethodEndpointHits, Service: svc.ResourceName()})
+	assert.NoError(t, err)
+	assert.Empty(t, rsp.Error)
+	assert.JSONEq(t, `{}`, string(rsp.Result))
+
+	// wl2 waits on svc3 which is not received yet
+	wl2 := createWorkload("wl2", "10.244.0.2", workloadapi.NetworkMode_STANDARD, "svc3")
+	assert.NoError(t, p.handleWorkload(wl2))
+	rsp, err = QueryAdmin(path, &AdminRequest{Method: AdminMethodPendingReferences})
+	assert.NoError(t, err)
+	assert.Empty(t, rsp.Error)
+	var refs []PendingRef
+	assert.NoError(t, json.Unmarshal(rsp.Result, &refs))
+	assert.Equal(t, []PendingRef{
+		{Kind: PendingRefService, Resource: wl2.ResourceName(), Reference: "default/svc3.default.svc.cluster.local"},
+	}, refs)
+
+	rsp, err = QueryAdmin(path, &AdminRequest{Method: AdminMethodTopology})
+	assert.NoError(t, err)
+	assert.Empty(t, rsp.Error)
+	var dot string
+	assert.NoError(t, json.Unmarshal(rsp.Result, &dot))
+	assert.Equal(t, p.ExportTopologyDOT(), dot)
+	assert.Contains(t, dot, svc.ResourceName())
+
+	rsp, err = QueryAdmin(path, &AdminRequest{Method: "Unknown"})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, rsp.Error)
+}
+
+func TestAdminServerOperations(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+	p.nodeName = "node1"
+
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc))
+	wl := createWorkload("wl1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	wl.Node = "node1"
+	assert.NoError(t, p.handleWorkload(wl))
+
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	s := NewAdminServer(p, path)
+	assert.NoError(t, s.Start())
+	defer func() {
+		assert.NoError(t, s.Stop())
+	}()
+
+	rsp, err := QueryAdmin(path, &AdminRequest{Method: AdminMethodDrain})
+	assert.NoError(t, err)
+	assert.Empty(t, rsp.Error)
+	checkEndpointMap(t, p, svc, []uint32{})
+
+	rsp, err = QueryAdmin(path, &AdminRequest{Method: AdminMethodResume})
+	assert.NoError(t, err)
+	assert.Empty(t, rsp.Error)
+	checkEndpointMap(t, p, svc, []uint32{p.hashName.Hash(wl.Uid)})
+
+	assert.NoError(t, p.bpf.BackendDelete(&bpfcache.BackendKey{BackendUid: p.hashName.Hash(wl.Uid)}))
+	rsp, err = QueryAdmin(path, &AdminRequest{Method: AdminMethodResync})
+	assert.NoError(t, err)
+	assert.Empty(t, rsp.Error)
+	checkBackendMap(t, p, p.hashName.Hash(wl.Uid), wl)
+	checkEndpointMap(t, p, svc, []uint32{p.hashName.Hash(wl.Uid)})
+
+	rsp, err = QueryAdmin(path, &AdminRequest{Method: AdminMethodVerifyShadow})
+	assert.NoError(t, err)
+	assert.Contains(t, rsp.Error, "shadow maps are not set")
+
+	wl2 := createWorkload("wl2", "10.244.0.2", workloadapi.NetworkMode_STANDARD)
+	assert.NoError(t, p.handleWorkload(wl2))
+	rsp, err = QueryAdmin(path, &AdminRequest{
+		Method:   AdminMethodReplaceEndpoints,
+		Service:  svc.ResourceName(),
+		Backends: []uint32{p.hashName.Hash(wl2.Uid)},
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, rsp.Error)
+	checkEndpointMap(t, p, svc, []uint32{p.hashName.Hash(wl2.Uid)})
+
+	rsp, err = QueryAdmin(path, &AdminRequest{Method: AdminMethodRemoveAddress, Address: "10.244.0"})
+	assert.NoError(t, err)
+	assert.Contains(t, rsp.Error, "invalid address")
+	rsp, err = QueryAdmin(path, &AdminRequest{Method: AdminMethodRemoveAddress, Address: "10.244.0.1"})
+	assert.NoError(t, err)
+	assert.Empty(t, rsp.Error)
+	assert.Nil(t, p.WorkloadCache.GetWorkloadByUid(wl.Uid))
+}
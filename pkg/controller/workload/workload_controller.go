@@ -18,13 +18,17 @@ package workload
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 
+	"kmesh.net/kmesh/daemon/options"
 	"kmesh.net/kmesh/pkg/auth"
 	"kmesh.net/kmesh/pkg/bpf"
 	"kmesh.net/kmesh/pkg/controller/telemetry"
+	"kmesh.net/kmesh/pkg/controller/workload/bpfcache"
 	"kmesh.net/kmesh/pkg/logger"
 )
 
@@ -41,26 +45,90 @@ type Controller struct {
 	Rbac             *auth.Rbac
 	MetricController *telemetry.MetricController
 	bpfWorkloadObj   *bpf.BpfKmeshWorkload
+	bpfFsEvents      chan bpfcache.BpfFsEvent
+	// tracerProvider exports the spans of the processor, nil if tracing is disabled
+	tracerProvider *sdktrace.TracerProvider
+	// snapshotPath is the file the caches are saved to on stop, empty if the warm start is disabled
+	snapshotPath string
 }
 
-func NewController(bpfWorkload *bpf.BpfKmeshWorkload) *Controller {
+func NewController(bpfWorkload *bpf.BpfKmeshWorkload, opts *options.WorkloadConfig) (*Controller, error) {
 	c := &Controller{
 		Processor:      newProcessor(bpfWorkload.SockConn.KmeshCgroupSockWorkloadObjects.KmeshCgroupSockWorkloadMaps),
 		bpfWorkloadObj: bpfWorkload,
+		bpfFsEvents:    make(chan bpfcache.BpfFsEvent, 16),
+	}
+	c.Processor.bpf.SetPinPath(bpfWorkload.SockConn.Info.MapPath)
+	if err := c.Processor.applyOptions(opts); err != nil {
+		return nil, fmt.Errorf("apply workload options failed, %s", err)
+	}
+	if opts.TracingEndpoint != "" {
+		tp, err := telemetry.NewOTLPTracerProvider(context.Background(), opts.TracingEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		c.tracerProvider = tp
+		c.Processor.SetTracerProvider(tp)
 	}
 	// do some initialization when restart
 	// restore endpoint index, otherwise endpoint number can double
 	if bpf.GetStartType() == bpf.Restart {
 		c.Processor.bpf.RestoreEndpointKeys()
+		c.Processor.bpf.CompactEndpointIndices()
+		c.Processor.bpf.ReconcileEndpointCount()
+		c.Processor.RestoreWorkloadDigests()
+	}
+	if opts.SnapshotPath != "" {
+		c.snapshotPath = opts.SnapshotPath
+		// the maps are programmed from the control plane anyway, a bad snapshot does not prevent the boot
+		if err := c.Processor.WarmStart(opts.SnapshotPath); err != nil {
+			log.Errorf("warm start from %s failed: %v", opts.SnapshotPath, err)
+		}
 	}
 	c.Rbac = auth.NewRbac(c.Processor.WorkloadCache)
 	c.MetricController = telemetry.NewMetric(c.Processor.WorkloadCache)
-	return c
+	return c, nil
 }
 
 func (c *Controller) Run(ctx context.Context) {
 	go c.Rbac.Run(ctx, c.bpfWorkloadObj.SockOps.MapOfTuple, c.bpfWorkloadObj.XdpAuth.MapOfAuth)
 	go c.MetricController.Run(ctx, c.bpfWorkloadObj.SockConn.MapOfTcpInfo)
+	c.Processor.Start(ctx, c.bpfWorkloadObj.SockConn.KmeshFrontendMiss)
+	go func() {
+		if err := c.Processor.bpf.Watch(ctx, c.bpfFsEvents); err != nil {
+			log.Errorf("watch pinned bpf maps failed: %v", err)
+		}
+	}()
+}
+
+// Stop closes the processor once the stream is no longer handled, the bpf maps are left to the loader.
+// The caches are saved for the warm start of the next boot and the spans of the last responses are
+// exported before it returns.
+func (c *Controller) Stop() error {
+	err := c.Processor.Close()
+	// saved after the pending updates are flushed by Close
+	if c.snapshotPath != "" {
+		if snapshotErr := c.Processor.SaveSnapshot(c.snapshotPath); snapshotErr != nil {
+			err = errors.Join(err, fmt.Errorf("save snapshot failed, %s", snapshotErr))
+		}
+	}
+	if c.tracerProvider != nil {
+		err = errors.Join(err, c.tracerProvider.Shutdown(context.Background()))
+	}
+	return err
+}
+
+// reconcileIfNeeded drains the pending bpf fs events and reconciles the processor once,
+// it runs in the stream goroutine so that the processor is never accessed concurrently.
+func (c *Controller) reconcileIfNeeded() {
+	pending := false
+	for len(c.bpfFsEvents) > 0 {
+		<-c.bpfFsEvents
+		pending = true
+	}
+	if pending {
+		c.Processor.Reconcile()
+	}
 }
 
 func (c *Controller) WorkloadStreamCreateAndSend(client discoveryv3.AggregatedDiscoveryServiceClient, ctx context.Context) error {
@@ -113,6 +181,7 @@ func (c *Controller) HandleWorkloadStream() error {
 		return fmt.Errorf("stream recv failed, %s", err)
 	}
 
+	c.reconcileIfNeeded()
 	c.Processor.processWorkloadResponse(rspDelta, c.Rbac)
 
 	if err = c.Stream.Send(c.Processor.ack); err != nil {
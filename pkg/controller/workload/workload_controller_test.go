@@ -19,8 +19,10 @@ package workload
 import (
 	"context"
 	"errors"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/agiledragon/gomonkey/v2"
 	config_cluster_v3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
@@ -32,11 +34,79 @@ import (
 	core_v2 "kmesh.net/kmesh/api/v2/core"
 	"kmesh.net/kmesh/api/v2/workloadapi"
 	"kmesh.net/kmesh/api/v2/workloadapi/security"
+	"kmesh.net/kmesh/bpf/kmesh/bpf2go"
+	"kmesh.net/kmesh/daemon/options"
 	"kmesh.net/kmesh/pkg/auth"
+	"kmesh.net/kmesh/pkg/bpf"
+	"kmesh.net/kmesh/pkg/constants"
+	"kmesh.net/kmesh/pkg/controller/config"
 	"kmesh.net/kmesh/pkg/controller/workload/bpfcache"
 	"kmesh.net/kmesh/pkg/controller/xdstest"
 )
 
+func TestNewControllerWithFakeProgramLoader(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	workloadObj := &bpf.BpfKmeshWorkload{}
+	workloadObj.SockConn.KmeshCgroupSockWorkloadMaps = workloadMap
+	var loader bpf.ProgramLoader = bpf.NewFakeProgramLoader(workloadObj)
+	if err := loader.Load(); err != nil {
+		t.Fatalf("load fake programs failed, %s", err)
+	}
+	defer func() {
+		_ = loader.Unload()
+	}()
+
+	workloadController, err := NewController(loader.GetBpfKmeshWorkload(), &options.WorkloadConfig{})
+	if err != nil {
+		t.Fatalf("create workload controller failed, %s", err)
+	}
+	wl := createFakeWorkload("10.240.10.1", workloadapi.NetworkMode_STANDARD)
+	if err := workloadController.Processor.handleWorkload(wl); err != nil {
+		t.Fatalf("handle workload failed, %s", err)
+	}
+	backendUid := workloadController.Processor.hashName.Hash(wl.Uid)
+	checkBackendMap(t, workloadController.Processor, backendUid, wl)
+	hashNameClean(workloadController.Processor)
+}
+
+func TestControllerWarmStart(t *testing.T) {
+	snapshotPath := filepath.Join(t.TempDir(), "snapshot")
+	newController := func(workloadMap bpf2go.KmeshCgroupSockWorkloadMaps) *Controller {
+		workloadObj := &bpf.BpfKmeshWorkload{}
+		workloadObj.SockConn.KmeshCgroupSockWorkloadMaps = workloadMap
+		workloadController, err := NewController(workloadObj, &options.WorkloadConfig{SnapshotPath: snapshotPath})
+		if err != nil {
+			t.Fatalf("create workload controller failed, %s", err)
+		}
+		return workloadController
+	}
+
+	// the caches are saved on stop
+	lastMap := bpfcache.NewFakeWorkloadMap(t)
+	last := newController(lastMap)
+	wl := createFakeWorkload("10.240.10.1", workloadapi.NetworkMode_STANDARD)
+	if err := last.Processor.handleWorkload(wl); err != nil {
+		t.Fatalf("handle workload failed, %s", err)
+	}
+	if err := last.Stop(); err != nil {
+		t.Fatalf("stop workload controller failed, %s", err)
+	}
+	hashNameClean(last.Processor)
+	bpfcache.CleanupFakeWorkloadMap(lastMap)
+
+	// and programmed on boot before any response
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+	workloadController := newController(workloadMap)
+	defer hashNameClean(workloadController.Processor)
+	if workloadController.Processor.WorkloadCache.GetWorkloadByUid(wl.Uid) == nil {
+		t.Fatalf("workload %s not warm started", wl.Uid)
+	}
+	checkBackendMap(t, workloadController.Processor, workloadController.Processor.hashName.Hash(wl.Uid), wl)
+}
+
 func TestWorkloadStreamCreateAndSend(t *testing.T) {
 	// create a fake grpc service client
 	mockDiscovery := xdstest.NewXdsServer(t)
@@ -196,6 +266,45 @@ func TestWorkloadStreamCreateAndSend(t *testing.T) {
 	}
 }
 
+func TestWorkloadStreamNodeMetadata(t *testing.T) {
+	mockDiscovery := xdstest.NewXdsServer(t)
+	fakeClient, err := xdstest.NewClient(mockDiscovery)
+	if err != nil {
+		t.Fatalf("create stream failed, %s", err)
+	}
+	defer fakeClient.Cleanup()
+
+	xdsConfig := config.GetConfig(constants.WorkloadMode)
+	defer func(metadata map[string]string) { xdsConfig.XdsNodeMetadata = metadata }(xdsConfig.XdsNodeMetadata)
+	xdsConfig.XdsNodeMetadata = map[string]string{
+		config.NodeMetadataClusterID: "cluster1",
+		config.NodeMetadataNetwork:   "network1",
+		config.NodeMetadataRegion:    "region1",
+	}
+
+	workloadController := Controller{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := workloadController.WorkloadStreamCreateAndSend(fakeClient.Client, ctx); err != nil {
+		t.Fatalf("create workload stream failed, %s", err)
+	}
+
+	select {
+	case req := <-mockDiscovery.DeltaRequests:
+		if req.GetTypeUrl() != AddressType {
+			t.Errorf("first request type is %s, want %s", req.GetTypeUrl(), AddressType)
+		}
+		fields := req.GetNode().GetMetadata().GetFields()
+		for key, want := range xdsConfig.XdsNodeMetadata {
+			if got := fields[key].GetStringValue(); got != want {
+				t.Errorf("node metadata %s is %q, want %q", key, got, want)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request received")
+	}
+}
+
 func TestAdsStream_AdsStreamProcess(t *testing.T) {
 	workloadStream := Controller{
 		Processor: &Processor{
@@ -0,0 +1,94 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"sort"
+
+	service_discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+)
+
+// ResourceDiff holds the resource names of one type changed by a proposed response
+type ResourceDiff struct {
+	Added    []string
+	Removed  []string
+	Modified []string
+}
+
+// AddressDiff is the difference between a proposed address response and the currently applied config
+type AddressDiff struct {
+	Workloads ResourceDiff
+	Services  ResourceDiff
+}
+
+// DiffAddressTypeResponse computes what would change in the WorkloadCache and ServiceCache
+// if rsp was applied, without applying it. Unchanged resources are not reported.
+func (p *Processor) DiffAddressTypeResponse(rsp *service_discovery_v3.DeltaDiscoveryResponse) *AddressDiff {
+	diff := &AddressDiff{}
+
+	for _, resource := range rsp.GetResources() {
+		address := &workloadapi.Address{}
+		if err := anypb.UnmarshalTo(resource.Resource, address, proto.UnmarshalOptions{}); err != nil {
+			log.Errorf("unmarshal resource %s failed: %v", resource.GetName(), err)
+			continue
+		}
+
+		switch address.GetType().(type) {
+		case *workloadapi.Address_Workload:
+			workload := address.GetWorkload()
+			cached := p.WorkloadCache.GetWorkloadByUid(workload.GetUid())
+			if cached == nil {
+				diff.Workloads.Added = append(diff.Workloads.Added, workload.ResourceName())
+			} else if !proto.Equal(cached, workload) {
+				diff.Workloads.Modified = append(diff.Workloads.Modified, workload.ResourceName())
+			}
+		case *workloadapi.Address_Service:
+			service := address.GetService()
+			cached := p.ServiceCache.GetService(service.ResourceName())
+			if cached == nil {
+				diff.Services.Added = append(diff.Services.Added, service.ResourceName())
+			} else if !proto.Equal(cached, service) {
+				diff.Services.Modified = append(diff.Services.Modified, service.ResourceName())
+			}
+		default:
+			log.Errorf("unknown type")
+		}
+	}
+
+	// removing a resource which is not applied is a no-op, so it is not reported
+	for _, name := range rsp.GetRemovedResources() {
+		if isWorkloadResourceName(name) {
+			if p.WorkloadCache.GetWorkloadByUid(name) != nil {
+				diff.Workloads.Removed = append(diff.Workloads.Removed, name)
+			}
+		} else if p.ServiceCache.GetService(name) != nil {
+			diff.Services.Removed = append(diff.Services.Removed, name)
+		}
+	}
+
+	for _, names := range [][]string{
+		diff.Workloads.Added, diff.Workloads.Removed, diff.Workloads.Modified,
+		diff.Services.Added, diff.Services.Removed, diff.Services.Modified,
+	} {
+		sort.Strings(names)
+	}
+	return diff
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"testing"
+
+	service_discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"istio.io/istio/pilot/pkg/util/protoconv"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+)
+
+func TestDiffAddressTypeResponse(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+
+	// 1. apply an initial snapshot
+	svc1 := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	svc2 := createFakeService("svc2", "10.240.10.2", "10.240.10.200")
+	wl1 := createWorkload("wl1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	wl2 := createWorkload("wl2", "10.244.0.2", workloadapi.NetworkMode_STANDARD, "svc2")
+	res := &service_discovery_v3.DeltaDiscoveryResponse{}
+	for _, addr := range []*workloadapi.Address{
+		serviceToAddress(svc1), serviceToAddress(svc2), workloadToAddress(wl1), workloadToAddress(wl2),
+	} {
+		res.Resources = append(res.Resources, &service_discovery_v3.Resource{
+			Resource: protoconv.MessageToAny(addr),
+		})
+	}
+	err := p.handleAddressTypeResponse(res)
+	assert.NoError(t, err)
+
+	// 2. diff a proposed response
+	// svc1 is modified, svc2 is unchanged, svc3 is added
+	newSvc1 := proto.Clone(svc1).(*workloadapi.Service)
+	newSvc1.Ports = newSvc1.Ports[:1]
+	svc3 := createFakeService("svc3", "10.240.10.3", "10.240.10.200")
+	// wl1 is modified, wl2 is removed, wl3 is added
+	newWl1 := proto.Clone(wl1).(*workloadapi.Workload)
+	newWl1.Services["default/svc3.default.svc.cluster.local"] = &workloadapi.PortList{}
+	wl3 := createWorkload("wl3", "10.244.0.3", workloadapi.NetworkMode_STANDARD, "svc3")
+
+	proposed := &service_discovery_v3.DeltaDiscoveryResponse{
+		RemovedResources: []string{wl2.ResourceName(), "default/unknown.default.svc.cluster.local"},
+	}
+	for _, addr := range []*workloadapi.Address{
+		serviceToAddress(newSvc1), serviceToAddress(svc2), serviceToAddress(svc3), workloadToAddress(newWl1), workloadToAddress(wl3),
+	} {
+		proposed.Resources = append(proposed.Resources, &service_discovery_v3.Resource{
+			Resource: protoconv.MessageToAny(addr),
+		})
+	}
+
+	diff := p.DiffAddressTypeResponse(proposed)
+	assert.Equal(t, &AddressDiff{
+		Workloads: ResourceDiff{
+			Added:    []string{wl3.ResourceName()},
+			Removed:  []string{wl2.ResourceName()},
+			Modified: []string{wl1.ResourceName()},
+		},
+		Services: ResourceDiff{
+			Added:    []string{svc3.ResourceName()},
+			Modified: []string{svc1.ResourceName()},
+		},
+	}, diff)
+
+	// 3. the proposed response must not be applied
+	assert.Nil(t, p.WorkloadCache.GetWorkloadByUid(wl3.ResourceName()))
+	assert.NotNil(t, p.WorkloadCache.GetWorkloadByUid(wl2.ResourceName()))
+	assert.Nil(t, p.ServiceCache.GetService(svc3.ResourceName()))
+	assert.Len(t, p.ServiceCache.GetService(svc1.ResourceName()).GetPorts(), 3)
+
+	hashNameClean(p)
+}
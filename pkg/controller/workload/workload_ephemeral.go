@@ -0,0 +1,79 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"slices"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+)
+
+// defaultEphemeralWorkloadTypes are the types of the workloads run to completion, whose pods churn rapidly
+var defaultEphemeralWorkloadTypes = []workloadapi.WorkloadType{
+	workloadapi.WorkloadType_JOB,
+	workloadapi.WorkloadType_CRONJOB,
+}
+
+// EphemeralWorkloadPolicy tells which workloads are short-lived and how they are handled
+type EphemeralWorkloadPolicy struct {
+	// Types are the workload types of the ephemeral workloads, Job and CronJob if empty
+	Types []workloadapi.WorkloadType
+	// SkipPersist keeps the hash names of the ephemeral workloads out of the persist file, so that their
+	// churn does not grow it. Their backends left by the last run are removed on restart unless received again.
+	SkipPersist bool
+}
+
+// SetEphemeralWorkloadPolicy sets how the ephemeral workloads are classified and handled. They are
+// counted apart in Stats, the zero policy classifies the Job and CronJob workloads as ephemeral.
+func (p *Processor) SetEphemeralWorkloadPolicy(policy EphemeralWorkloadPolicy) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	// the policy is read by handleWorkload
+	p.handleMutex.Lock()
+	defer p.handleMutex.Unlock()
+
+	policy.Types = slices.Clone(policy.Types)
+	p.ephemeralPolicy = policy
+}
+
+// isEphemeralWorkload tells whether the workload is ephemeral per the ephemeral workload policy
+func (p *Processor) isEphemeralWorkload(workload *workloadapi.Workload) bool {
+	types := p.ephemeralPolicy.Types
+	if len(types) == 0 {
+		types = defaultEphemeralWorkloadTypes
+	}
+	return slices.Contains(types, workload.GetWorkloadType())
+}
+
+// removeUnknownBackends removes the backends whose uid has no hash name, these are the ephemeral
+// workloads of the last run not persisted and not received again
+func (p *Processor) removeUnknownBackends() {
+	digests, err := p.bpf.BackendDigests()
+	if err != nil {
+		log.Errorf("list backends failed: %v", err)
+		return
+	}
+	for uid := range digests {
+		if p.hashName.NumToStr(uid) != "" {
+			continue
+		}
+		log.Debugf("backend %d has no hash name, remove it", uid)
+		if err := p.removeBackendFromBpfMap(uid); err != nil {
+			log.Errorf("remove backend %d failed: %v", uid, err)
+		}
+	}
+}
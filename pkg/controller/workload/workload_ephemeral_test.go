@@ -0,0 +1,85 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"testing"
+
+	service_discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/stretchr/testify/assert"
+	"istio.io/istio/pilot/pkg/util/protoconv"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/bpf"
+	"kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+)
+
+func TestEphemeralWorkloads(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	p.SetEphemeralWorkloadPolicy(EphemeralWorkloadPolicy{SkipPersist: true})
+
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	pod := createWorkload("pod", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	job := createWorkload("job", "10.244.0.2", workloadapi.NetworkMode_STANDARD, "svc1")
+	job.WorkloadType = workloadapi.WorkloadType_JOB
+	assert.False(t, p.isEphemeralWorkload(pod))
+	assert.True(t, p.isEphemeralWorkload(job))
+
+	assert.NoError(t, p.handleService(svc))
+	assert.NoError(t, p.handleWorkload(pod))
+	assert.NoError(t, p.handleWorkload(job))
+	jobId := p.hashName.Hash(job.Uid)
+	checkBackendMap(t, p, jobId, job)
+	checkServiceMap(t, p, p.hashName.Hash(svc.ResourceName()), svc, 2)
+
+	stats, err := p.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.Workloads)
+	assert.Equal(t, 1, stats.EphemeralWorkloads)
+
+	// the uid of the job is not persisted
+	persisted := NewHashName()
+	assert.NotEmpty(t, persisted.NumToStr(p.hashName.Hash(pod.Uid)))
+	assert.Empty(t, persisted.NumToStr(jobId))
+
+	// restart, the job is gone meanwhile and its backend is removed
+	bpf.SetStartType(bpf.Restart)
+	defer bpf.SetStartType(bpf.Normal)
+	p = newProcessor(workloadMap)
+	defer hashNameClean(p)
+	p.bpf.RestoreEndpointKeys()
+	res := &service_discovery_v3.DeltaDiscoveryResponse{
+		Resources: []*service_discovery_v3.Resource{
+			{Resource: protoconv.MessageToAny(serviceToAddress(svc))},
+			{Resource: protoconv.MessageToAny(workloadToAddress(pod))},
+		},
+	}
+	assert.NoError(t, p.handleAddressTypeResponse(res))
+	var bv bpfcache.BackendValue
+	assert.Error(t, p.bpf.BackendLookup(&bpfcache.BackendKey{BackendUid: jobId}, &bv))
+	checkNotExistInFrontEndMap(t, job.Addresses[0], p)
+	checkServiceMap(t, p, p.hashName.Hash(svc.ResourceName()), svc, 1)
+	checkEndpointMap(t, p, svc, []uint32{p.hashName.Hash(pod.Uid)})
+
+	// the policy applies to the configured types only
+	p.SetEphemeralWorkloadPolicy(EphemeralWorkloadPolicy{Types: []workloadapi.WorkloadType{workloadapi.WorkloadType_POD}})
+	assert.True(t, p.isEphemeralWorkload(pod))
+	assert.False(t, p.isEphemeralWorkload(job))
+}
@@ -30,17 +30,27 @@ const (
 	persistPath = "/mnt/workload_hash_name.yaml"
 )
 
-// HashName converts a string to a uint32 integer as the key of bpf map
+// HashName converts a string to a uint32 integer as the key of bpf map. Distinct strings always get
+// distinct integers: a string whose hash is taken by another one gets the next free integer.
 type HashName struct {
 	numToStr map[uint32]string
 	strToNum map[string]uint32
 	hash     hash.Hash32
+	// names not persisted, see HashEphemeral
+	ephemeral map[string]struct{}
 }
 
 func NewHashName() *HashName {
+	return NewHashNameWithHasher(fnv.New32a())
+}
+
+// NewHashNameWithHasher is the same as NewHashName, except the strings are hashed with hasher,
+// the strings persisted by the last run keep their integers whatever hashed them
+func NewHashNameWithHasher(hasher hash.Hash32) *HashName {
 	hashName := &HashName{
-		strToNum: make(map[string]uint32),
-		hash:     fnv.New32a(),
+		strToNum:  make(map[string]uint32),
+		hash:      hasher,
+		ephemeral: make(map[string]struct{}),
 	}
 	// if read failed, initialize with an empty map
 	if err := hashName.readFromPersistFile(); err != nil {
@@ -65,11 +75,20 @@ func (h *HashName) readFromPersistFile() error {
 
 func (h *HashName) flush() error {
 	// We only need to flush strToNum here, since we can generate numToStr from it.
-	if len(h.strToNum) == 0 {
+	persisted := h.strToNum
+	if len(h.ephemeral) > 0 {
+		persisted = make(map[string]uint32, len(h.strToNum))
+		for str, num := range h.strToNum {
+			if _, ok := h.ephemeral[str]; !ok {
+				persisted[str] = num
+			}
+		}
+	}
+	if len(persisted) == 0 {
 		return os.WriteFile(persistPath, nil, 0644)
 	}
 
-	yaml, err := yaml.Marshal(h.strToNum)
+	yaml, err := yaml.Marshal(persisted)
 	if err != nil {
 		return err
 	}
@@ -91,6 +110,17 @@ func (h *HashName) flushDelta(str string, num uint32) error {
 }
 
 func (h *HashName) Hash(str string) uint32 {
+	return h.hashName(str, true)
+}
+
+// HashEphemeral is the same as Hash, except a new name is not persisted, its integer is lost on restart.
+// It is meant for short-lived names whose churn would grow the persist file. A name already hashed is
+// left as is.
+func (h *HashName) HashEphemeral(str string) uint32 {
+	return h.hashName(str, false)
+}
+
+func (h *HashName) hashName(str string, persist bool) uint32 {
 	var num uint32
 
 	if num, exists := h.strToNum[str]; exists {
@@ -99,12 +129,23 @@ func (h *HashName) Hash(str string) uint32 {
 
 	h.hash.Reset()
 	h.hash.Write([]byte(str))
+	sum := h.hash.Sum32()
 	// Using linear probing to solve hash conflicts
-	for num = h.hash.Sum32(); num < math.MaxUint32; num++ {
+	for num = sum; num < math.MaxUint32; num++ {
 		// Create a new item if we find an empty slot
 		if _, exists := h.numToStr[num]; !exists {
+			if num != sum {
+				log.Warnf("hash %d of %s collides with %s, allocate %d instead", sum, str, h.numToStr[sum], num)
+			}
 			h.numToStr[num] = str
 			h.strToNum[str] = num
+			if !persist {
+				if h.ephemeral == nil {
+					h.ephemeral = make(map[string]struct{})
+				}
+				h.ephemeral[str] = struct{}{}
+				break
+			}
 			// Create a new item here, should flush
 			if err := h.flushDelta(str, num); err != nil {
 				log.Errorf("error flushing when calling Hash: %v", err)
@@ -129,6 +170,11 @@ func (h *HashName) Delete(str string) {
 	if num, exists := h.strToNum[str]; exists {
 		delete(h.numToStr, num)
 		delete(h.strToNum, str)
+		if _, ok := h.ephemeral[str]; ok {
+			// not persisted, nothing to flush
+			delete(h.ephemeral, str)
+			return
+		}
 		// delete an old item here, should flush
 		if err := h.flush(); err != nil {
 			log.Errorf("error flushing when calling Delete: %v", err)
@@ -136,7 +182,35 @@ func (h *HashName) Delete(str string) {
 	}
 }
 
+// DeleteAll is the same as calling Delete for each name, except the persist file is flushed once
+func (h *HashName) DeleteAll(strs []string) {
+	deleted := false
+	for _, str := range strs {
+		if num, exists := h.strToNum[str]; exists {
+			delete(h.numToStr, num)
+			delete(h.strToNum, str)
+			if _, ok := h.ephemeral[str]; ok {
+				delete(h.ephemeral, str)
+				continue
+			}
+			deleted = true
+		}
+	}
+
+	if deleted {
+		if err := h.flush(); err != nil {
+			log.Errorf("error flushing when calling DeleteAll: %v", err)
+		}
+	}
+}
+
+// Reset clears all the names, both in memory and in the persist file.
 // Should only be used by test
 func (h *HashName) Reset() {
-	os.Remove(persistPath)
+	h.strToNum = make(map[string]uint32)
+	h.numToStr = make(map[uint32]string)
+	h.ephemeral = make(map[string]struct{})
+	if err := os.Remove(persistPath); err != nil && !os.IsNotExist(err) {
+		log.Errorf("remove hash name persist file failed: %v", err)
+	}
 }
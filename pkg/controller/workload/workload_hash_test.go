@@ -17,6 +17,7 @@
 package workload
 
 import (
+	"encoding/binary"
 	"hash/fnv"
 	"os"
 	"testing"
@@ -114,3 +115,126 @@ func TestWorkloadHash_StrToNumAfterDelete(t *testing.T) {
 
 	hashName.Reset()
 }
+
+func TestWorkloadHash_Reset(t *testing.T) {
+	cleanPersistFile()
+	hashName := NewHashName()
+	num := hashName.Hash("foo")
+
+	hashName.Reset()
+	if _, err := os.Stat(persistPath); !os.IsNotExist(err) {
+		t.Errorf("persist file should be removed, stat err: %v", err)
+	}
+	if str := hashName.NumToStr(num); str != "" {
+		t.Errorf("NumToStr(%d) = %s after reset, want empty", num, str)
+	}
+	if reloaded := NewHashName(); len(reloaded.strToNum) != 0 {
+		t.Errorf("reloaded hash name should be empty, got %v", reloaded.strToNum)
+	}
+}
+
+func TestWorkloadHash_DeleteAll(t *testing.T) {
+	cleanPersistFile()
+	hashName := NewHashName()
+	foo := hashName.Hash("foo")
+	bar := hashName.Hash("bar")
+	baz := hashName.Hash("baz")
+
+	hashName.DeleteAll([]string{"foo", "baz", "unknown"})
+	if str := hashName.NumToStr(foo); str != "" {
+		t.Errorf("NumToStr(%d) = %s after delete, want empty", foo, str)
+	}
+	if str := hashName.NumToStr(baz); str != "" {
+		t.Errorf("NumToStr(%d) = %s after delete, want empty", baz, str)
+	}
+	// the remaining names are persisted
+	reloaded := NewHashName()
+	if len(reloaded.strToNum) != 1 || reloaded.NumToStr(bar) != "bar" {
+		t.Errorf("reloaded hash name should only contain bar, got %v", reloaded.strToNum)
+	}
+	cleanPersistFile()
+}
+
+func TestWorkloadHash_Ephemeral(t *testing.T) {
+	cleanPersistFile()
+	hashName := NewHashName()
+	defer hashName.Reset()
+
+	foo := hashName.Hash("foo")
+	job := hashName.HashEphemeral("job")
+	if num := hashName.Hash("job"); num != job {
+		t.Errorf("Hash(job) = %d, want %d", num, job)
+	}
+	// a persisted name stays persisted
+	if num := hashName.HashEphemeral("foo"); num != foo {
+		t.Errorf("HashEphemeral(foo) = %d, want %d", num, foo)
+	}
+
+	reloaded := NewHashName()
+	if len(reloaded.strToNum) != 1 || reloaded.NumToStr(foo) != "foo" {
+		t.Errorf("reloaded hash name should only contain foo, got %v", reloaded.strToNum)
+	}
+
+	// a full flush does not persist it either
+	hashName.Hash("bar")
+	hashName.Delete("bar")
+	reloaded = NewHashName()
+	if len(reloaded.strToNum) != 1 || reloaded.NumToStr(foo) != "foo" {
+		t.Errorf("reloaded hash name should only contain foo, got %v", reloaded.strToNum)
+	}
+
+	hashName.Delete("job")
+	if str := hashName.NumToStr(job); str != "" {
+		t.Errorf("NumToStr(%d) = %s after delete, want empty", job, str)
+	}
+	if len(hashName.ephemeral) != 0 {
+		t.Errorf("ephemeral names should be empty, got %v", hashName.ephemeral)
+	}
+}
+
+// constHash hashes every string to the same sum
+type constHash struct {
+	sum uint32
+}
+
+func (c constHash) Write(p []byte) (int, error) { return len(p), nil }
+func (c constHash) Sum(b []byte) []byte         { return binary.BigEndian.AppendUint32(b, c.sum) }
+func (c constHash) Reset()                      {}
+func (c constHash) Size() int                   { return 4 }
+func (c constHash) BlockSize() int              { return 1 }
+func (c constHash) Sum32() uint32               { return c.sum }
+
+func TestWorkloadHash_Collision(t *testing.T) {
+	cleanPersistFile()
+	hashName := NewHashNameWithHasher(constHash{sum: 42})
+	defer hashName.Reset()
+
+	// every name collides, each gets the next free id
+	for i, str := range []string{"foo", "bar", "baz"} {
+		if num := hashName.Hash(str); num != uint32(42+i) {
+			t.Errorf("Hash(%s) = %d, want %d", str, num, 42+i)
+		}
+	}
+	if num := hashName.Hash("bar"); num != 43 {
+		t.Errorf("Hash(bar) = %d after collisions, want 43", num)
+	}
+	for num, str := range map[uint32]string{42: "foo", 43: "bar", 44: "baz"} {
+		if got := hashName.NumToStr(num); got != str {
+			t.Errorf("NumToStr(%d) = %s, want %s", num, got, str)
+		}
+	}
+
+	// the id freed is allocated again
+	hashName.Delete("bar")
+	if num := hashName.Hash("qux"); num != 43 {
+		t.Errorf("Hash(qux) = %d, want the freed 43", num)
+	}
+
+	// the ids persisted are kept whatever the hasher
+	reloaded := NewHashName()
+	for str, num := range map[string]uint32{"foo": 42, "qux": 43, "baz": 44} {
+		if got := reloaded.Hash(str); got != num {
+			t.Errorf("reloaded Hash(%s) = %d, want %d", str, got, num)
+		}
+	}
+}
@@ -0,0 +1,371 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sync/errgroup"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	bpf "kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+)
+
+const (
+	defaultHealthCheckTimeout = time.Second
+	// maximum number of probes in flight
+	healthCheckConcurrency = 32
+
+	// protocol numbers of ICMP and ICMPv6, to parse the replies
+	protocolICMP     = 1
+	protocolIPv6ICMP = 58
+)
+
+// icmpSeq numbers the echo requests, so that each probe recognizes its reply among the ones
+// received by all the raw sockets
+var icmpSeq atomic.Uint32
+
+// Prober checks whether a backend is reachable at address, a nil error means it is
+type Prober func(ctx context.Context, address netip.AddrPort) error
+
+// tcpProbe tells a backend is reachable if a TCP connection to it is established
+func tcpProbe(ctx context.Context, address netip.AddrPort) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address.String())
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// icmpProbe tells a backend is reachable if it answers an ICMP echo request, the port is ignored.
+// It needs a raw socket, hence CAP_NET_RAW.
+func icmpProbe(ctx context.Context, address netip.AddrPort) error {
+	addr := address.Addr().Unmap()
+	network, listenAddr, protocol := "ip4:icmp", "0.0.0.0", protocolICMP
+	var requestType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	if addr.Is6() {
+		network, listenAddr, protocol = "ip6:ipv6-icmp", "::", protocolIPv6ICMP
+		requestType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+	}
+
+	conn, err := icmp.ListenPacket(network, listenAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	// unblocks the read below once ctx is canceled
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	echo := &icmp.Echo{ID: os.Getpid() & 0xffff, Seq: int(icmpSeq.Add(1) & 0xffff), Data: []byte("kmesh")}
+	request, err := (&icmp.Message{Type: requestType, Body: echo}).Marshal(nil)
+	if err != nil {
+		return err
+	}
+	if _, err = conn.WriteTo(request, &net.IPAddr{IP: addr.AsSlice()}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		reply, err := icmp.ParseMessage(protocol, buf[:n])
+		if err != nil || reply.Type != replyType {
+			continue
+		}
+		body, ok := reply.Body.(*icmp.Echo)
+		if !ok || body.ID != echo.ID || body.Seq != echo.Seq {
+			continue
+		}
+		if ip, ok := peer.(*net.IPAddr); !ok || !ip.IP.Equal(addr.AsSlice()) {
+			return fmt.Errorf("echo reply from %s instead of %s", peer, addr)
+		}
+		return nil
+	}
+}
+
+// SetActiveHealthCheck probes the backend of every endpoint each interval, by default with a TCP connection
+// to the target port of the service, or of another service of the workload if the service has no port.
+// Virtual machines are pinged at their address instead, they may not listen on the service ports. The endpoints whose probe fails or does not
+// complete within timeout are marked unready and skipped by the load balancing until a probe succeeds.
+// The endpoints without an address or a port to probe are left ready, and logged once excluded.
+// It is meant as a fallback when the health reported by the control plane is stale. A zero interval
+// disables it, and a nil prober uses TCP, the prober is not used for virtual machines. It must be called before Start.
+func (p *Processor) SetActiveHealthCheck(interval, timeout time.Duration, prober Prober) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if interval <= 0 {
+		p.healthChecker = nil
+		return
+	}
+	p.healthChecker = newHealthChecker(p, interval, timeout, prober)
+}
+
+// healthChecker marks the endpoints whose backend is unreachable as unready. Like the other operations
+// on the caches and the bpf maps, it lists the targets and writes the readiness under mutex then
+// handleMutex, the probes run without any lock.
+type healthChecker struct {
+	p        *Processor
+	interval time.Duration
+	timeout  time.Duration
+	probe    Prober
+	// ping probes the virtual machines
+	ping Prober
+	// endpoints excluded from the last check with the reason, each exclusion is logged once
+	excluded map[bpf.EndpointKey]string
+}
+
+// healthTarget is the backend of an endpoint, the address probed for it,
+// a virtual machine is pinged so its address has no port
+type healthTarget struct {
+	serviceId  uint32
+	backendUid uint32
+	address    netip.AddrPort
+	vm         bool
+}
+
+func newHealthChecker(p *Processor, interval, timeout time.Duration, prober Prober) *healthChecker {
+	if timeout <= 0 {
+		timeout = defaultHealthCheckTimeout
+	}
+	if prober == nil {
+		prober = tcpProbe
+	}
+	return &healthChecker{
+		p:        p,
+		interval: interval,
+		timeout:  timeout,
+		probe:    prober,
+		ping:     icmpProbe,
+		excluded: make(map[bpf.EndpointKey]string),
+	}
+}
+
+func (h *healthChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.check(ctx)
+		}
+	}
+}
+
+// check probes the backends of all the endpoints and returns the endpoints whose readiness changed
+func (h *healthChecker) check(ctx context.Context) []bpf.EndpointKey {
+	targets := h.targets()
+
+	unready := make([]bool, len(targets))
+	g := errgroup.Group{}
+	g.SetLimit(healthCheckConcurrency)
+	for i, target := range targets {
+		g.Go(func() error {
+			probeCtx, cancel := context.WithTimeout(ctx, h.timeout)
+			defer cancel()
+			probe := h.probe
+			if target.vm {
+				probe = h.ping
+			}
+			if err := probe(probeCtx, target.address); err != nil {
+				log.Debugf("probe backend %d at %s failed: %v", target.backendUid, target.address, err)
+				unready[i] = true
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+	if ctx.Err() != nil {
+		// the probes were canceled, their failures tell nothing about the backends
+		return nil
+	}
+
+	return h.update(targets, unready)
+}
+
+// targets lists the backends of the endpoints with the address to probe them at. An endpoint is
+// excluded if its workload is unknown or has no address, e.g. a virtual machine only reachable through
+// its network gateway, or if no port of its services is known, unless it is a virtual machine.
+func (h *healthChecker) targets() []healthTarget {
+	p := h.p
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.handleMutex.Lock()
+	defer p.handleMutex.Unlock()
+
+	var targets []healthTarget
+	seen := make(map[healthTarget]struct{})
+	excluded := make(map[bpf.EndpointKey]string)
+	exclude := func(key bpf.EndpointKey, backendUid uint32, reason string) {
+		excluded[key] = reason
+		if h.excluded[key] != reason {
+			log.Infof("backend %d of service %d is not health checked: %s", backendUid, key.ServiceId, reason)
+		}
+	}
+	err := p.bpf.RangeEndpoints(func(key bpf.EndpointKey, value bpf.EndpointValue) error {
+		workload := p.WorkloadCache.GetWorkloadByUid(p.hashName.NumToStr(value.BackendUid))
+		serviceName := p.hashName.NumToStr(key.ServiceId)
+		if workload == nil {
+			exclude(key, value.BackendUid, "unknown workload")
+			return nil
+		}
+		addrs := reachableAddresses(workload)
+		if len(addrs) == 0 {
+			if isVirtualMachine(workload) {
+				exclude(key, value.BackendUid, "virtual machine without address")
+			} else {
+				exclude(key, value.BackendUid, "workload without address")
+			}
+			return nil
+		}
+		addr, ok := netip.AddrFromSlice(addrs[0])
+		if !ok {
+			exclude(key, value.BackendUid, "invalid address")
+			return nil
+		}
+
+		// virtual machines are pinged, they need no port
+		target := healthTarget{
+			serviceId:  key.ServiceId,
+			backendUid: value.BackendUid,
+			address:    netip.AddrPortFrom(addr.Unmap(), 0),
+			vm:         isVirtualMachine(workload),
+		}
+		if !target.vm {
+			port := healthCheckPort(workload, p.ServiceCache.GetService(serviceName), serviceName)
+			if port == 0 {
+				port = p.otherServiceHealthCheckPort(workload, serviceName)
+			}
+			if port == 0 {
+				exclude(key, value.BackendUid, "no port to probe")
+				return nil
+			}
+			target.address = netip.AddrPortFrom(target.address.Addr(), uint16(port))
+		}
+		if _, ok := seen[target]; !ok {
+			seen[target] = struct{}{}
+			targets = append(targets, target)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("iterate endpoint map failed: %v", err)
+		return targets
+	}
+	h.excluded = excluded
+	return targets
+}
+
+// otherServiceHealthCheckPort returns the health check port of the first other service of the workload
+// having one, in the order of the service names, 0 if none
+func (p *Processor) otherServiceHealthCheckPort(workload *workloadapi.Workload, serviceName string) uint32 {
+	names := make([]string, 0, len(workload.GetServices()))
+	for name := range workload.GetServices() {
+		if name != serviceName {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		if port := healthCheckPort(workload, p.ServiceCache.GetService(name), name); port != 0 {
+			return port
+		}
+	}
+	return 0
+}
+
+// healthCheckPort returns the first target port of the workload for the service, or of the service
+func healthCheckPort(workload *workloadapi.Workload, service *workloadapi.Service, serviceName string) uint32 {
+	for _, port := range workload.GetServices()[serviceName].GetPorts() {
+		if port.GetTargetPort() != 0 {
+			return port.GetTargetPort()
+		}
+	}
+	for _, port := range service.GetPorts() {
+		if port.GetTargetPort() != 0 {
+			return port.GetTargetPort()
+		}
+		if port.GetServicePort() != 0 {
+			return port.GetServicePort()
+		}
+	}
+	return 0
+}
+
+// update writes the readiness of the endpoints of the targets, the endpoints may have moved or
+// been removed while probing, so they are looked up again
+func (h *healthChecker) update(targets []healthTarget, unready []bool) []bpf.EndpointKey {
+	p := h.p
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.handleMutex.Lock()
+	defer p.handleMutex.Unlock()
+
+	var changed []bpf.EndpointKey
+	for i, target := range targets {
+		var flag uint8
+		if unready[i] {
+			flag = 1
+		}
+		for ek := range p.bpf.GetEndpointKeys(target.backendUid) {
+			if ek.ServiceId != target.serviceId {
+				continue
+			}
+			ev := bpf.EndpointValue{}
+			if err := p.bpf.EndpointLookup(&ek, &ev); err != nil || ev.Unready == flag {
+				continue
+			}
+			// LastUpdated tracks the writes of the xDS processing, it is kept
+			ev.Unready = flag
+			if err := p.bpf.EndpointUpdate(&ek, &ev); err != nil {
+				log.Errorf("update readiness of endpoint %#v failed: %v", ek, err)
+				continue
+			}
+			if unready[i] {
+				log.Warnf("backend %d of service %d is unreachable at %s, mark it unready", target.backendUid, target.serviceId, target.address)
+			} else {
+				log.Infof("backend %d of service %d is reachable at %s again, mark it ready", target.backendUid, target.serviceId, target.address)
+			}
+			changed = append(changed, ek)
+		}
+	}
+	return changed
+}
@@ -0,0 +1,229 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+)
+
+func TestHealthChecker(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc))
+	wl1 := createWorkload("wl1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	wl2 := createWorkload("wl2", "10.244.0.2", workloadapi.NetworkMode_STANDARD, "svc1")
+	assert.NoError(t, p.handleWorkload(wl1))
+	assert.NoError(t, p.handleWorkload(wl2))
+
+	var (
+		mu      sync.Mutex
+		down    = map[netip.AddrPort]bool{}
+		probed  []netip.AddrPort
+		wl2Addr = netip.MustParseAddrPort("10.244.0.2:8080")
+	)
+	h := newHealthChecker(p, time.Second, 10*time.Millisecond, func(ctx context.Context, address netip.AddrPort) error {
+		mu.Lock()
+		probed = append(probed, address)
+		isDown := down[address]
+		mu.Unlock()
+		if isDown {
+			// hangs until the timeout
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+
+	// readyBackends returns the backends of the endpoints the load balancing selects from
+	readyBackends := func() []uint32 {
+		var uids []uint32
+		for _, ev := range p.bpf.GetAllEndpointsForService(p.hashName.Hash(svc.ResourceName())) {
+			if ev.Unready == 0 {
+				uids = append(uids, ev.BackendUid)
+			}
+		}
+		return uids
+	}
+	wl1Id, wl2Id := p.hashName.Hash(wl1.Uid), p.hashName.Hash(wl2.Uid)
+
+	// 1. all the backends are reachable at the target port of the service
+	assert.Empty(t, h.check(context.Background()))
+	assert.ElementsMatch(t, []netip.AddrPort{netip.MustParseAddrPort("10.244.0.1:8080"), wl2Addr}, probed)
+	assert.ElementsMatch(t, []uint32{wl1Id, wl2Id}, readyBackends())
+
+	// 2. wl2 probe times out, it is excluded from selection
+	ek := p.bpf.GetEndpointKeys(wl2Id).UnsortedList()[0]
+	var ev bpfcache.EndpointValue
+	assert.NoError(t, p.bpf.EndpointLookup(&ek, &ev))
+	lastUpdated := ev.LastUpdated
+
+	down[wl2Addr] = true
+	assert.Equal(t, []bpfcache.EndpointKey{ek}, h.check(context.Background()))
+	assert.Equal(t, []uint32{wl1Id}, readyBackends())
+	assert.Empty(t, h.check(context.Background()))
+
+	// 3. wl2 is reachable again, the readiness changes do not count as updates
+	down[wl2Addr] = false
+	assert.Equal(t, []bpfcache.EndpointKey{ek}, h.check(context.Background()))
+	assert.ElementsMatch(t, []uint32{wl1Id, wl2Id}, readyBackends())
+	assert.NoError(t, p.bpf.EndpointLookup(&ek, &ev))
+	assert.Equal(t, lastUpdated, ev.LastUpdated)
+
+	// 4. the failures of canceled probes are ignored
+	down[wl2Addr] = true
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Empty(t, h.check(ctx))
+	assert.ElementsMatch(t, []uint32{wl1Id, wl2Id}, readyBackends())
+}
+
+func TestSetActiveHealthCheck(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	p.SetActiveHealthCheck(time.Second, 0, nil)
+	assert.NotNil(t, p.healthChecker)
+	assert.Equal(t, defaultHealthCheckTimeout, p.healthChecker.timeout)
+	assert.Error(t, p.healthChecker.probe(context.Background(), netip.MustParseAddrPort("127.0.0.1:0")))
+
+	p.SetActiveHealthCheck(0, 0, func(context.Context, netip.AddrPort) error { return errors.New("down") })
+	assert.Nil(t, p.healthChecker)
+}
+
+func TestHealthCheckerTargets(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	svc1 := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	portless := createFakeService("svc2", "10.240.10.2", "10.240.10.200")
+	portless.Ports = nil
+	assert.NoError(t, p.handleService(svc1))
+	assert.NoError(t, p.handleService(portless))
+
+	// wl1 is probed for svc2 at the port of its other service
+	wl1 := createWorkload("wl1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1", "svc2")
+	// wl2 has no port to probe for svc2
+	wl2 := createWorkload("wl2", "10.244.0.2", workloadapi.NetworkMode_STANDARD, "svc2")
+	// the vm has no address, it is only reachable through its network gateway
+	vm := createWorkload("vm1", "10.10.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	vm.Uid = "cluster0/networking.istio.io/WorkloadEntry/default/vm1"
+	vm.Addresses = nil
+	// the workloads have no port for svc2 either
+	wl1.Services[portless.ResourceName()] = &workloadapi.PortList{}
+	wl2.Services[portless.ResourceName()] = &workloadapi.PortList{}
+	for _, wl := range []*workloadapi.Workload{wl1, wl2, vm} {
+		assert.NoError(t, p.handleWorkload(wl))
+	}
+
+	h := newHealthChecker(p, time.Second, 0, nil)
+	targets := h.targets()
+	addresses := make(map[uint32]netip.AddrPort)
+	for _, target := range targets {
+		if target.serviceId == p.hashName.Hash(portless.ResourceName()) {
+			addresses[target.backendUid] = target.address
+		}
+	}
+	assert.Len(t, targets, 2)
+	assert.Equal(t, map[uint32]netip.AddrPort{p.hashName.Hash(wl1.Uid): netip.MustParseAddrPort("10.244.0.1:8080")}, addresses)
+
+	reasons := make(map[uint32]string)
+	for ek, reason := range h.excluded {
+		for _, wl := range []*workloadapi.Workload{wl2, vm} {
+			if p.bpf.GetEndpointKeys(p.hashName.Hash(wl.Uid)).Contains(ek) {
+				reasons[p.hashName.Hash(wl.Uid)] = reason
+			}
+		}
+	}
+	assert.Equal(t, map[uint32]string{
+		p.hashName.Hash(wl2.Uid): "no port to probe",
+		p.hashName.Hash(vm.Uid):  "virtual machine without address",
+	}, reasons)
+}
+
+func TestHealthCheckerVirtualMachine(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc))
+	pod := createWorkload("pod1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	vm := createWorkload("vm1", "10.10.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	vm.Uid = "cluster0/networking.istio.io/WorkloadEntry/default/vm1"
+	// the vm is probed even without port
+	vm.Services[svc.ResourceName()] = &workloadapi.PortList{}
+	assert.NoError(t, p.handleWorkload(pod))
+	assert.NoError(t, p.handleWorkload(vm))
+
+	var (
+		mu     sync.Mutex
+		probed []netip.AddrPort
+		pinged []netip.AddrPort
+	)
+	h := newHealthChecker(p, time.Second, 0, func(ctx context.Context, address netip.AddrPort) error {
+		mu.Lock()
+		defer mu.Unlock()
+		probed = append(probed, address)
+		return nil
+	})
+	h.ping = func(ctx context.Context, address netip.AddrPort) error {
+		mu.Lock()
+		defer mu.Unlock()
+		pinged = append(pinged, address)
+		return errors.New("no echo reply")
+	}
+
+	vmId := p.hashName.Hash(vm.Uid)
+	changed := h.check(context.Background())
+	assert.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("10.244.0.1:8080")}, probed)
+	assert.Equal(t, []netip.AddrPort{netip.AddrPortFrom(netip.MustParseAddr("10.10.0.1"), 0)}, pinged)
+	assert.Equal(t, p.bpf.GetEndpointKeys(vmId).UnsortedList(), changed)
+}
+
+func TestICMPProbe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := icmpProbe(ctx, netip.MustParseAddrPort("127.0.0.1:0"))
+	if errors.Is(err, os.ErrPermission) {
+		t.Skip("raw sockets are not permitted")
+	}
+	assert.NoError(t, err)
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"fmt"
+
+	"kmesh.net/kmesh/pkg/controller/telemetry"
+)
+
+const (
+	namespaceKindWorkload = "workload"
+	namespaceKindService  = "service"
+)
+
+// NamespaceLimit caps the resources of a namespace programmed in the bpf maps, so that a namespace
+// cannot exhaust the maps shared by all of them
+type NamespaceLimit struct {
+	// Workloads is the max number of workloads of the namespace, 0 for no limit
+	Workloads int
+	// Services is the max number of services of the namespace, 0 for no limit
+	Services int
+}
+
+// namespaceUsage counts the cached workloads and services of a namespace
+type namespaceUsage struct {
+	workloads int
+	services  int
+}
+
+// SetNamespaceLimit caps the workloads and services of namespace, the zero limit removes the cap. The
+// new resources of the namespace beyond its cap are rejected with an error, the updates of the resources
+// already programmed are not. Lowering a cap below the current usage does not remove any resource.
+func (p *Processor) SetNamespaceLimit(namespace string, limit NamespaceLimit) error {
+	if limit.Workloads < 0 || limit.Services < 0 {
+		return fmt.Errorf("negative limit %+v of namespace %s", limit, namespace)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	// the limits are read by handleWorkload and handleService
+	p.handleMutex.Lock()
+	defer p.handleMutex.Unlock()
+
+	if limit == (NamespaceLimit{}) {
+		delete(p.namespaceLimits, namespace)
+		return nil
+	}
+	p.namespaceLimits[namespace] = limit
+	return nil
+}
+
+// admitNamespaceResource returns an error if a new resource of the kind would exceed the cap of namespace
+func (p *Processor) admitNamespaceResource(kind, namespace, name string) error {
+	limit, ok := p.namespaceLimits[namespace]
+	if !ok {
+		return nil
+	}
+	usage := p.namespaceUsage[namespace]
+
+	capacity, count := limit.Workloads, usage.workloads
+	if kind == namespaceKindService {
+		capacity, count = limit.Services, usage.services
+	}
+	if capacity == 0 || count < capacity {
+		return nil
+	}
+	log.Warnf("namespace %s reached its limit of %d %ss, reject %s %s", namespace, capacity, kind, kind, name)
+	telemetry.NamespaceLimitRejected.WithLabelValues(namespace, kind).Inc()
+	return fmt.Errorf("namespace %s reached its limit of %d %ss", namespace, capacity, kind)
+}
+
+// countNamespaceResource adds delta to the resources of the kind cached for namespace
+func (p *Processor) countNamespaceResource(kind, namespace string, delta int) {
+	usage := p.namespaceUsage[namespace]
+	if kind == namespaceKindService {
+		usage.services += delta
+	} else {
+		usage.workloads += delta
+	}
+	if usage == (namespaceUsage{}) {
+		delete(p.namespaceUsage, namespace)
+		return
+	}
+	p.namespaceUsage[namespace] = usage
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/controller/telemetry"
+	"kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+)
+
+func TestNamespaceLimit(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	assert.Error(t, p.SetNamespaceLimit("tenant", NamespaceLimit{Workloads: -1}))
+	assert.NoError(t, p.SetNamespaceLimit("tenant", NamespaceLimit{Workloads: 2, Services: 1}))
+	rejectedWorkloads := testutil.ToFloat64(telemetry.NamespaceLimitRejected.WithLabelValues("tenant", namespaceKindWorkload))
+	rejectedServices := testutil.ToFloat64(telemetry.NamespaceLimitRejected.WithLabelValues("tenant", namespaceKindService))
+
+	tenantWorkload := func(name, ip string) *workloadapi.Workload {
+		wl := createWorkload(name, ip, workloadapi.NetworkMode_STANDARD)
+		wl.Namespace = "tenant"
+		wl.Uid = "cluster0//Pod/tenant/" + name
+		return wl
+	}
+	tenantService := func(name, ip string) *workloadapi.Service {
+		svc := createFakeService(name, ip, "10.240.10.200")
+		svc.Namespace = "tenant"
+		return svc
+	}
+
+	// the additions beyond the caps of the namespace are rejected
+	wl1 := tenantWorkload("wl1", "10.244.0.1")
+	wl2 := tenantWorkload("wl2", "10.244.0.2")
+	wl3 := tenantWorkload("wl3", "10.244.0.3")
+	assert.NoError(t, p.handleWorkload(wl1))
+	assert.NoError(t, p.handleWorkload(wl2))
+	assert.ErrorContains(t, p.handleWorkload(wl3), "namespace tenant reached its limit of 2 workloads")
+	assert.Nil(t, p.WorkloadCache.GetWorkloadByUid(wl3.Uid))
+	checkNotExistInFrontEndMap(t, wl3.Addresses[0], p)
+	assert.Equal(t, rejectedWorkloads+1, testutil.ToFloat64(telemetry.NamespaceLimitRejected.WithLabelValues("tenant", namespaceKindWorkload)))
+
+	svc1 := tenantService("svc1", "10.240.10.1")
+	svc2 := tenantService("svc2", "10.240.10.2")
+	assert.NoError(t, p.handleService(svc1))
+	assert.ErrorContains(t, p.handleService(svc2), "namespace tenant reached its limit of 1 services")
+	assert.Nil(t, p.ServiceCache.GetService(svc2.ResourceName()))
+	checkNotExistInFrontEndMap(t, svc2.Addresses[0].Address, p)
+	assert.Equal(t, rejectedServices+1, testutil.ToFloat64(telemetry.NamespaceLimitRejected.WithLabelValues("tenant", namespaceKindService)))
+
+	// the resources already programmed are still updated
+	wl1.Node = "node2"
+	assert.NoError(t, p.handleWorkload(wl1))
+	assert.NoError(t, p.handleService(svc1))
+
+	// other namespaces are not affected
+	assert.NoError(t, p.handleWorkload(createWorkload("wl4", "10.244.0.4", workloadapi.NetworkMode_STANDARD)))
+	assert.NoError(t, p.handleWorkload(createWorkload("wl5", "10.244.0.5", workloadapi.NetworkMode_STANDARD)))
+	assert.NoError(t, p.handleService(createFakeService("svc3", "10.240.10.3", "10.240.10.200")))
+
+	// a removal frees a slot
+	p.handleRemovedAddresses([]string{wl2.ResourceName(), svc1.ResourceName()})
+	assert.NoError(t, p.handleWorkload(wl3))
+	assert.NoError(t, p.handleService(svc2))
+
+	// without a limit, the namespace accepts the additions again
+	assert.NoError(t, p.SetNamespaceLimit("tenant", NamespaceLimit{}))
+	assert.NoError(t, p.handleWorkload(wl2))
+	assert.NoError(t, p.handleService(svc1))
+}
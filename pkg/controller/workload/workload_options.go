@@ -0,0 +1,92 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"fmt"
+	"net/netip"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/daemon/options"
+)
+
+// applyOptions configures the processor from the workload options of the daemon,
+// it is called once before the processor is started
+func (p *Processor) applyOptions(opts *options.WorkloadConfig) error {
+	p.bpf.SetWriteRateLimit(opts.WriteRateLimit, opts.WriteRateBurst)
+	// applied before the endpoint keys are restored on restart
+	p.bpf.SetRestoreWorkers(opts.RestoreWorkers)
+	// written even if disabled, the map may be left enabled by the last run
+	if err := p.bpf.SetEndpointHits(opts.CountEndpointHits); err != nil {
+		return fmt.Errorf("set endpoint hits failed, %s", err)
+	}
+	p.SetDeferUnknownWaypoints(opts.DeferUnknownWaypoints)
+	p.SetConsistencyCheck(opts.ConsistencyCheck)
+	p.SetZeroPortPassthrough(opts.ZeroPortPassthrough)
+	p.SetQuarantineThreshold(opts.QuarantineThreshold)
+	p.SetCoalescing(opts.CoalescingMaxSize)
+	p.SetServiceDebounceWindow(opts.ServiceDebounceWindow)
+	p.SetActiveHealthCheck(opts.HealthCheckInterval, opts.HealthCheckTimeout, nil)
+	// applied before the backends of the ephemeral workloads not persisted are removed on restart
+	ephemeralPolicy := EphemeralWorkloadPolicy{SkipPersist: opts.EphemeralSkipPersist}
+	for _, workloadType := range opts.EphemeralWorkloadTypes {
+		// validated with the options
+		ephemeralPolicy.Types = append(ephemeralPolicy.Types, workloadapi.WorkloadType(workloadapi.WorkloadType_value[workloadType]))
+	}
+	p.SetEphemeralWorkloadPolicy(ephemeralPolicy)
+	p.SetLocalClusterId(opts.LocalClusterId)
+	if opts.CloseTimeout > 0 {
+		p.SetCloseTimeout(opts.CloseTimeout)
+	}
+	namespaceLimits := make(map[string]NamespaceLimit)
+	for namespace, limit := range opts.NamespaceWorkloadLimits {
+		namespaceLimit := namespaceLimits[namespace]
+		namespaceLimit.Workloads = limit
+		namespaceLimits[namespace] = namespaceLimit
+	}
+	for namespace, limit := range opts.NamespaceServiceLimits {
+		namespaceLimit := namespaceLimits[namespace]
+		namespaceLimit.Services = limit
+		namespaceLimits[namespace] = namespaceLimit
+	}
+	for namespace, limit := range namespaceLimits {
+		if err := p.SetNamespaceLimit(namespace, limit); err != nil {
+			return fmt.Errorf("set limit of namespace %s failed, %s", namespace, err)
+		}
+	}
+	for namespace, waypoint := range opts.NamespaceWaypoints {
+		// validated with the options
+		addrPort := netip.MustParseAddrPort(waypoint)
+		if err := p.SetNamespaceWaypoint(namespace, &workloadapi.GatewayAddress{
+			Destination: &workloadapi.GatewayAddress_Address{
+				Address: &workloadapi.NetworkAddress{Address: addrPort.Addr().AsSlice()},
+			},
+			HboneMtlsPort: uint32(addrPort.Port()),
+		}); err != nil {
+			return fmt.Errorf("set waypoint of namespace %s failed, %s", namespace, err)
+		}
+	}
+	if err := p.SetUserspaceMirror(opts.UserspaceMapMirror); err != nil {
+		return fmt.Errorf("copy workload maps to userspace failed, %s", err)
+	}
+	if opts.ShadowMapPath != "" {
+		if err := p.bpf.LoadShadowMaps(opts.ShadowMapPath); err != nil {
+			return fmt.Errorf("load shadow maps failed, %s", err)
+		}
+	}
+	return nil
+}
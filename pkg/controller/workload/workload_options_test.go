@@ -0,0 +1,98 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/daemon/options"
+	"kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+)
+
+func TestApplyOptions(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	countEndpointHits := func() uint32 {
+		var key, value uint32
+		assert.NoError(t, workloadMap.KmeshCountEndpointHits.Lookup(&key, &value))
+		return value
+	}
+
+	p := newProcessor(workloadMap)
+	assert.NoError(t, p.applyOptions(&options.WorkloadConfig{
+		CountEndpointHits:       true,
+		DeferUnknownWaypoints:   true,
+		ConsistencyCheck:        true,
+		NamespaceWaypoints:      map[string]string{"default": "10.240.10.100:15008"},
+		ZeroPortPassthrough:     true,
+		CloseTimeout:            time.Second,
+		QuarantineThreshold:     3,
+		CoalescingMaxSize:       100,
+		ServiceDebounceWindow:   time.Second,
+		HealthCheckInterval:     10 * time.Second,
+		HealthCheckTimeout:      2 * time.Second,
+		EphemeralWorkloadTypes:  []string{"POD"},
+		EphemeralSkipPersist:    true,
+		LocalClusterId:          "cluster0",
+		UserspaceMapMirror:      true,
+		NamespaceWorkloadLimits: map[string]int{"default": 10, "tenant": 5},
+		NamespaceServiceLimits:  map[string]int{"default": 2},
+	}))
+	assert.Equal(t, uint32(1), countEndpointHits())
+	assert.True(t, p.deferUnknownWaypoints)
+	assert.True(t, p.checkConsistency)
+	assert.True(t, p.zeroPortPassthrough)
+	assert.Equal(t, time.Second, p.closeTimeout)
+	assert.Equal(t, 3, p.quarantine.threshold)
+	assert.NotNil(t, p.coalescer)
+	assert.Equal(t, time.Second, p.serviceDebounceWindow)
+	assert.Equal(t, 10*time.Second, p.healthChecker.interval)
+	assert.Equal(t, 2*time.Second, p.healthChecker.timeout)
+	assert.Equal(t, EphemeralWorkloadPolicy{
+		Types:       []workloadapi.WorkloadType{workloadapi.WorkloadType_POD},
+		SkipPersist: true,
+	}, p.ephemeralPolicy)
+	assert.Equal(t, "cluster0", p.localClusterId)
+	assert.NotNil(t, p.mapMirror)
+	assert.Equal(t, map[string]NamespaceLimit{
+		"default": {Workloads: 10, Services: 2},
+		"tenant":  {Workloads: 5},
+	}, p.namespaceLimits)
+	waypoint := p.namespaceWaypoints["default"]
+	assert.Equal(t, netip.MustParseAddr("10.240.10.100").AsSlice(), waypoint.GetAddress().GetAddress())
+	assert.Equal(t, uint32(15008), waypoint.GetHboneMtlsPort())
+
+	// the defaults disable what the last run enabled
+	p = newProcessor(workloadMap)
+	assert.NoError(t, p.applyOptions(&options.WorkloadConfig{}))
+	assert.Equal(t, uint32(0), countEndpointHits())
+	assert.Equal(t, DefaultProcessorCloseTimeout, p.closeTimeout)
+	assert.Nil(t, p.coalescer)
+	assert.Nil(t, p.healthChecker)
+	assert.Equal(t, EphemeralWorkloadPolicy{}, p.ephemeralPolicy)
+	assert.Equal(t, "", p.localClusterId)
+	assert.Nil(t, p.mapMirror)
+	assert.Empty(t, p.namespaceLimits)
+
+	assert.ErrorContains(t, p.applyOptions(&options.WorkloadConfig{ShadowMapPath: t.TempDir()}), "load shadow maps failed")
+}
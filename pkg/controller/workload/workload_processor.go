@@ -17,13 +17,21 @@
 package workload
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/netip"
 	"os"
 	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/cilium/ebpf"
 	service_discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/anypb"
 	"istio.io/istio/pkg/util/sets"
@@ -44,6 +52,16 @@ import (
 const (
 	LbPolicyRandom    = 0
 	KmeshWaypointPort = 15019 // use this fixed port instead of the HboneMtlsPort in kmesh
+
+	// uid of a WorkloadEntry workload is <cluster>/networking.istio.io/WorkloadEntry/<namespace>/<name>
+	workloadEntryUidInfix = "/networking.istio.io/WorkloadEntry/"
+	// hostname suffix of the services inside the cluster, the others are external, e.g. ServiceEntry egress targets
+	clusterServiceSuffix = ".svc.cluster.local"
+	// prefix of the authorization policy names hashed into policy ids
+	authzPolicyIdPrefix = "authz/"
+
+	// DefaultProcessorCloseTimeout is how long Close waits for the background goroutines by default
+	DefaultProcessorCloseTimeout = 5 * time.Second
 )
 
 type Processor struct {
@@ -55,18 +73,299 @@ type Processor struct {
 	nodeName      string
 	WorkloadCache cache.WorkloadCache
 	ServiceCache  cache.ServiceCache
+	// network of the local cluster, workloads on other networks are reached through their network gateway
+	network             string
+	NetworkGatewayCache cache.NetworkGatewayCache
+	// cluster id given to the workloads received without one, they are left in an unknown cluster if empty
+	localClusterId string
+	// records the handling of every workload and service for auditing
+	EventLog *EventLog
+	// authorization policies the workloads refer to
+	PolicyCache cache.PolicyCache
+
+	// addresses of the node's interfaces, a workload owning one of them runs on the local node
+	localAddresses sets.Set[netip.Addr]
 
 	once sync.Once
+	// mutex serializes the xDS processing with the operations triggered by operators,
+	// such as ForceResync and DrainAndPause
+	mutex sync.Mutex
+	// paused is set during node drain, endpoints of local workloads are kept out of the endpoint map
+	paused bool
+	// handleMutex serializes handleWorkload and handleService, which share the hash names, the caches
+	// and the endpoint index, so that they are safe to call concurrently. It is taken after mutex.
+	handleMutex sync.Mutex
+
+	// lifetime counters of the workloads and services programmed since start, a resource
+	// removed and added again is counted twice
+	totalWorkloads atomic.Uint64
+	totalServices  atomic.Uint64
+
+	// deferUnknownWaypoints holds back the waypoint of a service until its address is learned,
+	// pendingWaypoints are the services whose waypoint is held back
+	deferUnknownWaypoints bool
+	pendingWaypoints      sets.Set[string]
+
+	// frontendLRU evicts the frontend entries of the serviceless workloads under pressure, nil if disabled,
+	// the frontends of pinnedWorkloads are never evicted
+	frontendLRU     *frontendLRU
+	pinnedWorkloads sets.Set[string]
+
+	// checkConsistency verifies the bpf maps after each address response
+	checkConsistency bool
+
+	// waypoints applied to the workloads and services without waypoint, keyed by namespace
+	namespaceWaypoints map[string]*workloadapi.GatewayAddress
+
+	// the services and workloads programmed with each waypoint address, to redirect them when it changes
+	serviceWaypointIndex  *waypointIndex
+	workloadWaypointIndex *waypointIndex
+
+	// digests of the backends left by the last run, keyed by backend uid, only set on restart until the
+	// first address response is handled
+	restoredDigests map[uint32]uint64
+
+	// warmResources are the resources programmed by WarmStart, only set until the first address response is handled
+	warmResources sets.Set[string]
+
+	// lazyFrontend defers programming the frontends of services until the datapath misses them,
+	// lazyFrontends are the vips not programmed yet, keyed to their service names
+	lazyFrontend  bool
+	lazyFrontends map[bpf.FrontendKey]string
+
+	// zeroPortPassthrough programs the vips of the services without ports
+	zeroPortPassthrough bool
+
+	// mapMirror is the userspace copy of the workload maps read by the queries, nil if they read the maps in kernel
+	mapMirror *bpf.UserspaceWorkloadMap
+
+	// ephemeralPolicy classifies the short-lived workloads, such as the pods of Jobs
+	ephemeralPolicy EphemeralWorkloadPolicy
+
+	// namespaceLimits cap the workloads and services of the namespaces, namespaceUsage counts the cached ones
+	namespaceLimits map[string]NamespaceLimit
+	namespaceUsage  map[string]namespaceUsage
+
+	// terminatingWorkloads are the uids of the workloads whose endpoints are terminating in the kubernetes
+	// api server, they are kept out of the endpoint map
+	terminatingWorkloads sets.Set[string]
+
+	// healthChecker marks the endpoints of unreachable backends unready, nil if disabled
+	healthChecker *healthChecker
+
+	// quarantine skips the resources repeatedly failing to be programmed until they change
+	quarantine quarantine
+
+	// coalescer holds the updates of services and workloads to coalesce the updates of the same resource, nil if disabled
+	coalescer *CoalescingQueue
+	// coalescedErrs are the failures of the coalesced updates written after their response was acked,
+	// they nack the next response
+	coalescedErrs []error
+
+	// serviceDebounceWindow holds the newly-seen services before programming them, pendingServices
+	// are the services held, keyed by resource name
+	serviceDebounceWindow time.Duration
+	pendingServices       map[string]*pendingService
+
+	// tracer traces the handling of the address responses, nil if disabled
+	tracer *telemetry.Tracer
+
+	// ctx is cancelled by Close, wg tracks the goroutines started by Start
+	ctx          context.Context
+	cancel       context.CancelFunc
+	wg           sync.WaitGroup
+	closeTimeout time.Duration
+	closed       bool
 }
 
 func newProcessor(workloadMap bpf2go.KmeshCgroupSockWorkloadMaps) *Processor {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Processor{
 		hashName:      NewHashName(),
 		bpf:           bpf.NewCache(workloadMap),
 		nodeName:      os.Getenv("NODE_NAME"),
 		WorkloadCache: cache.NewWorkloadCache(),
 		ServiceCache:  cache.NewServiceCache(),
+
+		network:             os.Getenv("NETWORK"),
+		NetworkGatewayCache: cache.NewNetworkGatewayCache(),
+		EventLog:            NewEventLog(DefaultEventLogSize),
+		PolicyCache:         cache.NewPolicyCache(),
+
+		localAddresses: sets.New(nets.InterfaceAddresses()...),
+
+		pendingWaypoints:     sets.New[string](),
+		pinnedWorkloads:      sets.New[string](),
+		terminatingWorkloads: sets.New[string](),
+
+		namespaceWaypoints:    make(map[string]*workloadapi.GatewayAddress),
+		serviceWaypointIndex:  newWaypointIndex(),
+		workloadWaypointIndex: newWaypointIndex(),
+		lazyFrontends:         make(map[bpf.FrontendKey]string),
+		namespaceLimits:       make(map[string]NamespaceLimit),
+		namespaceUsage:        make(map[string]namespaceUsage),
+
+		ctx:          ctx,
+		cancel:       cancel,
+		closeTimeout: DefaultProcessorCloseTimeout,
+	}
+}
+
+// Start starts the background goroutines of the processor: the watchers of the datapath frontend misses
+// and of the stale endpoints, and the active health checker if set. They exit once ctx is done or the processor is closed.
+func (p *Processor) Start(ctx context.Context, frontendMissMap *ebpf.Map) {
+	p.goAsync(ctx, func(ctx context.Context) {
+		p.WatchFrontendMisses(ctx, frontendMissMap)
+	})
+	p.goAsync(ctx, func(ctx context.Context) {
+		newStaleEndpointWatchdog(p.bpf, defaultStaleEndpointWindow).Run(ctx, defaultStaleEndpointInterval)
+	})
+
+	p.mutex.Lock()
+	healthChecker := p.healthChecker
+	p.mutex.Unlock()
+	if healthChecker != nil {
+		p.goAsync(ctx, healthChecker.Run)
+	}
+}
+
+// goAsync runs fn in a goroutine tracked by Close, the context passed to fn is done
+// when either ctx is done or the processor is closed
+func (p *Processor) goAsync(ctx context.Context, fn func(context.Context)) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		stop := context.AfterFunc(p.ctx, cancel)
+		defer stop()
+		fn(ctx)
+	}()
+}
+
+// SetCloseTimeout sets how long Close waits for the background goroutines to exit
+func (p *Processor) SetCloseTimeout(timeout time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.closeTimeout = timeout
+}
+
+// Close stops the background goroutines and waits up to the close timeout for them to exit,
+// writes the coalesced updates and the services held for debouncing, then waits for the resources being
+// handled so that their bpf map writes are all issued. The errors of these writes are returned. The workload bpf maps are owned by the bpf loader and left open, only the shadow maps are closed.
+// The processor must not be used afterwards.
+func (p *Processor) Close() error {
+	p.mutex.Lock()
+	timeout := p.closeTimeout
+	p.mutex.Unlock()
+
+	var errs []error
+	p.cancel()
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		errs = append(errs, fmt.Errorf("processor goroutines did not exit within %s", timeout))
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return errors.Join(errs...)
+	}
+	p.closed = true
+	if p.coalescer != nil {
+		errs = append(errs, p.flushCoalesced(context.Background())...)
+	}
+	for name, pending := range p.pendingServices {
+		if err := p.programPendingService(name, pending); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	p.handleMutex.Lock()
+	defer p.handleMutex.Unlock()
+	p.bpf.CloseShadowMaps()
+	if p.mapMirror != nil {
+		p.mapMirror.Close()
+	}
+	return errors.Join(errs...)
+}
+
+// SetDeferUnknownWaypoints configures how a service referencing a waypoint address kmesh
+// hasn't learned yet is handled. By default the waypoint is programmed as is, when enabled
+// the service is programmed without waypoint until a service or workload owning the address is added.
+func (p *Processor) SetDeferUnknownWaypoints(enabled bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.deferUnknownWaypoints = enabled
+}
+
+// SetConsistencyCheck runs CheckConsistency after each address response when enabled, it is meant
+// for debugging since every check dumps the bpf maps
+func (p *Processor) SetConsistencyCheck(enabled bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.checkConsistency = enabled
+}
+
+// SetZeroPortPassthrough configures how a service without ports is handled. By default a warning is logged
+// and its vips are not programmed, so the connections to them are not touched by kmesh. When enabled the vips
+// are programmed as for any other service, the datapath then finds no port mapping and passes the connections
+// through to the original destination, or redirects them to the waypoint of the service.
+func (p *Processor) SetZeroPortPassthrough(enabled bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.zeroPortPassthrough = enabled
+}
+
+// SetLocalClusterId sets the cluster id given to the workloads received without one, some sources
+// omit it. A warning is logged for each of them. By default they are left in an unknown cluster.
+func (p *Processor) SetLocalClusterId(clusterId string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	// the cluster id is read by handleWorkload
+	p.handleMutex.Lock()
+	defer p.handleMutex.Unlock()
+
+	p.localClusterId = clusterId
+}
+
+// RestoreWorkloadDigests records the digests of the backends restored on restart, so that the workloads
+// identical to the bpf maps are not rewritten when received again
+func (p *Processor) RestoreWorkloadDigests() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	digests, err := p.bpf.BackendDigests()
+	if err != nil {
+		log.Errorf("restore workload digests failed: %v", err)
+		return
 	}
+	p.restoredDigests = digests
+}
+
+// Reconcile rebuilds the endpoint index from the bpf maps, compacts the endpoint indices and
+// corrects the service endpoint counts, it is called when the pinned maps are changed outside of kmesh.
+func (p *Processor) Reconcile() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	log.Infof("reconcile processor state with bpf maps")
+	p.bpf.RestoreEndpointKeys()
+	p.bpf.CompactEndpointIndices()
+	p.bpf.ReconcileEndpointCount()
 }
 
 func newDeltaRequest(typeUrl string, names []string, initialResourceVersions map[string]string) *service_discovery_v3.DeltaDiscoveryRequest {
@@ -93,10 +392,18 @@ func newAckRequest(rsp *service_discovery_v3.DeltaDiscoveryResponse) *service_di
 func (p *Processor) processWorkloadResponse(rsp *service_discovery_v3.DeltaDiscoveryResponse, rbac *auth.Rbac) {
 	var err error
 
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
 	p.ack = newAckRequest(rsp)
 	switch rsp.GetTypeUrl() {
 	case AddressType:
 		err = p.handleAddressTypeResponse(rsp)
+		if p.checkConsistency {
+			if inconsistency := p.CheckConsistency(); inconsistency != nil {
+				log.Errorf("bpf maps are inconsistent after handling address response: %v", inconsistency)
+			}
+		}
 	case AuthorizationType:
 		err = p.handleAuthorizationTypeResponse(rsp, rbac)
 	default:
@@ -104,6 +411,11 @@ func (p *Processor) processWorkloadResponse(rsp *service_discovery_v3.DeltaDisco
 	}
 	if err != nil {
 		log.Error(err)
+		// nack the response, the resources handled successfully are kept
+		p.ack.ErrorDetail = &status.Status{
+			Code:    int32(codes.InvalidArgument),
+			Message: err.Error(),
+		}
 	}
 }
 
@@ -117,52 +429,120 @@ func (p *Processor) deletePodFrontendData(uid uint32) error {
 	bk.BackendUid = uid
 	if err := p.bpf.BackendLookup(&bk, &bv); err == nil {
 		log.Debugf("Find BackendValue: [%#v]", bv)
-		fk.Ip = bv.Ip
-		if err = p.bpf.FrontendDelete(&fk); err != nil {
-			log.Errorf("FrontendDelete failed: %v", err)
-			return err
+		for _, ip := range bv.Addresses() {
+			fk.Ip = ip
+			// the frontend of a serviceless workload may have been evicted
+			if err = p.bpf.FrontendDelete(&fk); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+				log.Errorf("FrontendDelete failed: %v", err)
+				return err
+			}
 		}
 	}
 
 	return nil
 }
 
-func (p *Processor) storePodFrontendData(uid uint32, ip []byte) error {
+func (p *Processor) removeWorkloadResource(removedResources []string) error {
+	// the ip of a removed pod may be reused by a pod added before the removal is received,
+	// the frontend of the ip is the new pod's then
+	var reassigned []bpf.FrontendKey
+	for _, uid := range removedResources {
+		wl := p.WorkloadCache.DeleteWorkload(uid)
+		if wl != nil {
+			p.countNamespaceResource(namespaceKindWorkload, wl.GetNamespace(), -1)
+		}
+		telemetry.DeleteWorkloadMetric(wl)
+		p.workloadWaypointIndex.delete(uid)
+		p.terminatingWorkloads.Delete(uid)
+		// the addresses reassigned are still indexed once the workload is deleted
+		for _, ip := range wl.GetAddresses() {
+			addr, _ := netip.AddrFromSlice(ip)
+			if p.WorkloadCache.GetWorkloadByAddr(cache.NetworkAddress{Network: wl.GetNetwork(), Address: addr}) == nil {
+				continue
+			}
+			log.Debugf("address %s of removed workload %s is reassigned, keep its frontend", addr, uid)
+			fk := bpf.FrontendKey{}
+			nets.CopyIpByteFromSlice(&fk.Ip, ip)
+			reassigned = append(reassigned, fk)
+		}
+	}
+	return p.removeWorkloadsFromBpfMapKeeping(removedResources, reassigned)
+}
+
+// removeWorkloadsFromBpfMap is the same as calling removeWorkloadFromBpfMap for each workload,
+// except that the frontend, backend and hash name deletions are grouped and batched, which matters
+// for mass removals such as a namespace deletion. The endpoint deletions are still done one by one,
+// each of them may move the last endpoint of the service.
+func (p *Processor) removeWorkloadsFromBpfMap(uids []string) error {
+	return p.removeWorkloadsFromBpfMapKeeping(uids, nil)
+}
+
+// removeWorkloadsFromBpfMapKeeping is removeWorkloadsFromBpfMap keeping the frontends in kept
+func (p *Processor) removeWorkloadsFromBpfMapKeeping(uids []string, kept []bpf.FrontendKey) error {
 	var (
-		fk = bpf.FrontendKey{}
-		fv = bpf.FrontendValue{}
+		errs []error
+		fks  = make([]bpf.FrontendKey, 0, len(uids))
+		bks  = make([]bpf.BackendKey, 0, len(uids))
+		bv   = bpf.BackendValue{}
 	)
 
-	nets.CopyIpByteFromSlice(&fk.Ip, ip)
+	if len(uids) == 0 {
+		return nil
+	}
 
-	fv.UpstreamId = uid
-	if err := p.bpf.FrontendUpdate(&fk, &fv); err != nil {
-		log.Errorf("Update frontend map failed, err:%s", err)
-		return err
+	removed := make([]string, 0, len(uids))
+	for _, uid := range uids {
+		backendUid := p.hashName.Hash(uid)
+		// keep the workload entirely if its endpoints can't be removed, like removeWorkloadFromBpfMap does
+		if eks := p.bpf.GetEndpointKeys(backendUid); len(eks) > 0 {
+			if err := p.deleteEndpointRecords(backendUid, eks.UnsortedList()); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+
+		bk := bpf.BackendKey{BackendUid: backendUid}
+		if err := p.bpf.BackendLookup(&bk, &bv); err == nil {
+			for _, ip := range bv.Addresses() {
+				fk := bpf.FrontendKey{Ip: ip}
+				if !p.frontendEvicted(ip) && !slices.Contains(kept, fk) {
+					fks = append(fks, fk)
+				}
+			}
+		}
+		bks = append(bks, bk)
+		removed = append(removed, uid)
 	}
 
-	return nil
+	if err := p.bpf.FrontendBatchDelete(fks); err != nil {
+		log.Errorf("FrontendBatchDelete failed: %v", err)
+		errs = append(errs, err)
+	}
+	if err := p.bpf.BackendBatchDelete(bks); err != nil {
+		log.Errorf("BackendBatchDelete failed: %v", err)
+		errs = append(errs, err)
+	}
+
+	p.hashName.DeleteAll(removed)
+	return errors.Join(errs...)
 }
 
-func (p *Processor) removeWorkloadResource(removedResources []string) error {
-	for _, uid := range removedResources {
-		wl := p.WorkloadCache.GetWorkloadByUid(uid)
-		p.WorkloadCache.DeleteWorkload(uid)
-		telemetry.DeleteWorkloadMetric(wl)
-		if err := p.removeWorkloadFromBpfMap(uid); err != nil {
-			return err
-		}
+func (p *Processor) removeWorkloadFromBpfMap(uid string) error {
+	if err := p.removeBackendFromBpfMap(p.hashName.Hash(uid)); err != nil {
+		return err
 	}
+
+	p.hashName.Delete(uid)
 	return nil
 }
 
-func (p *Processor) removeWorkloadFromBpfMap(uid string) error {
+// removeBackendFromBpfMap deletes the frontends, the endpoints and the backend of a workload
+func (p *Processor) removeBackendFromBpfMap(backendUid uint32) error {
 	var (
 		err      error
 		bkDelete = bpf.BackendKey{}
 	)
 
-	backendUid := p.hashName.Hash(uid)
 	// 1. for Pod to Pod access, Pod info stored in frontend map, when Pod offline, we need delete the related records
 	if err = p.deletePodFrontendData(backendUid); err != nil {
 		log.Errorf("deletePodFrontendData %d failed: %v", backendUid, err)
@@ -183,8 +563,6 @@ func (p *Processor) removeWorkloadFromBpfMap(uid string) error {
 		log.Errorf("BackendDelete %d failed: %v", backendUid, err)
 		return err
 	}
-
-	p.hashName.Delete(uid)
 	return nil
 }
 
@@ -198,7 +576,8 @@ func (p *Processor) deleteServiceFrontendData(service *workloadapi.Service, id u
 	if service != nil {
 		for _, networkAddress := range service.GetAddresses() {
 			nets.CopyIpByteFromSlice(&fk.Ip, networkAddress.Address)
-			if err = p.bpf.FrontendDelete(&fk); err != nil {
+			// the frontends of a lazy service may not be programmed
+			if err = p.bpf.FrontendDelete(&fk); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
 				log.Errorf("delete service %s frontend key %v, err: %v", service.ResourceName(), fk, err)
 			}
 		}
@@ -220,11 +599,40 @@ func (p *Processor) deleteServiceFrontendData(service *workloadapi.Service, id u
 	return nil
 }
 
+// deleteStaleServiceFrontendData deletes the frontend entries of the vips in the old service
+// but not in the new one
+func (p *Processor) deleteStaleServiceFrontendData(oldService, newService *workloadapi.Service) {
+	var fk = bpf.FrontendKey{}
+
+	for _, oldAddress := range oldService.GetAddresses() {
+		stale := true
+		for _, newAddress := range newService.GetAddresses() {
+			if slices.Equal(oldAddress.GetAddress(), newAddress.GetAddress()) {
+				stale = false
+				break
+			}
+		}
+		if !stale {
+			continue
+		}
+		nets.CopyIpByteFromSlice(&fk.Ip, oldAddress.GetAddress())
+		delete(p.lazyFrontends, fk)
+		if err := p.bpf.FrontendDelete(&fk); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			log.Errorf("delete service %s stale frontend key %v, err: %v", newService.ResourceName(), fk, err)
+		}
+	}
+}
+
 func (p *Processor) removeServiceResource(resources []string) error {
 	for _, name := range resources {
 		telemetry.DeleteServiceMetric(name)
-		svc := p.ServiceCache.GetService(name)
-		p.ServiceCache.DeleteService(name)
+		svc := p.ServiceCache.DeleteService(name)
+		if svc != nil {
+			p.countNamespaceResource(namespaceKindService, svc.GetNamespace(), -1)
+		}
+		p.pendingWaypoints.Delete(name)
+		p.serviceWaypointIndex.delete(name)
+		p.forgetLazyFrontends(svc)
 		_ = p.removeServiceResourceFromBpfMap(svc, name)
 	}
 	return nil
@@ -262,27 +670,43 @@ func (p *Processor) removeServiceResourceFromBpfMap(svc *workloadapi.Service, na
 	return nil
 }
 
-// addWorkloadToService update service & endpoint bpf map when a workload has new bound services
-func (p *Processor) addWorkloadToService(sk *bpf.ServiceKey, sv *bpf.ServiceValue, uid uint32) error {
+// addWorkloadToService update service & endpoint bpf map when a workload has new bound services,
+// local tells whether the workload runs on the local node
+func (p *Processor) addWorkloadToService(sk *bpf.ServiceKey, sv *bpf.ServiceValue, uid uint32, local bool) error {
 	var (
 		err error
 		ek  = bpf.EndpointKey{}
 		ev  = bpf.EndpointValue{}
 	)
 
+	ek.BackendIndex = sv.EndpointCount + 1
+	ek.ServiceId = sk.ServiceId
 	// TODO: make this check only run once on restart
-	if !p.shouldAddEndpoint(uid, sk.ServiceId) {
-		return nil
+	for k := range p.bpf.GetEndpointKeys(uid) {
+		if k.ServiceId != sk.ServiceId {
+			continue
+		}
+		if k.BackendIndex <= sv.EndpointCount {
+			log.Debugf("workload %d has been stored as endpoint of service %d", uid, sk.ServiceId)
+			return nil
+		}
+		// written beyond the endpoint count by an attempt failing to update the service, the next slot
+		// is updated in place, so that a retry doesn't store the workload in two slots
+		if k.BackendIndex != ek.BackendIndex {
+			if err = p.bpf.EndpointDelete(&k); err != nil {
+				return err
+			}
+		}
 	}
 
-	sv.EndpointCount++
-	ek.BackendIndex = sv.EndpointCount
-	ek.ServiceId = sk.ServiceId
 	ev.BackendUid = uid
+	ev.Local = localFlag(local)
+	ev.LastUpdated = time.Now().UnixNano()
 	if err = p.bpf.EndpointUpdate(&ek, &ev); err != nil {
 		log.Errorf("Update endpoint map failed, err:%s", err)
 		return err
 	}
+	sv.EndpointCount++
 	if err = p.bpf.ServiceUpdate(sk, sv); err != nil {
 		log.Errorf("Update ServiceUpdate map failed, err:%s", err)
 		return err
@@ -327,13 +751,18 @@ func (p *Processor) handleWorkloadNewBoundServices(workload *workloadapi.Workloa
 		return nil
 	}
 
+	if p.paused && p.isLocalWorkload(workload) {
+		log.Debugf("processor paused, skip adding local workload %s to services %v", workload.ResourceName(), newServices)
+		return nil
+	}
+
 	log.Debugf("handleWorkloadNewBoundServices %s: %v", workload.ResourceName(), newServices)
 	workloadId := p.hashName.Hash(workload.GetUid())
 	for _, serviceName := range newServices {
 		sk.ServiceId = p.hashName.Hash(serviceName)
 		// the service already stored in map, add endpoint
 		if err = p.bpf.ServiceLookup(&sk, &sv); err == nil {
-			if err = p.addWorkloadToService(&sk, &sv, workloadId); err != nil {
+			if err = p.addWorkloadToService(&sk, &sv, workloadId, p.isLocalWorkload(workload)); err != nil {
 				log.Errorf("addWorkloadToService workload %d service %d failed: %v", workloadId, sk.ServiceId, err)
 				return err
 			}
@@ -351,11 +780,24 @@ func (p *Processor) updateWorkload(workload *workloadapi.Workload) error {
 	)
 
 	uid := p.hashName.Hash(workload.GetUid())
-
-	if waypoint := workload.GetWaypoint(); waypoint != nil {
+	waypoint := p.workloadWaypoint(workload)
+	if waypoint != nil {
 		nets.CopyIpByteFromSlice(&bv.WaypointAddr, waypoint.GetAddress().Address)
 		bv.WaypointPort = nets.ConvertPortToBigEndian(waypoint.GetHboneMtlsPort())
 	}
+	p.workloadWaypointIndex.set(workload.GetUid(), waypoint)
+
+	bv.PolicyCount, bv.Policies = p.workloadPolicies(workload)
+
+	if p.isRemoteNetwork(workload.GetNetwork()) {
+		if gateway := p.networkGateway(workload); gateway != nil {
+			bv.TunnelType = bpf.TunnelTypeHbone
+			nets.CopyIpByteFromSlice(&bv.TunnelEndpoint, gateway.GetAddress().GetAddress())
+			bv.TunnelPort = nets.ConvertPortToBigEndian(gateway.GetHboneMtlsPort())
+		} else {
+			log.Warnf("no network gateway known for network %s of workload %s", workload.GetNetwork(), workload.ResourceName())
+		}
+	}
 
 	for serviceName := range workload.GetServices() {
 		bv.Services[bv.ServiceCount] = p.hashName.Hash(serviceName)
@@ -366,31 +808,288 @@ func (p *Processor) updateWorkload(workload *workloadapi.Workload) error {
 		}
 	}
 
+	if p.unchangedSinceRestart(uid, workload, bv) {
+		log.Debugf("workload %s unchanged since restart, skip updating bpf maps", workload.ResourceName())
+		telemetry.WorkloadUnchangedOnRestart.Inc()
+		return nil
+	}
+
+	// a workload without any address has no backend, handleWorkload skips the ones left without address
+	// once filtered before writing their endpoints
+	ips := reachableAddresses(workload)
+	if len(ips) < len(workload.GetAddresses()) {
+		log.Warnf("skip the loopback and link-local addresses of workload %s", workload.ResourceName())
+	}
+	if len(ips) == 0 {
+		return nil
+	}
+
+	bk.BackendUid = uid
+	setBackendAddresses(&bv, ips)
+	// the backend and its frontends are written as a whole, a failure leaves the previous ones in place
+	ops := []bpf.BpfOp{{Map: bpf.BackendMap, Op: bpf.BpfOpUpdate, Key: &bk, Value: &bv}}
+	// we should not store frontend data of hostname network mode pods
+	// please see https://github.com/kmesh-net/kmesh/issues/631
+	if networkMode != workloadapi.NetworkMode_HOST_NETWORK {
+		for _, ip := range ips {
+			fk := &bpf.FrontendKey{}
+			nets.CopyIpByteFromSlice(&fk.Ip, ip)
+			ops = append(ops, bpf.BpfOp{Map: bpf.FrontendMap, Op: bpf.BpfOpUpdate, Key: fk, Value: &bpf.FrontendValue{UpstreamId: uid}})
+		}
+	}
+	if err = p.bpf.MultiUpdate(ops); err != nil {
+		log.Errorf("Update backend and frontends of workload %s failed, err:%s", workload.ResourceName(), err)
+		return err
+	}
+	return nil
+}
+
+// unchangedSinceRestart tells whether the backend and frontends of the workload left by the last run are
+// identical to the ones to write, bv is the backend value to write without ip. The restored digest of
+// the workload is used only once, the later updates are always written.
+func (p *Processor) unchangedSinceRestart(uid uint32, workload *workloadapi.Workload, bv bpf.BackendValue) bool {
+	var (
+		fk = bpf.FrontendKey{}
+		fv = bpf.FrontendValue{}
+	)
+
+	digest, ok := p.restoredDigests[uid]
+	if !ok {
+		return false
+	}
+	delete(p.restoredDigests, uid)
+
+	ips := reachableAddresses(workload)
+	for _, ip := range ips {
+		if workload.GetNetworkMode() == workloadapi.NetworkMode_HOST_NETWORK {
+			continue
+		}
+		nets.CopyIpByteFromSlice(&fk.Ip, ip)
+		if err := p.bpf.FrontendLookup(&fk, &fv); err != nil || fv.UpstreamId != uid {
+			return false
+		}
+	}
+	// the backend holds the addresses as written by updateWorkload
+	setBackendAddresses(&bv, ips)
+	return bv.Digest() == digest
+}
+
+// reachableAddresses returns the addresses of the workload but the loopback and link-local ones, which are
+// not reachable from other nodes and would only create unusable bpf entries
+func reachableAddresses(workload *workloadapi.Workload) [][]byte {
+	var ips [][]byte
 	for _, ip := range workload.GetAddresses() {
-		bk.BackendUid = uid
-		nets.CopyIpByteFromSlice(&bv.Ip, ip)
-		if err = p.bpf.BackendUpdate(&bk, &bv); err != nil {
-			log.Errorf("Update backend map failed, err:%s", err)
-			return err
+		if nets.IsLoopback(ip) || nets.IsLinkLocal(ip) {
+			addr, _ := netip.AddrFromSlice(ip)
+			log.Debugf("skip invalid address %s of workload %s", addr, workload.ResourceName())
+			continue
 		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
 
-		// we should not store frontend data of hostname network mode pods
-		// please see https://github.com/kmesh-net/kmesh/issues/631
-		if networkMode != workloadapi.NetworkMode_HOST_NETWORK {
-			if err = p.storePodFrontendData(uid, ip); err != nil {
-				log.Errorf("storePodFrontendData failed, err:%s", err)
-				return err
+// setBackendAddresses sets the addresses of the backend: the first ipv4 and the first ipv6 addresses of
+// a dual-stack workload, as the datapath selects the address of the family of the connection, otherwise
+// the first address
+func setBackendAddresses(bv *bpf.BackendValue, ips [][]byte) {
+	var ip4, ip6 []byte
+	for _, ip := range ips {
+		switch family, _ := nets.IPFamilyOf(ip); family {
+		case nets.IPv4:
+			if ip4 == nil {
+				ip4 = ip
+			}
+		case nets.IPv6:
+			if ip6 == nil {
+				ip6 = ip
 			}
 		}
 	}
-	return nil
+
+	bv.Ip, bv.Ip6 = [16]byte{}, [16]byte{}
+	switch {
+	case ip4 != nil && ip6 != nil:
+		nets.CopyIpByteFromSlice(&bv.Ip, ip4)
+		nets.CopyIpByteFromSlice(&bv.Ip6, ip6)
+	case ip4 != nil:
+		nets.CopyIpByteFromSlice(&bv.Ip, ip4)
+	case ip6 != nil:
+		nets.CopyIpByteFromSlice(&bv.Ip, ip6)
+	}
+}
+
+// isVirtualMachine tells whether the workload is a virtual machine with a static ip,
+// istio registers them by WorkloadEntry and generates the uid accordingly.
+func isVirtualMachine(workload *workloadapi.Workload) bool {
+	return strings.Contains(workload.GetUid(), workloadEntryUidInfix)
+}
+
+// policyId returns the id of the authorization policy in the datapath, the name is prefixed so that
+// the ids of the policies never share the hash name entries of the workloads and services
+func (p *Processor) policyId(name string) uint32 {
+	return p.hashName.Hash(authzPolicyIdPrefix + name)
+}
+
+// workloadPolicies returns the ids of the authorization policies of the workload, at most MaxPolicyNum of them.
+// The policies not received yet are encoded once they arrive.
+func (p *Processor) workloadPolicies(workload *workloadapi.Workload) (uint32, bpf.PolicyList) {
+	var (
+		count uint32
+		ids   bpf.PolicyList
+	)
+
+	for _, name := range workload.GetAuthorizationPolicies() {
+		if p.PolicyCache.GetPolicy(name) == nil {
+			continue
+		}
+		if count >= bpf.MaxPolicyNum {
+			log.Warnf("workload %s has more than %d authorization policies, the rest are not checked in the datapath",
+				workload.ResourceName(), bpf.MaxPolicyNum)
+			break
+		}
+		ids[count] = p.policyId(name)
+		count++
+	}
+	return count, ids
+}
+
+// authzPolicyValue encodes the authorization policy for the datapath, which only refuses the connections
+// to a workload with a DENY policy matching all of them. The rest is enforced by the userspace rbac.
+func authzPolicyValue(policy *security.Authorization) *bpf.AuthzPolicyValue {
+	value := &bpf.AuthzPolicyValue{Action: bpf.AuthzActionAllow}
+	if policy.GetAction() == security.Action_DENY {
+		value.Action = bpf.AuthzActionDeny
+	}
+	// a rule matches when all its clauses match, and a clause without any match matches every connection
+	for _, rule := range policy.GetRules() {
+		if !slices.ContainsFunc(rule.GetClauses(), func(clause *security.Clause) bool { return len(clause.GetMatches()) != 0 }) {
+			value.MatchAll = 1
+			break
+		}
+	}
+	return value
+}
+
+// updateWorkloadPolicies re-encodes the policy ids of the workloads referring to the policies
+func (p *Processor) updateWorkloadPolicies(policies sets.Set[string]) {
+	var (
+		bk = bpf.BackendKey{}
+		bv = bpf.BackendValue{}
+	)
+
+	for _, workload := range p.WorkloadCache.List() {
+		if !slices.ContainsFunc(workload.GetAuthorizationPolicies(), policies.Contains) {
+			continue
+		}
+
+		bk.BackendUid = p.hashName.Hash(workload.GetUid())
+		if err := p.bpf.BackendLookup(&bk, &bv); err != nil {
+			log.Errorf("lookup backend of workload %s failed: %v", workload.ResourceName(), err)
+			continue
+		}
+		count, ids := p.workloadPolicies(workload)
+		if count == bv.PolicyCount && ids == bv.Policies {
+			continue
+		}
+		bv.PolicyCount, bv.Policies = count, ids
+		if err := p.bpf.BackendUpdate(&bk, &bv); err != nil {
+			log.Errorf("update policies of workload %s failed: %v", workload.ResourceName(), err)
+		}
+	}
+}
+
+// isRemoteNetwork returns whether the network differs from the local one, all the workloads
+// are considered local if either network is unset
+func (p *Processor) isRemoteNetwork(network string) bool {
+	return p.network != "" && network != "" && network != p.network
+}
+
+// networkGateway returns the gateway of the workload's network, the gateway set on the workload
+// is recorded for the workloads of the same network which don't carry it
+func (p *Processor) networkGateway(workload *workloadapi.Workload) *workloadapi.GatewayAddress {
+	if gateway := workload.GetNetworkGateway(); gateway.GetAddress() != nil {
+		p.NetworkGatewayCache.AddOrUpdateGateway(workload.GetNetwork(), gateway)
+		return gateway
+	}
+	return p.NetworkGatewayCache.GetGateway(workload.GetNetwork())
 }
 
 func (p *Processor) handleWorkload(workload *workloadapi.Workload) error {
+	return p.handleWorkloadInSpan(context.Background(), workload)
+}
+
+// handleWorkloadInSpan is handleWorkload traced as a child of the span in ctx
+func (p *Processor) handleWorkloadInSpan(ctx context.Context, workload *workloadapi.Workload) (err error) {
 	var newServices []string
 	log.Debugf("handle workload: %s", workload.Uid)
+	p.handleMutex.Lock()
+	defer p.handleMutex.Unlock()
+	defer func() { p.EventLog.Record(EventOpWorkload, workload.ResourceName(), err) }()
+	span := p.startWorkloadSpan(ctx, workload)
+	defer func() { span.end(p, err) }()
+
+	// the addresses are filtered before any write, a workload left without address would only create
+	// unusable bpf entries, it is skipped and its previous version, if any, is kept
+	if len(workload.GetAddresses()) > 0 && len(reachableAddresses(workload)) == 0 {
+		log.Warnf("skip workload %s, all its addresses are loopback or link-local", workload.ResourceName())
+		return nil
+	}
+
+	// set before the workload is cached, the cached and the received versions are then compared equal
+	if workload.GetClusterId() == "" && p.localClusterId != "" {
+		log.Warnf("workload %s has no cluster id, default to the local cluster %s", workload.ResourceName(), p.localClusterId)
+		workload.ClusterId = p.localClusterId
+	}
+
+	if p.WorkloadCache.GetWorkloadByUid(workload.GetUid()) == nil {
+		if err := p.admitNamespaceResource(namespaceKindWorkload, workload.GetNamespace(), workload.ResourceName()); err != nil {
+			return err
+		}
+	}
 
-	_, newServices = p.WorkloadCache.AddOrUpdateWorkload(workload)
+	if p.ephemeralPolicy.SkipPersist && p.isEphemeralWorkload(workload) {
+		// hashed first, the hashes of the uid below find it
+		p.hashName.HashEphemeral(workload.GetUid())
+	}
+
+	cachedWorkload, created := p.WorkloadCache.GetOrCreate(workload.GetUid(), func() *workloadapi.Workload { return workload })
+	if created {
+		p.countNamespaceResource(namespaceKindWorkload, workload.GetNamespace(), 1)
+		for key := range workload.Services {
+			newServices = append(newServices, key)
+		}
+	} else {
+		// A workload whose last programming failed is cached nonetheless, it is fully updated again
+		failing := p.quarantine.failing(workload.GetUid())
+		sameButWaypoint := !failing && equalExceptWaypoint(cachedWorkload, workload)
+		// Skip the bpf map writes if the workload is identical to the cached one,
+		// this is the common case for steady-state xDS pushes
+		if sameButWaypoint && proto.Equal(cachedWorkload.GetWaypoint(), workload.GetWaypoint()) {
+			log.Debugf("workload %s unchanged, skip updating bpf maps", workload.ResourceName())
+			telemetry.WorkloadSkippedUpdates.Inc()
+			return nil
+		}
+		// A waypoint reassignment only changes the backend value, the endpoints and frontends are kept
+		if sameButWaypoint {
+			waypoint := p.workloadWaypoint(workload)
+			if err := p.updateBackendWaypoint(p.hashName.Hash(workload.GetUid()), waypoint); err == nil {
+				p.WorkloadCache.AddOrUpdateWorkload(workload)
+				p.workloadWaypointIndex.set(workload.GetUid(), waypoint)
+				return nil
+			}
+			log.Debugf("workload %s backend not found, fall back to a full update", workload.ResourceName())
+		}
+		_, newServices = p.WorkloadCache.AddOrUpdateWorkload(workload)
+		// the endpoints may be partially written by the failed attempt, all of them are added again,
+		// addWorkloadToService skips the ones already stored
+		if failing {
+			newServices = nil
+			for key := range workload.Services {
+				newServices = append(newServices, key)
+			}
+		}
+	}
 
 	// TODO: how can we know service on restart? maybe also rely on endpoint index
 	if err := p.handleWorkloadUnboundServices(workload); err != nil {
@@ -398,8 +1097,14 @@ func (p *Processor) handleWorkload(workload *workloadapi.Workload) error {
 		return err
 	}
 
-	// Add new services associated with the workload
-	if err := p.handleWorkloadNewBoundServices(workload, newServices); err != nil {
+	// Add new services associated with the workload, unless it is terminating, then it is removed from
+	// the endpoints of all its services and only its backend is kept below for the existing connections
+	if p.isTerminatingWorkload(workload) {
+		if err := p.removeWorkloadEndpoints(workload); err != nil {
+			log.Errorf("removeWorkloadEndpoints %s failed: %v", workload.ResourceName(), err)
+			return err
+		}
+	} else if err := p.handleWorkloadNewBoundServices(workload, newServices); err != nil {
 		log.Errorf("handleWorkloadNewBoundServices %s failed: %v", workload.ResourceName(), err)
 		return err
 	}
@@ -410,6 +1115,11 @@ func (p *Processor) handleWorkload(workload *workloadapi.Workload) error {
 		return err
 	}
 
+	if created {
+		p.totalWorkloads.Add(1)
+	}
+	p.retryPendingWaypoints()
+	p.evictFrontends()
 	return nil
 }
 
@@ -442,10 +1152,12 @@ func (p *Processor) storeServiceData(serviceName string, waypoint *workloadapi.G
 
 	newValue := bpf.ServiceValue{}
 	newValue.LbPolicy = LbPolicyRandom
+	newValue.External = isExternalService(serviceName)
 	if waypoint != nil {
 		nets.CopyIpByteFromSlice(&newValue.WaypointAddr, waypoint.GetAddress().Address)
 		newValue.WaypointPort = nets.ConvertPortToBigEndian(waypoint.GetHboneMtlsPort())
 	}
+	p.serviceWaypointIndex.set(serviceName, waypoint)
 
 	for i, port := range ports {
 		if i >= bpf.MaxPortNum {
@@ -485,7 +1197,15 @@ func (p *Processor) shouldAddEndpoint(wlUid uint32, serviceUid uint32) bool {
 }
 
 func (p *Processor) handleService(service *workloadapi.Service) error {
+	p.handleMutex.Lock()
+	defer p.handleMutex.Unlock()
+	return p.handleServiceLocked(service)
+}
+
+// handleServiceLocked is handleService with handleMutex held
+func (p *Processor) handleServiceLocked(service *workloadapi.Service) (err error) {
 	log.Debugf("handle service resource: %s", service.ResourceName())
+	defer func() { p.EventLog.Record(EventOpService, service.ResourceName(), err) }()
 
 	containsPort := func(port uint32) bool {
 		for _, p := range service.GetPorts() {
@@ -505,40 +1225,521 @@ func (p *Processor) handleService(service *workloadapi.Service) error {
 		// TODO: remove when upstream istiod will not set the waypoint address for itself
 		if slices.Equal(service.GetWaypoint().GetAddress().Address, service.Addresses[0].Address) || containsPort(15021) {
 			service.Waypoint = nil
+		} else if containsAddress(service.GetAddresses(), service.GetWaypoint().GetAddress().GetAddress()) {
+			// any other vip of the service as its waypoint is a misconfiguration
+			wpAddr, _ := netip.AddrFromSlice(service.GetWaypoint().GetAddress().GetAddress())
+			log.Errorf("waypoint %s of service %s is one of its own addresses, refuse to program it to avoid a routing loop",
+				wpAddr, service.ResourceName())
+			telemetry.ServiceSelfWaypoints.Inc()
+			service.Waypoint = nil
 		}
 	}
 
-	p.ServiceCache.AddOrUpdateService(service)
 	serviceName := service.ResourceName()
+	oldService := p.ServiceCache.GetService(serviceName)
+	if oldService == nil {
+		if err := p.admitNamespaceResource(namespaceKindService, service.GetNamespace(), serviceName); err != nil {
+			return err
+		}
+		p.countNamespaceResource(namespaceKindService, service.GetNamespace(), 1)
+	}
+	p.ServiceCache.AddOrUpdateService(service)
 	serviceId := p.hashName.Hash(serviceName)
 
-	// store in frontend
-	if err := p.storeServiceFrontendData(serviceId, service); err != nil {
+	// store in frontend, unless deferred to the first access
+	if len(service.GetPorts()) == 0 && !p.zeroPortPassthrough {
+		log.Warnf("service %s has no ports, skip programming its addresses", serviceName)
+		telemetry.ServiceZeroPortsSkipped.Inc()
+		p.forgetLazyFrontends(oldService)
+		if err := p.deleteServiceFrontendData(oldService, serviceId); err != nil {
+			log.Errorf("deleteServiceFrontendData for service %s failed: %v", serviceName, err)
+		}
+	} else if p.deferServiceFrontends(oldService, service) {
+		log.Debugf("defer programming the frontends of service %s", serviceName)
+	} else if err := p.storeServiceFrontendData(serviceId, service); err != nil {
 		log.Errorf("storeServiceFrontendData failed, err:%s", err)
 		return err
 	}
+	// and remove the vips no longer owned by the service
+	p.deleteStaleServiceFrontendData(oldService, service)
+
+	waypoint := p.serviceWaypoint(service)
+	if p.deferUnknownWaypoints && waypoint != nil && !p.isKnownAddress(waypoint.GetAddress().GetAddress()) {
+		log.Infof("waypoint of service %s is not known yet, defer programming it", serviceName)
+		p.pendingWaypoints.Insert(serviceName)
+		waypoint = nil
+	} else {
+		p.pendingWaypoints.Delete(serviceName)
+	}
 
 	// get endpoint from ServiceCache, and update service and endpoint map
-	if err := p.storeServiceData(serviceName, service.GetWaypoint(), service.GetPorts()); err != nil {
+	if err := p.storeServiceData(serviceName, waypoint, service.GetPorts()); err != nil {
 		log.Errorf("storeServiceData failed, err:%s", err)
 		return err
 	}
+	// the service may be a waypoint whose address changed
+	p.moveWaypointDependents(oldService, service)
+
+	if oldService == nil {
+		p.totalServices.Add(1)
+	}
+	p.retryPendingWaypoints()
+	return nil
+}
+
+// isKnownAddress returns whether the address belongs to a service or workload already programmed
+func (p *Processor) isKnownAddress(address []byte) bool {
+	var (
+		fk = bpf.FrontendKey{}
+		fv = bpf.FrontendValue{}
+	)
+
+	nets.CopyIpByteFromSlice(&fk.Ip, address)
+	return p.bpf.FrontendLookup(&fk, &fv) == nil
+}
+
+// retryPendingWaypoints programs the deferred waypoints whose address has been learned
+func (p *Processor) retryPendingWaypoints() {
+	for serviceName := range p.pendingWaypoints {
+		svc := p.ServiceCache.GetService(serviceName)
+		waypoint := p.serviceWaypoint(svc)
+		if waypoint == nil {
+			p.pendingWaypoints.Delete(serviceName)
+			continue
+		}
+		if !p.isKnownAddress(waypoint.GetAddress().GetAddress()) {
+			continue
+		}
+
+		log.Infof("waypoint of service %s is known now, program it", serviceName)
+		if err := p.storeServiceData(serviceName, waypoint, svc.GetPorts()); err != nil {
+			log.Errorf("storeServiceData for service %s failed: %v", serviceName, err)
+			continue
+		}
+		p.pendingWaypoints.Delete(serviceName)
+	}
+}
+
+// isExternalService returns whether the service of the resource name, <namespace>/<hostname>, is outside of the cluster
+func isExternalService(serviceName string) bool {
+	return !strings.HasSuffix(serviceName, clusterServiceSuffix)
+}
+
+func containsAddress(addresses []*workloadapi.NetworkAddress, address []byte) bool {
+	for _, networkAddress := range addresses {
+		if slices.Equal(networkAddress.GetAddress(), address) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLocalWorkload tells whether the workload runs on the local node, as indicated by its node name,
+// or by an address owned by the node as for the workloads in host network mode
+func (p *Processor) isLocalWorkload(workload *workloadapi.Workload) bool {
+	if p.nodeName != "" && workload.GetNode() == p.nodeName {
+		return true
+	}
+	for _, ip := range workload.GetAddresses() {
+		if addr, ok := netip.AddrFromSlice(ip); ok && p.localAddresses.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+func localFlag(local bool) uint8 {
+	if local {
+		return 1
+	}
+	return 0
+}
+
+// DrainAndPause removes the endpoints of all the workloads on the local node from the endpoint map,
+// so that no new connections are sent to them during node maintenance. The local workloads are kept
+// out of the endpoint map until Resume is called.
+func (p *Processor) DrainAndPause(ctx context.Context) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.handleMutex.Lock()
+	defer p.handleMutex.Unlock()
+
+	p.paused = true
+	for _, workload := range p.WorkloadCache.List() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !p.isLocalWorkload(workload) {
+			continue
+		}
+
+		uid := p.hashName.Hash(workload.GetUid())
+		if eks := p.bpf.GetEndpointKeys(uid); len(eks) > 0 {
+			if err := p.deleteEndpointRecords(uid, eks.UnsortedList()); err != nil {
+				return fmt.Errorf("drain workload %s failed: %v", workload.ResourceName(), err)
+			}
+		}
+	}
+	log.Infof("drained local workloads of node %s", p.nodeName)
+	return nil
+}
+
+// Resume restores the endpoints of the local workloads from WorkloadCache after DrainAndPause
+func (p *Processor) Resume() error {
+	var (
+		sk = bpf.ServiceKey{}
+		sv = bpf.ServiceValue{}
+	)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.handleMutex.Lock()
+	defer p.handleMutex.Unlock()
+
+	for _, workload := range p.WorkloadCache.List() {
+		if !p.isLocalWorkload(workload) || p.isTerminatingWorkload(workload) {
+			continue
+		}
+
+		uid := p.hashName.Hash(workload.GetUid())
+		for serviceName := range workload.GetServices() {
+			sk.ServiceId = p.hashName.Hash(serviceName)
+			if err := p.bpf.ServiceLookup(&sk, &sv); err != nil {
+				continue
+			}
+			if err := p.addWorkloadToService(&sk, &sv, uid, true); err != nil {
+				return fmt.Errorf("restore workload %s failed: %v", workload.ResourceName(), err)
+			}
+		}
+	}
+	p.paused = false
+	log.Infof("resumed local workloads of node %s", p.nodeName)
+	return nil
+}
+
+// ForceResync flushes the workload bpf maps and replays them from WorkloadCache and ServiceCache,
+// it is used by operators to recover from inconsistent bpf maps without restarting the daemon.
+// It is serialized with the xDS processing and the other operations on the caches.
+func (p *Processor) ForceResync() error {
+	var (
+		sk = bpf.ServiceKey{}
+		sv = bpf.ServiceValue{}
+	)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.handleMutex.Lock()
+	defer p.handleMutex.Unlock()
+
+	log.Infof("force resync bpf maps from caches")
+	if err := p.bpf.Flush(); err != nil {
+		return fmt.Errorf("flush bpf maps failed: %v", err)
+	}
+
+	// services first, so that the endpoints can be added to them
+	for _, service := range p.ServiceCache.List() {
+		if err := p.handleServiceLocked(service); err != nil {
+			return fmt.Errorf("resync service %s failed: %v", service.ResourceName(), err)
+		}
+	}
+	for _, workload := range p.WorkloadCache.List() {
+		if (!p.paused || !p.isLocalWorkload(workload)) && !p.isTerminatingWorkload(workload) {
+			uid := p.hashName.Hash(workload.GetUid())
+			for serviceName := range workload.GetServices() {
+				sk.ServiceId = p.hashName.Hash(serviceName)
+				if err := p.bpf.ServiceLookup(&sk, &sv); err != nil {
+					continue
+				}
+				if err := p.addWorkloadToService(&sk, &sv, uid, p.isLocalWorkload(workload)); err != nil {
+					return fmt.Errorf("resync workload %s failed: %v", workload.ResourceName(), err)
+				}
+			}
+		}
+		if err := p.updateWorkload(workload); err != nil {
+			return fmt.Errorf("resync workload %s failed: %v", workload.ResourceName(), err)
+		}
+	}
+	if p.lazyFrontend {
+		// the vips still deferred are left to the datapath misses
+		if err := p.restoreMaterializedFrontends(); err != nil {
+			return fmt.Errorf("resync frontends failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// SetWorkloadWaypoint updates only the waypoint of a known workload, in WorkloadCache and in the
+// backend map, instead of reprocessing the whole workload. A nil waypoint clears it.
+func (p *Processor) SetWorkloadWaypoint(uid string, wp *workloadapi.GatewayAddress) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.handleMutex.Lock()
+	defer p.handleMutex.Unlock()
+
+	cached := p.WorkloadCache.GetWorkloadByUid(uid)
+	if cached == nil {
+		return fmt.Errorf("workload %s not found", uid)
+	}
+
+	if err := p.updateBackendWaypoint(p.hashName.Hash(uid), wp); err != nil {
+		return fmt.Errorf("update backend of workload %s failed: %v", uid, err)
+	}
+
+	// do not mutate the cached workload, it may be shared with readers
+	workload := proto.Clone(cached).(*workloadapi.Workload)
+	workload.Waypoint = wp
+	p.WorkloadCache.AddOrUpdateWorkload(workload)
+	p.workloadWaypointIndex.set(uid, wp)
+	return nil
+}
+
+// updateBackendWaypoint rewrites only the waypoint of the backend, a nil waypoint clears it
+func (p *Processor) updateBackendWaypoint(uid uint32, wp *workloadapi.GatewayAddress) error {
+	var (
+		bk = bpf.BackendKey{BackendUid: uid}
+		bv = bpf.BackendValue{}
+	)
+
+	if err := p.bpf.BackendLookup(&bk, &bv); err != nil {
+		return fmt.Errorf("lookup backend %d failed: %v", uid, err)
+	}
+	bv.WaypointAddr = [16]byte{}
+	bv.WaypointPort = 0
+	if wp != nil {
+		nets.CopyIpByteFromSlice(&bv.WaypointAddr, wp.GetAddress().GetAddress())
+		bv.WaypointPort = nets.ConvertPortToBigEndian(wp.GetHboneMtlsPort())
+	}
+	return p.bpf.BackendUpdate(&bk, &bv)
+}
+
+// equalExceptWaypoint tells whether the workloads are equal regardless of their waypoints,
+// they are compared on copies with the waypoint cleared so that neither is modified
+func equalExceptWaypoint(cached, workload *workloadapi.Workload) bool {
+	cachedCopy := proto.Clone(cached).(*workloadapi.Workload)
+	workloadCopy := proto.Clone(workload).(*workloadapi.Workload)
+	cachedCopy.Waypoint = nil
+	workloadCopy.Waypoint = nil
+	return proto.Equal(cachedCopy, workloadCopy)
+}
+
+// SetNamespaceWaypoint sets the default waypoint of a namespace, applied to its workloads and services
+// which have no waypoint of their own, except the waypoint itself. A nil waypoint removes the default.
+// The cached workloads and services of the namespace are reprogrammed accordingly.
+func (p *Processor) SetNamespaceWaypoint(namespace string, wp *workloadapi.GatewayAddress) error {
+	if wp != nil && wp.GetAddress() == nil {
+		return fmt.Errorf("waypoint of namespace %s must have an address", namespace)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.handleMutex.Lock()
+	defer p.handleMutex.Unlock()
+
+	if wp == nil {
+		delete(p.namespaceWaypoints, namespace)
+	} else {
+		p.namespaceWaypoints[namespace] = wp
+	}
+
+	var errs []error
+	for _, svc := range p.ServiceCache.List() {
+		if svc.GetNamespace() != namespace || svc.GetWaypoint() != nil {
+			continue
+		}
+		p.pendingWaypoints.Delete(svc.ResourceName())
+		if err := p.storeServiceData(svc.ResourceName(), p.serviceWaypoint(svc), svc.GetPorts()); err != nil {
+			errs = append(errs, fmt.Errorf("update service %s failed: %v", svc.ResourceName(), err))
+		}
+	}
+	for _, workload := range p.WorkloadCache.List() {
+		if workload.GetNamespace() != namespace || workload.GetWaypoint() != nil {
+			continue
+		}
+		if err := p.updateWorkload(workload); err != nil {
+			errs = append(errs, fmt.Errorf("update workload %s failed: %v", workload.ResourceName(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// workloadWaypoint returns the waypoint of the workload, or the default waypoint of its namespace if it has none
+// and it is not an instance of the waypoint, which must not redirect to itself
+func (p *Processor) workloadWaypoint(workload *workloadapi.Workload) *workloadapi.GatewayAddress {
+	if waypoint := workload.GetWaypoint(); waypoint != nil {
+		return waypoint
+	}
+
+	waypoint := p.namespaceWaypoints[workload.GetNamespace()]
+	if waypoint == nil {
+		return nil
+	}
+	for serviceName := range workload.GetServices() {
+		if svc := p.ServiceCache.GetService(serviceName); svc != nil &&
+			containsAddress(svc.GetAddresses(), waypoint.GetAddress().GetAddress()) {
+			return nil
+		}
+	}
+	return waypoint
+}
+
+// serviceWaypoint returns the waypoint of the service, or the default waypoint of its namespace if it has none
+// and it is not a waypoint service
+func (p *Processor) serviceWaypoint(service *workloadapi.Service) *workloadapi.GatewayAddress {
+	if service == nil {
+		return nil
+	}
+	if waypoint := service.GetWaypoint(); waypoint != nil {
+		return waypoint
+	}
+
+	waypoint := p.namespaceWaypoints[service.GetNamespace()]
+	if waypoint == nil || containsAddress(service.GetAddresses(), waypoint.GetAddress().GetAddress()) {
+		return nil
+	}
+	// see the waypoint service preprocessing in handleService
+	if slices.ContainsFunc(service.GetPorts(), func(port *workloadapi.Port) bool { return port.GetServicePort() == 15021 }) {
+		return nil
+	}
+	return waypoint
+}
+
+// ReplaceServiceEndpoints replaces all the endpoints of a service with the backends of workloadUIDs,
+// e.g. to switch a blue/green deployment. The service never has zero endpoints meanwhile:
+// the endpoints are overwritten in place, the extra ones are staged beyond EndpointCount before
+// it is raised, and the endpoint count is lowered before the surplus endpoints are deleted.
+// The service is selected by a mix of old and new backends during the replacement.
+// The next xDS update of the workloads of the service may add their endpoints back.
+func (p *Processor) ReplaceServiceEndpoints(resourceName string, workloadUIDs []uint32) error {
+	var (
+		sk = bpf.ServiceKey{}
+		sv = bpf.ServiceValue{}
+		bk = bpf.BackendKey{}
+		bv = bpf.BackendValue{}
+	)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	// hashName and the endpoint index are shared with handleWorkload and handleService
+	p.handleMutex.Lock()
+	defer p.handleMutex.Unlock()
+
+	if p.ServiceCache.GetService(resourceName) == nil {
+		return fmt.Errorf("service %s not found", resourceName)
+	}
+	if len(workloadUIDs) == 0 {
+		return fmt.Errorf("refuse to replace the endpoints of service %s with an empty set", resourceName)
+	}
+	if len(workloadUIDs) != sets.New(workloadUIDs...).Len() {
+		return fmt.Errorf("duplicate workloads in the endpoints of service %s", resourceName)
+	}
+	for _, uid := range workloadUIDs {
+		bk.BackendUid = uid
+		if err := p.bpf.BackendLookup(&bk, &bv); err != nil {
+			return fmt.Errorf("workload %d has no backend: %v", uid, err)
+		}
+	}
+
+	sk.ServiceId = p.hashName.Hash(resourceName)
+	if err := p.bpf.ServiceLookup(&sk, &sv); err != nil {
+		return fmt.Errorf("lookup service %s failed: %v", resourceName, err)
+	}
+
+	oldCount, newCount := sv.EndpointCount, uint32(len(workloadUIDs))
+	now := time.Now().UnixNano()
+	// overwrite the endpoints in place, and stage the extra ones beyond the current count
+	for i, uid := range workloadUIDs {
+		ek := bpf.EndpointKey{ServiceId: sk.ServiceId, BackendIndex: uint32(i) + 1}
+		ev := bpf.EndpointValue{BackendUid: uid, LastUpdated: now}
+		if workload := p.WorkloadCache.GetWorkloadByUid(p.hashName.NumToStr(uid)); workload != nil {
+			ev.Local = localFlag(p.isLocalWorkload(workload))
+		}
+		if err := p.bpf.EndpointUpdate(&ek, &ev); err != nil {
+			return fmt.Errorf("update endpoint [%#v] failed: %v", ek, err)
+		}
+	}
+
+	// flip the count, the new endpoints are all selected from now on
+	sv.EndpointCount = newCount
+	if err := p.bpf.ServiceUpdate(&sk, &sv); err != nil {
+		return fmt.Errorf("update service %s failed: %v", resourceName, err)
+	}
+
+	for index := newCount + 1; index <= oldCount; index++ {
+		ek := bpf.EndpointKey{ServiceId: sk.ServiceId, BackendIndex: index}
+		if err := p.bpf.EndpointDelete(&ek); err != nil {
+			return fmt.Errorf("delete endpoint [%#v] failed: %v", ek, err)
+		}
+	}
+
+	log.Infof("replaced %d endpoints of service %s with %d", oldCount, resourceName, newCount)
 	return nil
 }
 
+// RemoveByAddress removes the workload owning the address in the network, as if it was removed by xDS.
+// The owner is looked up in WorkloadCache, or in the frontend map if not cached, e.g. on restart.
+// It is a no-op if the address is unknown or belongs to a service.
+func (p *Processor) RemoveByAddress(ip netip.Addr, network string) error {
+	var (
+		fk = bpf.FrontendKey{}
+		fv = bpf.FrontendValue{}
+		bk = bpf.BackendKey{}
+		bv = bpf.BackendValue{}
+	)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	ip = ip.Unmap()
+	uid := ""
+	if workload := p.WorkloadCache.GetWorkloadByAddr(cache.NetworkAddress{Network: network, Address: ip}); workload != nil {
+		uid = workload.GetUid()
+	} else {
+		nets.CopyIpByteFromAddr(&fk.Ip, ip)
+		if err := p.bpf.FrontendLookup(&fk, &fv); err != nil {
+			log.Debugf("address %s/%s is unknown, nothing to remove", network, ip)
+			return nil
+		}
+		// only workloads have a backend
+		bk.BackendUid = fv.UpstreamId
+		if err := p.bpf.BackendLookup(&bk, &bv); err != nil {
+			log.Debugf("address %s/%s does not belong to a workload, nothing to remove", network, ip)
+			return nil
+		}
+		if uid = p.hashName.NumToStr(fv.UpstreamId); uid == "" {
+			return fmt.Errorf("workload %d of address %s/%s has no name", fv.UpstreamId, network, ip)
+		}
+	}
+
+	log.Infof("remove workload %s by address %s/%s", uid, network, ip)
+	return p.removeWorkloadResource([]string{uid})
+}
+
+// isWorkloadResourceName tells whether an address resource name refers to a workload
+func isWorkloadResourceName(name string) bool {
+	// workload resource name format: <cluster>/<group>/<kind>/<namespace>/<name></section-name>
+	// service resource name format: namespace/hostname
+	return strings.Count(name, "/") > 2
+}
+
 func (p *Processor) handleRemovedAddresses(removed []string) {
+	p.quarantine.forget(removed)
+	if p.coalescer != nil {
+		p.coalescer.Remove(removed)
+	}
+	p.dropPendingServices(removed)
+
 	var workloadNames []string
 	var serviceNames []string
 	for _, res := range removed {
-		// workload resource name format: <cluster>/<group>/<kind>/<namespace>/<name></section-name>
-		if strings.Count(res, "/") > 2 {
+		if isWorkloadResourceName(res) {
 			workloadNames = append(workloadNames, res)
 		} else {
-			// service resource name format: namespace/hostname
 			serviceNames = append(serviceNames, res)
 		}
 	}
 
+	// workloads must be removed before services whatever the order of the list, removing a workload
+	// decrements the endpoint count of its services, which are gone once removed
 	if err := p.removeWorkloadResource(workloadNames); err != nil {
 		log.Errorf("RemoveWorkloadResource failed: %v", err)
 	}
@@ -547,14 +1748,22 @@ func (p *Processor) handleRemovedAddresses(removed []string) {
 	}
 }
 
+// handleAddressTypeResponse handles all the resources of the response even if some of them fail,
+// the errors of all the failed resources are returned together. The resources handled successfully
+// are stored and not retried. With coalescing enabled the resources are queued instead, see SetCoalescing,
+// and the errors of the coalesced updates written since the last response are returned too.
 func (p *Processor) handleAddressTypeResponse(rsp *service_discovery_v3.DeltaDiscoveryResponse) error {
-	var err error
+	ctx, span := p.startSpan(context.Background(), spanHandleAddressResponse, len(rsp.GetResources())+len(rsp.GetRemovedResources()))
+	var errs []error
+	defer func() { endSpan(span, len(errs)) }()
+
 	// sort resources, first process services, then workload
 	var services []*workloadapi.Service
 	var workloads []*workloadapi.Workload
 	for _, resource := range rsp.GetResources() {
 		address := &workloadapi.Address{}
-		if err = anypb.UnmarshalTo(resource.Resource, address, proto.UnmarshalOptions{}); err != nil {
+		if err := anypb.UnmarshalTo(resource.Resource, address, proto.UnmarshalOptions{}); err != nil {
+			errs = append(errs, fmt.Errorf("unmarshal resource %s failed: %v", resource.GetName(), err))
 			continue
 		}
 
@@ -568,23 +1777,109 @@ func (p *Processor) handleAddressTypeResponse(rsp *service_discovery_v3.DeltaDis
 		}
 	}
 
+	if p.coalescer == nil {
+		errs = append(errs, p.handleAddresses(ctx, services, workloads)...)
+	} else {
+		full := false
+		for _, service := range services {
+			full = p.coalescer.Add(service.ResourceName(), service) || full
+		}
+		for _, workload := range workloads {
+			full = p.coalescer.Add(workload.ResourceName(), workload) || full
+		}
+		if full {
+			errs = append(errs, p.flushCoalesced(ctx)...)
+		}
+	}
+
+	_, removedSpan := p.startSpan(ctx, spanHandleRemoved, len(rsp.GetRemovedResources()))
+	p.handleRemovedAddresses(rsp.RemovedResources)
+	removedSpan.End()
+	p.once.Do(func() {
+		// the addresses of the first response must be cached to tell the removed ones
+		if p.coalescer != nil {
+			errs = append(errs, p.flushCoalesced(ctx)...)
+		}
+		p.reconcileWarmStart(services, workloads)
+		_, restartSpan := p.startSpan(ctx, spanHandleRestartRemoved, 0)
+		p.handleRemovedAddressesDuringRestart()
+		restartSpan.End()
+	})
+	errs = append(errs, p.coalescedErrs...)
+	p.coalescedErrs = nil
+	return errors.Join(errs...)
+}
+
+// handleAddresses handles the services, then the workloads, and returns the errors of the failed ones.
+// The services are programmed before the workloads joining them, and the workloads bound to services are
+// sorted by uid in place, so that the endpoint indices of a service do not depend on the order the control
+// plane sends its workloads in, and are the same across restarts for the same members.
+func (p *Processor) handleAddresses(ctx context.Context, services []*workloadapi.Service, workloads []*workloadapi.Workload) []error {
+	var errs []error
+	sortServiceWorkloads(workloads)
+	_, span := p.startSpan(ctx, spanHandleServices, len(services))
 	for _, service := range services {
+		if p.debounceService(service) {
+			log.Debugf("service %s is newly seen, hold it for the debounce window", service.ResourceName())
+			continue
+		}
+		if !p.quarantine.admit(service.ResourceName(), service) {
+			log.Debugf("service %s is quarantined, skip it", service.ResourceName())
+			continue
+		}
 		log.Debugf("handle service %v", service.ResourceName())
-		if err = p.handleService(service); err != nil {
+		err := p.handleService(service)
+		p.quarantine.record(service.ResourceName(), service, err)
+		if err != nil {
 			log.Errorf("handle service failed, err: %v", err)
+			errs = append(errs, fmt.Errorf("handle service %s failed: %v", service.ResourceName(), err))
 		}
 	}
+	endSpan(span, len(errs))
 
+	failedServices := len(errs)
+	workloadsCtx, span := p.startSpan(ctx, spanHandleWorkloads, len(workloads))
 	for _, workload := range workloads {
+		if !p.quarantine.admit(workload.ResourceName(), workload) {
+			log.Debugf("workload %s is quarantined, skip it", workload.ResourceName())
+			continue
+		}
 		log.Debugf("handle workload %v", workload.ResourceName())
-		if err = p.handleWorkload(workload); err != nil {
+		err := p.handleWorkloadInSpan(workloadsCtx, workload)
+		p.quarantine.record(workload.ResourceName(), workload, err)
+		if err != nil {
 			log.Errorf("handle workload failed, err: %v", err)
+			errs = append(errs, fmt.Errorf("handle workload %s failed: %v", workload.ResourceName(), err))
 		}
 	}
+	endSpan(span, len(errs)-failedServices)
+	return errs
+}
 
-	p.handleRemovedAddresses(rsp.RemovedResources)
-	p.once.Do(p.handleRemovedAddressesDuringRestart)
-	return err
+func sortWorkloadsByUid(workloads []*workloadapi.Workload) {
+	slices.SortFunc(workloads, func(a, b *workloadapi.Workload) int {
+		return strings.Compare(a.GetUid(), b.GetUid())
+	})
+}
+
+// sortServiceWorkloads sorts by uid the workloads bound to services, among the positions they hold,
+// the workloads without service are not assigned any endpoint index and keep their position
+func sortServiceWorkloads(workloads []*workloadapi.Workload) {
+	var (
+		positions []int
+		bound     []*workloadapi.Workload
+	)
+
+	for i, workload := range workloads {
+		if len(workload.GetServices()) != 0 {
+			positions = append(positions, i)
+			bound = append(bound, workload)
+		}
+	}
+	sortWorkloadsByUid(bound)
+	for i, position := range positions {
+		workloads[position] = bound[i]
+	}
 }
 
 // After restart, we can get the removed addresses by comparing the
@@ -598,6 +1893,9 @@ func (p *Processor) handleRemovedAddressesDuringRestart() {
 		sv = bpf.ServiceValue{}
 	)
 
+	// the workloads not received in the first response are rewritten
+	defer func() { p.restoredDigests = nil }()
+
 	if kmeshbpf.GetStartType() != kmeshbpf.Restart {
 		return
 	}
@@ -626,12 +1924,30 @@ func (p *Processor) handleRemovedAddressesDuringRestart() {
 			}
 		}
 	}
+	p.removeUnknownBackends()
 }
 
 func (p *Processor) handleAuthorizationTypeResponse(rsp *service_discovery_v3.DeltaDiscoveryResponse, rbac *auth.Rbac) error {
 	if rbac == nil {
 		return fmt.Errorf("Rbac module uninitialized")
 	}
+	p.handleMutex.Lock()
+	defer p.handleMutex.Unlock()
+
+	// the workloads referring to the policies changed get their policies updated at last,
+	// after the policies added are written and before the policies removed are deleted
+	changed := sets.New[string]()
+	removed := []string{}
+	defer func() {
+		p.updateWorkloadPolicies(changed)
+		for _, name := range removed {
+			if err := p.bpf.AuthzPolicyDelete(p.policyId(name)); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+				log.Errorf("delete authorization policy %s failed: %v", name, err)
+			}
+			p.hashName.Delete(authzPolicyIdPrefix + name)
+		}
+	}()
+
 	// update resource
 	for _, resource := range rsp.GetResources() {
 		auth := &security.Authorization{}
@@ -643,11 +1959,19 @@ func (p *Processor) handleAuthorizationTypeResponse(rsp *service_discovery_v3.De
 		if err := rbac.UpdatePolicy(auth); err != nil {
 			return err
 		}
+		p.PolicyCache.AddOrUpdatePolicy(auth)
+		if err := p.bpf.AuthzPolicyUpdate(p.policyId(auth.ResourceName()), authzPolicyValue(auth)); err != nil {
+			log.Errorf("update authorization policy %s failed: %v", auth.ResourceName(), err)
+		}
+		changed.Insert(auth.ResourceName())
 	}
 
 	// delete resource by name
 	for _, resourceName := range rsp.GetRemovedResources() {
 		rbac.RemovePolicy(resourceName)
+		p.PolicyCache.DeletePolicy(resourceName)
+		changed.Insert(resourceName)
+		removed = append(removed, resourceName)
 		log.Debugf("remove authorization policy %s", resourceName)
 	}
 
@@ -664,7 +1988,14 @@ func (p *Processor) deleteEndpointRecords(workloadId uint32, endpointKeys []bpf.
 	for _, ek := range endpointKeys {
 		// 1. find the service
 		sk.ServiceId = ek.ServiceId
-		if err := p.bpf.ServiceLookup(&sk, &sv); err == nil {
+		if err := p.bpf.ServiceLookup(&sk, &sv); err == nil && sv.EndpointCount == 0 {
+			// the endpoint count must not underflow, the endpoint is stale
+			log.Errorf("service %d has no endpoint, delete stale endpoint [%#v]", ek.ServiceId, ek)
+			if err := p.bpf.EndpointDelete(&ek); err != nil {
+				log.Errorf("EndpointDelete [%#v] failed: %v", ek, err)
+				return err
+			}
+		} else if err == nil {
 			// 2. find the last indexed endpoint of the service
 			if err := p.bpf.EndpointSwap(ek.BackendIndex, sv.EndpointCount, sk.ServiceId); err != nil {
 				log.Errorf("swap workload %d endpoint index failed: %s", workloadId, err)
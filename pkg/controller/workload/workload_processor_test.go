@@ -17,20 +17,33 @@
 package workload
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/netip"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/cilium/ebpf"
 	service_discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/goleak"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
 	"istio.io/istio/pilot/pkg/util/protoconv"
 	"istio.io/istio/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/rand"
 
 	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/api/v2/workloadapi/security"
 	"kmesh.net/kmesh/daemon/options"
+	"kmesh.net/kmesh/pkg/auth"
 	"kmesh.net/kmesh/pkg/bpf"
 	"kmesh.net/kmesh/pkg/constants"
+	"kmesh.net/kmesh/pkg/controller/telemetry"
 	"kmesh.net/kmesh/pkg/controller/workload/bpfcache"
 	"kmesh.net/kmesh/pkg/controller/workload/cache"
 	"kmesh.net/kmesh/pkg/nets"
@@ -90,6 +103,8 @@ func Test_handleWorkload(t *testing.T) {
 	checkServiceMap(t, p, svcID, fakeSvc, 2)
 
 	// 4 modify workload2 attribute not related with services
+	// xDS always delivers a new object, do not mutate the cached one
+	workload2 = proto.Clone(workload2).(*workloadapi.Workload)
 	workload2.Waypoint = &workloadapi.GatewayAddress{
 		Destination: &workloadapi.GatewayAddress_Address{
 			Address: &workloadapi.NetworkAddress{
@@ -149,27 +164,1458 @@ func Test_handleWorkload(t *testing.T) {
 	hashNameClean(p)
 }
 
+func Test_handleWorkload_idempotency(t *testing.T) {
+	const calls = 100
+
+	dualStack := createWorkload("dual", "10.244.0.4", workloadapi.NetworkMode_STANDARD, "svc1")
+	dualStack.Addresses = append(dualStack.Addresses, netip.MustParseAddr("fd00::4").AsSlice())
+	withWaypoint := createWorkload("waypointed", "10.244.0.3", workloadapi.NetworkMode_STANDARD, "svc1")
+	withWaypoint.Waypoint = createFakeService("svc1", "10.240.10.1", "10.240.10.200").GetWaypoint()
+
+	tests := []struct {
+		name     string
+		workload *workloadapi.Workload
+	}{
+		{
+			name:     "single service",
+			workload: createWorkload("single", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1"),
+		},
+		{
+			name:     "multiple services",
+			workload: createWorkload("multi", "10.244.0.2", workloadapi.NetworkMode_STANDARD, "svc1", "svc2"),
+		},
+		{
+			name:     "waypoint",
+			workload: withWaypoint,
+		},
+		{
+			name:     "dual stack",
+			workload: dualStack,
+		},
+		{
+			name:     "host network",
+			workload: createWorkload("host", "10.244.0.5", workloadapi.NetworkMode_HOST_NETWORK, "svc1"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workloadMap := bpfcache.NewFakeWorkloadMap(t)
+			defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+			p := newProcessor(workloadMap)
+			defer hashNameClean(p)
+
+			assert.NoError(t, p.handleService(createFakeService("svc1", "10.240.10.1", "10.240.10.200")))
+			assert.NoError(t, p.handleService(createFakeService("svc2", "10.240.10.2", "10.240.10.200")))
+			// an existing endpoint, so that a bloated endpoint count can't go unnoticed
+			assert.NoError(t, p.handleWorkload(createWorkload("other", "10.244.1.1", workloadapi.NetworkMode_STANDARD, "svc1", "svc2")))
+
+			assert.NoError(t, p.handleWorkload(tt.workload))
+			expected, err := p.bpf.Dump()
+			assert.NoError(t, err)
+
+			for i := 0; i < calls; i++ {
+				// a copy, as received from a new response
+				assert.NoError(t, p.handleWorkload(proto.Clone(tt.workload).(*workloadapi.Workload)))
+
+				dump, err := p.bpf.Dump()
+				assert.NoError(t, err)
+				assert.ElementsMatch(t, expected.Frontends, dump.Frontends, "frontends after call %d", i)
+				assert.ElementsMatch(t, expected.Services, dump.Services, "services after call %d", i)
+				assert.ElementsMatch(t, expected.Endpoints, dump.Endpoints, "endpoints after call %d", i)
+				assert.ElementsMatch(t, expected.Backends, dump.Backends, "backends after call %d", i)
+
+				endpointCount := make(map[uint32]uint32)
+				for _, e := range dump.Services {
+					endpointCount[e.Key.ServiceId] = e.Value.EndpointCount
+				}
+				backends := make(map[uint32]sets.Set[uint32])
+				for _, e := range dump.Endpoints {
+					if backends[e.Key.ServiceId] == nil {
+						backends[e.Key.ServiceId] = sets.New[uint32]()
+					}
+					assert.False(t, backends[e.Key.ServiceId].Contains(e.Value.BackendUid),
+						"duplicate backend %d in service %d after call %d", e.Value.BackendUid, e.Key.ServiceId, i)
+					backends[e.Key.ServiceId].Insert(e.Value.BackendUid)
+				}
+				for serviceId, count := range endpointCount {
+					assert.Equal(t, uint32(backends[serviceId].Len()), count, "endpoint count of service %d after call %d", serviceId, i)
+				}
+				if t.Failed() {
+					return
+				}
+			}
+
+			for serviceName := range tt.workload.GetServices() {
+				checkEndpointMap(t, p, p.ServiceCache.GetService(serviceName), []uint32{
+					p.hashName.Hash(createWorkload("other", "10.244.1.1", workloadapi.NetworkMode_STANDARD).Uid),
+					p.hashName.Hash(tt.workload.Uid),
+				})
+			}
+		})
+	}
+}
+
+func Test_handleWorkloadIPv6(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	var (
+		ek bpfcache.EndpointKey
+		ev bpfcache.EndpointValue
+	)
+
+	// 1. add related service
+	fakeSvc := createFakeService("testsvc", "fd00:10:96::1", "fd00:10:96::2")
+	assert.NoError(t, p.handleService(fakeSvc))
+	svcID := checkFrontEndMap(t, fakeSvc.Addresses[0].Address, p)
+
+	// 2. add workload
+	wl := createFakeWorkloadIPv6("fd00:10:244::1")
+	assert.NoError(t, p.handleWorkload(wl))
+	workloadID := checkFrontEndMap(t, wl.Addresses[0], p)
+	checkBackendMap(t, p, workloadID, wl)
+	checkServiceMap(t, p, svcID, fakeSvc, 1)
+	ek.BackendIndex = 1
+	ek.ServiceId = svcID
+	assert.NoError(t, p.bpf.EndpointLookup(&ek, &ev))
+	assert.Equal(t, workloadID, ev.BackendUid)
+
+	// 3. add another workload with service
+	workload2 := createFakeWorkloadIPv6("fd00:10:244::2")
+	assert.NoError(t, p.handleWorkload(workload2))
+	workload2ID := checkFrontEndMap(t, workload2.Addresses[0], p)
+	ek.BackendIndex = 2
+	assert.NoError(t, p.bpf.EndpointLookup(&ek, &ev))
+	assert.Equal(t, workload2ID, ev.BackendUid)
+	checkServiceMap(t, p, svcID, fakeSvc, 2)
+
+	// 4. modify workload2 waypoint
+	workload2 = proto.Clone(workload2).(*workloadapi.Workload)
+	workload2.Waypoint = &workloadapi.GatewayAddress{
+		Destination: &workloadapi.GatewayAddress_Address{
+			Address: &workloadapi.NetworkAddress{
+				Address: netip.MustParseAddr("fd00:10:10::10").AsSlice(),
+			},
+		},
+		HboneMtlsPort: 15008,
+	}
+	assert.NoError(t, p.handleWorkload(workload2))
+	checkBackendMap(t, p, workload2ID, workload2)
+	checkServiceMap(t, p, svcID, fakeSvc, 2)
+
+	// 5. update workload to remove the bound services
+	wl3 := proto.Clone(wl).(*workloadapi.Workload)
+	wl3.Services = nil
+	assert.NoError(t, p.handleWorkload(wl3))
+	checkServiceMap(t, p, svcID, fakeSvc, 1)
+	ek.BackendIndex = 1
+	assert.NoError(t, p.bpf.EndpointLookup(&ek, &ev))
+	assert.Equal(t, workload2ID, ev.BackendUid)
+
+	// 6. delete workload and service
+	assert.NoError(t, p.removeWorkloadResource([]string{wl.Uid}))
+	checkNotExistInFrontEndMap(t, wl.Addresses[0], p)
+	p.handleRemovedAddresses([]string{fakeSvc.ResourceName()})
+	checkNotExistInFrontEndMap(t, fakeSvc.Addresses[0].Address, p)
+}
+
+func Test_handleWorkloadDualStack(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	var (
+		ek bpfcache.EndpointKey
+		ev bpfcache.EndpointValue
+		bv bpfcache.BackendValue
+	)
+
+	// 1. add related dual-stack service
+	fakeSvc := createFakeService("testsvc", "10.240.10.1", "10.240.10.2")
+	fakeSvc.Addresses = append(fakeSvc.Addresses, &workloadapi.NetworkAddress{
+		Address: netip.MustParseAddr("fd00:10:96::1").AsSlice(),
+	})
+	assert.NoError(t, p.handleService(fakeSvc))
+	svcID := checkFrontEndMap(t, fakeSvc.Addresses[0].Address, p)
+	assert.Equal(t, svcID, checkFrontEndMap(t, fakeSvc.Addresses[1].Address, p))
+
+	// 2. add workload, both addresses resolve to it, and the backend holds both
+	wl := createFakeDualStackWorkload("10.244.0.1", "fd00:10:244::1")
+	assert.NoError(t, p.handleWorkload(wl))
+	workloadID := checkFrontEndMap(t, wl.Addresses[0], p)
+	assert.Equal(t, workloadID, checkFrontEndMap(t, wl.Addresses[1], p))
+	assert.NoError(t, p.bpf.BackendLookup(&bpfcache.BackendKey{BackendUid: workloadID}, &bv))
+	assert.True(t, test.EqualIp(bv.Ip, wl.Addresses[0]))
+	assert.True(t, test.EqualIp(bv.Ip6, wl.Addresses[1]))
+	checkServiceMap(t, p, svcID, fakeSvc, 1)
+	ek.BackendIndex = 1
+	ek.ServiceId = svcID
+	assert.NoError(t, p.bpf.EndpointLookup(&ek, &ev))
+	assert.Equal(t, workloadID, ev.BackendUid)
+
+	// 3. add another workload listing its ipv6 address first, the backend still holds the ipv4 one in Ip
+	workload2 := createFakeWorkload("fd00:10:244::2", workloadapi.NetworkMode_STANDARD)
+	workload2.Addresses = append(workload2.Addresses, netip.MustParseAddr("10.244.0.2").AsSlice())
+	assert.NoError(t, p.handleWorkload(workload2))
+	workload2ID := checkFrontEndMap(t, workload2.Addresses[0], p)
+	assert.Equal(t, workload2ID, checkFrontEndMap(t, workload2.Addresses[1], p))
+	assert.NoError(t, p.bpf.BackendLookup(&bpfcache.BackendKey{BackendUid: workload2ID}, &bv))
+	assert.True(t, test.EqualIp(bv.Ip, workload2.Addresses[1]))
+	assert.True(t, test.EqualIp(bv.Ip6, workload2.Addresses[0]))
+	checkServiceMap(t, p, svcID, fakeSvc, 2)
+
+	// 4. modify workload2 waypoint
+	workload2 = proto.Clone(workload2).(*workloadapi.Workload)
+	workload2.Waypoint = &workloadapi.GatewayAddress{
+		Destination: &workloadapi.GatewayAddress_Address{
+			Address: &workloadapi.NetworkAddress{
+				Address: netip.MustParseAddr("10.10.10.10").AsSlice(),
+			},
+		},
+		HboneMtlsPort: 15008,
+	}
+	assert.NoError(t, p.handleWorkload(workload2))
+	assert.NoError(t, p.bpf.BackendLookup(&bpfcache.BackendKey{BackendUid: workload2ID}, &bv))
+	assert.Equal(t, nets.ConvertPortToBigEndian(15008), bv.WaypointPort)
+	assert.True(t, test.EqualIp(bv.Ip6, workload2.Addresses[0]))
+
+	// 5. update workload to remove the bound services
+	wl3 := proto.Clone(wl).(*workloadapi.Workload)
+	wl3.Services = nil
+	assert.NoError(t, p.handleWorkload(wl3))
+	checkServiceMap(t, p, svcID, fakeSvc, 1)
+	ek.BackendIndex = 1
+	assert.NoError(t, p.bpf.EndpointLookup(&ek, &ev))
+	assert.Equal(t, workload2ID, ev.BackendUid)
+
+	// 6. delete workloads, the frontends of both addresses are removed
+	assert.NoError(t, p.removeWorkloadResource([]string{wl.Uid}))
+	checkNotExistInFrontEndMap(t, wl.Addresses[0], p)
+	checkNotExistInFrontEndMap(t, wl.Addresses[1], p)
+	assert.NoError(t, p.removeWorkloadsFromBpfMap([]string{workload2.Uid}))
+	checkNotExistInFrontEndMap(t, workload2.Addresses[0], p)
+	checkNotExistInFrontEndMap(t, workload2.Addresses[1], p)
+
+	// 7. delete service
+	p.handleRemovedAddresses([]string{fakeSvc.ResourceName()})
+	checkNotExistInFrontEndMap(t, fakeSvc.Addresses[0].Address, p)
+	checkNotExistInFrontEndMap(t, fakeSvc.Addresses[1].Address, p)
+}
+
 func Test_hostnameNetworkMode(t *testing.T) {
 	workloadMap := bpfcache.NewFakeWorkloadMap(t)
 	p := newProcessor(workloadMap)
-	workload := createFakeWorkload("1.2.3.4", workloadapi.NetworkMode_STANDARD)
-	workloadWithoutService := createFakeWorkload("1.2.3.5", workloadapi.NetworkMode_STANDARD)
-	workloadWithoutService.Services = nil
-	workloadHostname := createFakeWorkload("1.2.3.6", workloadapi.NetworkMode_HOST_NETWORK)
+	workload := createFakeWorkload("1.2.3.4", workloadapi.NetworkMode_STANDARD)
+	workloadWithoutService := createFakeWorkload("1.2.3.5", workloadapi.NetworkMode_STANDARD)
+	workloadWithoutService.Services = nil
+	workloadHostname := createFakeWorkload("1.2.3.6", workloadapi.NetworkMode_HOST_NETWORK)
+
+	p.handleWorkload(workload)
+	p.handleWorkload(workloadWithoutService)
+	p.handleWorkload(workloadHostname)
+
+	// Check Workload Cache
+	checkWorkloadCache(t, p, workload)
+	checkWorkloadCache(t, p, workloadWithoutService)
+	checkWorkloadCache(t, p, workloadHostname)
+
+	// Check Frontend Map
+	checkFrontEndMapWithNetworkMode(t, workload.Addresses[0], p, workload.NetworkMode)
+	checkFrontEndMapWithNetworkMode(t, workloadWithoutService.Addresses[0], p, workloadWithoutService.NetworkMode)
+	checkFrontEndMapWithNetworkMode(t, workloadHostname.Addresses[0], p, workloadHostname.NetworkMode)
+}
+
+func Test_handleWorkloadUnchanged(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+
+	fakeSvc := createFakeService("testsvc", "10.240.10.1", "10.240.10.2")
+	_ = p.handleService(fakeSvc)
+
+	wl := createFakeWorkload("1.2.3.4", workloadapi.NetworkMode_STANDARD)
+	err := p.handleWorkload(wl)
+	assert.NoError(t, err)
+	workloadID := checkFrontEndMap(t, wl.Addresses[0], p)
+	svcID := checkFrontEndMap(t, fakeSvc.Addresses[0].Address, p)
+	checkServiceMap(t, p, svcID, fakeSvc, 1)
+
+	// 1. the same workload pushed again should be skipped
+	skipped := testutil.ToFloat64(telemetry.WorkloadSkippedUpdates)
+	err = p.handleWorkload(proto.Clone(wl).(*workloadapi.Workload))
+	assert.NoError(t, err)
+	assert.Equal(t, skipped+1, testutil.ToFloat64(telemetry.WorkloadSkippedUpdates))
+	checkServiceMap(t, p, svcID, fakeSvc, 1)
+	checkEndpointMap(t, p, fakeSvc, []uint32{workloadID})
+
+	// 2. a changed workload should still update the bpf maps
+	wl2 := proto.Clone(wl).(*workloadapi.Workload)
+	wl2.Waypoint = &workloadapi.GatewayAddress{
+		Destination: &workloadapi.GatewayAddress_Address{
+			Address: &workloadapi.NetworkAddress{
+				Address: netip.MustParseAddr("10.10.10.10").AsSlice(),
+			},
+		},
+		HboneMtlsPort: 15008,
+	}
+	err = p.handleWorkload(wl2)
+	assert.NoError(t, err)
+	assert.Equal(t, skipped+1, testutil.ToFloat64(telemetry.WorkloadSkippedUpdates))
+	checkBackendMap(t, p, workloadID, wl2)
+
+	hashNameClean(p)
+}
+
+func Test_handleRemovedAddressesOrder(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc))
+	wl1 := createWorkload("pod1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	wl2 := createWorkload("pod2", "10.244.0.2", workloadapi.NetworkMode_STANDARD, "svc1")
+	assert.NoError(t, p.handleWorkload(wl1))
+	assert.NoError(t, p.handleWorkload(wl2))
+	svcId := p.hashName.Hash(svc.ResourceName())
+	wl2Id := p.hashName.Hash(wl2.Uid)
+
+	// 1. the service is listed before the workload, the workload must still be removed first
+	p.handleRemovedAddresses([]string{svc.ResourceName(), wl1.Uid})
+	assert.Nil(t, p.WorkloadCache.GetWorkloadByUid(wl1.Uid))
+	assert.Nil(t, p.ServiceCache.GetService(svc.ResourceName()))
+	checkNotExistInFrontEndMap(t, wl1.Addresses[0], p)
+	var sv bpfcache.ServiceValue
+	assert.Error(t, p.bpf.ServiceLookup(&bpfcache.ServiceKey{ServiceId: svcId}, &sv))
+	assert.Empty(t, p.bpf.GetAllEndpointsForService(svcId))
+
+	// 2. the service comes back without endpoints, while pod2 still indexes its old endpoint,
+	// removing pod2 must not underflow the endpoint count
+	assert.NoError(t, p.handleService(svc))
+	svcId = p.hashName.Hash(svc.ResourceName())
+	ek := bpfcache.EndpointKey{ServiceId: svcId, BackendIndex: 1}
+	assert.NoError(t, p.bpf.EndpointUpdate(&ek, &bpfcache.EndpointValue{BackendUid: wl2Id}))
+	checkServiceMap(t, p, svcId, svc, 0)
+
+	p.handleRemovedAddresses([]string{wl2.Uid})
+	checkServiceMap(t, p, svcId, svc, 0)
+	assert.Empty(t, p.bpf.GetAllEndpointsForService(svcId))
+	assert.Empty(t, p.bpf.GetEndpointKeys(wl2Id))
+
+	hashNameClean(p)
+}
+
+func Test_handleRemovedAddressesReassignedIp(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc))
+	oldPod := createWorkload("old-pod", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	assert.NoError(t, p.handleWorkload(oldPod))
+
+	// the new pod reusing the ip is received before the removal of the old pod
+	newPod := createWorkload("new-pod", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	assert.NoError(t, p.handleWorkload(newPod))
+	newPodId := p.hashName.Hash(newPod.Uid)
+	assert.Equal(t, newPodId, checkFrontEndMap(t, newPod.Addresses[0], p))
+	networkAddress := cache.NetworkAddress{Network: newPod.Network, Address: netip.MustParseAddr("10.244.0.1")}
+
+	p.handleRemovedAddresses([]string{oldPod.Uid})
+	assert.Equal(t, newPodId, checkFrontEndMap(t, newPod.Addresses[0], p))
+	checkBackendMap(t, p, newPodId, newPod)
+	assert.Equal(t, newPod, p.WorkloadCache.GetWorkloadByAddr(networkAddress))
+	checkServiceMap(t, p, p.hashName.Hash(svc.ResourceName()), svc, 1)
+
+	// the removal of the new pod deletes the frontend
+	p.handleRemovedAddresses([]string{newPod.Uid})
+	checkNotExistInFrontEndMap(t, newPod.Addresses[0], p)
+	assert.Nil(t, p.WorkloadCache.GetWorkloadByAddr(networkAddress))
+}
+
+func Test_handleWorkloadInvalidAddress(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+
+	wl := createFakeWorkload("10.244.0.1", workloadapi.NetworkMode_STANDARD)
+	loopback := netip.MustParseAddr("127.0.0.1").AsSlice()
+	linkLocal := netip.MustParseAddr("fe80::1").AsSlice()
+	wl.Addresses = append(wl.Addresses, loopback, linkLocal)
+	assert.NoError(t, p.handleWorkload(wl))
+
+	upstreamId := checkFrontEndMap(t, wl.Addresses[0], p)
+	assert.Equal(t, p.hashName.Hash(wl.Uid), upstreamId)
+	checkNotExistInFrontEndMap(t, loopback, p)
+	checkNotExistInFrontEndMap(t, linkLocal, p)
+	checkBackendMap(t, p, upstreamId, wl)
+
+	// a workload left without reachable address is skipped before any endpoint is written
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc))
+	svcId := p.hashName.Hash(svc.ResourceName())
+	unreachable := createWorkload("pod2", "127.0.0.2", workloadapi.NetworkMode_STANDARD, "svc1")
+	assert.NoError(t, p.handleWorkload(unreachable))
+	checkServiceMap(t, p, svcId, svc, 0)
+	assert.Nil(t, p.WorkloadCache.GetWorkloadByUid(unreachable.Uid))
+
+	// the previous version of a workload whose addresses become unreachable is kept
+	pod := createWorkload("pod3", "10.244.0.3", workloadapi.NetworkMode_STANDARD, "svc1")
+	assert.NoError(t, p.handleWorkload(pod))
+	checkServiceMap(t, p, svcId, svc, 1)
+	podId := p.hashName.Hash(pod.Uid)
+	unreachablePod := proto.Clone(pod).(*workloadapi.Workload)
+	unreachablePod.Addresses = [][]byte{linkLocal}
+	assert.NoError(t, p.handleWorkload(unreachablePod))
+	checkServiceMap(t, p, svcId, svc, 1)
+	assert.Equal(t, podId, checkFrontEndMap(t, pod.Addresses[0], p))
+	checkBackendMap(t, p, podId, pod)
+	assert.True(t, proto.Equal(pod, p.WorkloadCache.GetWorkloadByUid(pod.Uid)))
+
+	hashNameClean(p)
+}
+
+func Test_handleVirtualMachineWorkload(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+
+	vm := createWorkload("vm1", "10.10.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	vm.Uid = "cluster0/networking.istio.io/WorkloadEntry/default/vm1"
+	pod := createWorkload("pod1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc))
+	assert.NoError(t, p.handleWorkload(vm))
+	assert.NoError(t, p.handleWorkload(pod))
+
+	vmId := p.hashName.Hash(vm.Uid)
+	assert.True(t, p.WorkloadStatus(vm.Uid).VM)
+	checkBackendMap(t, p, vmId, vm)
+
+	podId := p.hashName.Hash(pod.Uid)
+	assert.False(t, p.WorkloadStatus(pod.Uid).VM)
+
+	// vm endpoints are inserted the same way as pods
+	checkFrontEndMap(t, vm.Addresses[0], p)
+	checkEndpointMap(t, p, svc, []uint32{vmId, podId})
+
+	hashNameClean(p)
+}
+
+func TestSetWorkloadWaypoint(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	assert.NoError(t, p.handleService(createFakeService("svc1", "10.240.10.1", "10.240.10.200")))
+	wl := createWorkload("pod1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	assert.NoError(t, p.handleWorkload(wl))
+	wlId := p.hashName.Hash(wl.Uid)
+	checkBackendMap(t, p, wlId, wl)
+
+	// 1. add a waypoint
+	wp := &workloadapi.GatewayAddress{
+		Destination: &workloadapi.GatewayAddress_Address{
+			Address: &workloadapi.NetworkAddress{
+				Address: netip.MustParseAddr("10.10.10.10").AsSlice(),
+			},
+		},
+		HboneMtlsPort: 15008,
+	}
+	assert.NoError(t, p.SetWorkloadWaypoint(wl.Uid, wp))
+	cached := p.WorkloadCache.GetWorkloadByUid(wl.Uid)
+	assert.True(t, proto.Equal(wp, cached.GetWaypoint()))
+	checkBackendMap(t, p, wlId, cached)
+	// the original workload is not mutated
+	assert.Nil(t, wl.GetWaypoint())
+
+	// 2. the services and endpoints are untouched
+	checkFrontEndMap(t, wl.Addresses[0], p)
+	checkEndpointMap(t, p, createFakeService("svc1", "10.240.10.1", "10.240.10.200"), []uint32{wlId})
+
+	// 3. clear the waypoint
+	assert.NoError(t, p.SetWorkloadWaypoint(wl.Uid, nil))
+	cached = p.WorkloadCache.GetWorkloadByUid(wl.Uid)
+	assert.Nil(t, cached.GetWaypoint())
+	checkBackendMap(t, p, wlId, cached)
+	var bv bpfcache.BackendValue
+	assert.NoError(t, p.bpf.BackendLookup(&bpfcache.BackendKey{BackendUid: wlId}, &bv))
+	assert.Equal(t, [16]byte{}, bv.WaypointAddr)
+
+	// 4. unknown workload
+	assert.Error(t, p.SetWorkloadWaypoint("cluster0//Pod/default/unknown", wp))
+
+	hashNameClean(p)
+}
+
+func Test_handleWorkloadWaypointOnlyChange(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+	counter := bpfcache.NewOpCounter()
+	p.bpf.SetOpCounter(counter)
+
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc))
+	wl := createWorkload("pod1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	assert.NoError(t, p.handleWorkload(wl))
+	wlId := p.hashName.Hash(wl.Uid)
+
+	// 1. only the backend is written when the waypoint is assigned
+	counter.Reset()
+	withWaypoint := proto.Clone(wl).(*workloadapi.Workload)
+	withWaypoint.Waypoint = &workloadapi.GatewayAddress{
+		Destination: &workloadapi.GatewayAddress_Address{
+			Address: &workloadapi.NetworkAddress{
+				Address: netip.MustParseAddr("10.10.10.10").AsSlice(),
+			},
+		},
+		HboneMtlsPort: 15008,
+	}
+	assert.NoError(t, p.handleWorkload(withWaypoint))
+	assert.Equal(t, 1, counter.Updates(bpfcache.BackendMap))
+	for _, m := range []bpfcache.BpfMapType{bpfcache.FrontendMap, bpfcache.ServiceMap, bpfcache.EndpointMap} {
+		assert.Zero(t, counter.Updates(m))
+		assert.Zero(t, counter.Deletes(m))
+	}
+	checkBackendMap(t, p, wlId, withWaypoint)
+	assert.True(t, proto.Equal(withWaypoint, p.WorkloadCache.GetWorkloadByUid(wl.Uid)))
+	checkFrontEndMap(t, wl.Addresses[0], p)
+	checkEndpointMap(t, p, svc, []uint32{wlId})
+
+	// 2. clearing the waypoint takes the fast path too
+	counter.Reset()
+	assert.NoError(t, p.handleWorkload(proto.Clone(wl).(*workloadapi.Workload)))
+	assert.Equal(t, 1, counter.Updates(bpfcache.BackendMap))
+	assert.Zero(t, counter.Updates(bpfcache.FrontendMap))
+	checkBackendMap(t, p, wlId, wl)
+
+	// 3. other changes along the waypoint take the full update
+	counter.Reset()
+	moved := proto.Clone(withWaypoint).(*workloadapi.Workload)
+	moved.Addresses = [][]byte{netip.MustParseAddr("10.244.0.2").AsSlice()}
+	assert.NoError(t, p.handleWorkload(moved))
+	assert.NotZero(t, counter.Updates(bpfcache.FrontendMap))
+	checkBackendMap(t, p, wlId, moved)
+	checkFrontEndMap(t, moved.Addresses[0], p)
+}
+
+func TestReplaceServiceEndpoints(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc))
+	var blue, green []uint32
+	for i := 0; i < 3; i++ {
+		wl := createWorkload(fmt.Sprintf("blue%d", i), fmt.Sprintf("10.244.0.%d", i+1), workloadapi.NetworkMode_STANDARD, "svc1")
+		assert.NoError(t, p.handleWorkload(wl))
+		blue = append(blue, p.hashName.Hash(wl.Uid))
+		wl = createWorkload(fmt.Sprintf("green%d", i), fmt.Sprintf("10.244.1.%d", i+1), workloadapi.NetworkMode_STANDARD)
+		assert.NoError(t, p.handleWorkload(wl))
+		green = append(green, p.hashName.Hash(wl.Uid))
+	}
+	checkEndpointMap(t, p, svc, blue)
+	svcId := p.hashName.Hash(svc.ResourceName())
+
+	// resolve the service as the datapath does while the endpoints are replaced
+	var (
+		stop    = make(chan struct{})
+		done    = make(chan struct{})
+		empty   = 0
+		missing = 0
+	)
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			var sv bpfcache.ServiceValue
+			if err := workloadMap.KmeshService.Lookup(&bpfcache.ServiceKey{ServiceId: svcId}, &sv); err != nil || sv.EndpointCount == 0 {
+				empty++
+				continue
+			}
+			for index := uint32(1); index <= sv.EndpointCount; index++ {
+				var ev bpfcache.EndpointValue
+				if err := workloadMap.KmeshEndpoint.Lookup(&bpfcache.EndpointKey{ServiceId: svcId, BackendIndex: index}, &ev); err != nil {
+					missing++
+				}
+			}
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		next := green
+		if i%2 == 1 {
+			next = blue
+		}
+		assert.NoError(t, p.ReplaceServiceEndpoints(svc.ResourceName(), next))
+	}
+	close(stop)
+	<-done
+	assert.Zero(t, empty)
+	assert.Zero(t, missing)
+
+	assert.NoError(t, p.ReplaceServiceEndpoints(svc.ResourceName(), green))
+	checkEndpointMap(t, p, svc, green)
+	for _, uid := range blue {
+		assert.Empty(t, p.bpf.GetEndpointKeys(uid))
+	}
+	for _, uid := range green {
+		assert.Equal(t, 1, p.bpf.GetEndpointKeys(uid).Len())
+	}
+
+	// shrink the set
+	assert.NoError(t, p.ReplaceServiceEndpoints(svc.ResourceName(), green[:1]))
+	checkEndpointMap(t, p, svc, green[:1])
+
+	assert.Error(t, p.ReplaceServiceEndpoints(svc.ResourceName(), nil))
+	assert.Error(t, p.ReplaceServiceEndpoints(svc.ResourceName(), []uint32{green[0], green[0]}))
+	assert.Error(t, p.ReplaceServiceEndpoints(svc.ResourceName(), []uint32{12345}))
+	assert.Error(t, p.ReplaceServiceEndpoints("default/unknown.default.svc.cluster.local", green))
+
+	hashNameClean(p)
+}
+
+func TestProcessorLifetimeCounters(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	checkStats := func(workloads, services int, totalWorkloads, totalServices uint64) {
+		stats, err := p.Stats()
+		assert.NoError(t, err)
+		assert.Equal(t, workloads, stats.Workloads)
+		assert.Equal(t, services, stats.Services)
+		assert.Equal(t, totalWorkloads, stats.TotalWorkloads)
+		assert.Equal(t, totalServices, stats.TotalServices)
+	}
+
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	wl1 := createWorkload("pod1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	wl2 := createWorkload("pod2", "10.244.0.2", workloadapi.NetworkMode_STANDARD, "svc1")
+
+	// 1. add resources
+	assert.NoError(t, p.handleService(svc))
+	assert.NoError(t, p.handleWorkload(wl1))
+	assert.NoError(t, p.handleWorkload(wl2))
+	checkStats(2, 1, 2, 1)
+
+	// 2. updates are not counted
+	wl1Updated := proto.Clone(wl1).(*workloadapi.Workload)
+	wl1Updated.Node = "node1"
+	assert.NoError(t, p.handleWorkload(wl1Updated))
+	assert.NoError(t, p.handleService(createFakeService("svc1", "10.240.10.1", "10.240.10.201")))
+	checkStats(2, 1, 2, 1)
+
+	// 3. remove resources, the current numbers drop while the lifetime ones are kept
+	p.handleRemovedAddresses([]string{wl1.Uid, svc.ResourceName()})
+	checkStats(1, 0, 2, 1)
+
+	// 4. add them again
+	assert.NoError(t, p.handleService(svc))
+	assert.NoError(t, p.handleWorkload(wl1))
+	checkStats(2, 1, 3, 2)
+
+	hashNameClean(p)
+}
+
+func TestShadowMaps(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+	shadowMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(shadowMap)
+
+	p := newProcessor(workloadMap)
+	p.bpf.SetShadowMaps(shadowMap)
+
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc))
+	wl1 := createWorkload("pod1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	wl2 := createWorkload("pod2", "10.244.0.2", workloadapi.NetworkMode_STANDARD, "svc1")
+	assert.NoError(t, p.handleWorkload(wl1))
+	assert.NoError(t, p.handleWorkload(wl2))
+	assert.NoError(t, p.bpf.VerifyShadow())
+
+	// removing the first endpoint swaps the last one in its place
+	p.handleRemovedAddresses([]string{wl1.Uid})
+	assert.NoError(t, p.bpf.VerifyShadow())
+	shadowDump, err := bpfcache.NewCache(shadowMap).Dump()
+	assert.NoError(t, err)
+	assert.Len(t, shadowDump.Endpoints, 1)
+	assert.Equal(t, p.hashName.Hash(wl2.Uid), shadowDump.Endpoints[0].Value.BackendUid)
+
+	// a write bypassing the cache is detected
+	bk := bpfcache.BackendKey{BackendUid: p.hashName.Hash(wl2.Uid)}
+	bv := bpfcache.BackendValue{ServiceCount: 5}
+	assert.NoError(t, workloadMap.KmeshBackend.Update(&bk, &bv, ebpf.UpdateAny))
+	assert.ErrorContains(t, p.bpf.VerifyShadow(), "backend map")
+
+	hashNameClean(p)
+}
+
+func TestGetAllFrontends(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	keys, values, err := p.bpf.GetAllFrontends()
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+	assert.Empty(t, values)
+
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc))
+	wl1 := createWorkload("pod1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	// host network workloads have no frontend
+	wl2 := createWorkload("pod2", "192.168.1.10", workloadapi.NetworkMode_HOST_NETWORK, "svc1")
+	assert.NoError(t, p.handleWorkload(wl1))
+	assert.NoError(t, p.handleWorkload(wl2))
+
+	keys, values, err = p.bpf.GetAllFrontends()
+	assert.NoError(t, err)
+	assert.Len(t, values, len(keys))
+	frontends := make(map[bpfcache.FrontendKey]uint32, len(keys))
+	for i := range keys {
+		frontends[keys[i]] = values[i].UpstreamId
+	}
+
+	svcKey := bpfcache.FrontendKey{}
+	nets.CopyIpByteFromSlice(&svcKey.Ip, svc.Addresses[0].Address)
+	wlKey := bpfcache.FrontendKey{}
+	nets.CopyIpByteFromSlice(&wlKey.Ip, wl1.Addresses[0])
+	assert.Equal(t, map[bpfcache.FrontendKey]uint32{
+		svcKey: p.hashName.Hash(svc.ResourceName()),
+		wlKey:  p.hashName.Hash(wl1.Uid),
+	}, frontends)
+}
+
+func TestRemoveByAddress(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc))
+	wl1 := createWorkload("pod1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	wl2 := createWorkload("pod2", "10.244.0.2", workloadapi.NetworkMode_STANDARD, "svc1")
+	assert.NoError(t, p.handleWorkload(wl1))
+	assert.NoError(t, p.handleWorkload(wl2))
+	svcId := p.hashName.Hash(svc.ResourceName())
+	wl1Id := p.hashName.Hash(wl1.Uid)
+	wl2Id := p.hashName.Hash(wl2.Uid)
+
+	// 1. unknown addresses and service vips are ignored
+	assert.NoError(t, p.RemoveByAddress(netip.MustParseAddr("10.244.0.100"), wl1.Network))
+	assert.NoError(t, p.RemoveByAddress(netip.MustParseAddr("10.240.10.1"), wl1.Network))
+	checkServiceMap(t, p, svcId, svc, 2)
+
+	// 2. remove a cached workload
+	assert.NoError(t, p.RemoveByAddress(netip.MustParseAddr("10.244.0.1"), wl1.Network))
+	assert.Nil(t, p.WorkloadCache.GetWorkloadByUid(wl1.Uid))
+	checkNotExistInFrontEndMap(t, wl1.Addresses[0], p)
+	var bv bpfcache.BackendValue
+	assert.Error(t, p.bpf.BackendLookup(&bpfcache.BackendKey{BackendUid: wl1Id}, &bv))
+	assert.Empty(t, p.bpf.GetEndpointKeys(wl1Id))
+	checkServiceMap(t, p, svcId, svc, 1)
+	checkEndpointMap(t, p, svc, []uint32{wl2Id})
+	assert.Empty(t, p.hashName.NumToStr(wl1Id))
+
+	// 3. remove a workload only known by the bpf maps, as on restart
+	p.WorkloadCache.DeleteWorkload(wl2.Uid)
+	assert.NoError(t, p.RemoveByAddress(netip.MustParseAddr("::ffff:10.244.0.2"), wl2.Network))
+	checkNotExistInFrontEndMap(t, wl2.Addresses[0], p)
+	assert.Error(t, p.bpf.BackendLookup(&bpfcache.BackendKey{BackendUid: wl2Id}, &bv))
+	checkServiceMap(t, p, svcId, svc, 0)
+	assert.Empty(t, p.hashName.NumToStr(wl2Id))
+
+	hashNameClean(p)
+}
+
+func TestDrainAndPause(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	p.nodeName = "node1"
+
+	svc1 := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	svc2 := createFakeService("svc2", "10.240.10.2", "10.240.10.200")
+	for _, svc := range []*workloadapi.Service{svc1, svc2} {
+		assert.NoError(t, p.handleService(svc))
+	}
+	local := createWorkload("local", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1", "svc2")
+	local.Node = "node1"
+	remote := createWorkload("remote", "10.244.1.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	remote.Node = "node2"
+	for _, wl := range []*workloadapi.Workload{local, remote} {
+		assert.NoError(t, p.handleWorkload(wl))
+	}
+	localId, remoteId := p.hashName.Hash(local.Uid), p.hashName.Hash(remote.Uid)
+
+	// 1. drain removes the local endpoints only
+	assert.NoError(t, p.DrainAndPause(context.Background()))
+	checkServiceMap(t, p, p.hashName.Hash(svc1.ResourceName()), svc1, 1)
+	checkEndpointMap(t, p, svc1, []uint32{remoteId})
+	checkServiceMap(t, p, p.hashName.Hash(svc2.ResourceName()), svc2, 0)
+	checkEndpointMap(t, p, svc2, []uint32{})
+	// the workload is still reachable by its own address
+	checkFrontEndMap(t, local.Addresses[0], p)
+
+	// 2. a local workload bound to a new service is not added while paused
+	svc3 := createFakeService("svc3", "10.240.10.3", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc3))
+	local = proto.Clone(local).(*workloadapi.Workload)
+	local.Services["default/svc3.default.svc.cluster.local"] = &workloadapi.PortList{}
+	assert.NoError(t, p.handleWorkload(local))
+	checkEndpointMap(t, p, svc3, []uint32{})
+
+	// 3. resume restores all the local endpoints
+	assert.NoError(t, p.Resume())
+	checkServiceMap(t, p, p.hashName.Hash(svc1.ResourceName()), svc1, 2)
+	checkEndpointMap(t, p, svc1, []uint32{localId, remoteId})
+	checkEndpointMap(t, p, svc2, []uint32{localId})
+	checkEndpointMap(t, p, svc3, []uint32{localId})
+
+	// 4. drain with a cancelled context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, p.DrainAndPause(ctx))
+
+	hashNameClean(p)
+}
+
+func Test_handleWorkloadIPv4MappedAddress(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+
+	mapped := netip.MustParseAddr("::ffff:10.244.0.1")
+	plain := netip.MustParseAddr("10.244.0.1")
+	wl := createFakeWorkload("10.244.0.1", workloadapi.NetworkMode_STANDARD)
+	wl.Addresses = [][]byte{mapped.AsSlice()}
+	assert.NoError(t, p.handleWorkload(wl))
+
+	// the frontend and backend map are keyed by the plain ipv4 form
+	upstreamId := checkFrontEndMap(t, plain.AsSlice(), p)
+	assert.Equal(t, p.hashName.Hash(wl.Uid), upstreamId)
+	var fv bpfcache.FrontendValue
+	assert.Error(t, p.bpf.FrontendLookup(&bpfcache.FrontendKey{Ip: mapped.As16()}, &fv))
+	var bv bpfcache.BackendValue
+	assert.NoError(t, p.bpf.BackendLookup(&bpfcache.BackendKey{BackendUid: upstreamId}, &bv))
+	assert.True(t, test.EqualIp(bv.Ip, plain.AsSlice()))
+
+	// both forms resolve to the workload in the cache
+	for _, addr := range []netip.Addr{plain, mapped} {
+		got := p.WorkloadCache.GetWorkloadByAddr(cache.NetworkAddress{Network: wl.Network, Address: addr})
+		assert.Equal(t, wl, got)
+	}
+
+	hashNameClean(p)
+}
+
+func TestForceResync(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+
+	svc1 := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	svc2 := createFakeService("svc2", "10.240.10.2", "10.240.10.200")
+	wl1 := createWorkload("wl1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1", "svc2")
+	wl2 := createWorkload("wl2", "10.244.0.2", workloadapi.NetworkMode_STANDARD, "svc2")
+	res := &service_discovery_v3.DeltaDiscoveryResponse{}
+	for _, addr := range []*workloadapi.Address{
+		serviceToAddress(svc1), serviceToAddress(svc2), workloadToAddress(wl1), workloadToAddress(wl2),
+	} {
+		res.Resources = append(res.Resources, &service_discovery_v3.Resource{
+			Resource: protoconv.MessageToAny(addr),
+		})
+	}
+	assert.NoError(t, p.handleAddressTypeResponse(res))
+	svc1Id, svc2Id := p.hashName.Hash(svc1.ResourceName()), p.hashName.Hash(svc2.ResourceName())
+	wl1Id, wl2Id := p.hashName.Hash(wl1.Uid), p.hashName.Hash(wl2.Uid)
+
+	// 1. scramble the bpf maps
+	ek := bpfcache.EndpointKey{ServiceId: svc2Id, BackendIndex: 2}
+	assert.NoError(t, p.bpf.EndpointDelete(&ek))
+	sk := bpfcache.ServiceKey{ServiceId: svc1Id}
+	sv := bpfcache.ServiceValue{}
+	assert.NoError(t, p.bpf.ServiceLookup(&sk, &sv))
+	sv.EndpointCount = 7
+	assert.NoError(t, p.bpf.ServiceUpdate(&sk, &sv))
+	bogus := netip.MustParseAddr("10.244.9.9").AsSlice()
+	fk := bpfcache.FrontendKey{}
+	nets.CopyIpByteFromSlice(&fk.Ip, bogus)
+	assert.NoError(t, p.bpf.FrontendUpdate(&fk, &bpfcache.FrontendValue{UpstreamId: 12345}))
+	assert.NoError(t, p.bpf.BackendDelete(&bpfcache.BackendKey{BackendUid: wl2Id}))
+
+	// 2. resync while a new workload is being processed
+	wl3 := createWorkload("wl3", "10.244.0.3", workloadapi.NetworkMode_STANDARD, "svc1")
+	res = &service_discovery_v3.DeltaDiscoveryResponse{
+		TypeUrl: AddressType,
+		Resources: []*service_discovery_v3.Resource{
+			{Resource: protoconv.MessageToAny(workloadToAddress(wl3))},
+		},
+	}
+	done := make(chan error)
+	go func() {
+		done <- p.ForceResync()
+	}()
+	p.processWorkloadResponse(res, nil)
+	assert.NoError(t, <-done)
+	wl3Id := p.hashName.Hash(wl3.Uid)
+
+	// 3. the bpf maps are consistent with the caches
+	checkServiceMap(t, p, svc1Id, svc1, 2)
+	checkServiceMap(t, p, svc2Id, svc2, 2)
+	checkEndpointMap(t, p, svc1, []uint32{wl1Id, wl3Id})
+	checkEndpointMap(t, p, svc2, []uint32{wl1Id, wl2Id})
+	for _, wl := range []*workloadapi.Workload{wl1, wl2, wl3} {
+		checkFrontEndMap(t, wl.Addresses[0], p)
+		checkBackendMap(t, p, p.hashName.Hash(wl.Uid), wl)
+	}
+	for _, svc := range []*workloadapi.Service{svc1, svc2} {
+		checkFrontEndMap(t, svc.Addresses[0].Address, p)
+	}
+	checkNotExistInFrontEndMap(t, bogus, p)
+	assert.Len(t, p.bpf.GetEndpointKeys(wl1Id), 2)
+
+	hashNameClean(p)
+}
+
+func Test_handleWorkloadMissingClusterId(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc))
+
+	// 1. no local cluster id, the workload is still written
+	wl1 := createWorkload("wl1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	wl1.ClusterId = ""
+	assert.NoError(t, p.handleWorkload(wl1))
+	checkBackendMap(t, p, p.hashName.Hash(wl1.Uid), wl1)
+
+	// 2. with a local cluster id, the workload is cached in the local cluster
+	p.SetLocalClusterId("cluster0")
+	wl2 := createWorkload("wl2", "10.244.0.2", workloadapi.NetworkMode_STANDARD, "svc1")
+	wl2.ClusterId = ""
+	assert.NoError(t, p.handleWorkload(wl2))
+	checkBackendMap(t, p, p.hashName.Hash(wl2.Uid), wl2)
+	assert.Equal(t, "cluster0", p.WorkloadCache.GetWorkloadByUid(wl2.Uid).GetClusterId())
+
+	// 3. a workload with a cluster id keeps it
+	wl3 := createWorkload("wl3", "10.244.0.3", workloadapi.NetworkMode_STANDARD, "svc1")
+	wl3.ClusterId = "cluster1"
+	assert.NoError(t, p.handleWorkload(wl3))
+	assert.Equal(t, "cluster1", p.WorkloadCache.GetWorkloadByUid(wl3.Uid).GetClusterId())
+}
+
+func Test_handleServiceDualStack(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+
+	// the ipv6 vip comes first, the ipv4 key must not inherit its bytes
+	v6 := netip.MustParseAddr("fd00:10:96::1").AsSlice()
+	v4 := netip.MustParseAddr("10.240.10.1").AsSlice()
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	svc.Addresses = []*workloadapi.NetworkAddress{{Address: v6}, {Address: v4}}
+	assert.NoError(t, p.handleService(svc))
+
+	svcId := p.hashName.Hash(svc.ResourceName())
+	assert.Equal(t, svcId, checkFrontEndMap(t, v6, p))
+	assert.Equal(t, svcId, checkFrontEndMap(t, v4, p))
+	assert.ElementsMatch(t, []bpfcache.FrontendKey{{Ip: [16]byte(v6)}, {Ip: [16]byte{10, 240, 10, 1}}},
+		p.bpf.FrontendIterFindKey(svcId))
+
+	// dropping a vip removes its frontend entry
+	svc = proto.Clone(svc).(*workloadapi.Service)
+	svc.Addresses = svc.Addresses[1:]
+	assert.NoError(t, p.handleService(svc))
+	checkNotExistInFrontEndMap(t, v6, p)
+	assert.Equal(t, svcId, checkFrontEndMap(t, v4, p))
+
+	// removing the service removes all the vips
+	svc = proto.Clone(svc).(*workloadapi.Service)
+	svc.Addresses = []*workloadapi.NetworkAddress{{Address: v4}, {Address: v6}}
+	assert.NoError(t, p.handleService(svc))
+	assert.Equal(t, svcId, checkFrontEndMap(t, v6, p))
+	p.handleRemovedAddresses([]string{svc.ResourceName()})
+	checkNotExistInFrontEndMap(t, v4, p)
+	checkNotExistInFrontEndMap(t, v6, p)
+
+	hashNameClean(p)
+}
+
+func Test_handleServiceSelfWaypoint(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	refused := testutil.ToFloat64(telemetry.ServiceSelfWaypoints)
+
+	// 1. the waypoint is the second vip of the service itself
+	svc := createFakeService("svc1", "10.240.10.1", "fd00::10")
+	svc.Addresses = append(svc.Addresses, &workloadapi.NetworkAddress{
+		Address: netip.MustParseAddr("fd00::10").AsSlice(),
+	})
+	assert.NoError(t, p.handleService(svc))
+	assert.Equal(t, refused+1, testutil.ToFloat64(telemetry.ServiceSelfWaypoints))
+	assert.Nil(t, p.ServiceCache.GetService(svc.ResourceName()).GetWaypoint())
+
+	var sv bpfcache.ServiceValue
+	svcId := p.hashName.Hash(svc.ResourceName())
+	assert.NoError(t, p.bpf.ServiceLookup(&bpfcache.ServiceKey{ServiceId: svcId}, &sv))
+	assert.Equal(t, [16]byte{}, sv.WaypointAddr)
+	assert.Equal(t, uint32(0), sv.WaypointPort)
+	// the vips are still served
+	assert.Equal(t, svcId, checkFrontEndMap(t, svc.Addresses[0].Address, p))
+	assert.Equal(t, svcId, checkFrontEndMap(t, svc.Addresses[1].Address, p))
+
+	// 2. a waypoint outside of the service is programmed
+	svc2 := createFakeService("svc2", "10.240.10.2", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc2))
+	assert.Equal(t, refused+1, testutil.ToFloat64(telemetry.ServiceSelfWaypoints))
+	checkServiceMap(t, p, p.hashName.Hash(svc2.ResourceName()), svc2, 0)
+
+	hashNameClean(p)
+}
+
+func Test_handleServiceWaypointTransition(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	// 1. the service starts without waypoint
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	svc.Waypoint = nil
+	assert.NoError(t, p.handleService(svc))
+	wl := createWorkload("wl1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	assert.NoError(t, p.handleWorkload(wl))
+	svcId := p.hashName.Hash(svc.ResourceName())
+	checkServiceMap(t, p, svcId, svc, 1)
+
+	waypoint := netip.MustParseAddr("10.240.10.200")
+	newWaypoint := netip.MustParseAddr("10.240.10.201")
+	// xDS always delivers a new object, do not mutate the cached one
+	for i, addr := range []netip.Addr{waypoint, {}, newWaypoint, waypoint, {}} {
+		svc = proto.Clone(svc).(*workloadapi.Service)
+		if addr.IsValid() {
+			// 2. the waypoint is added by a later update, or changed
+			svc.Waypoint = createFakeService("svc1", "10.240.10.1", addr.String()).GetWaypoint()
+		} else {
+			// 3. and removed, the waypoint fields are cleared
+			svc.Waypoint = nil
+		}
+		assert.NoError(t, p.handleService(svc), "update %d", i)
+		checkServiceMap(t, p, svcId, svc, 1)
+		checkEndpointMap(t, p, svc, []uint32{p.hashName.Hash(wl.Uid)})
+		assert.Equal(t, svcId, checkFrontEndMap(t, svc.Addresses[0].Address, p))
+
+		// the service is indexed under its current waypoint only
+		for _, indexed := range []netip.Addr{waypoint, newWaypoint} {
+			if indexed == addr {
+				assert.Equal(t, []string{svc.ResourceName()}, p.serviceWaypointIndex.get(indexed), "update %d", i)
+			} else {
+				assert.Empty(t, p.serviceWaypointIndex.get(indexed), "update %d", i)
+			}
+		}
+	}
+}
+
+func Test_handleServiceZeroPorts(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	skipped := testutil.ToFloat64(telemetry.ServiceZeroPortsSkipped)
+
+	// 1. by default the vips of a service without ports are skipped
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	svc.Ports = nil
+	wl := createWorkload("pod1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	assert.NoError(t, p.handleService(svc))
+	assert.NoError(t, p.handleWorkload(wl))
+	assert.Equal(t, skipped+1, testutil.ToFloat64(telemetry.ServiceZeroPortsSkipped))
+	checkNotExistInFrontEndMap(t, svc.Addresses[0].Address, p)
+	assert.NotNil(t, p.ServiceCache.GetService(svc.ResourceName()))
+	// the endpoints are still tracked
+	svcId := p.hashName.Hash(svc.ResourceName())
+	checkServiceMap(t, p, svcId, svc, 1)
+	checkEndpointMap(t, p, svc, []uint32{p.hashName.Hash(wl.ResourceName())})
+
+	// 2. the vips are programmed once the service has ports
+	withPorts := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	assert.NoError(t, p.handleService(withPorts))
+	assert.Equal(t, svcId, checkFrontEndMap(t, svc.Addresses[0].Address, p))
+	checkServiceMap(t, p, svcId, withPorts, 1)
+
+	// and removed when it loses them again
+	assert.NoError(t, p.handleService(svc))
+	assert.Equal(t, skipped+2, testutil.ToFloat64(telemetry.ServiceZeroPortsSkipped))
+	checkNotExistInFrontEndMap(t, svc.Addresses[0].Address, p)
+
+	// 3. with passthrough they are programmed as is
+	p.SetZeroPortPassthrough(true)
+	assert.NoError(t, p.handleService(svc))
+	assert.Equal(t, skipped+2, testutil.ToFloat64(telemetry.ServiceZeroPortsSkipped))
+	assert.Equal(t, svcId, checkFrontEndMap(t, svc.Addresses[0].Address, p))
+
+	var sv bpfcache.ServiceValue
+	assert.NoError(t, p.bpf.ServiceLookup(&bpfcache.ServiceKey{ServiceId: svcId}, &sv))
+	assert.Equal(t, bpfcache.ServicePorts{}, sv.ServicePort)
+
+	hashNameClean(p)
+}
+
+func Test_handleServicePendingWaypoint(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	p.SetDeferUnknownWaypoints(true)
+
+	noWaypoint := func(svc *workloadapi.Service) {
+		var sv bpfcache.ServiceValue
+		svcId := p.hashName.Hash(svc.ResourceName())
+		assert.NoError(t, p.bpf.ServiceLookup(&bpfcache.ServiceKey{ServiceId: svcId}, &sv))
+		assert.Equal(t, [16]byte{}, sv.WaypointAddr)
+		assert.Equal(t, uint32(0), sv.WaypointPort)
+	}
+
+	// 1. the waypoint is a service learned later
+	svc1 := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc1))
+	noWaypoint(svc1)
+	assert.True(t, p.pendingWaypoints.Contains(svc1.ResourceName()))
+
+	waypoint := createFakeService("waypoint", "10.240.10.200", "10.240.10.200")
+	assert.NoError(t, p.handleService(waypoint))
+	checkServiceMap(t, p, p.hashName.Hash(svc1.ResourceName()), svc1, 0)
+	assert.False(t, p.pendingWaypoints.Contains(svc1.ResourceName()))
+
+	// 2. the waypoint is a workload learned later
+	svc2 := createFakeService("svc2", "10.240.10.2", "10.240.10.201")
+	assert.NoError(t, p.handleService(svc2))
+	noWaypoint(svc2)
+
+	wl := createWorkload("waypoint-pod", "10.240.10.201", workloadapi.NetworkMode_STANDARD)
+	assert.NoError(t, p.handleWorkload(wl))
+	checkServiceMap(t, p, p.hashName.Hash(svc2.ResourceName()), svc2, 0)
+	assert.Empty(t, p.pendingWaypoints)
+
+	// 3. a removed service is no longer pending
+	svc3 := createFakeService("svc3", "10.240.10.3", "10.240.10.202")
+	assert.NoError(t, p.handleService(svc3))
+	assert.True(t, p.pendingWaypoints.Contains(svc3.ResourceName()))
+	assert.NoError(t, p.removeServiceResource([]string{svc3.ResourceName()}))
+	assert.Empty(t, p.pendingWaypoints)
+
+	hashNameClean(p)
+}
+
+func Test_handleWorkloadNetworkGateway(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	p.network = "network1"
+
+	backendOf := func(wl *workloadapi.Workload) bpfcache.BackendValue {
+		var bv bpfcache.BackendValue
+		err := p.bpf.BackendLookup(&bpfcache.BackendKey{BackendUid: p.hashName.Hash(wl.Uid)}, &bv)
+		assert.NoError(t, err)
+		return bv
+	}
+	gateway := &workloadapi.GatewayAddress{
+		Destination: &workloadapi.GatewayAddress_Address{
+			Address: &workloadapi.NetworkAddress{
+				Network: "network2",
+				Address: netip.MustParseAddr("172.16.0.1").AsSlice(),
+			},
+		},
+		HboneMtlsPort: 15008,
+	}
+
+	// 1. workloads on the local network are not tunneled
+	wl1 := createWorkload("wl1", "10.244.0.1", workloadapi.NetworkMode_STANDARD)
+	wl1.Network = "network1"
+	wl2 := createWorkload("wl2", "10.244.0.2", workloadapi.NetworkMode_STANDARD)
+	for _, wl := range []*workloadapi.Workload{wl1, wl2} {
+		assert.NoError(t, p.handleWorkload(wl))
+		bv := backendOf(wl)
+		assert.Equal(t, uint32(bpfcache.TunnelTypeNone), bv.TunnelType)
+		assert.Equal(t, [16]byte{}, bv.TunnelEndpoint)
+		assert.Zero(t, bv.TunnelPort)
+	}
+
+	// 2. a workload on a remote network is tunneled through its gateway
+	wl3 := createWorkload("wl3", "10.245.0.1", workloadapi.NetworkMode_STANDARD)
+	wl3.Network = "network2"
+	wl3.NetworkGateway = gateway
+	assert.NoError(t, p.handleWorkload(wl3))
+	var endpoint [16]byte
+	nets.CopyIpByteFromSlice(&endpoint, netip.MustParseAddr("172.16.0.1").AsSlice())
+	bv := backendOf(wl3)
+	assert.Equal(t, uint32(bpfcache.TunnelTypeHbone), bv.TunnelType)
+	assert.Equal(t, endpoint, bv.TunnelEndpoint)
+	assert.Equal(t, nets.ConvertPortToBigEndian(15008), bv.TunnelPort)
+
+	// 3. the gateway is looked up from the cache when the workload doesn't carry it
+	wl4 := createWorkload("wl4", "10.245.0.2", workloadapi.NetworkMode_STANDARD)
+	wl4.Network = "network2"
+	assert.NoError(t, p.handleWorkload(wl4))
+	bv = backendOf(wl4)
+	assert.Equal(t, uint32(bpfcache.TunnelTypeHbone), bv.TunnelType)
+	assert.Equal(t, endpoint, bv.TunnelEndpoint)
+	assert.Equal(t, nets.ConvertPortToBigEndian(15008), bv.TunnelPort)
+
+	// 4. no tunnel without a known gateway
+	wl5 := createWorkload("wl5", "10.246.0.1", workloadapi.NetworkMode_STANDARD)
+	wl5.Network = "network3"
+	assert.NoError(t, p.handleWorkload(wl5))
+	bv = backendOf(wl5)
+	assert.Equal(t, uint32(bpfcache.TunnelTypeNone), bv.TunnelType)
+	assert.Equal(t, [16]byte{}, bv.TunnelEndpoint)
+
+	hashNameClean(p)
+}
+
+func Test_handleWorkloadPolicies(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	rbac := auth.NewRbac(p.WorkloadCache)
+
+	allow := &security.Authorization{Name: "allow", Namespace: "default", Scope: security.Scope_WORKLOAD_SELECTOR, Action: security.Action_ALLOW}
+	deny := &security.Authorization{Name: "deny", Namespace: "default", Scope: security.Scope_WORKLOAD_SELECTOR, Action: security.Action_DENY,
+		Rules: []*security.Rule{{Clauses: []*security.Clause{{Matches: []*security.Match{{DestinationPorts: []uint32{8080}}}}}}}}
+	updatePolicies := func(policies []*security.Authorization, removed []string) {
+		rsp := &service_discovery_v3.DeltaDiscoveryResponse{RemovedResources: removed}
+		for _, policy := range policies {
+			rsp.Resources = append(rsp.Resources, &service_discovery_v3.Resource{Resource: protoconv.MessageToAny(policy)})
+		}
+		assert.NoError(t, p.handleAuthorizationTypeResponse(rsp, rbac))
+	}
+	policiesOf := func(wl *workloadapi.Workload) []uint32 {
+		var bv bpfcache.BackendValue
+		assert.NoError(t, p.bpf.BackendLookup(&bpfcache.BackendKey{BackendUid: p.hashName.Hash(wl.Uid)}, &bv))
+		return bv.Policies[:bv.PolicyCount]
+	}
+	policyOf := func(policy *security.Authorization) *bpfcache.AuthzPolicyValue {
+		var value bpfcache.AuthzPolicyValue
+		if err := p.bpf.AuthzPolicyLookup(p.policyId(policy.ResourceName()), &value); err != nil {
+			return nil
+		}
+		return &value
+	}
+
+	// 1. the policies are encoded once they arrive
+	wl := createWorkload("pod1", "10.244.0.1", workloadapi.NetworkMode_STANDARD)
+	wl.AuthorizationPolicies = []string{allow.ResourceName(), deny.ResourceName()}
+	other := createWorkload("pod2", "10.244.0.2", workloadapi.NetworkMode_STANDARD)
+	assert.NoError(t, p.handleWorkload(wl))
+	assert.NoError(t, p.handleWorkload(other))
+	assert.Empty(t, policiesOf(wl))
+
+	updatePolicies([]*security.Authorization{allow}, nil)
+	allowId := p.policyId(allow.ResourceName())
+	assert.Equal(t, []uint32{allowId}, policiesOf(wl))
+	assert.Equal(t, &bpfcache.AuthzPolicyValue{Action: bpfcache.AuthzActionAllow}, policyOf(allow))
+	updatePolicies([]*security.Authorization{deny}, nil)
+	denyId := p.policyId(deny.ResourceName())
+	assert.NotEqual(t, allowId, denyId)
+	assert.Equal(t, []uint32{allowId, denyId}, policiesOf(wl))
+	assert.Equal(t, &bpfcache.AuthzPolicyValue{Action: bpfcache.AuthzActionDeny}, policyOf(deny))
+	assert.Empty(t, policiesOf(other))
+
+	// 2. a DENY policy with a rule without any match refuses every connection in the datapath
+	denyAll := proto.Clone(deny).(*security.Authorization)
+	denyAll.Rules = append(denyAll.Rules, &security.Rule{})
+	updatePolicies([]*security.Authorization{denyAll}, nil)
+	assert.Equal(t, &bpfcache.AuthzPolicyValue{Action: bpfcache.AuthzActionDeny, MatchAll: 1}, policyOf(deny))
+	assert.Equal(t, []uint32{allowId, denyId}, policiesOf(wl))
+
+	// 3. a deleted policy is cleared from the workloads and the policy map
+	updatePolicies(nil, []string{deny.ResourceName()})
+	assert.Equal(t, []uint32{allowId}, policiesOf(wl))
+	assert.Nil(t, policyOf(deny))
+
+	// 4. rebinding the workloads to other policies
+	updatePolicies([]*security.Authorization{deny}, nil)
+	denyId = p.policyId(deny.ResourceName())
+	wl = proto.Clone(wl).(*workloadapi.Workload)
+	wl.AuthorizationPolicies = []string{deny.ResourceName()}
+	other = proto.Clone(other).(*workloadapi.Workload)
+	other.AuthorizationPolicies = []string{allow.ResourceName()}
+	assert.NoError(t, p.handleWorkload(wl))
+	assert.NoError(t, p.handleWorkload(other))
+	assert.Equal(t, []uint32{denyId}, policiesOf(wl))
+	assert.Equal(t, []uint32{allowId}, policiesOf(other))
+
+	hashNameClean(p)
+}
+
+func Test_handleConcurrently(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	// every workload also joins the shared service, so that they all append endpoints to it
+	assert.NoError(t, p.handleService(createFakeService("shared", "10.240.0.1", "10.240.10.200")))
+
+	const routines = 20
+	var wg sync.WaitGroup
+	for i := 0; i < routines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			svcName := fmt.Sprintf("svc%d", i)
+			assert.NoError(t, p.handleService(createFakeService(svcName, fmt.Sprintf("10.240.1.%d", i), "10.240.10.200")))
+			wl := createWorkload(fmt.Sprintf("pod%d", i), fmt.Sprintf("10.244.1.%d", i), workloadapi.NetworkMode_STANDARD,
+				svcName, "shared")
+			assert.NoError(t, p.handleWorkload(wl))
+		}(i)
+	}
+	wg.Wait()
 
-	p.handleWorkload(workload)
-	p.handleWorkload(workloadWithoutService)
-	p.handleWorkload(workloadHostname)
+	dump, err := p.bpf.Dump()
+	assert.NoError(t, err)
+	// a frontend for each vip and each workload, none of them duplicated
+	upstreams := sets.New[uint32]()
+	for _, entry := range dump.Frontends {
+		upstreams.Insert(entry.Value.UpstreamId)
+	}
+	assert.Len(t, dump.Frontends, 2*routines+1)
+	assert.Len(t, upstreams, 2*routines+1)
+	assert.Len(t, dump.Backends, routines)
+
+	checkEndpointCount := func(svcName string, expected uint32) {
+		sk := bpfcache.ServiceKey{ServiceId: p.hashName.Hash("default/" + svcName + ".default.svc.cluster.local")}
+		sv := bpfcache.ServiceValue{}
+		assert.NoError(t, p.bpf.ServiceLookup(&sk, &sv))
+		assert.Equal(t, expected, sv.EndpointCount, svcName)
+		for index := uint32(1); index <= expected; index++ {
+			ev := bpfcache.EndpointValue{}
+			assert.NoError(t, p.bpf.EndpointLookup(&bpfcache.EndpointKey{ServiceId: sk.ServiceId, BackendIndex: index}, &ev))
+		}
+	}
+	checkEndpointCount("shared", routines)
+	for i := 0; i < routines; i++ {
+		checkEndpointCount(fmt.Sprintf("svc%d", i), 1)
+	}
+	assert.Len(t, dump.Endpoints, 2*routines)
+}
 
-	// Check Workload Cache
-	checkWorkloadCache(t, p, workload)
-	checkWorkloadCache(t, p, workloadWithoutService)
-	checkWorkloadCache(t, p, workloadHostname)
+func Test_namespaceDefaultWaypoint(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
 
-	// Check Frontend Map
-	checkFrontEndMapWithNetworkMode(t, workload.Addresses[0], p, workload.NetworkMode)
-	checkFrontEndMapWithNetworkMode(t, workloadWithoutService.Addresses[0], p, workloadWithoutService.NetworkMode)
-	checkFrontEndMapWithNetworkMode(t, workloadHostname.Addresses[0], p, workloadHostname.NetworkMode)
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	gatewayAddress := func(ip string) *workloadapi.GatewayAddress {
+		return &workloadapi.GatewayAddress{
+			Destination: &workloadapi.GatewayAddress_Address{
+				Address: &workloadapi.NetworkAddress{
+					Address: netip.MustParseAddr(ip).AsSlice(),
+				},
+			},
+			HboneMtlsPort: 15008,
+		}
+	}
+	waypointOf := func(key any) [16]byte {
+		switch key := key.(type) {
+		case *bpfcache.BackendKey:
+			bv := bpfcache.BackendValue{}
+			assert.NoError(t, p.bpf.BackendLookup(key, &bv))
+			return bv.WaypointAddr
+		case *bpfcache.ServiceKey:
+			sv := bpfcache.ServiceValue{}
+			assert.NoError(t, p.bpf.ServiceLookup(key, &sv))
+			return sv.WaypointAddr
+		}
+		return [16]byte{}
+	}
+	addr := func(ip string) [16]byte {
+		var res [16]byte
+		nets.CopyIpByteFromSlice(&res, netip.MustParseAddr(ip).AsSlice())
+		return res
+	}
+
+	assert.Error(t, p.SetNamespaceWaypoint("default", &workloadapi.GatewayAddress{}))
+	assert.NoError(t, p.SetNamespaceWaypoint("default", gatewayAddress("10.240.10.100")))
+
+	// the waypoint and its instance are not redirected to themselves
+	waypoint := createFakeService("waypoint", "10.240.10.100", "10.240.10.100")
+	waypoint.Waypoint = nil
+	svc1 := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	svc1.Waypoint = nil
+	svc2 := createFakeService("svc2", "10.240.10.2", "10.240.10.200")
+	for _, svc := range []*workloadapi.Service{waypoint, svc1, svc2} {
+		assert.NoError(t, p.handleService(svc))
+	}
+	waypointPod := createWorkload("waypoint-pod", "10.244.0.100", workloadapi.NetworkMode_STANDARD, "waypoint")
+	wl1 := createWorkload("pod1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	wl2 := createWorkload("pod2", "10.244.0.2", workloadapi.NetworkMode_STANDARD, "svc1")
+	wl2.Waypoint = gatewayAddress("10.240.10.200")
+	wl3 := createWorkload("pod3", "10.244.0.3", workloadapi.NetworkMode_STANDARD)
+	wl3.Namespace = "other"
+	for _, wl := range []*workloadapi.Workload{waypointPod, wl1, wl2, wl3} {
+		assert.NoError(t, p.handleWorkload(wl))
+	}
+
+	backendKey := func(wl *workloadapi.Workload) *bpfcache.BackendKey {
+		return &bpfcache.BackendKey{BackendUid: p.hashName.Hash(wl.GetUid())}
+	}
+	serviceKey := func(svc *workloadapi.Service) *bpfcache.ServiceKey {
+		return &bpfcache.ServiceKey{ServiceId: p.hashName.Hash(svc.ResourceName())}
+	}
+	assert.Equal(t, addr("10.240.10.100"), waypointOf(backendKey(wl1)))
+	assert.Equal(t, addr("10.240.10.200"), waypointOf(backendKey(wl2)))
+	assert.Equal(t, [16]byte{}, waypointOf(backendKey(wl3)))
+	assert.Equal(t, [16]byte{}, waypointOf(backendKey(waypointPod)))
+	assert.Equal(t, addr("10.240.10.100"), waypointOf(serviceKey(svc1)))
+	assert.Equal(t, addr("10.240.10.200"), waypointOf(serviceKey(svc2)))
+	assert.Equal(t, [16]byte{}, waypointOf(serviceKey(waypoint)))
+
+	// removing the default reprograms the resources inheriting it
+	assert.NoError(t, p.SetNamespaceWaypoint("default", nil))
+	assert.Equal(t, [16]byte{}, waypointOf(backendKey(wl1)))
+	assert.Equal(t, addr("10.240.10.200"), waypointOf(backendKey(wl2)))
+	assert.Equal(t, [16]byte{}, waypointOf(serviceKey(svc1)))
+	assert.Equal(t, addr("10.240.10.200"), waypointOf(serviceKey(svc2)))
 }
 
 func checkWorkloadCache(t *testing.T, p *Processor, workload *workloadapi.Workload) {
@@ -196,9 +1642,11 @@ func checkServiceMap(t *testing.T, p *Processor, svcId uint32, fakeSvc *workload
 	waypointAddr := fakeSvc.GetWaypoint().GetAddress().GetAddress()
 	if waypointAddr != nil {
 		assert.Equal(t, test.EqualIp(sv.WaypointAddr, waypointAddr), true)
+	} else {
+		assert.Equal(t, [16]byte{}, sv.WaypointAddr)
 	}
 
-	assert.Equal(t, sv.WaypointPort, nets.ConvertPortToBigEndian(fakeSvc.Waypoint.GetHboneMtlsPort()))
+	assert.Equal(t, fakeSvc.GetWaypoint().GetHboneMtlsPort(), nets.ConvertPortFromBigEndian(sv.WaypointPort))
 }
 
 func checkEndpointMap(t *testing.T, p *Processor, fakeSvc *workloadapi.Service, backendUid []uint32) {
@@ -222,7 +1670,7 @@ func checkBackendMap(t *testing.T, p *Processor, workloadID uint32, wl *workload
 	if waypointAddr != nil {
 		assert.Equal(t, test.EqualIp(bv.WaypointAddr, waypointAddr), true)
 	}
-	assert.Equal(t, bv.WaypointPort, nets.ConvertPortToBigEndian(wl.GetWaypoint().GetHboneMtlsPort()))
+	assert.Equal(t, wl.GetWaypoint().GetHboneMtlsPort(), nets.ConvertPortFromBigEndian(bv.WaypointPort))
 }
 
 func checkFrontEndMapWithNetworkMode(t *testing.T, ip []byte, p *Processor, networkMode workloadapi.NetworkMode) (upstreamId uint32) {
@@ -270,7 +1718,8 @@ func BenchmarkAddNewServicesWithWorkload(b *testing.B) {
 	cleanup, bpfLoader := test.InitBpfMap(t, config)
 	b.Cleanup(cleanup)
 
-	workloadController := NewController(bpfLoader.GetBpfKmeshWorkload())
+	workloadController, err := NewController(bpfLoader.GetBpfKmeshWorkload(), &options.WorkloadConfig{})
+	assert.NoError(t, err)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -281,6 +1730,189 @@ func BenchmarkAddNewServicesWithWorkload(b *testing.B) {
 	workloadController.Processor.hashName.Reset()
 }
 
+func BenchmarkHandleUnchangedWorkload(b *testing.B) {
+	t := &testing.T{}
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	b.Cleanup(func() { bpfcache.CleanupFakeWorkloadMap(workloadMap) })
+
+	p := newProcessor(workloadMap)
+	_ = p.handleService(createFakeService("testsvc", "10.240.10.1", "10.240.10.2"))
+	workload := createFakeWorkload("1.2.3.4", workloadapi.NetworkMode_STANDARD)
+	err := p.handleWorkload(workload)
+	assert.NoError(t, err)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// simulate a steady-state xDS push, which carries a new but identical workload
+		err := p.handleWorkload(proto.Clone(workload).(*workloadapi.Workload))
+		assert.NoError(t, err)
+	}
+	b.StopTimer()
+	hashNameClean(p)
+}
+
+func BenchmarkHandleWorkloadWaypointChange(b *testing.B) {
+	waypoint := func(ip string) *workloadapi.GatewayAddress {
+		return &workloadapi.GatewayAddress{
+			Destination: &workloadapi.GatewayAddress_Address{
+				Address: &workloadapi.NetworkAddress{Address: netip.MustParseAddr(ip).AsSlice()},
+			},
+			HboneMtlsPort: 15008,
+		}
+	}
+
+	// each iteration is 10000 waypoint reassignments, alternating between two versions of the workload
+	run := func(b *testing.B, fastPath bool) {
+		t := &testing.T{}
+		workloadMap := bpfcache.NewFakeWorkloadMap(t)
+		b.Cleanup(func() { bpfcache.CleanupFakeWorkloadMap(workloadMap) })
+
+		p := newProcessor(workloadMap)
+		counter := bpfcache.NewOpCounter()
+		p.bpf.SetOpCounter(counter)
+		_ = p.handleService(createFakeService("testsvc", "10.240.10.1", "10.240.10.2"))
+		workload := createFakeWorkload("1.2.3.4", workloadapi.NetworkMode_STANDARD)
+		assert.NoError(t, p.handleWorkload(workload))
+
+		versions := make([]*workloadapi.Workload, 2)
+		for i := range versions {
+			versions[i] = proto.Clone(workload).(*workloadapi.Workload)
+			versions[i].Waypoint = waypoint(fmt.Sprintf("10.10.10.%d", i+10))
+			if !fastPath {
+				// a label change along the waypoint takes the full update
+				versions[i].CanonicalRevision = fmt.Sprintf("v%d", i)
+			}
+		}
+
+		counter.Reset()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < 10000; j++ {
+				assert.NoError(t, p.handleWorkload(versions[j%2]))
+			}
+		}
+		b.StopTimer()
+
+		writes := 0
+		for _, m := range []bpfcache.BpfMapType{bpfcache.FrontendMap, bpfcache.ServiceMap, bpfcache.EndpointMap, bpfcache.BackendMap} {
+			writes += counter.Updates(m) + counter.Deletes(m)
+		}
+		b.ReportMetric(float64(writes)/float64(b.N*10000), "writes/update")
+		hashNameClean(p)
+	}
+
+	b.Run("fast path", func(b *testing.B) { run(b, true) })
+	b.Run("full update", func(b *testing.B) { run(b, false) })
+}
+
+func Test_removeWorkloadsFromBpfMap(t *testing.T) {
+	// program the same resources twice, and remove the workloads one by one then in batch,
+	// the maps must end up identical
+	removed := []string{
+		"cluster0//Pod/default/wl0",
+		"cluster0//Pod/default/wl3",
+		"cluster0//Pod/default/wl4",
+		"cluster0//Pod/default/wl9",
+	}
+	run := func(remove func(p *Processor)) *bpfcache.MapDump {
+		workloadMap := bpfcache.NewFakeWorkloadMap(t)
+		defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+		p := newProcessor(workloadMap)
+		// start from the same hash ids
+		p.hashName.Reset()
+		assert.NoError(t, p.handleService(createFakeService("svc1", "10.240.10.1", "10.240.10.200")))
+		assert.NoError(t, p.handleService(createFakeService("svc2", "10.240.10.2", "10.240.10.200")))
+		for i := 0; i < 10; i++ {
+			wl := createWorkload(fmt.Sprintf("wl%d", i), fmt.Sprintf("10.244.0.%d", i+1), workloadapi.NetworkMode_STANDARD,
+				"svc1", "svc2")
+			assert.NoError(t, p.handleWorkload(wl))
+		}
+
+		remove(p)
+		for _, uid := range removed {
+			assert.NotContains(t, p.hashName.strToNum, uid)
+		}
+		dump, err := p.bpf.Dump()
+		assert.NoError(t, err)
+		hashNameClean(p)
+		return dump
+	}
+
+	dump1 := run(func(p *Processor) {
+		for _, uid := range removed {
+			assert.NoError(t, p.removeWorkloadFromBpfMap(uid))
+		}
+	})
+	dump2 := run(func(p *Processor) {
+		assert.NoError(t, p.removeWorkloadsFromBpfMap(removed))
+		// removing the same workloads again reports the missing backends, but doesn't stop
+		assert.Error(t, p.removeWorkloadsFromBpfMap(removed[:2]))
+	})
+
+	assert.ElementsMatch(t, dump1.Frontends, dump2.Frontends)
+	assert.ElementsMatch(t, dump1.Services, dump2.Services)
+	// the order of the services of a backend is random
+	backendsOf := func(dump *bpfcache.MapDump) map[bpfcache.BackendKey][16]byte {
+		backends := make(map[bpfcache.BackendKey][16]byte)
+		for _, entry := range dump.Backends {
+			backends[entry.Key] = entry.Value.Ip
+		}
+		return backends
+	}
+	assert.Equal(t, backendsOf(dump1), backendsOf(dump2))
+	assert.Len(t, dump2.Backends, 6)
+	// the update time of the endpoints differs
+	endpointsOf := func(dump *bpfcache.MapDump) map[bpfcache.EndpointKey]uint32 {
+		endpoints := make(map[bpfcache.EndpointKey]uint32)
+		for _, entry := range dump.Endpoints {
+			endpoints[entry.Key] = entry.Value.BackendUid
+		}
+		return endpoints
+	}
+	assert.Equal(t, endpointsOf(dump1), endpointsOf(dump2))
+}
+
+func BenchmarkRemoveWorkloads(b *testing.B) {
+	const workloads = 1000
+	t := &testing.T{}
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	b.Cleanup(func() { bpfcache.CleanupFakeWorkloadMap(workloadMap) })
+
+	p := newProcessor(workloadMap)
+	uids := make([]string, 0, workloads)
+	add := func() {
+		for i := 0; i < workloads; i++ {
+			wl := createWorkload(fmt.Sprintf("wl%d", i), netip.AddrFrom4([4]byte{10, 244, byte(i >> 8), byte(i)}).String(),
+				workloadapi.NetworkMode_STANDARD)
+			assert.NoError(t, p.updateWorkload(wl))
+			if len(uids) < workloads {
+				uids = append(uids, wl.GetUid())
+			}
+		}
+	}
+
+	b.Run("per-entry", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			add()
+			b.StartTimer()
+			for _, uid := range uids {
+				_ = p.removeWorkloadFromBpfMap(uid)
+			}
+		}
+	})
+	b.Run("batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			add()
+			b.StartTimer()
+			_ = p.removeWorkloadsFromBpfMap(uids)
+		}
+	})
+	hashNameClean(p)
+}
+
 func createTestWorkloadWithService(withService bool) *workloadapi.Workload {
 	workload := workloadapi.Workload{
 		Namespace:         "ns",
@@ -320,6 +1952,19 @@ func createTestWorkloadWithService(withService bool) *workloadapi.Workload {
 	return &workload
 }
 
+func createFakeWorkloadIPv6(ip string) *workloadapi.Workload {
+	if !netip.MustParseAddr(ip).Is6() {
+		panic(ip + " is not an ipv6 address")
+	}
+	return createFakeWorkload(ip, workloadapi.NetworkMode_STANDARD)
+}
+
+func createFakeDualStackWorkload(ipv4, ipv6 string) *workloadapi.Workload {
+	workload := createFakeWorkload(ipv4, workloadapi.NetworkMode_STANDARD)
+	workload.Addresses = append(workload.Addresses, netip.MustParseAddr(ipv6).AsSlice())
+	return workload
+}
+
 func createFakeWorkload(ip string, networkMode workloadapi.NetworkMode) *workloadapi.Workload {
 	workload := workloadapi.Workload{
 		Namespace:         "ns",
@@ -487,9 +2132,17 @@ func TestRestart(t *testing.T) {
 	// 2. Second simulate restart
 	// Set a restart label and simulate missing data in the cache
 	bpf.SetStartType(bpf.Restart)
+	// simulate a wrong endpoint count of svc2 left by the last epoch
+	svc2Key := bpfcache.ServiceKey{ServiceId: p.hashName.Hash(svc2.ResourceName())}
+	svc2Value := bpfcache.ServiceValue{}
+	assert.NoError(t, p.bpf.ServiceLookup(&svc2Key, &svc2Value))
+	svc2Value.EndpointCount = 5
+	assert.NoError(t, p.bpf.ServiceUpdate(&svc2Key, &svc2Value))
 	// reconstruct a new processor
 	p = newProcessor(workloadMap)
 	p.bpf.RestoreEndpointKeys()
+	p.bpf.ReconcileEndpointCount()
+	checkServiceMap(t, p, p.hashName.Hash(svc2.ResourceName()), svc2, 2)
 	// 2.1 simulate workload add/delete during restart
 	// simulate workload update during restart
 
@@ -563,22 +2216,468 @@ func TestRestart(t *testing.T) {
 	hashNameClean(p)
 }
 
+func TestRestartUnchangedWorkloads(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	svc1 := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	wl1 := createWorkload("wl1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	wl2 := createWorkload("wl2", "10.244.0.2", workloadapi.NetworkMode_STANDARD, "svc1")
+	assert.NoError(t, p.handleService(svc1))
+	assert.NoError(t, p.handleWorkload(wl1))
+	assert.NoError(t, p.handleWorkload(wl2))
+
+	// restart, wl2 gets a waypoint meanwhile
+	p = newProcessor(workloadMap)
+	defer hashNameClean(p)
+	p.bpf.RestoreEndpointKeys()
+	p.RestoreWorkloadDigests()
+	wl2.Waypoint = &workloadapi.GatewayAddress{
+		Destination: &workloadapi.GatewayAddress_Address{
+			Address: &workloadapi.NetworkAddress{
+				Address: netip.MustParseAddr("10.240.10.200").AsSlice(),
+			},
+		},
+		HboneMtlsPort: 15008,
+	}
+
+	unchanged := testutil.ToFloat64(telemetry.WorkloadUnchangedOnRestart)
+	assert.NoError(t, p.handleService(svc1))
+	assert.NoError(t, p.handleWorkload(proto.Clone(wl1).(*workloadapi.Workload)))
+	assert.NoError(t, p.handleWorkload(wl2))
+	assert.Equal(t, unchanged+1, testutil.ToFloat64(telemetry.WorkloadUnchangedOnRestart))
+
+	checkBackendMap(t, p, p.hashName.Hash(wl1.ResourceName()), wl1)
+	checkBackendMap(t, p, p.hashName.Hash(wl2.ResourceName()), wl2)
+	checkFrontEndMap(t, wl1.Addresses[0], p)
+	checkServiceMap(t, p, p.hashName.Hash(svc1.ResourceName()), svc1, 2)
+	bk := bpfcache.BackendKey{BackendUid: p.hashName.Hash(wl2.ResourceName())}
+	bv := bpfcache.BackendValue{}
+	assert.NoError(t, p.bpf.BackendLookup(&bk, &bv))
+	assert.Equal(t, nets.ConvertPortToBigEndian(15008), bv.WaypointPort)
+
+	// the digest is only used once, a later update is written
+	wl1.Waypoint = wl2.Waypoint
+	assert.NoError(t, p.handleWorkload(wl1))
+	bk.BackendUid = p.hashName.Hash(wl1.ResourceName())
+	assert.NoError(t, p.bpf.BackendLookup(&bk, &bv))
+	assert.Equal(t, nets.ConvertPortToBigEndian(15008), bv.WaypointPort)
+	assert.Equal(t, unchanged+1, testutil.ToFloat64(telemetry.WorkloadUnchangedOnRestart))
+}
+
+func TestRestartKeepsEndpointIndices(t *testing.T) {
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	wl1 := createWorkload("wl1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	wl2 := createWorkload("wl2", "10.244.0.2", workloadapi.NetworkMode_STANDARD, "svc1")
+	wl3 := createWorkload("wl3", "10.244.0.3", workloadapi.NetworkMode_STANDARD, "svc1")
+	wl4 := createWorkload("wl4", "10.244.0.4", workloadapi.NetworkMode_STANDARD, "svc1")
+
+	push := func(p *Processor, workloads ...*workloadapi.Workload) {
+		res := &service_discovery_v3.DeltaDiscoveryResponse{}
+		res.Resources = append(res.Resources, &service_discovery_v3.Resource{
+			Resource: protoconv.MessageToAny(serviceToAddress(svc)),
+		})
+		for _, wl := range workloads {
+			res.Resources = append(res.Resources, &service_discovery_v3.Resource{
+				Resource: protoconv.MessageToAny(workloadToAddress(wl)),
+			})
+		}
+		assert.NoError(t, p.handleAddressTypeResponse(res))
+	}
+	indices := func(p *Processor) map[string]uint32 {
+		out := make(map[string]uint32)
+		assert.NoError(t, p.bpf.IterateEndpoints(p.hashName.Hash(svc.ResourceName()), func(ek bpfcache.EndpointKey, ev bpfcache.EndpointValue) error {
+			out[p.hashName.NumToStr(ev.BackendUid)] = ek.BackendIndex
+			return nil
+		}))
+		return out
+	}
+
+	// 1. the indices follow the order of the uids, not the order received
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	p := newProcessor(workloadMap)
+	push(p, wl3, wl1, wl2)
+	expected := map[string]uint32{wl1.Uid: 1, wl2.Uid: 2, wl3.Uid: 3}
+	assert.Equal(t, expected, indices(p))
+	hashNameClean(p)
+	bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	// 2. a fresh start with the same members in another order assigns the same indices
+	workloadMap = bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+	p = newProcessor(workloadMap)
+	push(p, wl2, wl3, wl1)
+	assert.Equal(t, expected, indices(p))
+
+	// 3. restart on the pinned maps, the unchanged members keep their indices and the new one is appended
+	bpf.SetStartType(bpf.Restart)
+	defer bpf.SetStartType(bpf.Normal)
+	p = newProcessor(workloadMap)
+	defer hashNameClean(p)
+	p.bpf.RestoreEndpointKeys()
+	p.bpf.ReconcileEndpointCount()
+	push(p, wl4, wl3, wl2, wl1)
+	expected[wl4.Uid] = 4
+	assert.Equal(t, expected, indices(p))
+	checkServiceMap(t, p, p.hashName.Hash(svc.ResourceName()), svc, 4)
+}
+
+func TestSortServiceWorkloads(t *testing.T) {
+	wl1 := createWorkload("wl1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	wl2 := createWorkload("wl2", "10.244.0.2", workloadapi.NetworkMode_STANDARD, "svc2")
+	wl3 := createWorkload("wl3", "10.244.0.3", workloadapi.NetworkMode_STANDARD, "svc1")
+	standalone1 := createWorkload("standalone1", "10.244.0.4", workloadapi.NetworkMode_STANDARD)
+	standalone2 := createWorkload("standalone2", "10.244.0.5", workloadapi.NetworkMode_STANDARD)
+
+	// the workloads bound to services are sorted among their positions, the others keep theirs
+	workloads := []*workloadapi.Workload{wl3, standalone2, wl2, standalone1, wl1}
+	sortServiceWorkloads(workloads)
+	assert.Equal(t, []*workloadapi.Workload{wl1, standalone2, wl2, standalone1, wl3}, workloads)
+}
+
+func BenchmarkRestartWorkloads(b *testing.B) {
+	const workloads = 10000
+	t := &testing.T{}
+	workloadMap := bpfcache.NewFakeWorkloadMapWithSize(t, 2*workloads)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	_ = p.handleService(svc)
+	wls := make([]*workloadapi.Workload, 0, workloads)
+	for i := 0; i < workloads; i++ {
+		wl := createWorkload(fmt.Sprintf("wl%d", i), fmt.Sprintf("10.244.%d.%d", i/250, i%250+1),
+			workloadapi.NetworkMode_STANDARD, "svc1")
+		if err := p.handleWorkload(wl); err != nil {
+			b.Fatal(err)
+		}
+		wls = append(wls, wl)
+	}
+
+	for _, restoreDigests := range []bool{false, true} {
+		b.Run(fmt.Sprintf("restoreDigests=%v", restoreDigests), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				restarted := newProcessor(workloadMap)
+				restarted.bpf.RestoreEndpointKeys()
+				b.StartTimer()
+				if restoreDigests {
+					restarted.RestoreWorkloadDigests()
+				}
+				_ = restarted.handleService(svc)
+				for _, wl := range wls {
+					_ = restarted.handleWorkload(proto.Clone(wl).(*workloadapi.Workload))
+				}
+			}
+		})
+	}
+	// resetting without flushing the bpf maps, which are dropped anyway
+	p.hashName.Reset()
+}
+
 // The hashname will be saved as a file by default.
 // If it is not cleaned, it will affect other use cases.
+// hashNameClean removes the bpf map entries of every hashed name, as a workload and as a service
+// since the kind is unknown, before resetting the names, so that no entry is left with an unknown id
 func hashNameClean(p *Processor) {
+	names := make([]string, 0, len(p.hashName.strToNum))
 	for str := range p.hashName.strToNum {
-		if err := p.removeWorkloadFromBpfMap(str); err != nil {
-			log.Errorf("RemoveWorkloadResource failed: %v", err)
+		names = append(names, str)
+	}
+	for _, str := range names {
+		// a name which is not a workload has no backend to delete
+		if err := p.removeWorkloadFromBpfMap(str); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			log.Errorf("remove workload %s failed: %v", str, err)
 		}
-
 		if err := p.removeServiceResourceFromBpfMap(nil, str); err != nil {
-			log.Errorf("RemoveServiceResource failed: %v", err)
+			log.Errorf("remove service %s failed: %v", str, err)
 		}
-		p.hashName.Delete(str)
 	}
 	p.hashName.Reset()
 }
 
+func TestHandleAddressTypeResponseRateLimited(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	// 30 workloads produce more than 100 map writes, which takes at least 200ms at 400 ops/sec
+	p.bpf.SetWriteRateLimit(400, 10)
+
+	res := &service_discovery_v3.DeltaDiscoveryResponse{}
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	res.Resources = append(res.Resources, &service_discovery_v3.Resource{
+		Resource: protoconv.MessageToAny(serviceToAddress(svc)),
+	})
+	var (
+		wls  []*workloadapi.Workload
+		uids []uint32
+	)
+	for i := 0; i < 30; i++ {
+		wl := createWorkload(fmt.Sprintf("wl%d", i), fmt.Sprintf("10.244.0.%d", i+1), workloadapi.NetworkMode_STANDARD, "svc1")
+		wls = append(wls, wl)
+		res.Resources = append(res.Resources, &service_discovery_v3.Resource{
+			Resource: protoconv.MessageToAny(workloadToAddress(wl)),
+		})
+	}
+
+	start := time.Now()
+	err := p.handleAddressTypeResponse(res)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+
+	checkServiceMap(t, p, p.hashName.Hash(svc.ResourceName()), svc, uint32(len(wls)))
+	for _, wl := range wls {
+		uid := p.hashName.Hash(wl.ResourceName())
+		uids = append(uids, uid)
+		checkFrontEndMap(t, wl.Addresses[0], p)
+		checkBackendMap(t, p, uid, wl)
+	}
+	checkEndpointMap(t, p, svc, uids)
+
+	hashNameClean(p)
+}
+
+func TestHandleAddressTypeResponsePartialFailure(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	wl1 := createWorkload("wl1", "10.244.0.1", workloadapi.NetworkMode_STANDARD)
+	wl3 := createWorkload("wl3", "10.244.0.3", workloadapi.NetworkMode_STANDARD)
+	good := protoconv.MessageToAny(workloadToAddress(wl1))
+	res := &service_discovery_v3.DeltaDiscoveryResponse{
+		TypeUrl: AddressType,
+		Resources: []*service_discovery_v3.Resource{
+			{Name: wl1.ResourceName(), Resource: good},
+			// the second resource can not be decoded
+			{Name: "wl2", Resource: &anypb.Any{TypeUrl: good.TypeUrl, Value: []byte{0xff}}},
+			{Name: wl3.ResourceName(), Resource: protoconv.MessageToAny(workloadToAddress(wl3))},
+		},
+	}
+
+	p.processWorkloadResponse(res, nil)
+	// the response is nacked with the failed resource
+	assert.NotNil(t, p.ack.ErrorDetail)
+	assert.Contains(t, p.ack.ErrorDetail.Message, "unmarshal resource wl2 failed")
+	assert.NotContains(t, p.ack.ErrorDetail.Message, wl1.ResourceName())
+	assert.NotContains(t, p.ack.ErrorDetail.Message, wl3.ResourceName())
+
+	// the other resources are handled
+	for _, wl := range []*workloadapi.Workload{wl1, wl3} {
+		assert.NotNil(t, p.WorkloadCache.GetWorkloadByUid(wl.Uid))
+		checkFrontEndMap(t, wl.Addresses[0], p)
+		checkBackendMap(t, p, p.hashName.Hash(wl.ResourceName()), wl)
+	}
+
+	// a response without failure is acked
+	res.Resources = res.Resources[:1]
+	p.processWorkloadResponse(res, nil)
+	assert.Nil(t, p.ack.ErrorDetail)
+}
+
+func TestQuarantineFailingWorkload(t *testing.T) {
+	// the frontend map holds the address of good and 3 of the 4 addresses of bad
+	workloadMap := bpfcache.NewFakeWorkloadMapWithSize(t, 4)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+	p.SetQuarantineThreshold(3)
+
+	good := createWorkload("good", "10.244.0.1", workloadapi.NetworkMode_STANDARD)
+	bad := createWorkload("bad", "10.244.0.2", workloadapi.NetworkMode_STANDARD)
+	for _, ip := range []string{"10.244.0.3", "10.244.0.4", "10.244.0.5"} {
+		bad.Addresses = append(bad.Addresses, netip.MustParseAddr(ip).AsSlice())
+	}
+	push := func(wls ...*workloadapi.Workload) error {
+		res := &service_discovery_v3.DeltaDiscoveryResponse{TypeUrl: AddressType}
+		for _, wl := range wls {
+			res.Resources = append(res.Resources, &service_discovery_v3.Resource{
+				Resource: protoconv.MessageToAny(workloadToAddress(wl)),
+			})
+		}
+		return p.handleAddressTypeResponse(res)
+	}
+
+	quarantined := testutil.ToFloat64(telemetry.ResourcesQuarantined)
+	// bad is retried on every push though unchanged, until quarantined
+	for i := 0; i < 3; i++ {
+		err := push(good, bad)
+		assert.ErrorContains(t, err, bad.ResourceName())
+		assert.NotContains(t, err.Error(), good.ResourceName())
+	}
+	assert.Equal(t, quarantined+1, testutil.ToFloat64(telemetry.ResourcesQuarantined))
+	assert.Equal(t, []string{bad.ResourceName()}, p.QuarantinedResources())
+
+	// the unchanged bad is skipped, the other workloads proceed
+	other := createWorkload("other", "10.244.0.6", workloadapi.NetworkMode_HOST_NETWORK)
+	assert.NoError(t, push(good, bad, other))
+	checkFrontEndMap(t, good.Addresses[0], p)
+	checkBackendMap(t, p, p.hashName.Hash(good.ResourceName()), good)
+	checkBackendMap(t, p, p.hashName.Hash(other.ResourceName()), other)
+	assert.Equal(t, quarantined+1, testutil.ToFloat64(telemetry.ResourcesQuarantined))
+
+	// bad is re-admitted once changed
+	bad = proto.Clone(bad).(*workloadapi.Workload)
+	bad.Addresses = bad.Addresses[:1]
+	assert.NoError(t, push(bad))
+	assert.Empty(t, p.QuarantinedResources())
+	checkBackendMap(t, p, p.hashName.Hash(bad.ResourceName()), bad)
+}
+
+func TestRetryPartiallyWrittenWorkload(t *testing.T) {
+	// the endpoint map holds the 4 endpoints of wl1, wl2 fails to be added to svc1
+	workloadMap := bpfcache.NewFakeWorkloadMapWithSize(t, 4)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	push := func(addresses ...*workloadapi.Address) error {
+		res := &service_discovery_v3.DeltaDiscoveryResponse{TypeUrl: AddressType}
+		for _, addr := range addresses {
+			res.Resources = append(res.Resources, &service_discovery_v3.Resource{Resource: protoconv.MessageToAny(addr)})
+		}
+		return p.handleAddressTypeResponse(res)
+	}
+	// endpoints returns the slots of the workload in the endpoint map, whether counted or not
+	endpoints := func(svc *workloadapi.Service, wl *workloadapi.Workload) []uint32 {
+		var indices []uint32
+		assert.NoError(t, p.bpf.RangeEndpoints(func(ek bpfcache.EndpointKey, ev bpfcache.EndpointValue) error {
+			if ek.ServiceId == p.hashName.Hash(svc.ResourceName()) && ev.BackendUid == p.hashName.Hash(wl.ResourceName()) {
+				indices = append(indices, ek.BackendIndex)
+			}
+			return nil
+		}))
+		return indices
+	}
+
+	var services []*workloadapi.Service
+	var addresses []*workloadapi.Address
+	for i := 1; i <= 4; i++ {
+		svc := createFakeService(fmt.Sprintf("svc%d", i), fmt.Sprintf("10.240.10.%d", i), "10.240.10.200")
+		services = append(services, svc)
+		addresses = append(addresses, serviceToAddress(svc))
+	}
+	wl1 := createWorkload("wl1", "10.244.0.1", workloadapi.NetworkMode_HOST_NETWORK, "svc1", "svc2", "svc3", "svc4")
+	wl2 := createWorkload("wl2", "10.244.0.2", workloadapi.NetworkMode_HOST_NETWORK, "svc1")
+	assert.NoError(t, push(append(addresses, workloadToAddress(wl1))...))
+
+	// 1. the endpoint write fails, the workload is cached nonetheless
+	assert.ErrorContains(t, push(workloadToAddress(wl2)), wl2.ResourceName())
+	assert.NotNil(t, p.WorkloadCache.GetWorkloadByUid(wl2.Uid))
+	assert.Empty(t, p.bpf.GetEndpointKeys(p.hashName.Hash(wl2.ResourceName())))
+	checkServiceMap(t, p, p.hashName.Hash(services[0].ResourceName()), services[0], 1)
+
+	// 2. once there is room, the unchanged workload is added by the retry
+	wl1 = proto.Clone(wl1).(*workloadapi.Workload)
+	delete(wl1.Services, services[2].ResourceName())
+	delete(wl1.Services, services[3].ResourceName())
+	assert.NoError(t, push(workloadToAddress(wl1)))
+	assert.NoError(t, push(workloadToAddress(wl2)))
+	checkServiceMap(t, p, p.hashName.Hash(services[0].ResourceName()), services[0], 2)
+	checkEndpointMap(t, p, services[0], []uint32{p.hashName.Hash(wl1.ResourceName()), p.hashName.Hash(wl2.ResourceName())})
+	checkBackendMap(t, p, p.hashName.Hash(wl2.ResourceName()), wl2)
+	assert.Equal(t, []uint32{2}, endpoints(services[0], wl2))
+
+	// 3. an endpoint written beyond the count by an attempt failing to update the service is counted in place
+	sk := bpfcache.ServiceKey{ServiceId: p.hashName.Hash(services[3].ResourceName())}
+	sv := bpfcache.ServiceValue{}
+	assert.NoError(t, p.bpf.ServiceLookup(&sk, &sv))
+	assert.NoError(t, p.bpf.EndpointUpdate(&bpfcache.EndpointKey{ServiceId: sk.ServiceId, BackendIndex: sv.EndpointCount + 1},
+		&bpfcache.EndpointValue{BackendUid: p.hashName.Hash(wl2.ResourceName())}))
+	assert.NoError(t, p.addWorkloadToService(&sk, &sv, p.hashName.Hash(wl2.ResourceName()), false))
+	checkServiceMap(t, p, sk.ServiceId, services[3], 1)
+	assert.Equal(t, []uint32{1}, endpoints(services[3], wl2))
+}
+
+// txOps returns the map and op of each write recorded in the tx log
+func txOps(l *bpfcache.TxLog) []string {
+	var ops []string
+	for _, line := range strings.Split(strings.TrimSpace(l.String()), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 2 {
+			ops = append(ops, fields[0]+" "+fields[1])
+		}
+	}
+	return ops
+}
+
+func TestBpfWriteOrder(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+	txLog := &bpfcache.TxLog{}
+	p.bpf.SetTxLog(txLog)
+
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	wl1 := createWorkload("pod1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	wl2 := createWorkload("pod2", "10.244.0.2", workloadapi.NetworkMode_STANDARD, "svc1")
+
+	// the cases run in order, each one on the state left by the previous ones
+	testCases := []struct {
+		name     string
+		apply    func()
+		expected []string
+	}{
+		{
+			name:     "new service writes its vip before the service",
+			apply:    func() { assert.NoError(t, p.handleService(svc)) },
+			expected: []string{"frontend update", "service update"},
+		},
+		{
+			name:  "new endpoint is written before the endpoint count covers it",
+			apply: func() { assert.NoError(t, p.handleWorkload(wl1)) },
+			expected: []string{
+				"endpoint update", "service update",
+				"backend update", "frontend update",
+			},
+		},
+		{
+			name: "unbound endpoint is replaced by the last one before the count shrinks",
+			apply: func() {
+				assert.NoError(t, p.handleWorkload(wl2))
+				txLog.Reset()
+				unbound := proto.Clone(wl1).(*workloadapi.Workload)
+				unbound.Services = nil
+				assert.NoError(t, p.handleWorkload(unbound))
+			},
+			expected: []string{
+				"endpoint update", "endpoint delete", "service update",
+				"backend update", "frontend update",
+			},
+		},
+		{
+			name:  "removed workload leaves the endpoints before its backend is deleted",
+			apply: func() { p.handleRemovedAddresses([]string{wl2.ResourceName()}) },
+			expected: []string{
+				"endpoint delete", "service update",
+				"frontend delete", "backend delete",
+			},
+		},
+		{
+			name:     "removed service deletes its vip before the service",
+			apply:    func() { p.handleRemovedAddresses([]string{svc.ResourceName()}) },
+			expected: []string{"frontend delete", "service delete"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			txLog.Reset()
+			tc.apply()
+			assert.Equal(t, tc.expected, txOps(txLog), txLog.String())
+			// and all of them succeed
+			assert.Equal(t, len(tc.expected), strings.Count(txLog.String(), "err=<nil>\n"))
+		})
+	}
+}
+
 func workloadToAddress(wl *workloadapi.Workload) *workloadapi.Address {
 	return &workloadapi.Address{
 		Type: &workloadapi.Address_Workload{
@@ -594,3 +2693,42 @@ func serviceToAddress(service *workloadapi.Service) *workloadapi.Address {
 		},
 	}
 }
+
+func TestProcessorClose(t *testing.T) {
+	// the log file rotation goroutine is started by the first log write
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent(),
+		goleak.IgnoreTopFunction("gopkg.in/natefinch/lumberjack%2ev2.(*Logger).millRun"))
+
+	for i := 0; i < 100; i++ {
+		workloadMap := bpfcache.NewFakeWorkloadMap(t)
+		p := newProcessor(workloadMap)
+		p.Start(context.Background(), workloadMap.KmeshFrontendMiss)
+
+		svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+		assert.NoError(t, p.handleService(svc))
+		hashNameClean(p)
+
+		assert.NoError(t, p.Close())
+		// the maps are left to their owner and closing again is a no-op
+		assert.NotEqual(t, -1, workloadMap.KmeshFrontend.FD())
+		assert.NoError(t, p.Close())
+		bpfcache.CleanupFakeWorkloadMap(workloadMap)
+	}
+}
+
+func TestProcessorCloseTimeout(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	p.SetCloseTimeout(10 * time.Millisecond)
+	release := make(chan struct{})
+	p.goAsync(context.Background(), func(ctx context.Context) {
+		<-ctx.Done()
+		<-release
+	})
+
+	assert.ErrorContains(t, p.Close(), "did not exit within")
+	close(release)
+	p.wg.Wait()
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+
+	"kmesh.net/kmesh/pkg/controller/telemetry"
+)
+
+// quarantine tracks the resources failing to be programmed into the bpf maps. A resource failing
+// threshold times in a row is quarantined: it is skipped until an update changes its content, so that
+// a resource which can never be programmed doesn't fail every response. It has its own lock since
+// handleWorkload checks it without holding the processor mutex. The failures are counted even though
+// the quarantine is disabled, a workload whose last attempt failed is fully updated by the next one.
+type quarantine struct {
+	mutex sync.Mutex
+	// threshold is the number of consecutive failures quarantining a resource, 0 disables the quarantine
+	threshold int
+	// consecutive failures of the resources, keyed by resource name, created on the first failure
+	failures map[string]int
+	// content of the quarantined resources when quarantined, keyed by resource name
+	quarantined map[string]proto.Message
+}
+
+// SetQuarantineThreshold quarantines the services and workloads failing to be programmed threshold
+// times in a row. They are logged, counted and skipped until a later update changes their content.
+// Setting it again resets the failure counts, threshold <= 0 disables the quarantine and re-admits all
+// the quarantined resources.
+func (p *Processor) SetQuarantineThreshold(threshold int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	q := &p.quarantine
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.threshold = max(threshold, 0)
+	q.failures = make(map[string]int)
+	q.quarantined = make(map[string]proto.Message)
+}
+
+// QuarantinedResources returns the names of the quarantined resources
+func (p *Processor) QuarantinedResources() []string {
+	q := &p.quarantine
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	names := make([]string, 0, len(q.quarantined))
+	for name := range q.quarantined {
+		names = append(names, name)
+	}
+	return names
+}
+
+// admit tells whether the resource should be handled. A quarantined resource is re-admitted once
+// its content differs from the one quarantined.
+func (q *quarantine) admit(name string, resource proto.Message) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	quarantined, ok := q.quarantined[name]
+	if !ok {
+		return true
+	}
+	if proto.Equal(quarantined, resource) {
+		return false
+	}
+	log.Infof("%s changed, release it from quarantine", name)
+	delete(q.quarantined, name)
+	delete(q.failures, name)
+	return true
+}
+
+// record records the result of handling the resource, and quarantines it once it failed threshold times in a row
+func (q *quarantine) record(name string, resource proto.Message, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if err == nil {
+		delete(q.failures, name)
+		return
+	}
+	if q.failures == nil {
+		q.failures = make(map[string]int)
+	}
+	q.failures[name]++
+	if q.threshold == 0 || q.failures[name] < q.threshold {
+		return
+	}
+	log.Warnf("%s failed to be programmed %d times in a row, quarantine it until it changes, last error: %v",
+		name, q.failures[name], err)
+	q.quarantined[name] = proto.Clone(resource)
+	telemetry.ResourcesQuarantined.Inc()
+}
+
+// failing tells whether the last attempt to program the resource failed
+func (q *quarantine) failing(name string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.failures[name] > 0
+}
+
+// forget drops the state of the removed resources
+func (q *quarantine) forget(names []string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for _, name := range names {
+		delete(q.failures, name)
+		delete(q.quarantined, name)
+	}
+}
@@ -0,0 +1,454 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	bpf "kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+	"kmesh.net/kmesh/pkg/nets"
+)
+
+// The queries below only read the caches and the bpf maps in kernel,
+// they are safe to be called concurrently with the xDS processing.
+
+// ProcessorStats is a snapshot of the numbers of resources held by the processor
+type ProcessorStats struct {
+	Workloads int `json:"workloads"`
+	Services  int `json:"services"`
+	Frontends int `json:"frontends"`
+	Backends  int `json:"backends"`
+	Endpoints int `json:"endpoints"`
+	// lifetime numbers of resources programmed since start
+	TotalWorkloads uint64 `json:"totalWorkloads"`
+	TotalServices  uint64 `json:"totalServices"`
+	// services outside of the cluster domain, included in Services
+	ExternalServices int `json:"externalServices"`
+	// short-lived workloads per the ephemeral workload policy, included in Workloads
+	EphemeralWorkloads int `json:"ephemeralWorkloads"`
+	// local and remote endpoints of each service in the endpoint map, keyed by service name
+	ServiceEndpoints map[string]EndpointLocality `json:"serviceEndpoints,omitempty"`
+}
+
+// EndpointLocality counts the endpoints of a service on the local node and on the other nodes
+type EndpointLocality struct {
+	Local  int `json:"local"`
+	Remote int `json:"remote"`
+}
+
+// ServiceInfo is a cached service and its classification
+type ServiceInfo struct {
+	Name     string `json:"name"`
+	External bool   `json:"external"`
+}
+
+// AddressInfo describes what an address is resolved to by the frontend map
+type AddressInfo struct {
+	Address    string `json:"address"`
+	UpstreamId uint32 `json:"upstreamId"`
+	// Kind is either service or workload, empty if the upstream is unknown to the caches
+	Kind string `json:"kind,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+const (
+	// PendingRefWaypoint is a service whose waypoint address is not known yet, see SetDeferUnknownWaypoints
+	PendingRefWaypoint = "waypoint"
+	// PendingRefService is a workload bound to a service not received yet
+	PendingRefService = "service"
+)
+
+// PendingRef is a resource waiting on a reference not resolved yet
+type PendingRef struct {
+	Kind string `json:"kind"`
+	// Resource is the name of the resource waiting
+	Resource string `json:"resource"`
+	// Reference is what the resource is waiting on, the waypoint address or the service name
+	Reference string `json:"reference"`
+}
+
+// WorkloadStatusReport describes how a workload is programmed in the bpf maps
+type WorkloadStatusReport struct {
+	Uid string `json:"uid"`
+	// InCache is false if the workload is unknown, the other fields are empty then
+	InCache    bool   `json:"inCache"`
+	Name       string `json:"name,omitempty"`
+	BackendUid uint32 `json:"backendUid,omitempty"`
+	Backend    bool   `json:"backend"`
+	// Frontends are the addresses of the workload resolved to it by the frontend map,
+	// there is none for a workload in host network mode
+	Frontends []string `json:"frontends,omitempty"`
+	// Services are the services having the workload as endpoint in the endpoint map
+	Services []string `json:"services,omitempty"`
+	// VM is true for a virtual machine registered by a WorkloadEntry
+	VM bool `json:"vm,omitempty"`
+}
+
+// Stats counts the resources in the caches and the entries in the bpf maps
+func (p *Processor) Stats() (*ProcessorStats, error) {
+	dump, err := p.bpf.Dump()
+	if err != nil {
+		return nil, err
+	}
+
+	workloads := p.WorkloadCache.List()
+	ephemeralWorkloads := 0
+	// the ephemeral workload policy is set under handleMutex
+	p.handleMutex.Lock()
+	for _, workload := range workloads {
+		if p.isEphemeralWorkload(workload) {
+			ephemeralWorkloads++
+		}
+	}
+	p.handleMutex.Unlock()
+
+	services := p.ServiceCache.List()
+	externalServices := 0
+	for _, svc := range services {
+		if isExternalService(svc.ResourceName()) {
+			externalServices++
+		}
+	}
+
+	// the endpoints staged beyond the endpoint count of their service are not selected
+	endpointCounts := make(map[uint32]uint32, len(dump.Services))
+	for _, entry := range dump.Services {
+		endpointCounts[entry.Key.ServiceId] = entry.Value.EndpointCount
+	}
+	var serviceEndpoints map[string]EndpointLocality
+	if len(dump.Endpoints) > 0 {
+		serviceEndpoints = make(map[string]EndpointLocality)
+		// hashName is shared with handleWorkload and handleService
+		p.handleMutex.Lock()
+		for _, entry := range dump.Endpoints {
+			if entry.Key.BackendIndex > endpointCounts[entry.Key.ServiceId] {
+				continue
+			}
+			name := p.hashName.NumToStr(entry.Key.ServiceId)
+			locality := serviceEndpoints[name]
+			if entry.Value.Local != 0 {
+				locality.Local++
+			} else {
+				locality.Remote++
+			}
+			serviceEndpoints[name] = locality
+		}
+		p.handleMutex.Unlock()
+	}
+
+	return &ProcessorStats{
+		Workloads: len(workloads),
+		Services:  len(services),
+		Frontends: len(dump.Frontends),
+		Backends:  len(dump.Backends),
+		Endpoints: len(dump.Endpoints),
+
+		TotalWorkloads: p.totalWorkloads.Load(),
+		TotalServices:  p.totalServices.Load(),
+
+		ExternalServices:   externalServices,
+		EphemeralWorkloads: ephemeralWorkloads,
+		ServiceEndpoints:   serviceEndpoints,
+	}, nil
+}
+
+// ListServices returns the cached services sorted by resource name
+func (p *Processor) ListServices() []ServiceInfo {
+	services := p.ServiceCache.List()
+	infos := make([]ServiceInfo, 0, len(services))
+	for _, svc := range services {
+		name := svc.ResourceName()
+		infos = append(infos, ServiceInfo{Name: name, External: isExternalService(name)})
+	}
+	slices.SortFunc(infos, func(a, b ServiceInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return infos
+}
+
+// PendingReferences returns the resources waiting on unresolved references, sorted by kind, resource and reference
+func (p *Processor) PendingReferences() []PendingRef {
+	var refs []PendingRef
+
+	// pendingWaypoints is updated by handleService
+	p.handleMutex.Lock()
+	for name := range p.pendingWaypoints {
+		ref := PendingRef{Kind: PendingRefWaypoint, Resource: name}
+		if waypoint := p.serviceWaypoint(p.ServiceCache.GetService(name)); waypoint != nil {
+			if addr, ok := netip.AddrFromSlice(waypoint.GetAddress().GetAddress()); ok {
+				ref.Reference = addr.String()
+			}
+		}
+		refs = append(refs, ref)
+	}
+	p.handleMutex.Unlock()
+
+	for _, workload := range p.WorkloadCache.List() {
+		for name := range workload.GetServices() {
+			if p.ServiceCache.GetService(name) == nil {
+				refs = append(refs, PendingRef{Kind: PendingRefService, Resource: workload.ResourceName(), Reference: name})
+			}
+		}
+	}
+
+	slices.SortFunc(refs, func(a, b PendingRef) int {
+		if c := strings.Compare(a.Kind, b.Kind); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.Resource, b.Resource); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Reference, b.Reference)
+	})
+	return refs
+}
+
+// SetUserspaceMirror makes the queries read a userspace copy of the workload bpf maps kept in sync with
+// the writes, rather than the maps in kernel, so that kmeshctl issues no bpf syscalls competing with the
+// writes. It must be called before Start.
+func (p *Processor) SetUserspaceMirror(enabled bool) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	// the writes issued while copying would be missed
+	p.handleMutex.Lock()
+	defer p.handleMutex.Unlock()
+
+	if p.mapMirror != nil {
+		p.mapMirror.Close()
+		p.mapMirror = nil
+	}
+	if !enabled {
+		return nil
+	}
+	mirror, err := p.bpf.CopyToUserspace()
+	if err != nil {
+		return err
+	}
+	p.mapMirror = mirror
+	return nil
+}
+
+// queryMaps returns the maps read by the queries, the userspace mirror if enabled
+func (p *Processor) queryMaps() bpf.MapStore {
+	if p.mapMirror != nil {
+		return p.mapMirror
+	}
+	return p.bpf
+}
+
+// DumpMaps returns all the entries of the workload bpf maps, the ports are converted to host order
+// for the readers of the dump
+func (p *Processor) DumpMaps() (*bpf.MapDump, error) {
+	var (
+		dump *bpf.MapDump
+		err  error
+	)
+	if p.mapMirror != nil {
+		dump = p.mapMirror.Dump()
+	} else if dump, err = p.bpf.Dump(); err != nil {
+		return nil, err
+	}
+
+	for i := range dump.Services {
+		sv := &dump.Services[i].Value
+		for j := range sv.ServicePort {
+			sv.ServicePort[j] = nets.ConvertPortFromBigEndian(sv.ServicePort[j])
+			sv.TargetPort[j] = nets.ConvertPortFromBigEndian(sv.TargetPort[j])
+		}
+		sv.WaypointPort = nets.ConvertPortFromBigEndian(sv.WaypointPort)
+	}
+	for i := range dump.Backends {
+		bv := &dump.Backends[i].Value
+		bv.WaypointPort = nets.ConvertPortFromBigEndian(bv.WaypointPort)
+		bv.TunnelPort = nets.ConvertPortFromBigEndian(bv.TunnelPort)
+	}
+	return dump, nil
+}
+
+// VerifyShadowMaps compares the workload bpf maps with the shadow maps loaded from the shadow map path
+func (p *Processor) VerifyShadowMaps() error {
+	// hold the writes back so that both sets of maps are dumped at the same point
+	p.handleMutex.Lock()
+	defer p.handleMutex.Unlock()
+
+	return p.bpf.VerifyShadow()
+}
+
+// LookupAddress looks up the frontend map for the address, and resolves the upstream to
+// the cached service or workload owning the address
+func (p *Processor) LookupAddress(address string) (*AddressInfo, error) {
+	var (
+		fk = bpf.FrontendKey{}
+		fv = bpf.FrontendValue{}
+	)
+
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %s, %s", address, err)
+	}
+	addr = addr.Unmap()
+	nets.CopyIpByteFromAddr(&fk.Ip, addr)
+	if err = p.queryMaps().FrontendLookup(&fk, &fv); err != nil {
+		return nil, fmt.Errorf("address %s not found in frontend map, %s", address, err)
+	}
+
+	info := &AddressInfo{
+		Address:    addr.String(),
+		UpstreamId: fv.UpstreamId,
+	}
+	for _, svc := range p.ServiceCache.List() {
+		for _, networkAddress := range svc.GetAddresses() {
+			if svcAddr, _ := netip.AddrFromSlice(networkAddress.GetAddress()); svcAddr.Unmap() == addr {
+				info.Kind, info.Name = "service", svc.ResourceName()
+				return info, nil
+			}
+		}
+	}
+	for _, workload := range p.WorkloadCache.List() {
+		for _, ip := range workload.GetAddresses() {
+			if wlAddr, _ := netip.AddrFromSlice(ip); wlAddr.Unmap() == addr {
+				info.Kind, info.Name = "workload", workload.ResourceName()
+				return info, nil
+			}
+		}
+	}
+	return info, nil
+}
+
+// ServiceEndpointHits returns the numbers of connections sent to each backend of the service, keyed by backend uid.
+// The service id is resolved through the frontend map rather than hashName, which is not safe for concurrent use.
+func (p *Processor) ServiceEndpointHits(serviceName string) (map[uint32]uint64, error) {
+	var (
+		fk = bpf.FrontendKey{}
+		fv = bpf.FrontendValue{}
+	)
+
+	svc := p.ServiceCache.GetService(serviceName)
+	if svc == nil {
+		return nil, fmt.Errorf("service %s not found", serviceName)
+	}
+	if len(svc.GetAddresses()) == 0 {
+		return nil, fmt.Errorf("service %s has no address", serviceName)
+	}
+	nets.CopyIpByteFromSlice(&fk.Ip, svc.GetAddresses()[0].GetAddress())
+	if err := p.bpf.FrontendLookup(&fk, &fv); err != nil {
+		return nil, fmt.Errorf("service %s not found in frontend map, %s", serviceName, err)
+	}
+	return p.bpf.GetEndpointHits(fv.UpstreamId)
+}
+
+// WorkloadStatus reports whether the workload is cached, has a backend and frontends,
+// and which services include it as endpoint
+func (p *Processor) WorkloadStatus(uid string) WorkloadStatusReport {
+	var (
+		fk = bpf.FrontendKey{}
+		fv = bpf.FrontendValue{}
+		bk = bpf.BackendKey{}
+		bv = bpf.BackendValue{}
+	)
+
+	report := WorkloadStatusReport{Uid: uid}
+	workload := p.WorkloadCache.GetWorkloadByUid(uid)
+	if workload == nil {
+		return report
+	}
+	report.InCache = true
+	report.Name = workload.ResourceName()
+	report.VM = isVirtualMachine(workload)
+
+	// hashName is shared with handleWorkload and handleService
+	p.handleMutex.Lock()
+	defer p.handleMutex.Unlock()
+
+	bk.BackendUid = p.hashName.Hash(uid)
+	report.BackendUid = bk.BackendUid
+	report.Backend = p.bpf.BackendLookup(&bk, &bv) == nil
+
+	for _, ip := range workload.GetAddresses() {
+		nets.CopyIpByteFromSlice(&fk.Ip, ip)
+		if err := p.bpf.FrontendLookup(&fk, &fv); err == nil && fv.UpstreamId == bk.BackendUid {
+			addr, _ := netip.AddrFromSlice(ip)
+			report.Frontends = append(report.Frontends, addr.Unmap().String())
+		}
+	}
+
+	_ = p.bpf.RangeEndpoints(func(key bpf.EndpointKey, value bpf.EndpointValue) error {
+		if value.BackendUid == bk.BackendUid {
+			report.Services = append(report.Services, p.hashName.NumToStr(key.ServiceId))
+		}
+		return nil
+	})
+	slices.Sort(report.Services)
+	return report
+}
+
+// CheckConsistency verifies the invariants between the bpf maps, and returns the violations found joined,
+// nil if there is none: the backend of every endpoint exists and has a frontend entry, unless it is
+// a workload in host network mode.
+func (p *Processor) CheckConsistency() error {
+	var errs []error
+
+	dump, err := p.bpf.Dump()
+	if err != nil {
+		return err
+	}
+
+	frontends := make(map[uint32]struct{}, len(dump.Frontends))
+	for _, entry := range dump.Frontends {
+		frontends[entry.Value.UpstreamId] = struct{}{}
+	}
+	backends := make(map[uint32]bpf.BackendValue, len(dump.Backends))
+	for _, entry := range dump.Backends {
+		backends[entry.Key.BackendUid] = entry.Value
+	}
+	// host network workloads share the node ip, they have no frontend
+	hostNetworkIps := make(map[[16]byte]struct{})
+	for _, workload := range p.WorkloadCache.List() {
+		if workload.GetNetworkMode() != workloadapi.NetworkMode_HOST_NETWORK {
+			continue
+		}
+		for _, ip := range workload.GetAddresses() {
+			var key [16]byte
+			nets.CopyIpByteFromSlice(&key, ip)
+			hostNetworkIps[key] = struct{}{}
+		}
+	}
+
+	for _, entry := range dump.Endpoints {
+		bv, ok := backends[entry.Value.BackendUid]
+		if !ok {
+			errs = append(errs, fmt.Errorf("endpoint %d of service %d: backend %d not found",
+				entry.Key.BackendIndex, entry.Key.ServiceId, entry.Value.BackendUid))
+			continue
+		}
+		if _, ok = frontends[entry.Value.BackendUid]; ok {
+			continue
+		}
+		if _, ok = hostNetworkIps[bv.Ip]; ok {
+			continue
+		}
+		errs = append(errs, fmt.Errorf("endpoint %d of service %d: backend %d has no frontend",
+			entry.Key.BackendIndex, entry.Key.ServiceId, entry.Value.BackendUid))
+	}
+
+	return errors.Join(errs...)
+}
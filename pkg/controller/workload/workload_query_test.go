@@ -0,0 +1,321 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/cilium/ebpf"
+	"github.com/stretchr/testify/assert"
+	"istio.io/istio/pkg/util/sets"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+	"kmesh.net/kmesh/pkg/nets"
+)
+
+func TestServiceEndpointHits(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	svc1 := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	svc2 := createFakeService("svc2", "10.240.10.2", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc1))
+	assert.NoError(t, p.handleService(svc2))
+	wl1 := createWorkload("pod1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1", "svc2")
+	wl2 := createWorkload("pod2", "10.244.0.2", workloadapi.NetworkMode_STANDARD, "svc1")
+	assert.NoError(t, p.handleWorkload(wl1))
+	assert.NoError(t, p.handleWorkload(wl2))
+
+	svc1Id := p.hashName.Hash(svc1.ResourceName())
+	svc2Id := p.hashName.Hash(svc2.ResourceName())
+	wl1Id := p.hashName.Hash(wl1.Uid)
+	wl2Id := p.hashName.Hash(wl2.Uid)
+
+	// seed the counters as the datapath does
+	seeded := map[bpfcache.EndpointHitKey]uint64{
+		{ServiceId: svc1Id, BackendUid: wl1Id}: 70,
+		{ServiceId: svc1Id, BackendUid: wl2Id}: 30,
+		{ServiceId: svc2Id, BackendUid: wl1Id}: 5,
+	}
+	for k, v := range seeded {
+		assert.NoError(t, workloadMap.KmeshEndpointHits.Update(&k, &v, ebpf.UpdateAny))
+	}
+
+	hits, err := p.ServiceEndpointHits(svc1.ResourceName())
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint32]uint64{wl1Id: 70, wl2Id: 30}, hits)
+
+	hits, err = p.ServiceEndpointHits(svc2.ResourceName())
+	assert.NoError(t, err)
+	assert.Equal(t, map[uint32]uint64{wl1Id: 5}, hits)
+
+	_, err = p.ServiceEndpointHits("default/unknown.default.svc.cluster.local")
+	assert.Error(t, err)
+}
+
+func TestExternalServices(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	internal := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	// a ServiceEntry egress target
+	external := createFakeService("example", "240.240.0.1", "10.240.10.200")
+	external.Hostname = "www.example.com"
+	assert.NoError(t, p.handleService(internal))
+	assert.NoError(t, p.handleService(external))
+
+	isExternal := func(svc *workloadapi.Service) bool {
+		var sv bpfcache.ServiceValue
+		err := p.bpf.ServiceLookup(&bpfcache.ServiceKey{ServiceId: p.hashName.Hash(svc.ResourceName())}, &sv)
+		assert.NoError(t, err)
+		return sv.External
+	}
+	assert.False(t, isExternal(internal))
+	assert.True(t, isExternal(external))
+
+	assert.Equal(t, []ServiceInfo{
+		{Name: "default/svc1.default.svc.cluster.local", External: false},
+		{Name: "default/www.example.com", External: true},
+	}, p.ListServices())
+
+	stats, err := p.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.Services)
+	assert.Equal(t, 1, stats.ExternalServices)
+}
+
+func TestDumpMapsPorts(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	wl := createWorkload("pod1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	wl.Waypoint = svc.Waypoint
+	assert.NoError(t, p.handleService(svc))
+	assert.NoError(t, p.handleWorkload(wl))
+
+	dump, err := p.DumpMaps()
+	assert.NoError(t, err)
+	assert.Len(t, dump.Services, 1)
+	sv := dump.Services[0].Value
+	assert.Equal(t, []uint32{80, 81, 82}, sv.ServicePort[:3])
+	assert.Equal(t, []uint32{8080, 8180, 82}, sv.TargetPort[:3])
+	assert.Equal(t, uint32(15008), sv.WaypointPort)
+	assert.Len(t, dump.Backends, 1)
+	assert.Equal(t, uint32(15008), dump.Backends[0].Value.WaypointPort)
+
+	// the maps keep the network order
+	var raw bpfcache.ServiceValue
+	assert.NoError(t, p.bpf.ServiceLookup(&dump.Services[0].Key, &raw))
+	assert.Equal(t, nets.ConvertPortToBigEndian(80), raw.ServicePort[0])
+}
+
+func TestQueryUserspaceMirror(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc))
+	// the entries written before the mirror is enabled are copied
+	assert.NoError(t, p.SetUserspaceMirror(true))
+	assert.NoError(t, p.handleWorkload(createWorkload("pod1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")))
+
+	dump, err := p.DumpMaps()
+	assert.NoError(t, err)
+	assert.Len(t, dump.Frontends, 2)
+	assert.Len(t, dump.Services, 1)
+	assert.Len(t, dump.Endpoints, 1)
+	assert.Len(t, dump.Backends, 1)
+	assert.Equal(t, uint32(80), dump.Services[0].Value.ServicePort[0])
+
+	info, err := p.LookupAddress("10.244.0.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "workload", info.Kind)
+
+	// an entry written behind the cache is not seen by the queries
+	fk := bpfcache.FrontendKey{}
+	nets.CopyIpByteFromAddr(&fk.Ip, netip.MustParseAddr("10.244.0.9"))
+	assert.NoError(t, workloadMap.KmeshFrontend.Update(&fk, &bpfcache.FrontendValue{UpstreamId: 1}, ebpf.UpdateAny))
+	_, err = p.LookupAddress("10.244.0.9")
+	assert.ErrorContains(t, err, "not found in frontend map")
+
+	assert.NoError(t, p.SetUserspaceMirror(false))
+	_, err = p.LookupAddress("10.244.0.9")
+	assert.NoError(t, err)
+}
+
+func TestCheckConsistency(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc))
+	assert.NoError(t, p.handleWorkload(createWorkload("pod1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")))
+	// a host network workload has an endpoint but no frontend
+	assert.NoError(t, p.handleWorkload(createWorkload("pod2", "172.18.0.2", workloadapi.NetworkMode_HOST_NETWORK, "svc1")))
+	assert.NoError(t, p.CheckConsistency())
+
+	// inject an endpoint whose backend has no frontend, and another one without backend
+	serviceId := p.hashName.Hash(svc.ResourceName())
+	assert.NoError(t, p.bpf.BackendUpdate(&bpfcache.BackendKey{BackendUid: 12345}, &bpfcache.BackendValue{}))
+	assert.NoError(t, p.bpf.EndpointUpdate(&bpfcache.EndpointKey{ServiceId: serviceId, BackendIndex: 3},
+		&bpfcache.EndpointValue{BackendUid: 12345}))
+	assert.NoError(t, p.bpf.EndpointUpdate(&bpfcache.EndpointKey{ServiceId: serviceId, BackendIndex: 4},
+		&bpfcache.EndpointValue{BackendUid: 54321}))
+
+	err := p.CheckConsistency()
+	assert.ErrorContains(t, err, "endpoint 3 of service")
+	assert.ErrorContains(t, err, "backend 12345 has no frontend")
+	assert.ErrorContains(t, err, "backend 54321 not found")
+}
+
+func TestWorkloadStatus(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	svc1 := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	svc2 := createFakeService("svc2", "10.240.10.2", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc1))
+	assert.NoError(t, p.handleService(svc2))
+	wl1 := createWorkload("pod1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1", "svc2")
+	wl2 := createWorkload("pod2", "192.168.1.10", workloadapi.NetworkMode_HOST_NETWORK, "svc1")
+	assert.NoError(t, p.handleWorkload(wl1))
+	assert.NoError(t, p.handleWorkload(wl2))
+
+	// 1. fully programmed workload
+	report := p.WorkloadStatus(wl1.Uid)
+	assert.Equal(t, WorkloadStatusReport{
+		Uid:        wl1.Uid,
+		InCache:    true,
+		Name:       wl1.ResourceName(),
+		BackendUid: p.hashName.Hash(wl1.Uid),
+		Backend:    true,
+		Frontends:  []string{"10.244.0.1"},
+		Services:   []string{svc1.ResourceName(), svc2.ResourceName()},
+	}, report)
+
+	// 2. host network workload has no frontend
+	report = p.WorkloadStatus(wl2.Uid)
+	assert.True(t, report.InCache)
+	assert.True(t, report.Backend)
+	assert.Empty(t, report.Frontends)
+	assert.Equal(t, []string{svc1.ResourceName()}, report.Services)
+
+	// 3. unknown workload, no hash allocated for it
+	uid := "cluster0//Pod/default/unknown"
+	assert.Equal(t, WorkloadStatusReport{Uid: uid}, p.WorkloadStatus(uid))
+	_, ok := p.hashName.strToNum[uid]
+	assert.False(t, ok)
+}
+
+func TestEndpointLocality(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+	p.nodeName = "node1"
+	p.localAddresses = sets.New(netip.MustParseAddr("192.168.1.10"))
+
+	svc1 := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	svc2 := createFakeService("svc2", "10.240.10.2", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc1))
+	assert.NoError(t, p.handleService(svc2))
+	// local by node name
+	wl1 := createWorkload("pod1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1", "svc2")
+	wl1.Node = "node1"
+	wl2 := createWorkload("pod2", "10.244.1.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	wl2.Node = "node2"
+	// local by address
+	wl3 := createWorkload("pod3", "192.168.1.10", workloadapi.NetworkMode_HOST_NETWORK, "svc1")
+	for _, wl := range []*workloadapi.Workload{wl1, wl2, wl3} {
+		assert.NoError(t, p.handleWorkload(wl))
+	}
+
+	localBackends := func(svc *workloadapi.Service) []uint32 {
+		var uids []uint32
+		for _, ev := range p.bpf.GetAllEndpointsForService(p.hashName.Hash(svc.ResourceName())) {
+			if ev.Local != 0 {
+				uids = append(uids, ev.BackendUid)
+			}
+		}
+		return uids
+	}
+	wl1Id, wl2Id, wl3Id := p.hashName.Hash(wl1.Uid), p.hashName.Hash(wl2.Uid), p.hashName.Hash(wl3.Uid)
+	assert.ElementsMatch(t, []uint32{wl1Id, wl3Id}, localBackends(svc1))
+	assert.ElementsMatch(t, []uint32{wl1Id}, localBackends(svc2))
+
+	stats, err := p.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]EndpointLocality{
+		svc1.ResourceName(): {Local: 2, Remote: 1},
+		svc2.ResourceName(): {Local: 1},
+	}, stats.ServiceEndpoints)
+
+	// the replaced endpoints keep their locality
+	assert.NoError(t, p.ReplaceServiceEndpoints(svc1.ResourceName(), []uint32{wl2Id, wl3Id}))
+	stats, err = p.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, EndpointLocality{Local: 1, Remote: 1}, stats.ServiceEndpoints[svc1.ResourceName()])
+}
+
+func TestPendingReferences(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+	p.SetDeferUnknownWaypoints(true)
+
+	// wl1 is bound to svc1 which is not received yet
+	wl1 := createWorkload("wl1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	assert.NoError(t, p.handleWorkload(wl1))
+	assert.Equal(t, []PendingRef{
+		{Kind: PendingRefService, Resource: wl1.ResourceName(), Reference: "default/svc1.default.svc.cluster.local"},
+	}, p.PendingReferences())
+
+	// svc1 resolves the reference of wl1 but its waypoint is unknown
+	svc1 := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc1))
+	assert.Equal(t, []PendingRef{
+		{Kind: PendingRefWaypoint, Resource: svc1.ResourceName(), Reference: "10.240.10.200"},
+	}, p.PendingReferences())
+
+	waypoint := createFakeService("waypoint", "10.240.10.200", "10.240.10.200")
+	assert.NoError(t, p.handleService(waypoint))
+	assert.Empty(t, p.PendingReferences())
+}
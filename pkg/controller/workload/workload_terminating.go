@@ -0,0 +1,84 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"net/netip"
+
+	"istio.io/istio/pkg/util/sets"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/controller/workload/cache"
+)
+
+// isTerminatingWorkload tells whether the workload is shutting down. The workload api has no such status,
+// a workload is terminating while its endpoints have the terminating condition in the kubernetes api server,
+// as found by the KubeReconciler. A terminating workload keeps its backend and frontends for its existing
+// connections, but is kept out of the endpoint map so that no new connection is sent to it.
+func (p *Processor) isTerminatingWorkload(workload *workloadapi.Workload) bool {
+	return p.terminatingWorkloads.Contains(workload.GetUid())
+}
+
+// removeWorkloadEndpoints removes the workload from the endpoints of all its services
+func (p *Processor) removeWorkloadEndpoints(workload *workloadapi.Workload) error {
+	uid := p.hashName.Hash(workload.GetUid())
+	eks := p.bpf.GetEndpointKeys(uid)
+	if len(eks) == 0 {
+		return nil
+	}
+	log.Infof("workload %s is terminating, remove it from the endpoints of its services", workload.ResourceName())
+	return p.deleteEndpointRecords(uid, eks.UnsortedList())
+}
+
+// reconcileTerminatingWorkloads marks the known workloads at the terminating endpoint addresses as terminating,
+// and the others as no longer terminating. It returns the uids of the workloads whose state changed.
+func (p *Processor) reconcileTerminatingWorkloads(addresses []netip.Addr) []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.handleMutex.Lock()
+	defer p.handleMutex.Unlock()
+
+	terminating := sets.New[string]()
+	for _, addr := range addresses {
+		if workload := p.WorkloadCache.GetWorkloadByAddr(cache.NetworkAddress{Network: p.network, Address: addr}); workload != nil {
+			terminating.Insert(workload.GetUid())
+		}
+	}
+
+	var changed []string
+	for _, uid := range sets.SortedList(terminating.Difference(p.terminatingWorkloads)) {
+		p.terminatingWorkloads.Insert(uid)
+		changed = append(changed, uid)
+		if err := p.removeWorkloadEndpoints(p.WorkloadCache.GetWorkloadByUid(uid)); err != nil {
+			log.Errorf("remove endpoints of terminating workload %s failed: %v", uid, err)
+		}
+	}
+	for _, uid := range sets.SortedList(p.terminatingWorkloads.Difference(terminating)) {
+		p.terminatingWorkloads.Delete(uid)
+		changed = append(changed, uid)
+		workload := p.WorkloadCache.GetWorkloadByUid(uid)
+		log.Infof("workload %s is no longer terminating, add it to the endpoints of its services again", workload.ResourceName())
+		services := make([]string, 0, len(workload.GetServices()))
+		for name := range workload.GetServices() {
+			services = append(services, name)
+		}
+		if err := p.handleWorkloadNewBoundServices(workload, services); err != nil {
+			log.Errorf("add endpoints of workload %s failed: %v", workload.ResourceName(), err)
+		}
+	}
+	return changed
+}
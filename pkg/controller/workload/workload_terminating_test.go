@@ -0,0 +1,137 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+)
+
+func TestHandleTerminatingWorkload(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+	// the endpoint addresses are resolved on the local network
+	p.network = "testnetwork"
+
+	ready, notReady := true, false
+	endpointSlice := func(terminating ...string) *discoveryv1.EndpointSlice {
+		slice := &discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "svc1-abcde",
+				Namespace: "default",
+				Labels:    map[string]string{discoveryv1.LabelServiceName: "svc1"},
+			},
+			Endpoints: []discoveryv1.Endpoint{
+				{Addresses: []string{"10.244.0.2"}, Conditions: discoveryv1.EndpointConditions{Ready: &ready}},
+			},
+		}
+		for _, address := range terminating {
+			slice.Endpoints = append(slice.Endpoints, discoveryv1.Endpoint{
+				Addresses:  []string{address},
+				Conditions: discoveryv1.EndpointConditions{Ready: &notReady, Terminating: &ready},
+			})
+		}
+		return slice
+	}
+	client := fake.NewSimpleClientset(
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "svc1", Namespace: "default"},
+			Spec: corev1.ServiceSpec{
+				ClusterIP:  "10.240.10.1",
+				ClusterIPs: []string{"10.240.10.1"},
+				Ports:      []corev1.ServicePort{{Port: 80}, {Port: 81}, {Port: 82}},
+			},
+		},
+		endpointSlice("10.244.0.1"),
+	)
+	r := NewKubeReconciler(client, p, 0)
+	reconcile := func() {
+		_, err := r.Reconcile(context.Background())
+		assert.NoError(t, err)
+	}
+
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	svcId := p.hashName.Hash(svc.ResourceName())
+	wl1 := createWorkload("wl1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	wl2 := createWorkload("wl2", "10.244.0.2", workloadapi.NetworkMode_STANDARD, "svc1")
+	wl1Id := p.hashName.Hash(wl1.Uid)
+	wl2Id := p.hashName.Hash(wl2.Uid)
+	assert.NoError(t, p.handleService(svc))
+	assert.NoError(t, p.handleWorkload(wl1))
+	assert.NoError(t, p.handleWorkload(wl2))
+	checkEndpointMap(t, p, svc, []uint32{wl1Id, wl2Id})
+
+	// a terminating workload gets no new connection, its backend and frontend are kept for the existing ones
+	reconcile()
+	checkEndpointMap(t, p, svc, []uint32{wl2Id})
+	checkServiceMap(t, p, svcId, svc, 1)
+	checkBackendMap(t, p, wl1Id, wl1)
+	assert.Equal(t, wl1Id, checkFrontEndMap(t, wl1.Addresses[0], p))
+	assert.Empty(t, p.bpf.GetEndpointKeys(wl1Id))
+
+	// unlike an unhealthy one, which is still an endpoint
+	wl2 = proto.Clone(wl2).(*workloadapi.Workload)
+	wl2.Status = workloadapi.WorkloadStatus_UNHEALTHY
+	assert.NoError(t, p.handleWorkload(wl2))
+	checkEndpointMap(t, p, svc, []uint32{wl2Id})
+
+	// the endpoints stay removed across an update of the workload and a resync
+	wl1 = proto.Clone(wl1).(*workloadapi.Workload)
+	wl1.Node = "node2"
+	assert.NoError(t, p.handleWorkload(wl1))
+	assert.NoError(t, p.ForceResync())
+	reconcile()
+	checkEndpointMap(t, p, svc, []uint32{wl2Id})
+	checkBackendMap(t, p, wl1Id, wl1)
+
+	// a workload learned terminating is removed from the endpoints by the next reconciliation
+	wl3 := createWorkload("wl3", "10.244.0.3", workloadapi.NetworkMode_STANDARD, "svc1")
+	wl3Id := p.hashName.Hash(wl3.Uid)
+	assert.NoError(t, p.handleWorkload(wl3))
+	_, err := client.DiscoveryV1().EndpointSlices("default").Update(context.Background(), endpointSlice("10.244.0.1", "10.244.0.3"), metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	reconcile()
+	checkBackendMap(t, p, wl3Id, wl3)
+	checkEndpointMap(t, p, svc, []uint32{wl2Id})
+
+	// no longer terminating, the workload is an endpoint again
+	_, err = client.DiscoveryV1().EndpointSlices("default").Update(context.Background(), endpointSlice("10.244.0.3"), metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	reconcile()
+	checkEndpointMap(t, p, svc, []uint32{wl1Id, wl2Id})
+	checkServiceMap(t, p, svcId, svc, 2)
+
+	// removed, its backend goes away and it is no longer tracked
+	p.handleRemovedAddresses([]string{wl3.ResourceName()})
+	var bv bpfcache.BackendValue
+	assert.Error(t, p.bpf.BackendLookup(&bpfcache.BackendKey{BackendUid: wl3Id}, &bv))
+	checkEndpointMap(t, p, svc, []uint32{wl1Id, wl2Id})
+	assert.Empty(t, p.terminatingWorkloads)
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	bpf "kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+)
+
+// topologyGraph collects the nodes and edges of the DOT graph, keyed by their statement
+// so that each is rendered once
+type topologyGraph struct {
+	nodes map[string]struct{}
+	edges map[string]struct{}
+}
+
+func (g *topologyGraph) node(id, attrs string) {
+	g.nodes[fmt.Sprintf("%s [%s];", strconv.Quote(id), attrs)] = struct{}{}
+}
+
+func (g *topologyGraph) edge(from, to, attrs string) {
+	stmt := fmt.Sprintf("%s -> %s", strconv.Quote(from), strconv.Quote(to))
+	if attrs != "" {
+		stmt += " [" + attrs + "]"
+	}
+	g.edges[stmt+";"] = struct{}{}
+}
+
+// waypoint adds the waypoint node and the edge from the service or backend redirected to it
+func (g *topologyGraph) waypoint(from string, waypoint *workloadapi.GatewayAddress) {
+	addr, ok := netip.AddrFromSlice(waypoint.GetAddress().GetAddress())
+	if !ok {
+		return
+	}
+	id := "waypoint " + netip.AddrPortFrom(addr.Unmap(), uint16(waypoint.GetHboneMtlsPort())).String()
+	g.node(id, "shape=diamond")
+	g.edge(from, id, "style=dashed")
+}
+
+// ExportTopologyDOT renders the services programmed, their endpoints and the backends of the endpoints as
+// a Graphviz DOT graph, with the waypoints they are redirected to as diamond nodes. The ids of the bpf maps
+// are resolved to the resource names, an id without name is rendered as is. The output is sorted so that
+// the same topology always renders the same.
+func (p *Processor) ExportTopologyDOT() string {
+	p.handleMutex.Lock()
+	defer p.handleMutex.Unlock()
+
+	g := &topologyGraph{
+		nodes: make(map[string]struct{}),
+		edges: make(map[string]struct{}),
+	}
+	name := func(id uint32) string {
+		if str := p.hashName.NumToStr(id); str != "" {
+			return str
+		}
+		return strconv.FormatUint(uint64(id), 10)
+	}
+
+	dump, err := p.bpf.Dump()
+	if err != nil {
+		log.Errorf("dump workload maps failed: %v", err)
+		dump = &bpf.MapDump{}
+	}
+	for _, e := range dump.Services {
+		serviceName := name(e.Key.ServiceId)
+		g.node(serviceName, "shape=box")
+		// the waypoint held back until its address is learned is not programmed yet
+		if e.Value.WaypointAddr != [16]byte{} {
+			g.waypoint(serviceName, p.serviceWaypoint(p.ServiceCache.GetService(serviceName)))
+		}
+	}
+	for _, e := range dump.Endpoints {
+		serviceName := name(e.Key.ServiceId)
+		endpoint := fmt.Sprintf("%s#%d", serviceName, e.Key.BackendIndex)
+		g.node(endpoint, fmt.Sprintf(`label="endpoint %d", shape=circle`, e.Key.BackendIndex))
+		g.edge(serviceName, endpoint, "")
+		g.edge(endpoint, name(e.Value.BackendUid), "")
+	}
+	for _, e := range dump.Backends {
+		uid := name(e.Key.BackendUid)
+		g.node(uid, "shape=ellipse")
+		if e.Value.WaypointAddr != [16]byte{} {
+			g.waypoint(uid, p.workloadWaypoint(p.WorkloadCache.GetWorkloadByUid(uid)))
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("digraph topology {\n\trankdir=LR;\n")
+	for _, stmts := range []map[string]struct{}{g.nodes, g.edges} {
+		sorted := make([]string, 0, len(stmts))
+		for stmt := range stmts {
+			sorted = append(sorted, stmt)
+		}
+		slices.Sort(sorted)
+		for _, stmt := range sorted {
+			b.WriteString("\t" + stmt + "\n")
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
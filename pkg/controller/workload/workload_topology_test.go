@@ -0,0 +1,81 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+)
+
+func TestExportTopologyDOT(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	// the fixture of Test_handleWorkload
+	fakeSvc := createFakeService("testsvc", "10.240.10.1", "10.240.10.2")
+	assert.NoError(t, p.handleService(fakeSvc))
+	wl := createTestWorkloadWithService(true)
+	assert.NoError(t, p.handleWorkload(wl))
+	workload2 := createFakeWorkload("1.2.3.5", workloadapi.NetworkMode_STANDARD)
+	assert.NoError(t, p.handleWorkload(workload2))
+	workload2 = proto.Clone(workload2).(*workloadapi.Workload)
+	workload2.Waypoint = &workloadapi.GatewayAddress{
+		Destination: &workloadapi.GatewayAddress_Address{
+			Address: &workloadapi.NetworkAddress{
+				Address: netip.MustParseAddr("10.10.10.10").AsSlice(),
+			},
+		},
+		HboneMtlsPort: 15008,
+	}
+	assert.NoError(t, p.handleWorkload(workload2))
+
+	dot := p.ExportTopologyDOT()
+	assert.True(t, strings.HasPrefix(dot, "digraph topology {\n"))
+	assert.True(t, strings.HasSuffix(dot, "}\n"))
+	svc := `"default/testsvc.default.svc.cluster.local"`
+	for _, stmt := range []string{
+		svc + ` [shape=box];`,
+		`"default/testsvc.default.svc.cluster.local#1" [label="endpoint 1", shape=circle];`,
+		`"default/testsvc.default.svc.cluster.local#2" [label="endpoint 2", shape=circle];`,
+		`"` + wl.Uid + `" [shape=ellipse];`,
+		`"` + workload2.Uid + `" [shape=ellipse];`,
+		`"waypoint 10.240.10.2:15008" [shape=diamond];`,
+		`"waypoint 10.10.10.10:15008" [shape=diamond];`,
+		svc + ` -> "default/testsvc.default.svc.cluster.local#1";`,
+		svc + ` -> "default/testsvc.default.svc.cluster.local#2";`,
+		`"default/testsvc.default.svc.cluster.local#1" -> "` + wl.Uid + `";`,
+		`"default/testsvc.default.svc.cluster.local#2" -> "` + workload2.Uid + `";`,
+		svc + ` -> "waypoint 10.240.10.2:15008" [style=dashed];`,
+		`"` + workload2.Uid + `" -> "waypoint 10.10.10.10:15008" [style=dashed];`,
+	} {
+		assert.Contains(t, dot, "\t"+stmt+"\n")
+	}
+	assert.NotContains(t, dot, `"`+wl.Uid+`" -> "waypoint`)
+
+	// the output is stable
+	assert.Equal(t, dot, p.ExportTopologyDOT())
+}
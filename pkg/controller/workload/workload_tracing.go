@@ -0,0 +1,124 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/controller/telemetry"
+	bpf "kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+)
+
+const (
+	tracerName = "kmesh.net/kmesh/pkg/controller/workload"
+
+	spanHandleAddressResponse = "handleAddressTypeResponse"
+	spanHandleServices        = "handleServices"
+	spanHandleWorkloads       = "handleWorkloads"
+	spanHandleRemoved         = "handleRemovedAddresses"
+	spanHandleRestartRemoved  = "handleRemovedAddressesDuringRestart"
+	spanFlushCoalesced        = "flushCoalesced"
+	spanHandleWorkload        = "handleWorkload"
+	spanBpfWrite              = "bpfMapWrite"
+
+	attrResources         = attribute.Key("kmesh.resources")
+	attrFailed            = attribute.Key("kmesh.failed")
+	attrWorkloadUid       = attribute.Key("kmesh.workload.uid")
+	attrWorkloadNamespace = attribute.Key("kmesh.workload.namespace")
+	attrWorkloadServices  = attribute.Key("kmesh.workload.services")
+	attrBpfOps            = attribute.Key("kmesh.bpf.ops")
+	attrBpfMap            = attribute.Key("kmesh.bpf.map")
+	attrBpfOp             = attribute.Key("kmesh.bpf.op")
+)
+
+// SetTracerProvider traces the handling of each address response: a span per response, with a child span per
+// batch of services, workloads and removed resources written to the bpf maps, carrying the number of resources
+// and of failures. Each workload handled has its own span, with a child span per bpf map write. nil disables it.
+func (p *Processor) SetTracerProvider(tp trace.TracerProvider) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.tracer = telemetry.NewTracer(tp, tracerName)
+}
+
+// startSpan starts a span counting resources as a child of the span in ctx, the span does not record if tracing is disabled
+func (p *Processor) startSpan(ctx context.Context, name string, resources int) (context.Context, trace.Span) {
+	return p.tracer.Start(ctx, name, trace.WithAttributes(attrResources.Int(resources)))
+}
+
+// workloadSpan is the span of a workload handled, counting the bpf map writes
+type workloadSpan struct {
+	span trace.Span
+	ops  int
+}
+
+// startWorkloadSpan starts the span of the workload as a child of the span in ctx, and a child span of it for
+// each bpf map write until it ends. It returns nil if tracing is disabled. It must be called under handleMutex.
+func (p *Processor) startWorkloadSpan(ctx context.Context, workload *workloadapi.Workload) *workloadSpan {
+	if !p.tracer.Enabled() {
+		return nil
+	}
+
+	ctx, span := p.tracer.Start(ctx, spanHandleWorkload, trace.WithAttributes(
+		attrWorkloadUid.String(workload.GetUid()),
+		attrWorkloadNamespace.String(workload.GetNamespace()),
+		attrWorkloadServices.Int(len(workload.GetServices())),
+	))
+	s := &workloadSpan{span: span}
+	p.bpf.SetWriteObserver(func(m bpf.BpfMapType, op bpf.BpfOpType, start time.Time, err error) {
+		s.ops++
+		_, opSpan := p.tracer.Start(ctx, spanBpfWrite, trace.WithTimestamp(start), trace.WithAttributes(
+			attrBpfMap.String(m.String()),
+			attrBpfOp.String(op.String()),
+		))
+		if err != nil {
+			opSpan.RecordError(err)
+			opSpan.SetStatus(codes.Error, "bpf map write failed")
+		}
+		opSpan.End()
+	})
+	return s
+}
+
+// end stops observing the bpf map writes, records the number of writes and the error on the span and ends it
+func (s *workloadSpan) end(p *Processor, err error) {
+	if s == nil {
+		return
+	}
+	p.bpf.SetWriteObserver(nil)
+	s.span.SetAttributes(attrBpfOps.Int(s.ops))
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, "workload failed to be handled")
+	}
+	s.span.End()
+}
+
+// endSpan records the number of failures on the span and ends it
+func endSpan(span trace.Span, failed int) {
+	if failed > 0 {
+		span.SetAttributes(attrFailed.Int(failed))
+		span.SetStatus(codes.Error, "some resources failed to be handled")
+	}
+	span.End()
+}
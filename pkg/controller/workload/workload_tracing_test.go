@@ -0,0 +1,184 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"context"
+	"testing"
+
+	service_discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"istio.io/istio/pilot/pkg/util/protoconv"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+)
+
+func TestHandleAddressTypeResponseTracing(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer func() { _ = tp.Shutdown(context.Background()) }()
+	p.SetTracerProvider(tp)
+
+	// the services and workloads of the first response in TestRestart
+	res := &service_discovery_v3.DeltaDiscoveryResponse{}
+	svc1 := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	svc2 := createFakeService("svc2", "10.240.10.2", "10.240.10.200")
+	svc3 := createFakeService("svc3", "10.240.10.3", "10.240.10.200")
+	for _, svc := range []*workloadapi.Service{svc1, svc2, svc3} {
+		res.Resources = append(res.Resources, &service_discovery_v3.Resource{
+			Resource: protoconv.MessageToAny(serviceToAddress(svc)),
+		})
+	}
+	wl1 := createWorkload("wl1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1", "svc2")
+	wl2 := createWorkload("wl2", "10.244.0.2", workloadapi.NetworkMode_STANDARD, "svc2", "svc3")
+	wl3 := createWorkload("wl3", "10.244.0.3", workloadapi.NetworkMode_STANDARD, "svc3")
+	for _, wl := range []*workloadapi.Workload{wl1, wl2, wl3} {
+		res.Resources = append(res.Resources, &service_discovery_v3.Resource{
+			Resource: protoconv.MessageToAny(workloadToAddress(wl)),
+		})
+	}
+	assert.NoError(t, p.handleAddressTypeResponse(res))
+
+	// the restart cleanup is traced for the first response only
+	assert.NoError(t, p.handleAddressTypeResponse(&service_discovery_v3.DeltaDiscoveryResponse{
+		RemovedResources: []string{wl3.ResourceName()},
+	}))
+
+	expected := [][]string{
+		{spanHandleServices, spanHandleWorkloads, spanHandleRemoved, spanHandleRestartRemoved},
+		{spanHandleServices, spanHandleWorkloads, spanHandleRemoved},
+	}
+	resources := [][]int64{{3, 3, 0, 0}, {0, 0, 1}}
+
+	spans := exporter.GetSpans()
+	var roots []tracetest.SpanStub
+	for _, s := range spans {
+		if !s.Parent.IsValid() {
+			roots = append(roots, s)
+		}
+	}
+	assert.Len(t, roots, 2)
+	for i, root := range roots {
+		assert.Equal(t, spanHandleAddressResponse, root.Name)
+		var children []string
+		var counts []int64
+		for _, s := range spans {
+			if s.Parent.SpanID() != root.SpanContext.SpanID() {
+				continue
+			}
+			assert.Equal(t, root.SpanContext.TraceID(), s.SpanContext.TraceID())
+			assert.False(t, s.EndTime.Before(s.StartTime))
+			children = append(children, s.Name)
+			for _, attr := range s.Attributes {
+				if attr.Key == attrResources {
+					counts = append(counts, attr.Value.AsInt64())
+				}
+			}
+		}
+		assert.Equal(t, expected[i], children)
+		assert.Equal(t, resources[i], counts)
+	}
+
+	// disabled, nothing is exported
+	exporter.Reset()
+	p.SetTracerProvider(nil)
+	assert.NoError(t, p.handleAddressTypeResponse(res))
+	assert.Empty(t, exporter.GetSpans())
+}
+
+func TestHandleWorkloadTracing(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer func() { _ = tp.Shutdown(context.Background()) }()
+	p.SetTracerProvider(tp)
+
+	svc1 := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	svc2 := createFakeService("svc2", "10.240.10.2", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc1))
+	assert.NoError(t, p.handleService(svc2))
+	wl := createWorkload("wl1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1", "svc2")
+	res := &service_discovery_v3.DeltaDiscoveryResponse{
+		Resources: []*service_discovery_v3.Resource{{Resource: protoconv.MessageToAny(workloadToAddress(wl))}},
+	}
+	assert.NoError(t, p.handleAddressTypeResponse(res))
+
+	var workloadSpan, workloadsSpan tracetest.SpanStub
+	spans := exporter.GetSpans()
+	for _, s := range spans {
+		switch s.Name {
+		case spanHandleWorkload:
+			workloadSpan = s
+		case spanHandleWorkloads:
+			workloadsSpan = s
+		}
+	}
+	assert.Equal(t, workloadsSpan.SpanContext.SpanID(), workloadSpan.Parent.SpanID())
+
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, attr := range workloadSpan.Attributes {
+		attrs[attr.Key] = attr.Value
+	}
+	assert.Equal(t, wl.Uid, attrs[attrWorkloadUid].AsString())
+	assert.Equal(t, "default", attrs[attrWorkloadNamespace].AsString())
+	assert.Equal(t, int64(2), attrs[attrWorkloadServices].AsInt64())
+
+	// a child span per bpf map write: an endpoint and a service endpoint count for each service,
+	// then the backend and the frontend of the workload
+	var writes []string
+	for _, s := range spans {
+		if s.Parent.SpanID() != workloadSpan.SpanContext.SpanID() {
+			continue
+		}
+		assert.Equal(t, spanBpfWrite, s.Name)
+		assert.False(t, s.StartTime.Before(workloadSpan.StartTime))
+		assert.False(t, s.EndTime.After(workloadSpan.EndTime))
+		var write string
+		for _, attr := range s.Attributes {
+			switch attr.Key {
+			case attrBpfMap:
+				write = attr.Value.AsString() + write
+			case attrBpfOp:
+				write += " " + attr.Value.AsString()
+			}
+		}
+		writes = append(writes, write)
+	}
+	assert.Equal(t, int64(len(writes)), attrs[attrBpfOps].AsInt64())
+	assert.Equal(t, []string{
+		"endpoint update", "service update", "endpoint update", "service update", "backend update", "frontend update",
+	}, writes)
+
+	// the workload spans are not recorded once disabled, nor the writes
+	exporter.Reset()
+	p.SetTracerProvider(nil)
+	assert.NoError(t, p.handleWorkload(createWorkload("wl2", "10.244.0.2", workloadapi.NetworkMode_STANDARD, "svc1")))
+	assert.Empty(t, exporter.GetSpans())
+}
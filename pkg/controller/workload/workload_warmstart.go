@@ -0,0 +1,134 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"google.golang.org/protobuf/encoding/protodelim"
+	"istio.io/istio/pkg/util/sets"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/utils"
+)
+
+// SaveSnapshot persists the cached services and workloads to path, for WarmStart to program them on the
+// next boot before the control plane is reachable. The addresses are written length-delimited, the
+// services first.
+func (p *Processor) SaveSnapshot(path string) error {
+	p.handleMutex.Lock()
+	services := p.ServiceCache.List()
+	workloads := p.WorkloadCache.List()
+	p.handleMutex.Unlock()
+
+	var buf bytes.Buffer
+	for _, service := range services {
+		address := &workloadapi.Address{Type: &workloadapi.Address_Service{Service: service}}
+		if _, err := protodelim.MarshalTo(&buf, address); err != nil {
+			return fmt.Errorf("marshal service %s failed: %v", service.ResourceName(), err)
+		}
+	}
+	for _, workload := range workloads {
+		address := &workloadapi.Address{Type: &workloadapi.Address_Workload{Workload: workload}}
+		if _, err := protodelim.MarshalTo(&buf, address); err != nil {
+			return fmt.Errorf("marshal workload %s failed: %v", workload.ResourceName(), err)
+		}
+	}
+	return utils.AtomicWrite(path, buf.Bytes(), 0644)
+}
+
+// WarmStart programs the services and workloads of the snapshot saved at path by SaveSnapshot, so that
+// the bpf maps serve traffic before the first address response. The resources not received again in the
+// first response are removed then. A missing snapshot is not an error. It must be called before Start.
+func (p *Processor) WarmStart(path string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			log.Infof("no snapshot at %s, skip warm start", path)
+			return nil
+		}
+		return err
+	}
+
+	var services []*workloadapi.Service
+	var workloads []*workloadapi.Workload
+	r := bufio.NewReader(bytes.NewReader(data))
+	for {
+		address := &workloadapi.Address{}
+		if err := protodelim.UnmarshalFrom(r, address); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return fmt.Errorf("unmarshal snapshot %s failed: %v", path, err)
+		}
+		switch address.GetType().(type) {
+		case *workloadapi.Address_Service:
+			services = append(services, address.GetService())
+		case *workloadapi.Address_Workload:
+			workloads = append(workloads, address.GetWorkload())
+		}
+	}
+
+	warm := sets.New[string]()
+	var errs []error
+	for _, service := range services {
+		if err := p.handleService(service); err != nil {
+			errs = append(errs, fmt.Errorf("handle service %s failed: %v", service.ResourceName(), err))
+			continue
+		}
+		warm.Insert(service.ResourceName())
+	}
+	sortWorkloadsByUid(workloads)
+	for _, workload := range workloads {
+		if err := p.handleWorkload(workload); err != nil {
+			errs = append(errs, fmt.Errorf("handle workload %s failed: %v", workload.ResourceName(), err))
+			continue
+		}
+		warm.Insert(workload.ResourceName())
+	}
+	p.warmResources = warm
+	log.Infof("warm started %d services and %d workloads from %s", len(services), len(workloads), path)
+	return errors.Join(errs...)
+}
+
+// reconcileWarmStart removes the resources programmed by WarmStart which are not in the first address response
+func (p *Processor) reconcileWarmStart(services []*workloadapi.Service, workloads []*workloadapi.Workload) {
+	if p.warmResources == nil {
+		return
+	}
+	defer func() { p.warmResources = nil }()
+
+	for _, service := range services {
+		p.warmResources.Delete(service.ResourceName())
+	}
+	for _, workload := range workloads {
+		p.warmResources.Delete(workload.ResourceName())
+	}
+	if p.warmResources.Len() == 0 {
+		return
+	}
+	log.Infof("remove %d warm started resources not received again", p.warmResources.Len())
+	p.handleRemovedAddresses(sets.SortedList(p.warmResources))
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"path/filepath"
+	"testing"
+
+	service_discovery_v3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/stretchr/testify/assert"
+	"istio.io/istio/pilot/pkg/util/protoconv"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+)
+
+func TestWarmStart(t *testing.T) {
+	snapshot := filepath.Join(t.TempDir(), "snapshot")
+
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	wl1 := createWorkload("wl1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	wl2 := createWorkload("wl2", "10.244.0.2", workloadapi.NetworkMode_STANDARD, "svc1")
+
+	// the last run saves its caches
+	lastMap := bpfcache.NewFakeWorkloadMap(t)
+	last := newProcessor(lastMap)
+	assert.NoError(t, last.handleService(svc))
+	assert.NoError(t, last.handleWorkload(wl1))
+	assert.NoError(t, last.handleWorkload(wl2))
+	assert.NoError(t, last.SaveSnapshot(snapshot))
+	hashNameClean(last)
+	bpfcache.CleanupFakeWorkloadMap(lastMap)
+
+	// the maps are programmed from the snapshot before any response
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+	assert.NoError(t, p.WarmStart(snapshot))
+
+	svcId := p.hashName.Hash(svc.ResourceName())
+	wl1Id := p.hashName.Hash(wl1.Uid)
+	wl2Id := p.hashName.Hash(wl2.Uid)
+	assert.Equal(t, svcId, checkFrontEndMap(t, svc.Addresses[0].Address, p))
+	checkServiceMap(t, p, svcId, svc, 2)
+	checkEndpointMap(t, p, svc, []uint32{wl1Id, wl2Id})
+	checkBackendMap(t, p, wl1Id, wl1)
+	checkBackendMap(t, p, wl2Id, wl2)
+
+	// the first response no longer has wl2, it is removed
+	res := &service_discovery_v3.DeltaDiscoveryResponse{
+		Resources: []*service_discovery_v3.Resource{
+			{Resource: protoconv.MessageToAny(serviceToAddress(svc))},
+			{Resource: protoconv.MessageToAny(workloadToAddress(wl1))},
+		},
+	}
+	assert.NoError(t, p.handleAddressTypeResponse(res))
+	assert.Nil(t, p.WorkloadCache.GetWorkloadByUid(wl2.Uid))
+	checkNotExistInFrontEndMap(t, wl2.Addresses[0], p)
+	checkServiceMap(t, p, svcId, svc, 1)
+	checkEndpointMap(t, p, svc, []uint32{wl1Id})
+	assert.Nil(t, p.warmResources)
+
+	// a missing snapshot is not an error
+	assert.NoError(t, newProcessor(workloadMap).WarmStart(filepath.Join(t.TempDir(), "missing")))
+}
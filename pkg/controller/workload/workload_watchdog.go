@@ -0,0 +1,98 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"context"
+	"time"
+
+	"kmesh.net/kmesh/pkg/controller/telemetry"
+	bpf "kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+)
+
+const (
+	defaultStaleEndpointWindow   = 5 * time.Minute
+	defaultStaleEndpointInterval = time.Minute
+)
+
+// staleEndpointWatchdog periodically scans the endpoints service by service and flags the ones
+// not updated within the window as potentially stale. It only reads the map in kernel and the
+// endpoint index by service id, which is guarded, so it can run alongside the xDS processing.
+type staleEndpointWatchdog struct {
+	bpf    *bpf.Cache
+	window time.Duration
+	// flagged endpoints with their LastUpdated, so that each stale endpoint is counted once
+	flagged map[bpf.EndpointKey]int64
+}
+
+func newStaleEndpointWatchdog(cache *bpf.Cache, window time.Duration) *staleEndpointWatchdog {
+	if window <= 0 {
+		window = defaultStaleEndpointWindow
+	}
+	return &staleEndpointWatchdog{
+		bpf:     cache,
+		window:  window,
+		flagged: make(map[bpf.EndpointKey]int64),
+	}
+}
+
+func (w *staleEndpointWatchdog) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			w.check(now)
+		}
+	}
+}
+
+// check returns the endpoints newly detected as stale at now
+func (w *staleEndpointWatchdog) check(now time.Time) []bpf.EndpointKey {
+	var (
+		stale   []bpf.EndpointKey
+		flagged = make(map[bpf.EndpointKey]int64, len(w.flagged))
+	)
+
+	deadline := now.Add(-w.window).UnixNano()
+	check := func(key bpf.EndpointKey, value bpf.EndpointValue) error {
+		if value.LastUpdated >= deadline {
+			return nil
+		}
+		flagged[key] = value.LastUpdated
+		if lastUpdated, ok := w.flagged[key]; ok && lastUpdated == value.LastUpdated {
+			return nil
+		}
+		log.Warnf("endpoint %#v of workload %d not updated since %s, it may be stale",
+			key, value.BackendUid, time.Unix(0, value.LastUpdated).Format(time.RFC3339))
+		stale = append(stale, key)
+		return nil
+	}
+	for _, serviceId := range w.bpf.EndpointServiceIds() {
+		if err := w.bpf.IterateEndpoints(serviceId, check); err != nil {
+			log.Errorf("iterate endpoints of service %d failed: %v", serviceId, err)
+			return nil
+		}
+	}
+
+	w.flagged = flagged
+	telemetry.StaleEndpointsDetected.Add(float64(len(stale)))
+	return stale
+}
@@ -0,0 +1,67 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/controller/telemetry"
+	"kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+)
+
+func TestStaleEndpointWatchdog(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	svc := createFakeService("svc1", "10.240.10.1", "10.240.10.200")
+	assert.NoError(t, p.handleService(svc))
+	wl1 := createWorkload("wl1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	assert.NoError(t, p.handleWorkload(wl1))
+	start := time.Now()
+
+	w := newStaleEndpointWatchdog(p.bpf, 0)
+	assert.Equal(t, defaultStaleEndpointWindow, w.window)
+	before := testutil.ToFloat64(telemetry.StaleEndpointsDetected)
+
+	// 1. a fresh endpoint is not stale
+	assert.Empty(t, w.check(start))
+
+	// 2. age wl1 endpoint past the window, while wl2 endpoint is inserted just before the check
+	wl2 := createWorkload("wl2", "10.244.0.2", workloadapi.NetworkMode_STANDARD, "svc1")
+	assert.NoError(t, p.handleWorkload(wl2))
+	ek := bpfcache.EndpointKey{ServiceId: p.hashName.Hash(svc.ResourceName()), BackendIndex: 1}
+	ev := bpfcache.EndpointValue{}
+	assert.NoError(t, p.bpf.EndpointLookup(&ek, &ev))
+	assert.Equal(t, p.hashName.Hash(wl1.Uid), ev.BackendUid)
+	ev.LastUpdated = start.Add(-defaultStaleEndpointWindow - time.Second).UnixNano()
+	assert.NoError(t, p.bpf.EndpointUpdate(&ek, &ev))
+
+	assert.Equal(t, []bpfcache.EndpointKey{ek}, w.check(time.Now()))
+	assert.Equal(t, before+1, testutil.ToFloat64(telemetry.StaleEndpointsDetected))
+
+	// 3. a stale endpoint is flagged only once
+	assert.Empty(t, w.check(time.Now()))
+	assert.Equal(t, before+1, testutil.ToFloat64(telemetry.StaleEndpointsDetected))
+}
@@ -0,0 +1,199 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"net/netip"
+
+	"google.golang.org/protobuf/proto"
+	"istio.io/istio/pkg/util/sets"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/nets"
+)
+
+// waypointIndex is the reverse index from the waypoint addresses to the services or the workloads
+// programmed with them, so that they are found when the address of a waypoint changes
+type waypointIndex struct {
+	// waypoint address of each dependent
+	addrOf map[string]netip.Addr
+	// dependents of each waypoint address
+	dependents map[netip.Addr]sets.Set[string]
+}
+
+func newWaypointIndex() *waypointIndex {
+	return &waypointIndex{
+		addrOf:     make(map[string]netip.Addr),
+		dependents: make(map[netip.Addr]sets.Set[string]),
+	}
+}
+
+// set records the waypoint programmed for name, a nil waypoint removes name from the index
+func (x *waypointIndex) set(name string, waypoint *workloadapi.GatewayAddress) {
+	addr, ok := netip.AddrFromSlice(waypoint.GetAddress().GetAddress())
+	if !ok {
+		x.delete(name)
+		return
+	}
+	addr = addr.Unmap()
+	if old, exists := x.addrOf[name]; exists {
+		if old == addr {
+			return
+		}
+		x.delete(name)
+	}
+	x.addrOf[name] = addr
+	if x.dependents[addr] == nil {
+		x.dependents[addr] = sets.New[string]()
+	}
+	x.dependents[addr].Insert(name)
+}
+
+func (x *waypointIndex) delete(name string) {
+	addr, exists := x.addrOf[name]
+	if !exists {
+		return
+	}
+	delete(x.addrOf, name)
+	x.dependents[addr].Delete(name)
+	if x.dependents[addr].Len() == 0 {
+		delete(x.dependents, addr)
+	}
+}
+
+// get returns the names programmed with the waypoint address, sorted
+func (x *waypointIndex) get(addr netip.Addr) []string {
+	return sets.SortedList(x.dependents[addr.Unmap()])
+}
+
+// moveWaypointDependents redirects the services and workloads programmed with an address the waypoint service
+// no longer has to its new address of the same family, they would be sent to a vip nobody serves until the
+// control plane updates them. The waypoints they were set with are rewritten in the caches too.
+func (p *Processor) moveWaypointDependents(oldService, service *workloadapi.Service) {
+	for _, oldAddress := range oldService.GetAddresses() {
+		if containsAddress(service.GetAddresses(), oldAddress.GetAddress()) {
+			continue
+		}
+		from, ok := netip.AddrFromSlice(oldAddress.GetAddress())
+		if !ok {
+			continue
+		}
+		from = from.Unmap()
+		services := p.serviceWaypointIndex.get(from)
+		workloads := p.workloadWaypointIndex.get(from)
+		if len(services) == 0 && len(workloads) == 0 {
+			continue
+		}
+
+		to := sameFamilyAddress(service.GetAddresses(), from)
+		if !to.IsValid() {
+			log.Warnf("waypoint service %s has no address of the family of %s anymore, its %d services and %d workloads are left",
+				service.ResourceName(), from, len(services), len(workloads))
+			continue
+		}
+		log.Infof("address of waypoint service %s changed from %s to %s, redirect its %d services and %d workloads",
+			service.ResourceName(), from, to, len(services), len(workloads))
+
+		for namespace, waypoint := range p.namespaceWaypoints {
+			if waypointAddressIs(waypoint, from) {
+				p.namespaceWaypoints[namespace] = waypointWithAddress(waypoint, to)
+			}
+		}
+		for _, name := range services {
+			if err := p.moveServiceWaypoint(name, from, to); err != nil {
+				log.Errorf("redirect service %s to waypoint %s failed: %v", name, to, err)
+			}
+		}
+		for _, uid := range workloads {
+			if err := p.moveWorkloadWaypoint(uid, from, to); err != nil {
+				log.Errorf("redirect workload %s to waypoint %s failed: %v", uid, to, err)
+			}
+		}
+	}
+}
+
+func (p *Processor) moveServiceWaypoint(name string, from, to netip.Addr) error {
+	svc := p.ServiceCache.GetService(name)
+	if svc == nil {
+		p.serviceWaypointIndex.delete(name)
+		return nil
+	}
+	if waypointAddressIs(svc.GetWaypoint(), from) {
+		// do not mutate the cached service, it may be shared with readers
+		svc = proto.Clone(svc).(*workloadapi.Service)
+		svc.Waypoint = waypointWithAddress(svc.GetWaypoint(), to)
+		p.ServiceCache.AddOrUpdateService(svc)
+	}
+	return p.storeServiceData(name, p.serviceWaypoint(svc), svc.GetPorts())
+}
+
+func (p *Processor) moveWorkloadWaypoint(uid string, from, to netip.Addr) error {
+	workload := p.WorkloadCache.GetWorkloadByUid(uid)
+	if workload == nil {
+		p.workloadWaypointIndex.delete(uid)
+		return nil
+	}
+	if waypointAddressIs(workload.GetWaypoint(), from) {
+		// do not mutate the cached workload, it may be shared with readers
+		workload = proto.Clone(workload).(*workloadapi.Workload)
+		workload.Waypoint = waypointWithAddress(workload.GetWaypoint(), to)
+		p.WorkloadCache.AddOrUpdateWorkload(workload)
+	}
+	waypoint := p.workloadWaypoint(workload)
+	p.workloadWaypointIndex.set(uid, waypoint)
+	return p.updateBackendWaypoint(p.hashName.Hash(uid), waypoint)
+}
+
+// sameFamilyAddress returns the first of the addresses in the family of addr, an invalid address if none
+func sameFamilyAddress(addresses []*workloadapi.NetworkAddress, addr netip.Addr) netip.Addr {
+	ip := nets.AddrToIPv6Bytes(addr)
+	family, _ := nets.IPFamilyOf(ip[:])
+	for _, address := range addresses {
+		if candidate, err := nets.IPFamilyOf(address.GetAddress()); err == nil && candidate == family {
+			ip, _ := netip.AddrFromSlice(address.GetAddress())
+			return ip.Unmap()
+		}
+	}
+	return netip.Addr{}
+}
+
+func waypointAddressIs(waypoint *workloadapi.GatewayAddress, addr netip.Addr) bool {
+	wpAddr, ok := netip.AddrFromSlice(waypoint.GetAddress().GetAddress())
+	return ok && wpAddr.Unmap() == addr
+}
+
+// waypointWithAddress returns a copy of the waypoint at addr
+func waypointWithAddress(waypoint *workloadapi.GatewayAddress, addr netip.Addr) *workloadapi.GatewayAddress {
+	waypoint = proto.Clone(waypoint).(*workloadapi.GatewayAddress)
+	waypoint.Destination = &workloadapi.GatewayAddress_Address{
+		Address: &workloadapi.NetworkAddress{
+			Network: waypoint.GetAddress().GetNetwork(),
+			Address: addressBytes(addr),
+		},
+	}
+	return waypoint
+}
+
+// addressBytes returns the bytes of addr as carried by the workload api, 4 bytes for an IPv4 or
+// IPv4-mapped address and 16 bytes otherwise
+func addressBytes(addr netip.Addr) []byte {
+	if ip4, ok := nets.AddrToIPv4Bytes(addr); ok {
+		return ip4[:]
+	}
+	ip6 := nets.AddrToIPv6Bytes(addr)
+	return ip6[:]
+}
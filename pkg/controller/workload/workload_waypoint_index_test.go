@@ -0,0 +1,113 @@
+/*
+ * Copyright The Kmesh Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at:
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workload
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+
+	"kmesh.net/kmesh/api/v2/workloadapi"
+	"kmesh.net/kmesh/pkg/controller/workload/bpfcache"
+	"kmesh.net/kmesh/pkg/nets"
+)
+
+func TestWaypointAddressChange(t *testing.T) {
+	workloadMap := bpfcache.NewFakeWorkloadMap(t)
+	defer bpfcache.CleanupFakeWorkloadMap(workloadMap)
+
+	p := newProcessor(workloadMap)
+	defer hashNameClean(p)
+
+	oldAddr := netip.MustParseAddr("10.240.10.200")
+	newAddr := netip.MustParseAddr("10.240.10.201")
+	var oldIp, newIp [16]byte
+	nets.CopyIpByteFromSlice(&oldIp, oldAddr.AsSlice())
+	nets.CopyIpByteFromSlice(&newIp, newAddr.AsSlice())
+	serviceWaypointIp := func(svc *workloadapi.Service) [16]byte {
+		sv := bpfcache.ServiceValue{}
+		assert.NoError(t, p.bpf.ServiceLookup(&bpfcache.ServiceKey{ServiceId: p.hashName.Hash(svc.ResourceName())}, &sv))
+		return sv.WaypointAddr
+	}
+	backendWaypointIp := func(wl *workloadapi.Workload) [16]byte {
+		bv := bpfcache.BackendValue{}
+		assert.NoError(t, p.bpf.BackendLookup(&bpfcache.BackendKey{BackendUid: p.hashName.Hash(wl.Uid)}, &bv))
+		return bv.WaypointAddr
+	}
+
+	// the waypoint service, whose waypoint is itself and dropped
+	waypointSvc := createFakeService("waypoint", oldAddr.String(), oldAddr.String())
+	assert.NoError(t, p.handleService(waypointSvc))
+	// svc1 and wl1 have the waypoint, svc2 and wl2 get it as the default of their namespace
+	svc1 := createFakeService("svc1", "10.240.10.1", oldAddr.String())
+	assert.NoError(t, p.handleService(svc1))
+	svc2 := createFakeService("svc2", "10.240.10.2", oldAddr.String())
+	svc2.Waypoint = nil
+	assert.NoError(t, p.handleService(svc2))
+	wl1 := createWorkload("wl1", "10.244.0.1", workloadapi.NetworkMode_STANDARD, "svc1")
+	assert.NoError(t, p.handleWorkload(wl1))
+	// wl1 gets the waypoint by a waypoint-only update, taking the fast path of handleWorkload
+	wl1 = proto.Clone(wl1).(*workloadapi.Workload)
+	wl1.Waypoint = svc1.GetWaypoint()
+	assert.NoError(t, p.handleWorkload(wl1))
+	wl2 := createWorkload("wl2", "10.244.0.2", workloadapi.NetworkMode_STANDARD, "svc2")
+	assert.NoError(t, p.handleWorkload(wl2))
+	assert.NoError(t, p.SetNamespaceWaypoint("default", svc1.GetWaypoint()))
+
+	assert.Equal(t, oldIp, serviceWaypointIp(svc1))
+	assert.Equal(t, oldIp, serviceWaypointIp(svc2))
+	assert.Equal(t, oldIp, backendWaypointIp(wl1))
+	assert.Equal(t, oldIp, backendWaypointIp(wl2))
+	assert.Equal(t, []string{svc1.ResourceName(), svc2.ResourceName()}, p.serviceWaypointIndex.get(oldAddr))
+	assert.Equal(t, []string{wl1.Uid, wl2.Uid}, p.workloadWaypointIndex.get(oldAddr))
+
+	// 1. the vip of the waypoint service changes, all the dependents are redirected
+	waypointSvc = createFakeService("waypoint", newAddr.String(), newAddr.String())
+	assert.NoError(t, p.handleService(waypointSvc))
+
+	assert.Equal(t, newIp, serviceWaypointIp(svc1))
+	assert.Equal(t, newIp, serviceWaypointIp(svc2))
+	assert.Equal(t, newIp, backendWaypointIp(wl1))
+	assert.Equal(t, newIp, backendWaypointIp(wl2))
+	assert.Empty(t, p.serviceWaypointIndex.get(oldAddr))
+	assert.Empty(t, p.workloadWaypointIndex.get(oldAddr))
+	assert.Equal(t, []string{svc1.ResourceName(), svc2.ResourceName()}, p.serviceWaypointIndex.get(newAddr))
+	assert.Equal(t, []string{wl1.Uid, wl2.Uid}, p.workloadWaypointIndex.get(newAddr))
+
+	// the waypoints are rewritten in the caches, the received resources are not mutated
+	assert.Equal(t, newAddr.AsSlice(), p.ServiceCache.GetService(svc1.ResourceName()).GetWaypoint().GetAddress().GetAddress())
+	assert.Equal(t, newAddr.AsSlice(), p.WorkloadCache.GetWorkloadByUid(wl1.Uid).GetWaypoint().GetAddress().GetAddress())
+	assert.Equal(t, newAddr.AsSlice(), p.namespaceWaypoints["default"].GetAddress().GetAddress())
+	assert.Equal(t, oldAddr.AsSlice(), svc1.GetWaypoint().GetAddress().GetAddress())
+	assert.Nil(t, p.ServiceCache.GetService(svc2.ResourceName()).GetWaypoint())
+	// the port is kept
+	assert.Equal(t, uint32(15008), p.ServiceCache.GetService(svc1.ResourceName()).GetWaypoint().GetHboneMtlsPort())
+
+	// 2. the removed dependents leave the index
+	assert.NoError(t, p.removeServiceResource([]string{svc1.ResourceName()}))
+	assert.NoError(t, p.removeWorkloadResource([]string{wl1.Uid}))
+	assert.Equal(t, []string{svc2.ResourceName()}, p.serviceWaypointIndex.get(newAddr))
+	assert.Equal(t, []string{wl2.Uid}, p.workloadWaypointIndex.get(newAddr))
+
+	// 3. a waypoint whose vip changes family has its dependents left
+	waypointSvc = createFakeService("waypoint", "fd00::1", "fd00::1")
+	assert.NoError(t, p.handleService(waypointSvc))
+	assert.Equal(t, newIp, serviceWaypointIp(svc2))
+	assert.Equal(t, newIp, backendWaypointIp(wl2))
+}
@@ -29,7 +29,9 @@ type XDSServer struct {
 	Listener       *bufconn.Listener
 	responses      chan *discoveryv3.DiscoveryResponse
 	DeltaResponses chan *discoveryv3.DeltaDiscoveryResponse
-	close          chan struct{}
+	// DeltaRequests receives the delta requests sent by the clients, the ones overflowing it are dropped
+	DeltaRequests chan *discoveryv3.DeltaDiscoveryRequest
+	close         chan struct{}
 }
 
 func NewXdsServer(t *testing.T) *XDSServer {
@@ -37,6 +39,7 @@ func NewXdsServer(t *testing.T) *XDSServer {
 		close:          make(chan struct{}),
 		responses:      make(chan *discoveryv3.DiscoveryResponse),
 		DeltaResponses: make(chan *discoveryv3.DeltaDiscoveryResponse),
+		DeltaRequests:  make(chan *discoveryv3.DeltaDiscoveryRequest, 16),
 	}
 
 	buffer := 1024 * 1024
@@ -73,6 +76,19 @@ func (f *XDSServer) StreamAggregatedResources(server discoveryv3.AggregatedDisco
 }
 
 func (f *XDSServer) DeltaAggregatedResources(server discoveryv3.AggregatedDiscoveryService_DeltaAggregatedResourcesServer) error {
+	go func() {
+		for {
+			req, err := server.Recv()
+			if err != nil {
+				return
+			}
+			select {
+			case f.DeltaRequests <- req:
+			default:
+			}
+		}
+	}()
+
 	numberOfSends := 0
 	for {
 		select {
@@ -19,7 +19,9 @@ package nets
 
 import (
 	"encoding/binary"
+	"fmt"
 	"net"
+	"net/netip"
 	"syscall"
 
 	"kmesh.net/kmesh/pkg/constants"
@@ -52,12 +54,126 @@ func ConvertPortToBigEndian(little uint32) uint32 {
 	return uint32(big16)
 }
 
+// ConvertPortFromBigEndian convert a network order port read from bpf maps back to host order
+func ConvertPortFromBigEndian(big uint32) uint32 {
+	tmp := make([]byte, 2)
+	binary.LittleEndian.PutUint16(tmp, uint16(big))
+	return uint32(binary.BigEndian.Uint16(tmp))
+}
+
+// CopyIpByteFromSlice copies the ip bytes to the bpf map ip field, IPv4-mapped IPv6
+// addresses are stored as IPv4 so that both forms of an address share the same key.
+// dst is cleared first, so that an IPv4 address does not inherit the tail of a previous IPv6 one.
 func CopyIpByteFromSlice(dst *[16]byte, src []byte) {
-	len := len(src)
-	if len != 4 && len != 16 {
+	addr, ok := netip.AddrFromSlice(src)
+	if !ok {
 		return
 	}
-	copy(dst[:], src)
+	CopyIpByteFromAddr(dst, addr)
+}
+
+// CopyIpByteFromAddr is the same as CopyIpByteFromSlice for a netip.Addr
+func CopyIpByteFromAddr(dst *[16]byte, addr netip.Addr) {
+	*dst = [16]byte{}
+	if ip4, ok := AddrToIPv4Bytes(addr); ok {
+		copy(dst[:], ip4[:])
+		return
+	}
+	*dst = AddrToIPv6Bytes(addr)
+}
+
+// AddrToIPv4Bytes returns the 4 bytes of an IPv4 or IPv4-mapped IPv6 address,
+// ok is false for the other addresses.
+func AddrToIPv4Bytes(addr netip.Addr) (ip4 [4]byte, ok bool) {
+	addr = addr.Unmap()
+	if !addr.Is4() {
+		return ip4, false
+	}
+	return addr.As4(), true
+}
+
+// AddrToIPv6Bytes returns the 16 bytes of an address, IPv4 addresses in the IPv4-mapped IPv6 form.
+// The zero Addr returns all zeros.
+func AddrToIPv6Bytes(addr netip.Addr) [16]byte {
+	if !addr.IsValid() {
+		return [16]byte{}
+	}
+	return addr.As16()
+}
+
+// IPFamily is the address family of an ip
+type IPFamily uint8
+
+const (
+	Unknown IPFamily = iota
+	IPv4
+	IPv6
+)
+
+func (f IPFamily) String() string {
+	switch f {
+	case IPv4:
+		return "IPv4"
+	case IPv6:
+		return "IPv6"
+	default:
+		return "Unknown"
+	}
+}
+
+// IPFamilyOf returns the family of the ip bytes, IPv4-mapped IPv6 addresses are IPv4 although they take
+// 16 bytes. Bytes which are not a 4 or 16 byte address are Unknown with an error.
+func IPFamilyOf(b []byte) (IPFamily, error) {
+	addr, ok := netip.AddrFromSlice(b)
+	if !ok {
+		return Unknown, fmt.Errorf("invalid ip of %d bytes", len(b))
+	}
+	if addr.Is4() || addr.Is4In6() {
+		return IPv4, nil
+	}
+	return IPv6, nil
+}
+
+// IsLoopback reports whether the ip bytes are a loopback address, 127.0.0.0/8 or ::1.
+// IPv4-mapped IPv6 addresses are checked as IPv4, invalid bytes are not loopback.
+func IsLoopback(b []byte) bool {
+	addr, ok := netip.AddrFromSlice(b)
+	if !ok {
+		return false
+	}
+	return addr.Unmap().IsLoopback()
+}
+
+// IsLinkLocal reports whether the ip bytes are a link-local unicast or multicast address,
+// e.g. 169.254.0.0/16 or fe80::/10. IPv4-mapped IPv6 addresses are checked as IPv4,
+// invalid bytes are not link-local.
+func IsLinkLocal(b []byte) bool {
+	addr, ok := netip.AddrFromSlice(b)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	return addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast()
+}
+
+// InterfaceAddresses returns the addresses of the network interfaces of the host, except the loopback ones
+func InterfaceAddresses() []netip.Addr {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+
+	var result []netip.Addr
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() {
+			continue
+		}
+		if ip, ok := netip.AddrFromSlice(ipnet.IP); ok {
+			result = append(result, ip.Unmap())
+		}
+	}
+	return result
 }
 
 func checkIPVersion() (ipv4, ipv6 bool) {
@@ -33,6 +33,38 @@ func Test_ConvertIpToUint32(t *testing.T) {
 	assert.Equal(t, uint32(0), val)
 }
 
+func TestConvertPortByteOrder(t *testing.T) {
+	testcases := []struct {
+		name string
+		host uint32
+		big  uint32
+	}{
+		{
+			name: "port 0",
+			host: 0,
+			big:  0,
+		},
+		{
+			name: "port 80",
+			host: 80,
+			big:  0x5000,
+		},
+		{
+			name: "port 65535",
+			host: 65535,
+			big:  65535,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.big, ConvertPortToBigEndian(tc.host))
+			assert.Equal(t, tc.host, ConvertPortFromBigEndian(tc.big))
+			assert.Equal(t, tc.host, ConvertPortFromBigEndian(ConvertPortToBigEndian(tc.host)))
+		})
+	}
+}
+
 func TestCopyIpByteFromSlice(t *testing.T) {
 	v6addr, _ := netip.ParseAddr("2001::1")
 	v6Slices := v6addr.AsSlice()
@@ -51,6 +83,11 @@ func TestCopyIpByteFromSlice(t *testing.T) {
 			input:    v6Slices,
 			expected: [16]byte{0x20, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1},
 		},
+		{
+			name:     "ipv4-mapped ipv6",
+			input:    netip.MustParseAddr("::ffff:192.168.1.1").AsSlice(),
+			expected: [16]byte{192, 168, 1, 1},
+		},
 		{
 			name:     "invalid",
 			input:    []byte{192, 168, 1, 1, 1, 1},
@@ -66,4 +103,190 @@ func TestCopyIpByteFromSlice(t *testing.T) {
 			assert.Equal(t, tc.expected, out)
 		})
 	}
+
+	t.Run("ipv4 after ipv6", func(t *testing.T) {
+		var out [16]byte
+
+		CopyIpByteFromSlice(&out, v6Slices)
+		CopyIpByteFromSlice(&out, []byte{192, 168, 1, 1})
+		assert.Equal(t, [16]byte{192, 168, 1, 1}, out)
+	})
+}
+
+func TestAddrToBytes(t *testing.T) {
+	testcases := []struct {
+		name      string
+		addr      netip.Addr
+		ipv4      [4]byte
+		isIPv4    bool
+		ipv6      [16]byte
+		bpfMapKey [16]byte
+	}{
+		{
+			name:      "ipv4",
+			addr:      netip.MustParseAddr("192.168.1.1"),
+			ipv4:      [4]byte{192, 168, 1, 1},
+			isIPv4:    true,
+			ipv6:      [16]byte{10: 0xff, 11: 0xff, 12: 192, 13: 168, 14: 1, 15: 1},
+			bpfMapKey: [16]byte{192, 168, 1, 1},
+		},
+		{
+			name:      "ipv4-mapped ipv6",
+			addr:      netip.MustParseAddr("::ffff:192.168.1.1"),
+			ipv4:      [4]byte{192, 168, 1, 1},
+			isIPv4:    true,
+			ipv6:      [16]byte{10: 0xff, 11: 0xff, 12: 192, 13: 168, 14: 1, 15: 1},
+			bpfMapKey: [16]byte{192, 168, 1, 1},
+		},
+		{
+			name:      "ipv6",
+			addr:      netip.MustParseAddr("2001::1"),
+			ipv6:      [16]byte{0: 0x20, 1: 0x1, 15: 0x1},
+			bpfMapKey: [16]byte{0: 0x20, 1: 0x1, 15: 0x1},
+		},
+		{
+			name: "invalid",
+			addr: netip.Addr{},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			ipv4, ok := AddrToIPv4Bytes(tc.addr)
+			assert.Equal(t, tc.isIPv4, ok)
+			assert.Equal(t, tc.ipv4, ipv4)
+			assert.Equal(t, tc.ipv6, AddrToIPv6Bytes(tc.addr))
+
+			// an IPv6 address left by a previous copy is cleared
+			out := [16]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+			CopyIpByteFromAddr(&out, tc.addr)
+			assert.Equal(t, tc.bpfMapKey, out)
+		})
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	testcases := []struct {
+		name     string
+		input    []byte
+		expected bool
+	}{
+		{name: "ipv4 loopback", input: netip.MustParseAddr("127.0.0.1").AsSlice(), expected: true},
+		{name: "ipv4 loopback range", input: netip.MustParseAddr("127.255.255.254").AsSlice(), expected: true},
+		{name: "ipv4 unicast", input: netip.MustParseAddr("10.244.0.1").AsSlice(), expected: false},
+		{name: "ipv4 unspecified", input: netip.MustParseAddr("0.0.0.0").AsSlice(), expected: false},
+		{name: "ipv6 loopback", input: netip.MustParseAddr("::1").AsSlice(), expected: true},
+		{name: "ipv6 unicast", input: netip.MustParseAddr("2001::1").AsSlice(), expected: false},
+		{name: "ipv6 unspecified", input: netip.MustParseAddr("::").AsSlice(), expected: false},
+		{name: "ipv4-mapped loopback", input: netip.MustParseAddr("::ffff:127.0.0.1").AsSlice(), expected: true},
+		{name: "empty", input: nil, expected: false},
+		{name: "invalid", input: []byte{127, 0, 0, 1, 1, 1}, expected: false},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, IsLoopback(tc.input))
+		})
+	}
+}
+
+func TestIsLinkLocal(t *testing.T) {
+	testcases := []struct {
+		name     string
+		input    []byte
+		expected bool
+	}{
+		{name: "ipv4 link-local", input: netip.MustParseAddr("169.254.0.1").AsSlice(), expected: true},
+		{name: "ipv4 link-local end", input: netip.MustParseAddr("169.254.255.255").AsSlice(), expected: true},
+		{name: "ipv4 out of link-local", input: netip.MustParseAddr("169.255.0.1").AsSlice(), expected: false},
+		{name: "ipv4 link-local multicast", input: netip.MustParseAddr("224.0.0.251").AsSlice(), expected: true},
+		{name: "ipv4 unicast", input: netip.MustParseAddr("10.244.0.1").AsSlice(), expected: false},
+		{name: "ipv6 link-local", input: netip.MustParseAddr("fe80::1").AsSlice(), expected: true},
+		{name: "ipv6 link-local upper bound", input: netip.MustParseAddr("febf::1").AsSlice(), expected: true},
+		{name: "ipv6 site-local", input: netip.MustParseAddr("fec0::1").AsSlice(), expected: false},
+		{name: "ipv6 link-local multicast", input: netip.MustParseAddr("ff02::1").AsSlice(), expected: true},
+		{name: "ipv6 unicast", input: netip.MustParseAddr("2001::1").AsSlice(), expected: false},
+		{name: "ipv4-mapped link-local", input: netip.MustParseAddr("::ffff:169.254.0.1").AsSlice(), expected: true},
+		{name: "empty", input: nil, expected: false},
+		{name: "invalid", input: []byte{169, 254}, expected: false},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, IsLinkLocal(tc.input))
+		})
+	}
+}
+
+func TestIPFamilyOf(t *testing.T) {
+	testcases := []struct {
+		name     string
+		input    []byte
+		expected IPFamily
+		err      bool
+	}{
+		{
+			name:     "ipv4",
+			input:    []byte{192, 168, 1, 1},
+			expected: IPv4,
+		},
+		{
+			name:     "ipv4 unspecified",
+			input:    []byte{0, 0, 0, 0},
+			expected: IPv4,
+		},
+		{
+			name:     "ipv4 in the 16-byte form",
+			input:    netip.MustParseAddr("::ffff:10.0.0.1").AsSlice(),
+			expected: IPv4,
+		},
+		{
+			name:     "ipv6",
+			input:    netip.MustParseAddr("2001::1").AsSlice(),
+			expected: IPv6,
+		},
+		{
+			name:     "ipv6 unspecified",
+			input:    netip.IPv6Unspecified().AsSlice(),
+			expected: IPv6,
+		},
+		{
+			name:     "ipv4-compatible ipv6",
+			input:    netip.MustParseAddr("::10.0.0.1").AsSlice(),
+			expected: IPv6,
+		},
+		{
+			name:     "nil",
+			input:    nil,
+			expected: Unknown,
+			err:      true,
+		},
+		{
+			name:     "5 bytes",
+			input:    []byte{10, 0, 0, 1, 0},
+			expected: Unknown,
+			err:      true,
+		},
+		{
+			name:     "15 bytes",
+			input:    make([]byte, 15),
+			expected: Unknown,
+			err:      true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			family, err := IPFamilyOf(tc.input)
+			assert.Equal(t, tc.expected, family)
+			if tc.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+	assert.Equal(t, "IPv4", IPv4.String())
+	assert.Equal(t, "IPv6", IPv6.String())
+	assert.Equal(t, "Unknown", Unknown.String())
 }
@@ -32,9 +32,11 @@ import (
 	adminv2 "kmesh.net/kmesh/api/v2/admin"
 	"kmesh.net/kmesh/api/v2/workloadapi/security"
 	"kmesh.net/kmesh/daemon/options"
+	"kmesh.net/kmesh/pkg/bpf"
 	"kmesh.net/kmesh/pkg/constants"
 	"kmesh.net/kmesh/pkg/controller"
 	"kmesh.net/kmesh/pkg/controller/ads"
+	"kmesh.net/kmesh/pkg/controller/workload"
 	"kmesh.net/kmesh/pkg/logger"
 )
 
@@ -46,11 +48,14 @@ const (
 	patternHelp               = "/help"
 	patternOptions            = "/options"
 	patternBpfAdsMaps         = "/debug/bpf/ads"
+	patternBpfWorkloadMaps    = "/debug/bpf/workload"
 	configDumpPrefix          = "/debug/config_dump"
 	patternConfigDumpAds      = configDumpPrefix + "/ads"
 	patternConfigDumpWorkload = configDumpPrefix + "/workload"
 	patternReadyProbe         = "/debug/ready"
 	patternLoggers            = "/debug/loggers"
+	patternEvents             = "/debug/events"
+	patternPrograms           = "/debug/programs"
 
 	bpfLoggerName = "bpf"
 
@@ -90,9 +95,12 @@ func NewServer(c *controller.XdsClient, configs *options.BootstrapConfigs, bpfLo
 	s.mux.HandleFunc(patternHelp, s.httpHelp)
 	s.mux.HandleFunc(patternOptions, s.httpOptions)
 	s.mux.HandleFunc(patternBpfAdsMaps, s.bpfAdsMaps)
+	s.mux.HandleFunc(patternBpfWorkloadMaps, s.bpfWorkloadMaps)
 	s.mux.HandleFunc(patternConfigDumpAds, s.configDumpAds)
 	s.mux.HandleFunc(patternConfigDumpWorkload, s.configDumpWorkload)
 	s.mux.HandleFunc(patternLoggers, s.loggersHandler)
+	s.mux.HandleFunc(patternEvents, s.events)
+	s.mux.HandleFunc(patternPrograms, s.bpfPrograms)
 
 	// TODO: add dump certificate, authorizationPolicies and services
 	s.mux.HandleFunc(patternReadyProbe, s.readyProbe)
@@ -115,12 +123,18 @@ func (s *Server) httpHelp(w http.ResponseWriter, r *http.Request) {
 		"print config options")
 	fmt.Fprintf(w, "\t%s: %s\n", patternBpfAdsMaps,
 		"print bpf kmesh maps in kernel")
+	fmt.Fprintf(w, "\t%s: %s\n", patternBpfWorkloadMaps,
+		"print bpf kmesh workload maps in kernel")
 	fmt.Fprintf(w, "\t%s: %s\n", patternConfigDumpAds,
 		"dump xDS[Listener, Route, Cluster] configurations")
 	fmt.Fprintf(w, "\t%s: %s\n", patternConfigDumpWorkload,
 		"dump workload configurations")
 	fmt.Fprintf(w, "\t%s: %s\n", patternLoggers,
 		"get or set logger level")
+	fmt.Fprintf(w, "\t%s: %s\n", patternEvents,
+		"dump the workload and service handling events, since=<RFC3339 time> to filter")
+	fmt.Fprintf(w, "\t%s: %s\n", patternPrograms,
+		"print the bpf programs pinned by kmesh")
 }
 
 func (s *Server) httpOptions(w http.ResponseWriter, r *http.Request) {
@@ -150,6 +164,51 @@ func (s *Server) bpfAdsMaps(w http.ResponseWriter, r *http.Request) {
 	}))
 }
 
+func (s *Server) bpfWorkloadMaps(w http.ResponseWriter, r *http.Request) {
+	client := s.xdsClient
+	if client == nil || client.WorkloadController == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "\t%s\n", "invalid ClientMode")
+		return
+	}
+
+	dump, err := client.WorkloadController.Processor.DumpMaps()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "\tdump workload maps failed: %v\n", err)
+		return
+	}
+	data, err := json.MarshalIndent(dump, "", "    ")
+	if err != nil {
+		log.Errorf("Failed to marshal workload maps: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
+
+func (s *Server) bpfPrograms(w http.ResponseWriter, r *http.Request) {
+	programs, err := bpf.GetLoadedPrograms(s.config.BpfConfig.BpfFsPath)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "\tget loaded programs failed: %v\n", err)
+		return
+	}
+	data, err := json.MarshalIndent(programs, "", "    ")
+	if err != nil {
+		log.Errorf("Failed to marshal bpf programs: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
+
 type LoggerInfo struct {
 	Name  string `json:"name,omitempty"`
 	Level string `json:"level,omitempty"`
@@ -305,6 +364,42 @@ func (s *Server) configDumpWorkload(w http.ResponseWriter, r *http.Request) {
 	printWorkloadDump(w, workloadDump)
 }
 
+func (s *Server) events(w http.ResponseWriter, r *http.Request) {
+	client := s.xdsClient
+	if client == nil || client.WorkloadController == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "\t%s\n", "invalid ClientMode")
+		return
+	}
+
+	var since time.Time
+	if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, sinceStr); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "\tinvalid since %q: %v\n", sinceStr, err)
+			return
+		}
+	}
+
+	events := make([]workload.Event, 0)
+	for _, event := range client.WorkloadController.Processor.EventLog.Events() {
+		if !event.Time.Before(since) {
+			events = append(events, event)
+		}
+	}
+	data, err := json.MarshalIndent(events, "", "    ")
+	if err != nil {
+		log.Errorf("Failed to marshal events: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(data)
+}
+
 func (s *Server) readyProbe(w http.ResponseWriter, r *http.Request) {
 	// TODO: Add some components check
 	w.WriteHeader(http.StatusOK)
@@ -19,12 +19,14 @@ package status
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"net/netip"
 	"sort"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -32,6 +34,7 @@ import (
 
 	"kmesh.net/kmesh/api/v2/workloadapi"
 	"kmesh.net/kmesh/daemon/options"
+	"kmesh.net/kmesh/pkg/bpf"
 	"kmesh.net/kmesh/pkg/constants"
 	"kmesh.net/kmesh/pkg/controller"
 	"kmesh.net/kmesh/pkg/controller/workload"
@@ -159,6 +162,41 @@ func TestServer_getAndSetBpfLevel(t *testing.T) {
 	}
 }
 
+func TestServer_bpfPrograms(t *testing.T) {
+	configs := []options.BpfConfig{{
+		Mode:        "ads",
+		BpfFsPath:   "/sys/fs/bpf",
+		Cgroup2Path: "/mnt/kmesh_cgroup2",
+	}, {
+		Mode:        "workload",
+		BpfFsPath:   "/sys/fs/bpf",
+		Cgroup2Path: "/mnt/kmesh_cgroup2",
+	}}
+
+	for _, config := range configs {
+		t.Run(config.Mode, func(t *testing.T) {
+			cleanup, _ := test.InitBpfMap(t, config)
+			defer cleanup()
+			server := &Server{
+				config: &options.BootstrapConfigs{BpfConfig: &config},
+			}
+
+			req := httptest.NewRequest(http.MethodGet, patternPrograms, nil)
+			w := httptest.NewRecorder()
+			server.bpfPrograms(w, req)
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			var programs []bpf.ProgramInfo
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &programs))
+			assert.NotEmpty(t, programs)
+			for _, prog := range programs {
+				assert.NotEmpty(t, prog.Type)
+				assert.NotEmpty(t, prog.PinPath)
+			}
+		})
+	}
+}
+
 func TestServer_setLoggerLevel(t *testing.T) {
 	server := &Server{
 		xdsClient: &controller.XdsClient{
@@ -295,3 +333,46 @@ func TestServer_configDumpWorkload(t *testing.T) {
 
 	util.CompareContent(t, w.Body.Bytes(), "./testdata/workload_configdump.json")
 }
+
+func TestServer_events(t *testing.T) {
+	eventLog := workload.NewEventLog(10)
+	eventLog.Record(workload.EventOpService, "ns/svc.ns.svc.cluster.local", nil)
+	eventLog.Record(workload.EventOpWorkload, "cluster0//Pod/ns/name", errors.New("update failed"))
+	server := &Server{
+		xdsClient: &controller.XdsClient{
+			WorkloadController: &workload.Controller{
+				Processor: &workload.Processor{
+					EventLog: eventLog,
+				},
+			},
+		},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, patternEvents, nil)
+	w := httptest.NewRecorder()
+	server.events(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var events []workload.Event
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &events))
+	assert.Len(t, events, 2)
+	assert.Equal(t, workload.EventOpService, events[0].Op)
+	assert.True(t, events[0].Success)
+	assert.Equal(t, "cluster0//Pod/ns/name", events[1].Resource)
+	assert.False(t, events[1].Success)
+	assert.Equal(t, "update failed", events[1].Error)
+
+	// no event after the last one
+	since := events[1].Time.Add(time.Second).Format(time.RFC3339)
+	req = httptest.NewRequest(http.MethodGet, patternEvents+"?since="+since, nil)
+	w = httptest.NewRecorder()
+	server.events(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &events))
+	assert.Empty(t, events)
+
+	req = httptest.NewRequest(http.MethodGet, patternEvents+"?since=yesterday", nil)
+	w = httptest.NewRecorder()
+	server.events(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}